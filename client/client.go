@@ -3,10 +3,13 @@ package client
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"math/rand"
 	"net"
 	"os"
@@ -26,9 +29,28 @@ var (
 	ErrInitNoServers            = errors.New("missing dracula udp server list on client init!")
 	ErrMessageTimedOut          = errors.New("timed out waiting for message response")
 	ErrClientAlreadyInit        = errors.New("client already initialized")
+	ErrClientClosed             = errors.New("dracula client closed")
+	ErrBadBindIP                = errors.New("dracula client bind ip is invalid")
+	ErrBadServerList            = errors.New("dracula client server list must be comma separated ip:port")
+	ErrBadTimeout               = errors.New("dracula client timeout can't be negative")
+	ErrBadMaxValueLen           = fmt.Errorf("dracula client max value length must be at most %d", protocol.DataValueSize)
+	ErrSendTimedOut             = errors.New("dracula client timed out sending request")
 	ErrCountReturnBytesTooShort = errors.New("too few bytes returned in count callback")
+	ErrCountAtOutOfRange        = errors.New("dracula count time must be unix seconds that fit in a uint32")
+	ErrBadHalfLife              = errors.New("dracula weighted count half life must be at least a millisecond")
+	ErrBadPutWeight             = fmt.Errorf("dracula put weight must be from 1 to %d", protocol.MaxPutWeight)
+	ErrBadWeightedResponse      = errors.New("malformed weighted count response")
+	ErrBadTTLResponse           = errors.New("malformed ttl response")
 	ErrNoHealthyUDPServers      = errors.New("no healthy dracula udp servers")
 	ErrNoHealthyTCPServers      = errors.New("no healthy dracula tcp servers")
+	ErrBadTopKeysResponse       = errors.New("malformed top keys response")
+	ErrBadPageResponse          = errors.New("malformed page response")
+	ErrBadInfoResponse          = errors.New("malformed server info response")
+	ErrBadListResponse          = errors.New("malformed quoted list response")
+	ErrNamespaceTooLong         = fmt.Errorf("namespace is longer than the %d byte limit", protocol.NamespaceSize)
+	// ErrValueTooLong is when an entry key or pattern does not fit in a packet, or a key is longer than
+	// Config.MaxValueLen or the server's own limit
+	ErrValueTooLong = fmt.Errorf("entry key or pattern is longer than the %d byte limit, or the max value length", protocol.DataValueSize)
 )
 
 type Client struct {
@@ -45,19 +67,166 @@ type Client struct {
 	messagesWaiting *waitingmessage.ResponseCache // byte is the expected response command type
 
 	messageIDCounter uint32
+	keyLock          sync.RWMutex
 	preSharedKey     []byte
 
-	disposed        bool
+	disposed        int32 // 1 once closed, accessed atomically
 	timeoutDuration time.Duration
+	bindIP          string
+	routingMode     RoutingMode
 	log             *log.Logger
+	// logOutput is where debug logs go while enabled
+	logOutput io.Writer
+	// reads shares identical reads in flight, and is nil unless Config.SingleFlightReads is set
+	reads *flightGroup
+	// counts caches Count results, and is nil unless Config.CountCacheTTL is set
+	counts *countCache
+	// muxConns are the shared tcp connections by server address, when Config.MultiplexTCP is set
+	multiplexTCP bool
+	muxLock      sync.Mutex
+	muxConns     map[string]*muxConn
+	// preferTCP sends counts and puts to the tcp servers, see Config.PreferTCP
+	preferTCP   bool
+	quotedLists bool
+	// requireHealthy fails Listen when no udp server is healthy, see Config.RequireHealthyOnListen
+	requireHealthy bool
+	// maxValueLen is the longest key Put and Count send, see Config.MaxValueLen
+	maxValueLen int
+	// durable queues PutDurable entries, and is nil unless EnableDurableQueue was called
+	durable *durableQueue
+	// subs stop the open subscriptions by their connection, see Subscribe
+	subsLock sync.Mutex
+	subs     map[*net.TCPConn]func()
 }
 
 // Config for the client
+// RoutingMode is how requests are spread across the servers in the pool.
+type RoutingMode int
+
+const (
+	// RoutingRandom sends each request to a random healthy server, for servers which replicate to each other.
+	RoutingRandom RoutingMode = iota
+	// RoutingConsistentHash sends requests for a namespace to the same server, for servers which each own a
+	// shard of the namespaces. Requests without a namespace, like CountServer, go to a random server.
+	RoutingConsistentHash
+	// RoutingConsistentHashKey is RoutingConsistentHash for requests about one key, like Count, Put and
+	// Delete, except a namespace's keys are spread across servers. Other requests still route by namespace,
+	// so CountNamespace only counts the keys on one server.
+	RoutingConsistentHashKey
+)
+
 type Config struct {
 	RemoteUDPIPPortList string
 	RemoteTCPIPPortList string
 	Timeout             time.Duration
 	PreSharedKey        string
+	// PreciseTimeouts makes each request time out exactly at Timeout, at the cost of a timer per request.
+	// Otherwise timeouts are checked periodically, so they can be up to 10 seconds late, and a Timeout under a
+	// second is a second.
+	PreciseTimeouts bool
+	// SingleFlightReads makes identical Count, CountNamespace and CountServer calls which are made at the same
+	// time share one request and its response, rather than each sending their own. Puts are never shared.
+	SingleFlightReads bool
+	// CountCacheTTL makes Count remember results for this long, for counts which can be a little stale.
+	// A Put by this client forgets the count of its key straight away, see also InvalidateCount. Zero,
+	// the default, does not cache. CountInto is never cached.
+	CountCacheTTL time.Duration
+	// MultiplexTCP sends concurrent TCP requests, like KeyMatch, over one shared connection per server instead of
+	// a connection each, matching responses to requests by message ID. Servers older than this option may
+	// drop requests which arrive back to back on a connection, so only enable it once every server is upgraded.
+	MultiplexTCP bool
+	// PreferTCP sends Count, Put, PutWeight and GetAndReset to the TCP servers instead of over UDP, so a dropped packet is
+	// resent rather than timing out, at the cost of a connection per request or a shared one with MultiplexTCP.
+	// RoutingMode does not apply to them. Clients with TCP servers and no UDP servers always prefer TCP.
+	PreferTCP bool
+	// QuotedLists asks servers to quote each key or namespace in KeyMatch, KeyMatchOpts, and ListNamespaces
+	// responses, so keys with line breaks, like ones restored from before puts refused them, come back intact
+	// instead of split into other keys. Servers older than this option respond unquoted, so only enable it once
+	// every server is upgraded.
+	QuotedLists bool
+	// MaxValueLen is the longest key, in bytes, which Put and Count send, returning ErrValueTooLong for longer
+	// ones without sending them. Set it to the servers' own limit to find out before a request is made. It can
+	// be at most, and defaults to, protocol.DataValueSize.
+	MaxValueLen int
+	// RoutingMode decides which server in the pool each UDP request goes to. The default is RoutingRandom.
+	RoutingMode RoutingMode
+	// HealthcheckInterval is how often the UDP servers are healthchecked while any are healthy, and
+	// UnhealthyHealthcheckInterval while none are. The defaults are serverpool.DefaultHealthyInterval and
+	// serverpool.DefaultUnhealthyInterval.
+	HealthcheckInterval          time.Duration
+	UnhealthyHealthcheckInterval time.Duration
+	// HealthcheckJitter is the fraction, up to 1, each healthcheck interval is randomly lengthened or shortened by,
+	// so many clients started together don't probe the servers in lockstep. The default is
+	// serverpool.DefaultJitter, and negative disables it.
+	HealthcheckJitter float64
+	// HealthcheckFailThreshold is how many healthchecks of a server must fail in a row before requests stop going
+	// to it, and HealthcheckRiseThreshold how many must pass in a row before they go to it again. Raising them
+	// stops isolated dropped packets on lossy networks failing over, at the cost of noticing a down server later.
+	// The default is serverpool.DefaultThreshold.
+	HealthcheckFailThreshold int
+	HealthcheckRiseThreshold int
+	// RequireHealthyOnListen makes Listen return an error wrapping ErrNoHealthyUDPServers, and close the client,
+	// when no UDP server passes the first healthcheck, so a service can refuse to start while dracula is
+	// unreachable. Listen always waits for that healthcheck, which takes up to Timeout, or a few seconds longer
+	// without PreciseTimeouts. Clients without UDP servers are not checked.
+	RequireHealthyOnListen bool
+	// BindIP is the local address the client listens for responses on. The default is 0.0.0.0, every interface.
+	BindIP string
+	// Logger receives the client's debug logs, using its output, prefix and flags, instead of stdout.
+	// The client does not modify it. Logs are still only written after DebugEnable.
+	Logger *log.Logger
+}
+
+// Validate checks the config without making a client, returning an error which names the field that is wrong,
+// so a bad config fails at startup with a clear message rather than a panic in NewClient. Servers must be
+// given by IP address, as host names are not resolved.
+func (conf Config) Validate() error {
+	udpServers, err := parseServerList(conf.RemoteUDPIPPortList, true)
+	if err != nil {
+		return fmt.Errorf("RemoteUDPIPPortList: %w", err)
+	}
+	tcpServers, err := parseServerList(conf.RemoteTCPIPPortList, true)
+	if err != nil {
+		return fmt.Errorf("RemoteTCPIPPortList: %w", err)
+	}
+	if len(udpServers) == 0 && len(tcpServers) == 0 {
+		return fmt.Errorf("RemoteUDPIPPortList and RemoteTCPIPPortList: %w", ErrInitNoServers)
+	}
+	if conf.Timeout < 0 {
+		return fmt.Errorf("Timeout: %w: %s", ErrBadTimeout, conf.Timeout)
+	}
+	if conf.BindIP != "" && net.ParseIP(conf.BindIP) == nil {
+		return fmt.Errorf("BindIP: %w: %q", ErrBadBindIP, conf.BindIP)
+	}
+	if conf.MaxValueLen > protocol.DataValueSize {
+		return fmt.Errorf("MaxValueLen: %w: %d", ErrBadMaxValueLen, conf.MaxValueLen)
+	}
+	return nil
+}
+
+// parseServerList parses a comma separated list of ip:port, skipping empty entries. An IP which does not parse
+// is an error when strict, and is otherwise left nil, as NewClient always has.
+func parseServerList(list string, strict bool) ([]net.UDPAddr, error) {
+	var servers []net.UDPAddr
+	for _, ipPort := range strings.Split(strings.Trim(list, " "), ",") {
+		p := strings.Split(strings.Trim(ipPort, " "), ":")
+		if p[0] == "" {
+			continue
+		}
+		if len(p) != 2 {
+			return nil, fmt.Errorf("%w: bad <ip:port> %q", ErrBadServerList, ipPort)
+		}
+		port, err := strconv.Atoi(p[1])
+		if err != nil {
+			return nil, fmt.Errorf("%w: bad ip:<port> %q", ErrBadServerList, ipPort)
+		}
+		ip := net.ParseIP(p[0])
+		if ip == nil && strict {
+			return nil, fmt.Errorf("%w: %q is not an ip address", ErrBadServerList, p[0])
+		}
+		servers = append(servers, net.UDPAddr{IP: ip, Port: port})
+	}
+	return servers, nil
 }
 
 func NewClient(conf Config) *Client {
@@ -65,60 +234,72 @@ func NewClient(conf Config) *Client {
 	if conf.Timeout == 0 {
 		conf.Timeout = time.Second
 	}
+	if conf.Timeout < time.Second && !conf.PreciseTimeouts {
+		// waiting messages are timed out in whole seconds, so anything shorter would time out responses
+		// whenever the clock ticks over to the next second
+		conf.Timeout = time.Second
+	}
+	if conf.BindIP == "" {
+		conf.BindIP = "0.0.0.0"
+	}
+	if conf.MaxValueLen <= 0 || conf.MaxValueLen > protocol.DataValueSize {
+		conf.MaxValueLen = protocol.DataValueSize
+	}
+	messagesWaiting := waitingmessage.NewCache
+	if conf.PreciseTimeouts {
+		messagesWaiting = waitingmessage.NewPreciseCache
+	}
 	client := &Client{
 		preSharedKey:    []byte(conf.PreSharedKey),
-		messagesWaiting: waitingmessage.NewCache(conf.Timeout),
+		messagesWaiting: messagesWaiting(conf.Timeout),
 		log:             log.New(os.Stdout, "", 0),
+		logOutput:       os.Stdout,
 		tcpPoolMap:      &sync.Map{},
 		timeoutDuration: conf.Timeout,
+		bindIP:          conf.BindIP,
+		routingMode:     conf.RoutingMode,
+		multiplexTCP:    conf.MultiplexTCP,
+		quotedLists:     conf.QuotedLists,
+		maxValueLen:     conf.MaxValueLen,
+		muxConns:        make(map[string]*muxConn),
+		subs:            make(map[*net.TCPConn]func()),
+	}
+	if conf.SingleFlightReads {
+		client.reads = newFlightGroup()
+	}
+	if conf.CountCacheTTL > 0 {
+		client.counts = newCountCache(conf.CountCacheTTL)
+	}
+	if conf.Logger != nil {
+		client.log = log.New(conf.Logger.Writer(), conf.Logger.Prefix(), conf.Logger.Flags())
+		client.logOutput = conf.Logger.Writer()
 	}
 
-	udpParts := strings.Split(strings.Trim(conf.RemoteUDPIPPortList, " "), ",")
-	tcpParts := strings.Split(strings.Trim(conf.RemoteTCPIPPortList, " "), ",")
-
-	for _, ipPort := range udpParts {
-		p := strings.Split(strings.Trim(ipPort, " "), ":")
-		if p[0] == "" {
-			continue
-		}
-		if len(p) != 2 {
-			panic(fmt.Errorf("bad <ip:port> dracula client init %s", ipPort))
-		}
-		sport, err := strconv.Atoi(p[1])
-		if err != nil {
-			panic(fmt.Errorf("bad ip:<port> dracula client init %s", ipPort))
-		}
-		servers = append(servers, &net.UDPAddr{
-			IP:   net.ParseIP(p[0]),
-			Port: sport,
-		})
+	udpServers, err := parseServerList(conf.RemoteUDPIPPortList, false)
+	if err != nil {
+		panic(fmt.Errorf("dracula client init: %w", err))
+	}
+	for i := range udpServers {
+		servers = append(servers, &udpServers[i])
 	}
 	client.udpPool = serverpool.NewPool(client, servers)
+	client.udpPool.SetHealthcheckIntervals(conf.HealthcheckInterval, conf.UnhealthyHealthcheckInterval, conf.HealthcheckJitter)
+	client.udpPool.SetHealthThresholds(conf.HealthcheckFailThreshold, conf.HealthcheckRiseThreshold)
 
 	// now parse tcp servers - not required
-	if tcpParts[0] != "" {
-		for _, ipPort := range tcpParts {
-			p := strings.Split(strings.Trim(ipPort, " "), ":")
-			if p[0] == "" {
-				continue
-			}
-			if len(p) != 2 {
-				panic(fmt.Errorf("bad <ip:port> dracula tcp client init %s", ipPort))
-			}
-			sport, err := strconv.Atoi(p[1])
-			if err != nil {
-				panic(fmt.Errorf("bad ip:<port> dracula tcp client init %s", ipPort))
-			}
-			client.tcpServerList = append(client.tcpServerList, net.TCPAddr{
-				IP:   net.ParseIP(p[0]),
-				Port: sport,
-			})
-		}
+	tcpServers, err := parseServerList(conf.RemoteTCPIPPortList, false)
+	if err != nil {
+		panic(fmt.Errorf("dracula tcp client init: %w", err))
+	}
+	for _, s := range tcpServers {
+		client.tcpServerList = append(client.tcpServerList, net.TCPAddr{IP: s.IP, Port: s.Port})
 	}
 
 	if len(servers) == 0 && len(client.tcpServerList) == 0 {
 		panic(ErrInitNoServers)
 	}
+	client.preferTCP = len(client.tcpServerList) > 0 && (conf.PreferTCP || len(servers) == 0)
+	client.requireHealthy = conf.RequireHealthyOnListen && len(servers) > 0
 
 	// setup the pool
 	client.tcpPool = &sync.Pool{
@@ -131,12 +312,14 @@ func NewClient(conf Config) *Client {
 			const maxTries = 5
 			for i := 0; i < maxTries; i++ {
 				randServer := client.tcpServerList[rand.Intn(len(client.tcpServerList))]
-				conn, err := net.DialTCP("tcp", nil, &randServer)
+				conn, err := net.DialTimeout("tcp", randServer.String(), client.timeoutDuration)
 				if err != nil {
 					client.log.Println("Connection to tcp dracula failed", randServer.String(), err)
+					continue
 				}
-				client.tcpPoolMap.Store(conn, true)
-				return conn
+				tcpConn := conn.(*net.TCPConn)
+				client.tcpPoolMap.Store(tcpConn, true)
+				return tcpConn
 			}
 
 			return nil
@@ -151,8 +334,22 @@ func (c *Client) GetConn() *net.UDPConn {
 	return c.conn
 }
 
+// SetPreSharedKey changes the key which signs packets sent to servers, without restarting.
+// Servers can accept more than one key while clients are switched over, see server.SetPreSharedKeys.
+func (c *Client) SetPreSharedKey(preSharedKey string) {
+	c.keyLock.Lock()
+	c.preSharedKey = []byte(preSharedKey)
+	c.keyLock.Unlock()
+}
+
+func (c *Client) signingKey() []byte {
+	c.keyLock.RLock()
+	defer c.keyLock.RUnlock()
+	return c.preSharedKey
+}
+
 func (c *Client) DebugEnable(prefix string) {
-	c.log.SetOutput(os.Stdout)
+	c.log.SetOutput(c.logOutput)
 	c.log.SetPrefix(prefix + " ")
 }
 
@@ -168,9 +365,13 @@ func (c *Client) Listen(localUDPPort int) error {
 	if c.conn != nil {
 		return ErrClientAlreadyInit
 	}
+	ip := net.ParseIP(c.bindIP)
+	if ip == nil {
+		return fmt.Errorf("%w: %q", ErrBadBindIP, c.bindIP)
+	}
 	conn, err := net.ListenUDP("udp", &net.UDPAddr{
 		Port: localUDPPort,
-		IP:   net.ParseIP("0.0.0.0"),
+		IP:   ip,
 	})
 	if err != nil {
 		return err
@@ -181,29 +382,37 @@ func (c *Client) Listen(localUDPPort int) error {
 
 	go c.handleResponsesForever()
 	go c.handleTimeouts()
+	if c.durable != nil {
+		go c.deliverDurableForever()
+	}
 
 	c.udpPool.Listen()
 	c.log.Printf("client created server udpPool %v\n", c.udpPool.ListServers())
+	if c.requireHealthy && len(c.udpPool.Healthy()) == 0 {
+		c.Close()
+		return fmt.Errorf("%w: none of %s passed the first healthcheck", ErrNoHealthyUDPServers, c.udpPool.ListServers())
+	}
 
 	return nil
 }
 
+// Close stops the client, failing the requests still waiting for a response with ErrClientClosed. It is safe
+// to call more than once, from several goroutines at once, and on a client whose Listen failed or was never
+// called. Only the first call does anything.
 func (c *Client) Close() error {
 	var err error
-	if c.disposed {
+	if !atomic.CompareAndSwapInt32(&c.disposed, 0, 1) {
 		return nil
 	}
-	c.disposed = true
-	c.messagesWaiting.Dispose()
+	// requests still waiting for a response return an error rather than block forever
+	c.messagesWaiting.DisposeWithError(ErrClientClosed)
 
 	if c.udpPool != nil {
 		c.udpPool.Dispose()
 	}
 	if c.conn != nil {
+		// the rest is still closed when this fails, and the error returned at the end
 		err = c.conn.Close()
-		if err != nil {
-			return err
-		}
 	}
 
 	c.tcpPoolMap.Range(func(key, value interface{}) bool {
@@ -214,14 +423,25 @@ func (c *Client) Close() error {
 		c.tcpPoolMap.Delete(key)
 		return true
 	})
+	c.closeMuxConns()
+	c.closeSubscriptions()
+	if c.durable != nil {
+		if durableErr := c.durable.close(); err == nil {
+			err = durableErr
+		}
+	}
+	return err
+}
 
-	return nil
+// isDisposed is true once Close was called
+func (c *Client) isDisposed() bool {
+	return atomic.LoadInt32(&c.disposed) == 1
 }
 
 func (c *Client) handleTimeouts() {
 	for timedOutCallback := range c.messagesWaiting.TimedOutMessages {
 		timedOutCallback([]byte{}, ErrMessageTimedOut)
-		if c.disposed {
+		if c.isDisposed() {
 			break
 		}
 	}
@@ -229,7 +449,7 @@ func (c *Client) handleTimeouts() {
 
 func (c *Client) handleResponsesForever() {
 	for {
-		if c.disposed {
+		if c.isDisposed() {
 			break
 		}
 		message := make([]byte, protocol.PacketSize)
@@ -238,7 +458,7 @@ func (c *Client) handleResponsesForever() {
 			c.log.Println("client read error:", err)
 			continue
 		}
-		packet, err := protocol.ParsePacket(message)
+		packet, err := protocol.ParsePacketSafe(message)
 		if err != nil {
 			if packet != nil && packet.MessageID > 0 {
 				c.log.Println("client parse packet error but has message id:", packet.MessageID, remote, err, message)
@@ -263,11 +483,15 @@ func (c *Client) handleResponsesForever() {
 
 		// handle packet error by constructing error from data value
 		if packet.Command == protocol.ResError {
-			cb([]byte{}, errors.New(packet.DataValueString()))
+			cb([]byte{}, newServerError(packet.DataValueString()))
 			continue
 		}
 
-		if packet.Command == protocol.CmdCount || packet.Command == protocol.CmdPut || packet.Command == protocol.CmdCountNamespace || packet.Command == protocol.CmdCountServer {
+		if packet.Command == protocol.CmdCount || packet.Command == protocol.CmdPut || packet.Command == protocol.CmdCountNamespace || packet.Command == protocol.CmdCountServer ||
+			packet.Command == protocol.CmdNamespaceInfo || packet.Command == protocol.CmdPing || packet.Command == protocol.CmdCountAt ||
+			packet.Command == protocol.CmdDelete || packet.Command == protocol.CmdCountKeys || packet.Command == protocol.CmdCountWeighted ||
+			packet.Command == protocol.CmdPutBytes || packet.Command == protocol.CmdCountBytes || packet.Command == protocol.CmdCompact ||
+			packet.Command == protocol.CmdGetReset || packet.Command == protocol.CmdPutWeight || packet.Command == protocol.CmdGetTTL {
 			cb(packet.DataValue, nil)
 			continue
 		}
@@ -276,6 +500,34 @@ func (c *Client) handleResponsesForever() {
 	}
 }
 
+// checkSizes returns an error when the namespace or value would not fit in a packet, instead of
+// letting them be truncated into a different key
+func checkSizes(namespace, value string) error {
+	if len(namespace) > protocol.NamespaceSize {
+		return ErrNamespaceTooLong
+	}
+	if len(value) > protocol.DataValueSize {
+		return ErrValueTooLong
+	}
+	return nil
+}
+
+// checkPut is checkSizes, and refuses line breaks, which the server would also refuse
+func checkPut(namespace, value string) error {
+	if err := checkSizes(namespace, value); err != nil {
+		return err
+	}
+	return protocol.CheckLineBreaks(namespace, value)
+}
+
+// checkValueLen refuses keys to put or count which are longer than Config.MaxValueLen
+func (c *Client) checkValueLen(entryKey []byte) error {
+	if len(entryKey) > c.maxValueLen {
+		return ErrValueTooLong
+	}
+	return nil
+}
+
 func (c *Client) makeMessageID() []byte {
 	id := atomic.AddUint32(&c.messageIDCounter, 1)
 	return protocol.Uint32ToBytes(id)
@@ -284,6 +536,44 @@ func (c *Client) makeMessageID() []byte {
 // Count asks for the number of unexpired entries in namespace at entryKey. The maximum supported
 // number of entries is max of type uint32.
 func (c *Client) Count(namespace, entryKey string) (int, error) {
+	if err := checkSizes(namespace, entryKey); err != nil {
+		return 0, err
+	}
+	if err := c.checkValueLen([]byte(entryKey)); err != nil {
+		return 0, err
+	}
+	cacheKey := readKey(0, namespace, entryKey)
+	if count, ok := c.counts.get(cacheKey); ok {
+		return count, nil
+	}
+	version := c.counts.version()
+	count, err := c.reads.do(readKey(protocol.CmdCount, namespace, entryKey), func() (int, error) {
+		return c.count(namespace, entryKey)
+	})
+	if err == nil {
+		c.counts.set(cacheKey, count, version)
+	}
+	return count, err
+}
+
+// CountBytes is Count for a binary key put with PutBytes. It is not shared or cached like Count.
+func (c *Client) CountBytes(namespace string, entryKey []byte) (int, error) {
+	data := protocol.LengthPrefixed(entryKey)
+	if err := checkSizes(namespace, string(data)); err != nil {
+		return 0, err
+	}
+	if err := c.checkValueLen(entryKey); err != nil {
+		return 0, err
+	}
+	return c.countCmd(protocol.CmdCountBytes, namespace, data)
+}
+
+func (c *Client) count(namespace, entryKey string) (int, error) {
+	return c.countCmd(protocol.CmdCount, namespace, []byte(entryKey))
+}
+
+// countCmd sends a count of one key, which is the data for CmdCount, or length prefixed for CmdCountBytes
+func (c *Client) countCmd(command byte, namespace string, data []byte) (int, error) {
 	messageID := c.makeMessageID()
 	var wg sync.WaitGroup
 	var output uint32
@@ -301,15 +591,151 @@ func (c *Client) Count(namespace, entryKey string) (int, error) {
 	}
 	wg.Add(1)
 	// callback has been setup, now make the request
-	p := protocol.NewPacketFromParts(protocol.CmdCount, messageID, []byte(namespace), []byte(entryKey), c.preSharedKey)
+	p := protocol.NewPacketFromParts(command, messageID, []byte(namespace), data, c.signingKey())
 	c.sendOrCallbackErr(p, cb)
 
 	wg.Wait() // wait for callback to be called
 	return int(output), err
 }
 
-// KeyMatch asks for the list of keys over TCP which match the pattern
+// CountAt returns how many entries at the key will still be unexpired at the unix seconds `atUnixSecs`,
+// for forecasting whether a key will still be over a limit in the near future. A time which is now or in
+// the past counts the same as Count. It is not shared or cached like Count.
+func (c *Client) CountAt(namespace, entryKey string, atUnixSecs int64) (int, error) {
+	if atUnixSecs < 0 || atUnixSecs > math.MaxUint32 {
+		return 0, ErrCountAtOutOfRange
+	}
+	data := append(protocol.Uint32ToBytes(uint32(atUnixSecs)), []byte(entryKey)...)
+	if err := checkSizes(namespace, string(data)); err != nil {
+		return 0, err
+	}
+	messageID := c.makeMessageID()
+	var wg sync.WaitGroup
+	var output uint32
+	var err error
+	cb := func(b []byte, e error) {
+		if e != nil {
+			err = e
+		} else if len(b) < 4 {
+			c.log.Println("client received too few bytes:", b)
+			err = ErrCountReturnBytesTooShort
+		} else {
+			output = protocol.Uint32FromBytes(b[0:4])
+		}
+		wg.Done()
+	}
+	wg.Add(1)
+	p := protocol.NewPacketFromParts(protocol.CmdCountAt, messageID, []byte(namespace), data, c.signingKey())
+	c.sendOrCallbackErr(p, cb)
+
+	wg.Wait() // wait for callback to be called
+	return int(output), err
+}
+
+// CountWeighted returns the entries at the key weighted by their age, halving every halfLifeSecs, so an entry
+// put now counts as 1 and one put a half life ago as 0.5. Bursts of recent entries stand out from the same
+// number spread across the expiry, which Count can't tell apart. It is not shared or cached like Count.
+func (c *Client) CountWeighted(namespace, entryKey string, halfLifeSecs float64) (float64, error) {
+	halfLifeMillis := int64(halfLifeSecs * 1000)
+	if halfLifeMillis < 1 {
+		return 0, ErrBadHalfLife
+	}
+	data := strconv.FormatInt(halfLifeMillis, 10) + " " + entryKey
+	if err := checkSizes(namespace, data); err != nil {
+		return 0, err
+	}
+	messageID := c.makeMessageID()
+	var wg sync.WaitGroup
+	var output float64
+	var err error
+	cb := func(b []byte, e error) {
+		if e != nil {
+			err = e
+		} else if output, e = strconv.ParseFloat(string(bytes.TrimSpace(b)), 64); e != nil {
+			c.log.Println("client received bad weighted count:", b)
+			err = ErrBadWeightedResponse
+		}
+		wg.Done()
+	}
+	wg.Add(1)
+	p := protocol.NewPacketFromParts(protocol.CmdCountWeighted, messageID, []byte(namespace), []byte(data), c.signingKey())
+	c.sendOrCallbackErr(p, cb)
+
+	wg.Wait() // wait for callback to be called
+	return output, err
+}
+
+// GetTTL returns how long entries put in the namespace count before they expire, in milliseconds, which is
+// the server's expiry. Counts decay as entries reach it, so it suits deciding how long a count can be cached.
+// Servers from before GetTTL respond with an unknown command error.
+func (c *Client) GetTTL(namespace string) (int64, error) {
+	if err := checkSizes(namespace, ""); err != nil {
+		return 0, err
+	}
+	messageID := c.makeMessageID()
+	var wg sync.WaitGroup
+	var output int64
+	var err error
+	cb := func(b []byte, e error) {
+		if e != nil {
+			err = e
+		} else if output, e = strconv.ParseInt(string(bytes.TrimSpace(b)), 10, 64); e != nil {
+			c.log.Println("client received bad ttl:", b)
+			err = ErrBadTTLResponse
+		}
+		wg.Done()
+	}
+	wg.Add(1)
+	p := protocol.NewPacketFromParts(protocol.CmdGetTTL, messageID, []byte(namespace), []byte{}, c.signingKey())
+	c.sendOrCallbackErr(p, cb)
+
+	wg.Wait() // wait for callback to be called
+	return output, err
+}
+
+// KeyMatch asks for the list of keys over TCP which match the glob pattern. The whole key must match,
+// where `*` matches any run of characters, including none, and every other character matches itself.
+// For example `user:*` matches keys starting with `user:`, and `*bot*` matches keys containing `bot`.
+// Keys are returned sorted lexicographically, so they can be paged through deterministically.
 func (c *Client) KeyMatch(namespace, keyPattern string) ([]string, error) {
+	if c.quotedLists {
+		// only the options command can ask for quoting
+		return c.KeyMatchOpts(namespace, keyPattern, MatchOptions{})
+	}
+	return c.keyMatch(protocol.CmdTCPOnlyKeys, namespace, keyPattern)
+}
+
+// MatchOptions adjust how KeyMatchOpts compares keys
+type MatchOptions struct {
+	// CaseInsensitive matches keys regardless of letter case
+	CaseInsensitive bool
+	// IncludeExpired also returns keys whose entries have all expired, but which the server has not
+	// cleaned up yet
+	IncludeExpired bool
+}
+
+// KeyMatchOpts is KeyMatch with options, such as matching case insensitively.
+func (c *Client) KeyMatchOpts(namespace, keyPattern string, opts MatchOptions) ([]string, error) {
+	flags := ""
+	if opts.CaseInsensitive {
+		flags += "i"
+	}
+	if opts.IncludeExpired {
+		flags += "e"
+	}
+	if c.quotedLists {
+		flags += "q"
+	}
+	if flags == "" {
+		flags = "-"
+	}
+	return c.keyMatch(protocol.CmdTCPOnlyKeysOpts, namespace, flags+" "+keyPattern)
+}
+
+func (c *Client) keyMatch(command byte, namespace, data string) ([]string, error) {
+	if err := checkSizes(namespace, data); err != nil {
+		return []string{}, err
+	}
 	messageID := c.makeMessageID()
 	var wg sync.WaitGroup
 	var output string
@@ -325,19 +751,231 @@ func (c *Client) KeyMatch(namespace, keyPattern string) ([]string, error) {
 	}
 	wg.Add(1)
 	// callback has been setup, now make the request
-	sendPacket := protocol.NewPacketFromParts(protocol.CmdTCPOnlyKeys, messageID, []byte(namespace), []byte(keyPattern), c.preSharedKey)
+	sendPacket := protocol.NewPacketFromParts(command, messageID, []byte(namespace), []byte(data), c.signingKey())
 	c.sendOrCallbackErr(sendPacket, cb)
 
 	wg.Wait() // wait for callback to be called
-	results := strings.Split(output, "\n")
-	if results[0] == "" {
-		results = []string{}
+	return c.splitList(output, err)
+}
+
+// splitList reads the items of a list response, which are quoted with Config.QuotedLists
+func (c *Client) splitList(output string, err error) ([]string, error) {
+	if err != nil || !c.quotedLists {
+		results := strings.Split(output, "\n")
+		if results[0] == "" {
+			results = []string{}
+		}
+		return results, err
+	}
+	results, err := protocol.SplitQuoted([]byte(output))
+	if err != nil {
+		return []string{}, fmt.Errorf("%w: %v", ErrBadListResponse, err)
 	}
-	return results, err
+	return results, nil
+}
+
+// KeyMatchPage is like KeyMatch, but returns up to limit keys after skipping the first offset matches,
+// and whether more matching keys remain. The server caps the limit, so a page may be shorter than
+// requested even when more remain.
+func (c *Client) KeyMatchPage(namespace, keyPattern string, offset, limit int) ([]string, bool, error) {
+	data := strconv.Itoa(offset) + " " + strconv.Itoa(limit) + " " + keyPattern
+	return c.requestPage(protocol.CmdTCPOnlyKeysPage, namespace, data)
 }
 
-// Healthcheck implements serverpool.Checker
+// ListNamespacesPage is like ListNamespaces, but returns up to limit namespaces in sorted order after
+// skipping the first offset, and whether more namespaces remain.
+func (c *Client) ListNamespacesPage(offset, limit int) ([]string, bool, error) {
+	data := strconv.Itoa(offset) + " " + strconv.Itoa(limit)
+	return c.requestPage(protocol.CmdTCPOnlyNamespacesPage, "", data)
+}
+
+func (c *Client) requestPage(command byte, namespace, data string) ([]string, bool, error) {
+	if err := checkSizes(namespace, data); err != nil {
+		return []string{}, false, err
+	}
+	messageID := c.makeMessageID()
+	var wg sync.WaitGroup
+	var output string
+	var err error
+	cb := func(b []byte, e error) {
+		defer wg.Done()
+
+		if e != nil {
+			err = e
+			return
+		}
+		output = string(b)
+	}
+	wg.Add(1)
+	// callback has been setup, now make the request
+	sendPacket := protocol.NewPacketFromParts(command, messageID, []byte(namespace), []byte(data), c.signingKey())
+	c.sendOrCallbackErr(sendPacket, cb)
+
+	wg.Wait() // wait for callback to be called
+	if err != nil {
+		return []string{}, false, err
+	}
+	lines := strings.Split(output, "\n")
+	if lines[0] != "0" && lines[0] != "1" {
+		return []string{}, false, ErrBadPageResponse
+	}
+	return lines[1:], lines[0] == "1", nil
+}
+
+// KeyCount is a key and its number of unexpired entries
+type KeyCount struct {
+	Key   string
+	Count int
+}
+
+// TopKeys asks over TCP for up to limit keys in the namespace with the most entries, highest count
+// first. The server caps the limit, so fewer keys may be returned.
+func (c *Client) TopKeys(namespace string, limit int) ([]KeyCount, error) {
+	if err := checkSizes(namespace, ""); err != nil {
+		return []KeyCount{}, err
+	}
+	messageID := c.makeMessageID()
+	var wg sync.WaitGroup
+	var output string
+	var err error
+	cb := func(b []byte, e error) {
+		defer wg.Done()
+
+		if e != nil {
+			err = e
+			return
+		}
+		output = string(b)
+	}
+	wg.Add(1)
+	// callback has been setup, now make the request
+	sendPacket := protocol.NewPacketFromParts(protocol.CmdTCPOnlyTopKeys, messageID, []byte(namespace), []byte(strconv.Itoa(limit)), c.signingKey())
+	c.sendOrCallbackErr(sendPacket, cb)
+
+	wg.Wait() // wait for callback to be called
+	results := []KeyCount{}
+	if err != nil || output == "" {
+		return results, err
+	}
+	for _, line := range strings.Split(output, "\n") {
+		// keys may contain colons, so the count is after the last one
+		sep := strings.LastIndexByte(line, ':')
+		if sep == -1 {
+			return results, ErrBadTopKeysResponse
+		}
+		count, convErr := strconv.Atoi(line[sep+1:])
+		if convErr != nil {
+			return results, ErrBadTopKeysResponse
+		}
+		results = append(results, KeyCount{Key: line[:sep], Count: count})
+	}
+	return results, nil
+}
+
+// ServerInfo describes how a server is configured
+type ServerInfo struct {
+	Version string `json:"version"`
+	Build   string `json:"build"`
+	// ExpireAfterSecs is rounded down, so it is 0 for an expiry under a second. See ExpireAfterMillis.
+	ExpireAfterSecs   int64 `json:"expireAfterSecs"`
+	ExpireAfterMillis int64 `json:"expireAfterMillis"`
+	// Peers is how many other servers puts are replicated to
+	Peers int `json:"peers"`
+	// Storage is where entries are kept, which is "memory"
+	Storage    string `json:"storage"`
+	UptimeSecs int64  `json:"uptimeSecs"`
+	// ReadOnly servers refuse puts and deletes
+	ReadOnly bool `json:"readOnly"`
+}
+
+// ServerInfo asks one of the TCP servers for its version and configuration, for debugging which server
+// is being talked to and how it is set up.
+func (c *Client) ServerInfo() (ServerInfo, error) {
+	messageID := c.makeMessageID()
+	var wg sync.WaitGroup
+	var output []byte
+	var err error
+	cb := func(b []byte, e error) {
+		defer wg.Done()
+
+		if e != nil {
+			err = e
+			return
+		}
+		output = b
+	}
+	wg.Add(1)
+	// callback has been setup, now make the request
+	sendPacket := protocol.NewPacketFromParts(protocol.CmdTCPOnlyInfo, messageID, []byte{}, []byte{}, c.signingKey())
+	c.sendOrCallbackErr(sendPacket, cb)
+
+	wg.Wait() // wait for callback to be called
+	var info ServerInfo
+	if err != nil {
+		return info, err
+	}
+	if jsonErr := json.Unmarshal(output, &info); jsonErr != nil {
+		return info, fmt.Errorf("%w: %v", ErrBadInfoResponse, jsonErr)
+	}
+	return info, nil
+}
+
+// ServerPeers asks one of the TCP servers which peers it replicates to, as comma separated ip:port. To manage
+// a particular server's peers, use a client with only that TCP server.
+func (c *Client) ServerPeers() ([]string, error) {
+	return c.changeServerPeers("")
+}
+
+// AddServerPeer makes one of the TCP servers replicate to another server at ip:port, and returns its peers.
+func (c *Client) AddServerPeer(hostPort string) ([]string, error) {
+	return c.changeServerPeers("+" + hostPort)
+}
+
+// RemoveServerPeer makes one of the TCP servers stop replicating to the server at ip:port, and returns its peers.
+func (c *Client) RemoveServerPeer(hostPort string) ([]string, error) {
+	return c.changeServerPeers("-" + hostPort)
+}
+
+func (c *Client) changeServerPeers(change string) ([]string, error) {
+	messageID := c.makeMessageID()
+	var wg sync.WaitGroup
+	var output []byte
+	var err error
+	cb := func(b []byte, e error) {
+		defer wg.Done()
+
+		if e != nil {
+			err = e
+			return
+		}
+		output = b
+	}
+	wg.Add(1)
+	// callback has been setup, now make the request
+	sendPacket := protocol.NewPacketFromParts(protocol.CmdTCPOnlyPeers, messageID, []byte{}, []byte(change), c.signingKey())
+	c.sendOrCallbackErr(sendPacket, cb)
+
+	wg.Wait() // wait for callback to be called
+	if err != nil {
+		return nil, err
+	}
+	if len(output) == 0 {
+		return []string{}, nil
+	}
+	return strings.Split(string(output), ","), nil
+}
+
+// Healthcheck implements serverpool.Checker. It pings the server, which does not touch its store.
 func (c *Client) Healthcheck(specificServer *net.UDPAddr) error {
+	err := c.healthcheck(specificServer, protocol.CmdPing, "", "")
+	if errors.Is(err, ErrBadPacket) {
+		// servers from before ping reject the command, so check them with a count like they expect
+		return c.healthcheck(specificServer, protocol.CmdCount, "server_healthcheck_"+specificServer.String(), "check")
+	}
+	return err
+}
+
+func (c *Client) healthcheck(specificServer *net.UDPAddr, command byte, namespace, entryKey string) error {
 	messageID := c.makeMessageID()
 	var wg sync.WaitGroup
 	var err error
@@ -349,7 +987,7 @@ func (c *Client) Healthcheck(specificServer *net.UDPAddr) error {
 	}
 	wg.Add(1)
 	// callback has been setup, now make the request
-	p := protocol.NewPacketFromParts(protocol.CmdCount, messageID, []byte("server_healthcheck_"+specificServer.String()), []byte("check"), c.preSharedKey)
+	p := protocol.NewPacketFromParts(command, messageID, []byte(namespace), []byte(entryKey), c.signingKey())
 	c._sendUDP(p, specificServer, cb)
 
 	wg.Wait() // wait for callback to be called
@@ -358,6 +996,43 @@ func (c *Client) Healthcheck(specificServer *net.UDPAddr) error {
 
 // CountNamespace (expensive) returns the number of key entries across all keys in a namespace.
 func (c *Client) CountNamespace(namespace string) (int, error) {
+	if err := checkSizes(namespace, ""); err != nil {
+		return 0, err
+	}
+	return c.reads.do(readKey(protocol.CmdCountNamespace, namespace, ""), func() (int, error) {
+		return c.countNamespace(namespace)
+	})
+}
+
+// CountDistinctKeys (expensive) returns the number of keys in a namespace with unexpired entries, no matter
+// how many entries each has, such as the unique IPs seen within the expiry. CountNamespace is the sum of
+// their entries instead, and NamespaceInfo is a cheaper key count which may include keys which just expired.
+func (c *Client) CountDistinctKeys(namespace string) (int, error) {
+	if err := checkSizes(namespace, ""); err != nil {
+		return 0, err
+	}
+	return c.reads.do(readKey(protocol.CmdCountKeys, namespace, ""), func() (int, error) {
+		return c.countNamespaceCmd(protocol.CmdCountKeys, namespace)
+	})
+}
+
+// Compact (expensive) makes a server remove the namespace's expired entries now, returning how many it removed.
+// Expired entries are otherwise only removed when their key is used or the server's periodic cleanup reaches
+// the namespace, so it reclaims memory straight after a burst of puts. Like CountNamespace it is sent to one
+// server, which compacts only its own copy.
+func (c *Client) Compact(namespace string) (reclaimed int, err error) {
+	if err = checkSizes(namespace, ""); err != nil {
+		return 0, err
+	}
+	return c.countNamespaceCmd(protocol.CmdCompact, namespace)
+}
+
+func (c *Client) countNamespace(namespace string) (int, error) {
+	return c.countNamespaceCmd(protocol.CmdCountNamespace, namespace)
+}
+
+// countNamespaceCmd sends a command which counts the namespace, and reads the uint32 count it responds with
+func (c *Client) countNamespaceCmd(command byte, namespace string) (int, error) {
 	messageID := c.makeMessageID()
 	var wg sync.WaitGroup
 	var output uint32
@@ -375,15 +1050,48 @@ func (c *Client) CountNamespace(namespace string) (int, error) {
 	}
 	wg.Add(1)
 	// callback has been setup, now make the request
-	p := protocol.NewPacketFromParts(protocol.CmdCountNamespace, messageID, []byte(namespace), []byte{}, c.preSharedKey)
+	p := protocol.NewPacketFromParts(command, messageID, []byte(namespace), []byte{}, c.signingKey())
 	c.sendOrCallbackErr(p, cb)
 
 	wg.Wait() // wait for callback to be called
 	return int(output), err
 }
 
+// NamespaceInfo (cheap) returns whether a namespace has any keys, and how many. Unlike CountNamespace,
+// entries are not counted, so keys whose entries recently expired may be included in the count.
+func (c *Client) NamespaceInfo(namespace string) (exists bool, keyCount int, err error) {
+	if err = checkSizes(namespace, ""); err != nil {
+		return false, 0, err
+	}
+	messageID := c.makeMessageID()
+	var wg sync.WaitGroup
+	var output uint32
+	cb := func(b []byte, e error) {
+		if e != nil {
+			err = e
+		} else if len(b) < 4 {
+			c.log.Println("client received too few bytes:", b)
+			err = ErrCountReturnBytesTooShort
+		} else {
+			output = protocol.Uint32FromBytes(b[0:4])
+		}
+		wg.Done()
+	}
+	wg.Add(1)
+	// callback has been setup, now make the request
+	p := protocol.NewPacketFromParts(protocol.CmdNamespaceInfo, messageID, []byte(namespace), []byte{}, c.signingKey())
+	c.sendOrCallbackErr(p, cb)
+
+	wg.Wait() // wait for callback to be called
+	return output > 0, int(output), err
+}
+
 // CountServer (very expensive) returns the number of key entries across all keys in all namespaces.
 func (c *Client) CountServer() (int, error) {
+	return c.reads.do(readKey(protocol.CmdCountServer, "", ""), c.countServer)
+}
+
+func (c *Client) countServer() (int, error) {
 	messageID := c.makeMessageID()
 	var wg sync.WaitGroup
 	var output uint32
@@ -401,7 +1109,7 @@ func (c *Client) CountServer() (int, error) {
 	}
 	wg.Add(1)
 	// callback has been setup, now make the request
-	p := protocol.NewPacketFromParts(protocol.CmdCountServer, messageID, []byte{}, []byte{}, c.preSharedKey)
+	p := protocol.NewPacketFromParts(protocol.CmdCountServer, messageID, []byte{}, []byte{}, c.signingKey())
 	c.sendOrCallbackErr(p, cb)
 
 	wg.Wait() // wait for callback to be called
@@ -422,30 +1130,152 @@ func (c *Client) ListNamespaces() ([]string, error) {
 		namespaces = string(b)
 	}
 	wg.Add(1)
-	sendPacket := protocol.NewPacketFromParts(protocol.CmdTCPOnlyNamespaces, messageID, []byte{}, []byte{}, c.preSharedKey)
+	var data []byte
+	if c.quotedLists {
+		data = []byte("q")
+	}
+	sendPacket := protocol.NewPacketFromParts(protocol.CmdTCPOnlyNamespaces, messageID, []byte{}, data, c.signingKey())
 	c.sendOrCallbackErr(sendPacket, cb)
 	wg.Wait()
+	if c.quotedLists {
+		return c.splitList(namespaces, err)
+	}
 	return strings.Split(namespaces, "\n"), err
 }
 
 func (c *Client) Put(namespace, value string) error {
+	_, err := c.put(namespace, value)
+	return err
+}
+
+// PutReturningCount is Put, returning the count of the key after the put, for when a Count would follow.
+// Servers from before the count was in the put response return ErrCountReturnBytesTooShort.
+func (c *Client) PutReturningCount(namespace, value string) (int, error) {
+	count, err := c.put(namespace, value)
+	if err == nil && count < 0 {
+		err = ErrCountReturnBytesTooShort
+	}
+	return count, err
+}
+
+// PutWeight is Put of weight entries at once, from 1 to protocol.MaxPutWeight, for events which count as
+// several, in one packet instead of weight of them. With peers, the weight is replicated too. Servers from
+// before PutWeight respond with an unknown command error.
+func (c *Client) PutWeight(namespace, value string, weight int) error {
+	if weight < 1 || weight > protocol.MaxPutWeight {
+		return ErrBadPutWeight
+	}
+	data := strconv.Itoa(weight) + " " + value
+	if err := checkPut(namespace, data); err != nil {
+		return err
+	}
+	if err := c.checkValueLen([]byte(value)); err != nil {
+		return err
+	}
+	_, err := c.putCmd(protocol.CmdPutWeight, namespace, []byte(data), value)
+	return err
+}
+
+// Delete removes the key and all its entries, returning whether it had any. With peers, the delete is
+// replicated, and wins over puts made before it which are still being replicated.
+func (c *Client) Delete(namespace, entryKey string) (bool, error) {
+	if err := checkSizes(namespace, entryKey); err != nil {
+		return false, err
+	}
 	messageID := c.makeMessageID()
 	var wg sync.WaitGroup
+	var deleted bool
 	var err error
 	cb := func(b []byte, e error) {
-		err = e
-		c.log.Println("client put error", e)
+		if e != nil {
+			err = e
+		} else if len(b) < 4 {
+			c.log.Println("client received too few bytes:", b)
+			err = ErrCountReturnBytesTooShort
+		} else {
+			deleted = protocol.Uint32FromBytes(b[0:4]) == 1
+		}
 		wg.Done()
 	}
 	wg.Add(1)
 	// callback has been setup, now make the request
-	p := protocol.NewPacketFromParts(protocol.CmdPut, messageID, []byte(namespace), []byte(value), c.preSharedKey)
+	p := protocol.NewPacketFromParts(protocol.CmdDelete, messageID, []byte(namespace), []byte(entryKey), c.signingKey())
 	c.sendOrCallbackErr(p, cb)
 
 	wg.Wait() // wait for callback to be called
+	c.InvalidateCount(namespace, entryKey)
+	return deleted, err
+}
+
+// GetAndReset returns the key's count and removes its entries at once, so each entry is counted by exactly
+// one GetAndReset, such as when billing fixed windows. With peers, the reset is replicated like Delete. When
+// the response is lost the key may have been reset anyway, so use PreferTCP where every entry matters.
+func (c *Client) GetAndReset(namespace, entryKey string) (int, error) {
+	if err := checkSizes(namespace, entryKey); err != nil {
+		return 0, err
+	}
+	count, err := c.countCmd(protocol.CmdGetReset, namespace, []byte(entryKey))
+	c.InvalidateCount(namespace, entryKey)
+	return count, err
+}
+
+// PutBytes is Put for binary keys, like raw hashes, which are sent with their length so they are stored
+// exactly, including any spaces or line breaks. They are always sent over udp, and servers from before
+// PutBytes respond with an unknown command error. The same key put with Put and PutBytes counts together,
+// unless Put trimmed it.
+func (c *Client) PutBytes(namespace string, value []byte) error {
+	data := protocol.LengthPrefixed(value)
+	if err := checkSizes(namespace, string(data)); err != nil {
+		return err
+	}
+	if err := protocol.CheckLineBreaks(namespace, ""); err != nil {
+		return err
+	}
+	if err := c.checkValueLen(value); err != nil {
+		return err
+	}
+	_, err := c.putCmd(protocol.CmdPutBytes, namespace, data, string(value))
 	return err
 }
 
+// put returns the count from the response, or -1 when the server did not include it
+func (c *Client) put(namespace, value string) (int, error) {
+	if err := checkPut(namespace, value); err != nil {
+		return 0, err
+	}
+	if err := c.checkValueLen([]byte(value)); err != nil {
+		return 0, err
+	}
+	return c.putCmd(protocol.CmdPut, namespace, []byte(value), value)
+}
+
+// putCmd sends a put of the data, which is entryKey for CmdPut, length prefixed for CmdPutBytes, or weighted
+// for CmdPutWeight
+func (c *Client) putCmd(command byte, namespace string, data []byte, entryKey string) (int, error) {
+	messageID := c.makeMessageID()
+	var wg sync.WaitGroup
+	var err error
+	count := -1
+	cb := func(b []byte, e error) {
+		err = e
+		if e != nil {
+			c.log.Println("client put error", e)
+		} else if len(b) >= 4 && !bytes.Equal(b[0:4], []byte("    ")) {
+			// older servers respond with only padding, which would otherwise read as a count of 538976288
+			count = int(protocol.Uint32FromBytes(b[0:4]))
+		}
+		wg.Done()
+	}
+	wg.Add(1)
+	// callback has been setup, now make the request
+	p := protocol.NewPacketFromParts(command, messageID, []byte(namespace), data, c.signingKey())
+	c.sendOrCallbackErr(p, cb)
+
+	wg.Wait() // wait for callback to be called
+	c.InvalidateCount(namespace, entryKey)
+	return count, err
+}
+
 func (c *Client) _sendUDP(packet *protocol.Packet, remoteServer *net.UDPAddr, cb waitingmessage.Callback) {
 	c.log.Println("client sending udp packet:", remoteServer, string(packet.Command), packet.MessageID, packet.NamespaceString(), packet.DataValueString())
 
@@ -463,8 +1293,13 @@ func (c *Client) _sendUDP(packet *protocol.Packet, remoteServer *net.UDPAddr, cb
 		return
 	}
 
-	_, err = c.conn.WriteToUDP(b, remoteServer)
+	// a full socket buffer should not block past the timeout
+	err = c.conn.SetWriteDeadline(time.Now().Add(c.timeoutDuration))
+	if err == nil {
+		_, err = c.conn.WriteToUDP(b, remoteServer)
+	}
 	if err != nil {
+		err = sendError(err)
 		// immediate failure, handle here
 		reCall, pullErr := c.messagesWaiting.Pull(packet.MessageID)
 		if pullErr != nil {
@@ -482,7 +1317,7 @@ func (c *Client) _sendTCP(packet *protocol.Packet, cb waitingmessage.Callback) {
 
 	// Get a connection from the pool.
 	key := c.tcpPool.Get()
-	conn := key.(*net.TCPConn)
+	conn, _ := key.(*net.TCPConn) // nil when no server could be dialed
 	defer func() {
 		if conn == nil {
 			c.tcpPoolMap.Delete(key)
@@ -499,8 +1334,8 @@ func (c *Client) _sendTCP(packet *protocol.Packet, cb waitingmessage.Callback) {
 	packet.DataValue = append(packet.DataValue, protocol.StopSymbol...)
 
 	packetBuf, err := packet.Bytes()
-	if err != nil {
-		// probably bad packet
+	if err != nil && err != protocol.ErrBadOutputSize {
+		// probably bad packet. udp commands are a full packet before the stop, so are too long with it
 		cb([]byte{}, err)
 		return
 	}
@@ -548,10 +1383,14 @@ func (c *Client) _sendTCP(packet *protocol.Packet, cb waitingmessage.Callback) {
 	}
 
 	// we are now waiting for the response, so send the message
-	_, err = conn.Write(packetBuf)
+	err = conn.SetWriteDeadline(time.Now().Add(c.timeoutDuration))
+	if err == nil {
+		_, err = conn.Write(packetBuf)
+	}
 	if err != nil {
 		c.log.Println("client tcp write failed", err)
-		cb([]byte{}, err)
+		conn.Close()
+		cb([]byte{}, sendError(err))
 		conn = nil
 		return
 	}
@@ -570,15 +1409,77 @@ func (c *Client) _sendTCP(packet *protocol.Packet, cb waitingmessage.Callback) {
 		cb([]byte{}, err)
 		return
 	}
-	cb(bytes.TrimSpace(resPacket.DataValue), nil)
+	if resPacket.Command == protocol.ResError {
+		cb([]byte{}, newServerError(resPacket.DataValueString()))
+		return
+	}
+	cb(tcpResponseData(resPacket), nil)
+}
+
+// isTCPPreferredCmd is true for the udp commands which are sent over tcp with Config.PreferTCP
+func isTCPPreferredCmd(c byte) bool {
+	return c == protocol.CmdCount || c == protocol.CmdPut || c == protocol.CmdGetReset || c == protocol.CmdPutWeight
+}
+
+// tcpResponseData is the data callbacks get from a tcp response. Counts are binary, so they are passed on
+// untrimmed like udp responses are, since their bytes can look like spaces.
+func tcpResponseData(resPacket *protocol.Packet) []byte {
+	if isTCPPreferredCmd(resPacket.Command) {
+		return resPacket.DataValue
+	}
+	return []byte(protocol.TrimPadding(resPacket.DataValue))
+}
+
+// sendError makes a write which hit its deadline an ErrSendTimedOut
+func sendError(err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("%w: %v", ErrSendTimedOut, err)
+	}
+	return err
+}
+
+// chooseServer picks the udp server for the packet according to the routing mode
+func (c *Client) chooseServer(packet *protocol.Packet) *net.UDPAddr {
+	ns := packet.NamespaceString()
+	switch c.routingMode {
+	case RoutingConsistentHashKey:
+		if packet.Command == protocol.CmdCount || packet.Command == protocol.CmdPut || packet.Command == protocol.CmdDelete ||
+			packet.Command == protocol.CmdGetReset {
+			return c.udpPool.ChooseFor(ns + " " + packet.DataValueString())
+		}
+		if packet.Command == protocol.CmdCountAt {
+			// skip the time, so the key routes to the same server it is put on
+			return c.udpPool.ChooseFor(ns + " " + protocol.TrimPadding(packet.DataValue[4:]))
+		}
+		if packet.Command == protocol.CmdPutBytes || packet.Command == protocol.CmdCountBytes {
+			key, _ := protocol.ReadLengthPrefixed(packet.DataValue)
+			return c.udpPool.ChooseFor(ns + " " + string(key))
+		}
+		if packet.Command == protocol.CmdCountWeighted || packet.Command == protocol.CmdPutWeight {
+			// skip the half life or weight, like the time of CmdCountAt
+			parts := strings.SplitN(packet.DataValueString(), " ", 2)
+			return c.udpPool.ChooseFor(ns + " " + parts[len(parts)-1])
+		}
+		fallthrough
+	case RoutingConsistentHash:
+		if ns != "" {
+			return c.udpPool.ChooseFor(ns)
+		}
+	}
+	return c.udpPool.Choose()
 }
 
 func (c *Client) sendOrCallbackErr(packet *protocol.Packet, cb waitingmessage.Callback) {
-	if protocol.IsTcpOnlyCmd(packet.Command) {
+	if protocol.IsTcpOnlyCmd(packet.Command) || (c.preferTCP && isTCPPreferredCmd(packet.Command)) {
+		if c.multiplexTCP {
+			c._sendTCPMux(packet, cb)
+			return
+		}
 		c._sendTCP(packet, cb)
 		return
 	}
-	remoteServer := c.udpPool.Choose()
+	remoteServer := c.chooseServer(packet)
 	if remoteServer == nil {
 		c.log.Println("No healthy udp servers")
 		cb([]byte{}, ErrNoHealthyUDPServers)
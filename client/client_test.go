@@ -1,13 +1,22 @@
 package client
 
 import (
+	"bytes"
+	"fmt"
+	"log"
 	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/mailsac/dracula/client/waitingmessage"
 	"github.com/mailsac/dracula/protocol"
 	"github.com/mailsac/dracula/server"
+	"github.com/mailsac/dracula/store"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -62,6 +71,52 @@ func TestClient_Auth(t *testing.T) {
 	err = badClient.Put("asdf", "99.33.22.44")
 	assert.Error(t, err)
 	assert.Equal(t, "auth failed: packet hash invalid", err.Error())
+	assert.ErrorIs(t, err, ErrAuthFailed)
+	var serverErr *ServerError
+	if assert.ErrorAs(t, err, &serverErr) {
+		assert.Equal(t, CodeAuthFailed, serverErr.Code)
+	}
+}
+
+func TestClient_PreSharedKeyRotation(t *testing.T) {
+	s := server.NewServer(60, "old-key")
+	s.DebugEnable("9000")
+	err := s.Listen(9000, 9000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	oldClient := NewClient(Config{RemoteUDPIPPortList: "127.0.0.1:9000", Timeout: 5 * time.Second, PreSharedKey: "old-key"})
+	assert.NoError(t, oldClient.Listen(9001))
+	defer oldClient.Close()
+	assert.NoError(t, oldClient.Put("asdf", "99.33.22.44"))
+
+	// overlap window where both keys are valid
+	s.SetPreSharedKeys("new-key", "old-key")
+	newClient := NewClient(Config{RemoteUDPIPPortList: "127.0.0.1:9000", Timeout: 5 * time.Second, PreSharedKey: "new-key"})
+	assert.NoError(t, newClient.Listen(9002))
+	defer newClient.Close()
+	assert.NoError(t, oldClient.Put("asdf", "99.33.22.44"))
+	assert.NoError(t, newClient.Put("asdf", "99.33.22.44"))
+	c, err := oldClient.Count("asdf", "99.33.22.44")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, c)
+	c, err = newClient.Count("asdf", "99.33.22.44")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, c)
+
+	// old key removed
+	s.SetPreSharedKeys("new-key")
+	err = oldClient.Put("asdf", "99.33.22.44")
+	assert.Error(t, err)
+	assert.Equal(t, "auth failed: packet hash invalid", err.Error())
+	oldClient.SetPreSharedKey("new-key")
+	assert.NoError(t, oldClient.Put("asdf", "99.33.22.44"))
+	assert.NoError(t, newClient.Put("asdf", "99.33.22.44"))
+	c, err = newClient.Count("asdf", "99.33.22.44")
+	assert.NoError(t, err)
+	assert.Equal(t, 5, c)
 }
 
 func TestClient_Healthcheck(t *testing.T) {
@@ -152,7 +207,7 @@ func TestClient_TcpKeyMatch(t *testing.T) {
 
 		matched, err := cl.KeyMatch("default", "blah*")
 		assert.NoError(t, err)
-		assert.ElementsMatch(t, []string{"blah", "blah:2", "blah:a", "blah:ce"}, matched)
+		assert.Equal(t, []string{"blah", "blah:2", "blah:a", "blah:ce"}, matched, "sorted")
 
 		// use the pool a bit
 		matched, err = cl.KeyMatch("other", "blah*")
@@ -162,6 +217,51 @@ func TestClient_TcpKeyMatch(t *testing.T) {
 		matched, err = cl.KeyMatch("notexisting", "blah*")
 		assert.NoError(t, err)
 		assert.ElementsMatch(t, []string{}, matched)
+
+		matched, err = cl.KeyMatchOpts("default", "BLA*", MatchOptions{CaseInsensitive: true})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"blaM!", "blah", "blah:2", "blah:a", "blah:ce", "blat"}, matched)
+		matched, err = cl.KeyMatchOpts("default", "BLA*", MatchOptions{})
+		assert.NoError(t, err)
+		assert.Empty(t, matched)
+	})
+}
+
+func TestClient_TcpTopKeys(t *testing.T) {
+	t.Run("returns keys with the most entries first", func(t *testing.T) {
+		secret := "asdf-!!?!|asdf"
+		s := server.NewServer(60, secret)
+		s.DebugEnable("9013")
+		err := s.Listen(9013, 9013)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		cl := NewClient(Config{RemoteUDPIPPortList: "127.0.0.1:9013", RemoteTCPIPPortList: "127.0.0.1:9013", Timeout: time.Second * 5, PreSharedKey: secret})
+		assert.NoError(t, cl.Listen(9014))
+		defer cl.Close()
+
+		for i := 0; i < 3; i++ {
+			assert.NoError(t, cl.Put("default", "user:abuser")) // colons in keys
+		}
+		for i := 0; i < 2; i++ {
+			assert.NoError(t, cl.Put("default", "b"))
+		}
+		assert.NoError(t, cl.Put("default", "a"))
+		assert.NoError(t, cl.Put("default", "c"))
+
+		top, err := cl.TopKeys("default", 3)
+		assert.NoError(t, err)
+		assert.Equal(t, []KeyCount{{Key: "user:abuser", Count: 3}, {Key: "b", Count: 2}, {Key: "a", Count: 1}}, top)
+
+		top, err = cl.TopKeys("default", 10)
+		assert.NoError(t, err)
+		assert.Len(t, top, 4)
+
+		top, err = cl.TopKeys("notexisting", 10)
+		assert.NoError(t, err)
+		assert.Equal(t, []KeyCount{}, top)
 	})
 }
 
@@ -194,3 +294,1195 @@ func TestClient_TcpListNamespaces(t *testing.T) {
 		assert.NoError(t, err) // out of order
 	})
 }
+
+func TestClient_TcpPages(t *testing.T) {
+	secret := "asdf-!!?!|asdf"
+	s := server.NewServer(60, secret)
+	s.DebugEnable("9015")
+	err := s.Listen(9015, 9015)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	cl := NewClient(Config{RemoteUDPIPPortList: "127.0.0.1:9015", RemoteTCPIPPortList: "127.0.0.1:9015", Timeout: time.Second * 5, PreSharedKey: secret})
+	assert.NoError(t, cl.Listen(9016))
+	defer cl.Close()
+
+	for _, key := range []string{"k:e", "k:a", "k:d", "k:b", "k:c", "other"} {
+		assert.NoError(t, cl.Put("default", key))
+	}
+	assert.NoError(t, cl.Put("second", "x"))
+
+	t.Run("pages through keys in order", func(t *testing.T) {
+		page, more, err := cl.KeyMatchPage("default", "k:*", 0, 2)
+		assert.NoError(t, err)
+		assert.True(t, more)
+		assert.Equal(t, []string{"k:a", "k:b"}, page)
+
+		page, more, err = cl.KeyMatchPage("default", "k:*", 2, 2)
+		assert.NoError(t, err)
+		assert.True(t, more)
+		assert.Equal(t, []string{"k:c", "k:d"}, page)
+
+		page, more, err = cl.KeyMatchPage("default", "k:*", 4, 2)
+		assert.NoError(t, err)
+		assert.False(t, more)
+		assert.Equal(t, []string{"k:e"}, page)
+
+		page, more, err = cl.KeyMatchPage("default", "k:*", 6, 2)
+		assert.NoError(t, err)
+		assert.False(t, more)
+		assert.Empty(t, page)
+	})
+	t.Run("pages through namespaces in order", func(t *testing.T) {
+		page, more, err := cl.ListNamespacesPage(0, 1)
+		assert.NoError(t, err)
+		assert.True(t, more)
+		assert.Equal(t, []string{"default"}, page)
+
+		page, more, err = cl.ListNamespacesPage(1, 1)
+		assert.NoError(t, err)
+		assert.False(t, more)
+		assert.Equal(t, []string{"second"}, page)
+	})
+}
+
+func TestClient_NamespaceInfo(t *testing.T) {
+	secret := "asdf-!!?!|asdf"
+	s := server.NewServer(60, secret)
+	s.DebugEnable("9017")
+	err := s.Listen(9017, 9017)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	cl := NewClient(Config{RemoteUDPIPPortList: "127.0.0.1:9017", Timeout: time.Second * 5, PreSharedKey: secret})
+	assert.NoError(t, cl.Listen(9018))
+	defer cl.Close()
+
+	assert.NoError(t, cl.Put("default", "a"))
+	assert.NoError(t, cl.Put("default", "a"))
+	assert.NoError(t, cl.Put("default", "b"))
+
+	exists, keyCount, err := cl.NamespaceInfo("default")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, 2, keyCount)
+
+	exists, keyCount, err = cl.NamespaceInfo("notexisting")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	assert.Equal(t, 0, keyCount)
+}
+
+func TestClient_CountDistinctKeys(t *testing.T) {
+	s := server.NewServer(60, "secret")
+	if err := s.Listen(9230, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	cl := NewClient(Config{RemoteUDPIPPortList: "127.0.0.1:9230", Timeout: time.Second, PreSharedKey: "secret"})
+	assert.NoError(t, cl.Listen(9231))
+	defer cl.Close()
+
+	for _, ip := range []string{"10.0.0.1", "10.0.0.1", "10.0.0.1", "10.0.0.2"} {
+		assert.NoError(t, cl.Put("visitors", ip))
+	}
+	distinct, err := cl.CountDistinctKeys("visitors")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, distinct)
+	entries, err := cl.CountNamespace("visitors")
+	assert.NoError(t, err)
+	assert.Equal(t, 4, entries)
+	distinct, err = cl.CountDistinctKeys("none")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, distinct)
+}
+
+func TestClient_GetAndReset(t *testing.T) {
+	peers := "127.0.0.1:9244,127.0.0.1:9245"
+	s1 := server.MustNewServerWithPeers(60, "secret", "127.0.0.1:9244", peers)
+	if err := s1.Listen(9244, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+	s2 := server.MustNewServerWithPeers(60, "secret", "127.0.0.1:9245", peers)
+	if err := s2.Listen(9245, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	cl := NewClient(Config{RemoteUDPIPPortList: "127.0.0.1:9244", Timeout: time.Second, PreSharedKey: "secret"})
+	assert.NoError(t, cl.Listen(9246))
+	defer cl.Close()
+	toPeer := NewClient(Config{RemoteUDPIPPortList: "127.0.0.1:9245", Timeout: time.Second, PreSharedKey: "secret"})
+	assert.NoError(t, toPeer.Listen(9247))
+	defer toPeer.Close()
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, cl.Put("billing", "acct"))
+	}
+	time.Sleep(50 * time.Millisecond)
+	count, err := cl.GetAndReset("billing", "acct")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+	count, err = cl.GetAndReset("billing", "acct")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count, "already reset")
+
+	time.Sleep(50 * time.Millisecond)
+	count, err = toPeer.Count("billing", "acct")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count, "the reset is replicated")
+}
+
+func TestClient_PutWeight(t *testing.T) {
+	peers := "127.0.0.1:9250,127.0.0.1:9251"
+	s1 := server.MustNewServerWithPeers(60, "secret", "127.0.0.1:9250", peers)
+	if err := s1.Listen(9250, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+	s2 := server.MustNewServerWithPeers(60, "secret", "127.0.0.1:9251", peers)
+	if err := s2.Listen(9251, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	cl := NewClient(Config{RemoteUDPIPPortList: "127.0.0.1:9250", Timeout: time.Second, PreSharedKey: "secret"})
+	assert.NoError(t, cl.Listen(9252))
+	defer cl.Close()
+	toPeer := NewClient(Config{RemoteUDPIPPortList: "127.0.0.1:9251", Timeout: time.Second, PreSharedKey: "secret"})
+	assert.NoError(t, toPeer.Listen(9253))
+	defer toPeer.Close()
+
+	assert.ErrorIs(t, cl.PutWeight("bulk", "acct", 0), ErrBadPutWeight)
+	assert.ErrorIs(t, cl.PutWeight("bulk", "acct", protocol.MaxPutWeight+1), ErrBadPutWeight)
+	assert.ErrorIs(t, cl.PutWeight("bulk", "acct\n", 2), protocol.ErrLineBreak)
+
+	assert.NoError(t, cl.Put("bulk", "acct"))
+	assert.NoError(t, cl.PutWeight("bulk", "acct", 10))
+	count, err := cl.Count("bulk", "acct")
+	assert.NoError(t, err)
+	assert.Equal(t, 11, count)
+
+	time.Sleep(50 * time.Millisecond)
+	count, err = toPeer.Count("bulk", "acct")
+	assert.NoError(t, err)
+	assert.Equal(t, 11, count, "the weight is replicated")
+}
+
+func TestClient_Subscribe(t *testing.T) {
+	s := server.NewServer(60, "secret")
+	if err := s.Configure(server.Config{MaxSubscriptions: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Listen(9248, 9248); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	cl := NewClient(Config{RemoteUDPIPPortList: "127.0.0.1:9248", RemoteTCPIPPortList: "127.0.0.1:9248", Timeout: time.Second, PreSharedKey: "secret"})
+	assert.NoError(t, cl.Listen(9249))
+	defer cl.Close()
+
+	events, stop, err := cl.Subscribe("ns", "a*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = cl.Subscribe("ns", "")
+	assert.ErrorIs(t, err, ErrTooManySubscriptions)
+
+	assert.NoError(t, cl.Put("other", "abc"))
+	assert.NoError(t, cl.Put("ns", "xyz"))
+	assert.NoError(t, cl.Put("ns", "abc"))
+	assert.NoError(t, cl.PutBytes("ns", []byte("a\n.\nb")))
+	for _, want := range []string{"abc", "a\n.\nb"} {
+		select {
+		case e := <-events:
+			assert.Equal(t, Event{Namespace: "ns", Key: want}, e)
+		case <-time.After(time.Second):
+			t.Fatal("no event for", want)
+		}
+	}
+
+	stop()
+	select {
+	case _, open := <-events:
+		assert.False(t, open, "stopping closes the channel")
+	case <-time.After(time.Second):
+		t.Fatal("channel was not closed")
+	}
+	time.Sleep(50 * time.Millisecond)
+	_, stop, err = cl.Subscribe("ns", "")
+	assert.NoError(t, err, "the server freed the subscription")
+	stop()
+}
+
+func TestClient_Compact(t *testing.T) {
+	s := server.NewServerMillis(250, "secret")
+	if err := s.Listen(9241, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	cl := NewClient(Config{RemoteUDPIPPortList: "127.0.0.1:9241", Timeout: time.Second, PreSharedKey: "secret"})
+	assert.NoError(t, cl.Listen(9242))
+	defer cl.Close()
+
+	for _, ip := range []string{"10.0.0.1", "10.0.0.1", "10.0.0.2"} {
+		assert.NoError(t, cl.Put("visitors", ip))
+	}
+	time.Sleep(300 * time.Millisecond)
+	assert.NoError(t, cl.Put("visitors", "10.0.0.3"))
+
+	reclaimed, err := cl.Compact("visitors")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, reclaimed)
+	exists, keyCount, err := cl.NamespaceInfo("visitors")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, 1, keyCount, "keys without entries are removed")
+	reclaimed, err = cl.Compact("none")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, reclaimed)
+}
+
+func TestClient_checkSizes(t *testing.T) {
+	cl := NewClient(Config{RemoteUDPIPPortList: "127.0.0.1:9019", Timeout: time.Second})
+
+	longNamespace := strings.Repeat("n", protocol.NamespaceSize+1)
+	longValue := strings.Repeat("v", protocol.DataValueSize+1)
+
+	assert.ErrorIs(t, cl.Put(longNamespace, "key"), ErrNamespaceTooLong)
+	assert.ErrorIs(t, cl.Put("default", longValue), ErrValueTooLong)
+	_, err := cl.Count(longNamespace, "key")
+	assert.ErrorIs(t, err, ErrNamespaceTooLong)
+	_, err = cl.KeyMatch("default", longValue)
+	assert.ErrorIs(t, err, ErrValueTooLong)
+	_, err = cl.CountNamespace(longNamespace)
+	assert.ErrorIs(t, err, ErrNamespaceTooLong)
+	assert.Contains(t, ErrNamespaceTooLong.Error(), "64")
+}
+
+func TestConfig_Validate(t *testing.T) {
+	valid := Config{RemoteUDPIPPortList: "127.0.0.1:3509", RemoteTCPIPPortList: "127.0.0.1:3509, 127.0.0.2:3509"}
+	assert.NoError(t, valid.Validate())
+	assert.NoError(t, Config{RemoteTCPIPPortList: "127.0.0.1:3509"}.Validate(), "tcp servers alone are enough")
+
+	cases := []struct {
+		conf  Config
+		field string
+		err   error
+	}{
+		{Config{}, "RemoteUDPIPPortList and RemoteTCPIPPortList", ErrInitNoServers},
+		{Config{RemoteUDPIPPortList: " , "}, "RemoteUDPIPPortList and RemoteTCPIPPortList", ErrInitNoServers},
+		{Config{RemoteUDPIPPortList: "127.0.0.1"}, "RemoteUDPIPPortList", ErrBadServerList},
+		{Config{RemoteUDPIPPortList: "127.0.0.1:nope"}, "RemoteUDPIPPortList", ErrBadServerList},
+		{Config{RemoteUDPIPPortList: "localhost:3509"}, "RemoteUDPIPPortList", ErrBadServerList},
+		{Config{RemoteUDPIPPortList: "127.0.0.1:3509", RemoteTCPIPPortList: "127.0.0.1:3509:1"}, "RemoteTCPIPPortList", ErrBadServerList},
+		{Config{RemoteUDPIPPortList: "127.0.0.1:3509", Timeout: -time.Second}, "Timeout", ErrBadTimeout},
+		{Config{RemoteUDPIPPortList: "127.0.0.1:3509", BindIP: "nope"}, "BindIP", ErrBadBindIP},
+		{Config{RemoteUDPIPPortList: "127.0.0.1:3509", MaxValueLen: protocol.DataValueSize + 1}, "MaxValueLen", ErrBadMaxValueLen},
+	}
+	for _, c := range cases {
+		err := c.conf.Validate()
+		assert.ErrorIs(t, err, c.err, c.field)
+		if err != nil {
+			assert.True(t, strings.HasPrefix(err.Error(), c.field+": "), err.Error())
+		}
+	}
+}
+
+func TestClient_Logger(t *testing.T) {
+	var out bytes.Buffer
+	logger := log.New(&out, "app: ", 0)
+	cl := NewClient(Config{RemoteUDPIPPortList: "127.0.0.1:9019", Logger: logger})
+
+	cl.log.Println("hidden")
+	assert.Empty(t, out.String())
+
+	cl.DebugEnable("client")
+	cl.log.Println("shown")
+	assert.Equal(t, "client shown\n", out.String())
+	assert.Equal(t, "app: ", logger.Prefix(), "injected logger should not be modified")
+
+	cl.DebugDisable()
+	cl.log.Println("hidden")
+	assert.Equal(t, "client shown\n", out.String())
+}
+
+func TestClient_CloseUnblocksPending(t *testing.T) {
+	s := server.NewServer(60, "")
+	if err := s.Listen(9024, 9024); err != nil {
+		t.Fatal(err)
+	}
+	cl := NewClient(Config{RemoteUDPIPPortList: "127.0.0.1:9024", Timeout: time.Second * 30})
+	if err := cl.Listen(9025); err != nil {
+		t.Fatal(err)
+	}
+	// the server is healthy until the next healthcheck, but nothing answers the request now, so
+	// it waits until the client is closed
+	time.Sleep(100 * time.Millisecond)
+	s.Close()
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := cl.Count("default", "somekey")
+		result <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	assert.NoError(t, cl.Close())
+
+	select {
+	case err := <-result:
+		assert.ErrorIs(t, err, ErrClientClosed)
+	case <-time.After(time.Second):
+		t.Fatal("pending Count did not return after Close")
+	}
+
+	_, err := cl.Count("default", "somekey")
+	assert.ErrorIs(t, err, ErrClientClosed)
+}
+
+func TestClient_CloseConcurrent(t *testing.T) {
+	assert.NoError(t, NewClient(Config{RemoteUDPIPPortList: "127.0.0.1:9257"}).Close(), "before listening")
+	failed := NewClient(Config{RemoteUDPIPPortList: "127.0.0.1:9257", BindIP: "nope"})
+	assert.Error(t, failed.Listen(9258))
+	assert.NoError(t, failed.Close(), "after a failed listen")
+
+	s := server.NewServer(60, "")
+	if err := s.Listen(9257, 0); err != nil {
+		t.Fatal(err)
+	}
+	cl := NewClient(Config{RemoteUDPIPPortList: "127.0.0.1:9257", Timeout: 50 * time.Millisecond, PreciseTimeouts: true})
+	if err := cl.Listen(9258); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	// the server is still healthy to the client, but nothing answers, so these are waiting, or timing out, as it closes
+	for i := 0; i < 10; i++ {
+		go cl.Count("default", "somekey")
+	}
+	time.Sleep(20 * time.Millisecond)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, cl.Close())
+		}()
+	}
+	wg.Wait()
+	_, err := cl.Count("default", "somekey")
+	assert.ErrorIs(t, err, ErrClientClosed)
+}
+
+func TestClient_RequireHealthyOnListen(t *testing.T) {
+	conf := Config{RemoteUDPIPPortList: "127.0.0.1:9259", Timeout: 100 * time.Millisecond, PreciseTimeouts: true}
+	lenient := NewClient(conf)
+	assert.NoError(t, lenient.Listen(9260), "off by default")
+	lenient.Close()
+
+	conf.RequireHealthyOnListen = true
+	strict := NewClient(conf)
+	err := strict.Listen(9260)
+	assert.ErrorIs(t, err, ErrNoHealthyUDPServers)
+	assert.True(t, strict.isDisposed(), "closed when listen fails")
+
+	s := server.NewServer(60, "")
+	if err := s.Listen(9259, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	healthy := NewClient(conf)
+	assert.NoError(t, healthy.Listen(9260), "the failed client let go of its port")
+	healthy.Close()
+}
+
+func TestClient_BindIP(t *testing.T) {
+	bad := NewClient(Config{RemoteUDPIPPortList: "127.0.0.1:9019", BindIP: "not-an-ip"})
+	assert.ErrorIs(t, bad.Listen(9026), ErrBadBindIP)
+
+	cl := NewClient(Config{RemoteUDPIPPortList: "127.0.0.1:9019", Timeout: 100 * time.Millisecond, BindIP: "127.0.0.1"})
+	if err := cl.Listen(9026); err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	assert.Equal(t, "127.0.0.1:9026", cl.GetConn().LocalAddr().String())
+}
+
+func TestClient_SendErrors(t *testing.T) {
+	// nothing listens on this port, so dialing fails and the request does not wait for a timeout
+	cl := NewClient(Config{RemoteTCPIPPortList: "127.0.0.1:9027", Timeout: 5 * time.Second})
+	start := time.Now()
+	_, err := cl.ListNamespaces()
+	assert.ErrorIs(t, err, ErrNoHealthyTCPServers)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	assert.NoError(t, conn.SetWriteDeadline(time.Now().Add(-time.Second)))
+	_, err = conn.WriteToUDP([]byte("x"), conn.LocalAddr().(*net.UDPAddr))
+	assert.ErrorIs(t, sendError(err), ErrSendTimedOut)
+	assert.Equal(t, ErrNoHealthyTCPServers, sendError(ErrNoHealthyTCPServers), "other errors are unchanged")
+}
+
+func TestClient_SubSecondTimeout(t *testing.T) {
+	precise := NewClient(Config{RemoteUDPIPPortList: "127.0.0.1:9266", Timeout: time.Millisecond, PreciseTimeouts: true})
+	assert.Equal(t, time.Millisecond, precise.timeoutDuration)
+	precise.Close()
+
+	s := server.NewServer(60, "")
+	if err := s.Listen(9266, 9266); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	// periodic timeouts are in whole seconds, so a nanosecond is a second and responses still arrive in time
+	cl := NewClient(Config{RemoteUDPIPPortList: "127.0.0.1:9266", Timeout: time.Nanosecond})
+	assert.Equal(t, time.Second, cl.timeoutDuration)
+	if err := cl.Listen(9267); err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	assert.NoError(t, cl.Put("tiny", "timeout"))
+	count, err := cl.Count("tiny", "timeout")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
+
+func TestClient_CountAll(t *testing.T) {
+	s1 := server.NewServer(60, "")
+	if err := s1.Listen(9028, 9028); err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+	s2 := server.NewServer(60, "")
+	if err := s2.Listen(9029, 9029); err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+
+	cl := NewClient(Config{
+		RemoteUDPIPPortList: "127.0.0.1:9028,127.0.0.1:9029",
+		Timeout:             200 * time.Millisecond,
+		PreciseTimeouts:     true,
+		RoutingMode:         RoutingConsistentHashKey,
+	})
+	if err := cl.Listen(9030); err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	// keys are sharded across both servers
+	for i := 0; i < 20; i++ {
+		assert.NoError(t, cl.Put("shard", fmt.Sprintf("key%d", i)))
+	}
+	assert.NoError(t, cl.Put("other", "key"))
+	one, err := cl.CountNamespace("shard")
+	assert.NoError(t, err)
+	assert.Less(t, one, 20, "a single server only has its shard")
+
+	total, err := cl.CountNamespaceAll("shard")
+	assert.NoError(t, err)
+	assert.Equal(t, 20, total)
+	total, err = cl.CountServerAll()
+	assert.NoError(t, err)
+	assert.Equal(t, 21, total)
+
+	// the pool still thinks the closed server is healthy, so its count times out
+	s2.Close()
+	partial, err := cl.CountNamespaceAll("shard")
+	var partialErr *PartialCountError
+	if assert.ErrorAs(t, err, &partialErr) {
+		assert.Len(t, partialErr.Failed, 1)
+		assert.ErrorIs(t, partialErr.Failed["127.0.0.1:9029"], ErrMessageTimedOut)
+	}
+	assert.Greater(t, partial, 0)
+	assert.Less(t, partial, 20)
+}
+
+func TestClient_CountCache(t *testing.T) {
+	s := server.NewServer(60, "")
+	if err := s.Listen(9031, 9031); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	cl := NewClient(Config{RemoteUDPIPPortList: "127.0.0.1:9031", Timeout: time.Second, CountCacheTTL: 300 * time.Millisecond})
+	if err := cl.Listen(9032); err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	other := NewClient(Config{RemoteUDPIPPortList: "127.0.0.1:9031", Timeout: time.Second})
+	if err := other.Listen(9033); err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	count, err := cl.Count("default", "cached")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	assert.NoError(t, other.Put("default", "cached"))
+	count, _ = cl.Count("default", "cached")
+	assert.Equal(t, 0, count, "stale count from the cache")
+	cl.InvalidateCount("default", "cached")
+	count, _ = cl.Count("default", "cached")
+	assert.Equal(t, 1, count)
+
+	assert.NoError(t, cl.Put("default", "cached"))
+	count, _ = cl.Count("default", "cached")
+	assert.Equal(t, 2, count, "a put by the same client is seen straight away")
+
+	assert.NoError(t, other.Put("default", "cached"))
+	time.Sleep(350 * time.Millisecond)
+	count, _ = cl.Count("default", "cached")
+	assert.Equal(t, 3, count, "cached count expired")
+}
+
+func TestClient_HealthchecksNotCounted(t *testing.T) {
+	s := server.NewServer(60, "")
+	if err := s.Listen(9034, 9034); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	cl := NewClient(Config{RemoteUDPIPPortList: "127.0.0.1:9034", RemoteTCPIPPortList: "127.0.0.1:9034", Timeout: time.Second})
+	if err := cl.Listen(9035); err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	// older servers are checked with a count of a synthetic namespace, which is only read, never created
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9034}
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, cl.Healthcheck(addr))
+		assert.NoError(t, cl.healthcheck(addr, protocol.CmdCount, "server_healthcheck_"+addr.String(), "check"))
+	}
+
+	total, err := cl.CountServer()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, total)
+	namespaces, err := cl.ListNamespaces()
+	assert.NoError(t, err)
+	for _, ns := range namespaces {
+		assert.NotContains(t, ns, "server_healthcheck_")
+	}
+}
+
+func TestClient_PutReturningCount(t *testing.T) {
+	s := server.NewServer(60, "")
+	if err := s.Listen(9036, 9036); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	cl := NewClient(Config{RemoteUDPIPPortList: "127.0.0.1:9036", Timeout: time.Second})
+	if err := cl.Listen(9037); err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	for i := 1; i <= 3; i++ {
+		count, err := cl.PutReturningCount("default", "limited")
+		assert.NoError(t, err)
+		assert.Equal(t, i, count)
+	}
+	assert.NoError(t, cl.Put("default", "limited"))
+	count, err := cl.Count("default", "limited")
+	assert.NoError(t, err)
+	assert.Equal(t, 4, count)
+}
+
+func TestClient_CountAt(t *testing.T) {
+	s := server.NewServer(60, "")
+	if err := s.Listen(9038, 9038); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	cl := NewClient(Config{RemoteUDPIPPortList: "127.0.0.1:9038", Timeout: time.Second})
+	if err := cl.Listen(9039); err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	assert.NoError(t, cl.Put("default", "forecast"))
+	assert.NoError(t, cl.Put("default", "forecast"))
+	now := time.Now().Unix()
+
+	count, err := cl.CountAt("default", "forecast", now)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	count, err = cl.CountAt("default", "forecast", now+120)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	_, err = cl.CountAt("default", "forecast", -1)
+	assert.ErrorIs(t, err, ErrCountAtOutOfRange)
+}
+
+func TestClient_CountWeighted(t *testing.T) {
+	s := server.NewServer(60, "")
+	if err := s.Listen(9232, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	cl := NewClient(Config{RemoteUDPIPPortList: "127.0.0.1:9232", Timeout: time.Second})
+	if err := cl.Listen(9233); err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	assert.NoError(t, cl.Put("default", "recent"))
+	assert.NoError(t, cl.Put("default", "recent"))
+	weighted, err := cl.CountWeighted("default", "recent", 30)
+	assert.NoError(t, err)
+	assert.InDelta(t, 2, weighted, 0.01, "entries put just now weigh about 1 each")
+	weighted, err = cl.CountWeighted("default", "missing", 30)
+	assert.NoError(t, err)
+	assert.Equal(t, float64(0), weighted)
+
+	_, err = cl.CountWeighted("default", "recent", 0)
+	assert.ErrorIs(t, err, ErrBadHalfLife)
+}
+
+func TestClient_GetTTL(t *testing.T) {
+	s := server.NewServerMillis(1500, "")
+	if err := s.Listen(9254, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	cl := NewClient(Config{RemoteUDPIPPortList: "127.0.0.1:9254", Timeout: time.Second})
+	if err := cl.Listen(9255); err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	for _, ns := range []string{"default", "", "never-put"} {
+		ttl, err := cl.GetTTL(ns)
+		assert.NoError(t, err, ns)
+		assert.Equal(t, int64(1500), ttl, ns)
+	}
+}
+
+func TestClient_PutBytes(t *testing.T) {
+	s := server.NewServer(60, "secret")
+	if err := s.Listen(9234, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	cl := NewClient(Config{RemoteUDPIPPortList: "127.0.0.1:9234", Timeout: time.Second, PreSharedKey: "secret"})
+	if err := cl.Listen(9235); err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	hashed := []byte{' ', 0x0a, 'h', 0x00, ' '}
+	assert.NoError(t, cl.PutBytes("ns", hashed))
+	assert.NoError(t, cl.PutBytes("ns", hashed))
+	count, err := cl.CountBytes("ns", hashed)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	count, err = cl.CountBytes("ns", []byte{0x0a, 'h', 0x00})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count, "the spaces around the key are kept")
+
+	// plain keys are the same keys either way
+	assert.NoError(t, cl.Put("ns", "plain"))
+	count, err = cl.CountBytes("ns", []byte("plain"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	assert.ErrorIs(t, cl.PutBytes("ns", make([]byte, protocol.DataValueSize)), ErrValueTooLong)
+}
+
+func TestClient_KeysWithSpaces(t *testing.T) {
+	s := server.NewServer(60, "secret")
+	if err := s.Listen(9236, 9236); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	cl := NewClient(Config{RemoteUDPIPPortList: "127.0.0.1:9236", RemoteTCPIPPortList: "127.0.0.1:9236", Timeout: time.Second, PreSharedKey: "secret"})
+	if err := cl.Listen(9237); err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	assert.NoError(t, cl.Put("ns", " alice "))
+	assert.NoError(t, cl.Put("ns", " alice "))
+	assert.NoError(t, cl.Put("ns", "alice"))
+	assert.NoError(t, cl.Put(" ns", "alice"))
+
+	count, err := cl.Count("ns", " alice ")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	count, err = cl.Count("ns", "alice")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count, "the trimmed key is a different key")
+	count, err = cl.CountNamespace(" ns")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	matched, err := cl.KeyMatch("ns", "*")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{" alice ", "alice"}, matched)
+}
+
+func TestClient_ServerInfo(t *testing.T) {
+	s := server.MustNewServerWithPeers(60, "secret", "127.0.0.1:9190", "127.0.0.1:9190,127.0.0.1:9192")
+	if err := s.Configure(server.Config{Version: "v1.2.3"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Listen(9190, 9190); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	cl := NewClient(Config{RemoteUDPIPPortList: "127.0.0.1:9190", RemoteTCPIPPortList: "127.0.0.1:9190", Timeout: time.Second, PreSharedKey: "secret"})
+	if err := cl.Listen(9191); err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	info, err := cl.ServerInfo()
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.2.3", info.Version)
+	assert.Equal(t, "unknown", info.Build)
+	assert.Equal(t, int64(60), info.ExpireAfterSecs)
+	assert.Equal(t, 1, info.Peers)
+	assert.Equal(t, "memory", info.Storage)
+}
+
+func TestClient_RateLimited(t *testing.T) {
+	s := server.NewServer(60, "secret")
+	if err := s.Configure(server.Config{ExpensiveRateLimit: 0.1, ExpensiveBurst: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Listen(9198, 9198); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	cl := NewClient(Config{RemoteUDPIPPortList: "127.0.0.1:9198", Timeout: time.Second, PreSharedKey: "secret"})
+	if err := cl.Listen(9199); err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	for i := 0; i < 2; i++ {
+		_, err := cl.CountServer()
+		assert.NoError(t, err, "within the burst")
+	}
+	_, err := cl.CountServer()
+	assert.ErrorIs(t, err, ErrRateLimited)
+
+	// cheap commands are not limited
+	assert.NoError(t, cl.Put("ns", "key"))
+	count, err := cl.Count("ns", "key")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
+
+func TestClient_ServerPeers(t *testing.T) {
+	s := server.MustNewServerWithPeers(60, "secret", "127.0.0.1:9202", "127.0.0.1:9202,127.0.0.1:9207")
+	if err := s.Listen(9202, 9202); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	cl := NewClient(Config{RemoteUDPIPPortList: "127.0.0.1:9202", RemoteTCPIPPortList: "127.0.0.1:9202", Timeout: time.Second, PreSharedKey: "secret"})
+	if err := cl.Listen(9203); err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	peers, err := cl.ServerPeers()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1:9207"}, peers)
+	peers, err = cl.AddServerPeer("127.0.0.1:9208")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1:9207", "127.0.0.1:9208"}, peers)
+	peers, err = cl.RemoveServerPeer("127.0.0.1:9207")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1:9208"}, peers)
+	peers, err = cl.RemoveServerPeer("127.0.0.1:9208")
+	assert.NoError(t, err)
+	assert.Empty(t, peers)
+
+	_, err = cl.AddServerPeer("nope")
+	assert.ErrorContains(t, err, server.ErrBadPeersFormat.Error())
+}
+
+func TestClient_ReadOnlyReplica(t *testing.T) {
+	writer := server.MustNewServerWithPeers(60, "secret", "127.0.0.1:9217", "127.0.0.1:9217,127.0.0.1:9218")
+	if err := writer.Listen(9217, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	replica := server.NewServer(60, "secret")
+	if err := replica.Configure(server.Config{ReadOnly: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := replica.Listen(9218, 9218); err != nil {
+		t.Fatal(err)
+	}
+	defer replica.Close()
+	toWriter := NewClient(Config{RemoteUDPIPPortList: "127.0.0.1:9217", Timeout: time.Second, PreSharedKey: "secret"})
+	if err := toWriter.Listen(9219); err != nil {
+		t.Fatal(err)
+	}
+	defer toWriter.Close()
+	toReplica := NewClient(Config{RemoteUDPIPPortList: "127.0.0.1:9218", RemoteTCPIPPortList: "127.0.0.1:9218", Timeout: time.Second, PreSharedKey: "secret"})
+	if err := toReplica.Listen(9220); err != nil {
+		t.Fatal(err)
+	}
+	defer toReplica.Close()
+
+	assert.ErrorIs(t, toReplica.Put("ns", "direct"), ErrReadOnly)
+	_, err := toReplica.Delete("ns", "direct")
+	assert.ErrorIs(t, err, ErrReadOnly)
+
+	assert.NoError(t, toWriter.Put("ns", "replicated"))
+	time.Sleep(50 * time.Millisecond)
+	count, err := toReplica.Count("ns", "replicated")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count, "replicated puts are applied")
+	count, err = toReplica.Count("ns", "direct")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+	keys, err := toReplica.KeyMatch("ns", "*")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"replicated"}, keys)
+}
+
+func TestClient_MultiplexTCP(t *testing.T) {
+	s := server.NewServer(60, "secret")
+	if err := s.Listen(9196, 9196); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	cl := NewClient(Config{RemoteUDPIPPortList: "127.0.0.1:9196", RemoteTCPIPPortList: "127.0.0.1:9196", Timeout: time.Second, PreSharedKey: "secret", MultiplexTCP: true})
+	if err := cl.Listen(9197); err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	for i := 0; i < 20; i++ {
+		assert.NoError(t, cl.Put("default", fmt.Sprintf("key%d", i)))
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// each response must get back to the request it answers
+			matched, err := cl.KeyMatch("default", fmt.Sprintf("key%d", i))
+			assert.NoError(t, err)
+			assert.Equal(t, []string{fmt.Sprintf("key%d", i)}, matched)
+		}(i)
+	}
+	wg.Wait()
+	assert.Len(t, cl.muxConns, 1, "requests should share one connection")
+
+	cl.Close()
+	_, err := cl.KeyMatch("default", "*")
+	assert.ErrorIs(t, err, ErrClientClosed)
+}
+
+func TestMuxConn_LateError(t *testing.T) {
+	cl := NewClient(Config{RemoteUDPIPPortList: "127.0.0.1:9228", PreSharedKey: "secret"})
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.DialTCP("tcp", nil, ln.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+	respond := func(command byte, messageID uint32, data string) {
+		packet := protocol.NewPacket(command, messageID, "ns", data, "secret")
+		packet.DataValue = append(packet.DataValue, protocol.StopSymbol...)
+		b, _ := packet.Bytes()
+		_, err := serverConn.Write(b)
+		assert.NoError(t, err)
+	}
+
+	m := &muxConn{conn: conn, pending: make(map[uint32]waitingmessage.Callback)}
+	defer m.fail(ErrClientClosed)
+	answered := make(chan error, 1)
+	m.pending[5] = func(b []byte, err error) {
+		answered <- err
+	}
+	go m.readForever(cl)
+
+	// an error for a request which already timed out leaves the other requests alone
+	respond(protocol.ResError, 4, "request_timed_out")
+	respond(protocol.CmdCount, 5, "")
+	select {
+	case err := <-answered:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("no response after the late error")
+	}
+	assert.False(t, m.failed())
+
+	// an error which isn't for any request fails the connection
+	respond(protocol.ResError, 0, "dracula server has too many tcp connections")
+	assert.Eventually(t, m.failed, time.Second, 10*time.Millisecond)
+}
+
+func TestClient_PutLineBreak(t *testing.T) {
+	cl := NewClient(Config{RemoteUDPIPPortList: "127.0.0.1:9228", PreSharedKey: "secret"})
+	// refused before sending, so no server is needed
+	assert.ErrorIs(t, cl.Put("ns", "first\nsecond"), protocol.ErrLineBreak)
+	assert.ErrorIs(t, cl.Put("ns\r", "key"), protocol.ErrLineBreak)
+}
+
+func TestClient_QuotedLists(t *testing.T) {
+	// keys with line breaks can only get in from before puts refused them, like by restoring a snapshot
+	old := store.NewStore(60)
+	keys := []string{"first\nsecond", "plain", "stop\n.\nsymbol", "\xff\"quoted\""}
+	for _, key := range keys {
+		old.Put("ns\r\nbroken", key)
+	}
+	var snapshot bytes.Buffer
+	if err := old.Snapshot(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	s := server.NewServer(60, "secret")
+	if err := s.Restore(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Listen(9229, 9229); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	cl := NewClient(Config{RemoteUDPIPPortList: "127.0.0.1:9229", RemoteTCPIPPortList: "127.0.0.1:9229", Timeout: time.Second, PreSharedKey: "secret", QuotedLists: true})
+	defer cl.Close()
+	matched, err := cl.KeyMatch("ns\r\nbroken", "*")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"first\nsecond", "plain", "stop\n.\nsymbol", "\xff\"quoted\""}, matched)
+	matched, err = cl.KeyMatchOpts("ns\r\nbroken", "PLAIN", MatchOptions{CaseInsensitive: true})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"plain"}, matched)
+	matched, err = cl.KeyMatch("ns\r\nbroken", "nothing")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{}, matched)
+	namespaces, err := cl.ListNamespaces()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ns\r\nbroken"}, namespaces)
+
+	// without quoting, the keys are split apart
+	unquoted := NewClient(Config{RemoteTCPIPPortList: "127.0.0.1:9229", Timeout: time.Second, PreSharedKey: "secret"})
+	defer unquoted.Close()
+	matched, err = unquoted.KeyMatch("ns\r\nbroken", "plain")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"plain"}, matched)
+}
+
+func TestClient_PreferTCP(t *testing.T) {
+	s := server.NewServer(60, "secret")
+	if err := s.Listen(9221, 9221); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, multiplex := range []bool{false, true} {
+		// nothing answers udp, so only tcp requests succeed
+		cl := NewClient(Config{RemoteUDPIPPortList: "127.0.0.1:9222", RemoteTCPIPPortList: "127.0.0.1:9221", Timeout: time.Second, PreSharedKey: "secret", PreferTCP: true, MultiplexTCP: multiplex})
+		if err := cl.Listen(9223); err != nil {
+			t.Fatal(err)
+		}
+		key := fmt.Sprintf("multiplex-%v", multiplex)
+		// counts of 10 and 32 are a newline and a space, which must not be trimmed from the response
+		for i := 1; i <= 32; i++ {
+			count, err := cl.PutReturningCount("ns", key)
+			assert.NoError(t, err)
+			assert.Equal(t, i, count)
+		}
+		count, err := cl.Count("ns", key)
+		assert.NoError(t, err)
+		assert.Equal(t, 32, count)
+		cl.Close()
+	}
+
+	// without udp servers, counts and puts go over tcp without listening on udp
+	cl := NewClient(Config{RemoteTCPIPPortList: "127.0.0.1:9221", Timeout: time.Second, PreSharedKey: "secret"})
+	defer cl.Close()
+	assert.NoError(t, cl.Put("ns", "tcp-only"))
+	count, err := cl.Count("ns", "tcp-only")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
+
+func TestClient_PutDurable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "durable.wal")
+	conf := Config{RemoteUDPIPPortList: "127.0.0.1:9224", Timeout: 100 * time.Millisecond, PreSharedKey: "secret"}
+
+	cl := NewClient(conf)
+	assert.ErrorIs(t, cl.PutDurable("ns", "k"), ErrNoDurableQueue)
+	if err := cl.EnableDurableQueue(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Listen(9225); err != nil {
+		t.Fatal(err)
+	}
+	assert.ErrorIs(t, cl.EnableDurableQueue(path, 0), ErrClientAlreadyInit)
+	// no server is listening yet, so the puts stay queued
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, cl.PutDurable("ns", "k"))
+	}
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 3, cl.DurablePending())
+	cl.Close()
+	assert.ErrorIs(t, cl.PutDurable("ns", "k"), ErrDurableQueueClosed)
+
+	// a put cut short by a crash is dropped
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write(append(protocol.Uint32ToBytes(2), protocol.Uint32ToBytes(9)...))
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	s := server.NewServer(60, "secret")
+	if err := s.Listen(9224, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	// the restarted client delivers the puts left by the last one
+	cl = NewClient(conf)
+	if err := cl.EnableDurableQueue(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 3, cl.DurablePending())
+	if err := cl.Listen(9226); err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	assert.NoError(t, cl.PutDurable("ns", "k"))
+	for i := 0; i < 100 && cl.DurablePending() > 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.Equal(t, 0, cl.DurablePending())
+	count, err := cl.Count("ns", "k")
+	assert.NoError(t, err)
+	assert.Equal(t, 4, count)
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), info.Size(), "delivered puts are trimmed from the file")
+
+	full := NewClient(conf)
+	if err := full.EnableDurableQueue(filepath.Join(t.TempDir(), "full.wal"), 20); err != nil {
+		t.Fatal(err)
+	}
+	defer full.Close()
+	assert.NoError(t, full.PutDurable("ns", "k"))
+	assert.ErrorIs(t, full.PutDurable("ns", "0123456789"), ErrDurableQueueFull)
+}
+
+func TestClient_CountInto(t *testing.T) {
+	secret := "asdf-!!?!|asdf"
+	s := server.NewServer(60, secret)
+	s.DebugEnable("9020")
+	err := s.Listen(9020, 9020)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	cl := NewClient(Config{RemoteUDPIPPortList: "127.0.0.1:9020", Timeout: time.Second * 5, PreSharedKey: secret})
+	assert.NoError(t, cl.Listen(9021))
+	defer cl.Close()
+
+	assert.NoError(t, cl.Put("default", "a"))
+	assert.NoError(t, cl.Put("default", "a"))
+	assert.NoError(t, cl.Put("default", "b"))
+
+	var count int
+	assert.NoError(t, cl.CountInto("default", "a", &count))
+	assert.Equal(t, 2, count)
+	// pooled state from the previous call must not leak into the next one
+	assert.NoError(t, cl.CountInto("default", "b", &count))
+	assert.Equal(t, 1, count)
+	assert.NoError(t, cl.CountInto("other", "a", &count))
+	assert.Equal(t, 0, count)
+}
+
+func benchmarkCount(b *testing.B, count func(cl *Client) error) {
+	s := server.NewServer(60, "")
+	if err := s.Listen(9022, 9022); err != nil {
+		b.Fatal(err)
+	}
+	defer s.Close()
+	cl := NewClient(Config{RemoteUDPIPPortList: "127.0.0.1:9022", Timeout: time.Second * 5})
+	if err := cl.Listen(9023); err != nil {
+		b.Fatal(err)
+	}
+	defer cl.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := count(cl); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkClient_Count(b *testing.B) {
+	benchmarkCount(b, func(cl *Client) error {
+		_, err := cl.Count("default", "hot")
+		return err
+	})
+}
+
+func BenchmarkClient_CountInto(b *testing.B) {
+	var count int
+	benchmarkCount(b, func(cl *Client) error {
+		return cl.CountInto("default", "hot", &count)
+	})
+}
+
+func TestClient_MaxValueLen(t *testing.T) {
+	s := server.NewServer(60, "secret")
+	if err := s.Configure(server.Config{MaxValueLen: 8}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Listen(9238, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	cl := NewClient(Config{RemoteUDPIPPortList: "127.0.0.1:9238", Timeout: time.Second, PreSharedKey: "secret"})
+	if err := cl.Listen(9239); err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	limited := NewClient(Config{RemoteUDPIPPortList: "127.0.0.1:9238", Timeout: time.Second, PreSharedKey: "secret", MaxValueLen: 4})
+	if err := limited.Listen(9240); err != nil {
+		t.Fatal(err)
+	}
+	defer limited.Close()
+
+	assert.NoError(t, cl.Put("ns", "12345678"))
+	err := cl.Put("ns", "123456789")
+	assert.ErrorIs(t, err, ErrValueTooLong, "the server refuses keys past its limit")
+	var serverErr *ServerError
+	assert.ErrorAs(t, err, &serverErr)
+	_, err = cl.Count("ns", "123456789")
+	assert.ErrorIs(t, err, ErrValueTooLong)
+	assert.ErrorIs(t, cl.PutBytes("ns", []byte("123456789")), ErrValueTooLong)
+
+	err = limited.Put("ns", "12345")
+	assert.ErrorIs(t, err, ErrValueTooLong, "the client refuses keys past its own limit without sending them")
+	_, fromServer := err.(*ServerError)
+	assert.False(t, fromServer)
+	_, err = limited.Count("ns", "12345")
+	assert.ErrorIs(t, err, ErrValueTooLong)
+	count, err := limited.Count("ns", "1234")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
@@ -0,0 +1,82 @@
+package client
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mailsac/dracula/protocol"
+)
+
+// PartialCountError is when some servers did not answer a count sent to every server in the pool. The
+// count returned with it only sums the servers which answered.
+type PartialCountError struct {
+	// Failed is the error from each server which did not answer, by address
+	Failed map[string]error
+}
+
+func (e *PartialCountError) Error() string {
+	servers := make([]string, 0, len(e.Failed))
+	for server, err := range e.Failed {
+		servers = append(servers, server+": "+err.Error())
+	}
+	sort.Strings(servers)
+	return fmt.Sprintf("dracula count failed on %d servers: %s", len(e.Failed), strings.Join(servers, ", "))
+}
+
+// CountServerAll (very expensive) is CountServer summed across every healthy server in the pool, for
+// servers which each hold a shard of the data rather than replicating it. When some servers fail the sum
+// of the others is returned along with a *PartialCountError.
+func (c *Client) CountServerAll() (int, error) {
+	return c.countAll(protocol.CmdCountServer, "")
+}
+
+// CountNamespaceAll (expensive) is CountNamespace summed across every healthy server in the pool, for
+// servers which each hold a shard of the namespace's keys. When some servers fail the sum of the others is
+// returned along with a *PartialCountError.
+func (c *Client) CountNamespaceAll(namespace string) (int, error) {
+	if err := checkSizes(namespace, ""); err != nil {
+		return 0, err
+	}
+	return c.countAll(protocol.CmdCountNamespace, namespace)
+}
+
+// countAll sends a count command to every healthy server at once and sums the answers
+func (c *Client) countAll(command byte, namespace string) (int, error) {
+	servers := c.udpPool.Healthy()
+	if len(servers) == 0 {
+		return 0, ErrNoHealthyUDPServers
+	}
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	total := 0
+	failed := make(map[string]error)
+	for _, server := range servers {
+		server := server
+		cb := func(b []byte, e error) {
+			if e == nil && len(b) < 4 {
+				c.log.Println("client received too few bytes:", b)
+				e = ErrCountReturnBytesTooShort
+			}
+			lock.Lock()
+			if e != nil {
+				failed[server.String()] = e
+			} else {
+				total += int(protocol.Uint32FromBytes(b[0:4]))
+			}
+			lock.Unlock()
+			wg.Done()
+		}
+		wg.Add(1)
+		p := protocol.NewPacketFromParts(command, c.makeMessageID(), []byte(namespace), []byte{}, c.signingKey())
+		c._sendUDP(p, server, cb)
+	}
+
+	wg.Wait() // wait for every callback to be called
+	if len(failed) > 0 {
+		return total, &PartialCountError{Failed: failed}
+	}
+	return total, nil
+}
@@ -0,0 +1,86 @@
+package client
+
+import (
+	"sync"
+	"time"
+)
+
+type cachedCount struct {
+	count   int
+	expires time.Time
+}
+
+// countCache remembers recent Count results for a short time. A nil cache remembers nothing.
+type countCache struct {
+	sync.Mutex
+	ttl     time.Duration
+	entries map[string]cachedCount
+	// invalidations changes on every invalidate, so a count which was in flight during one is not cached
+	invalidations uint64
+	lastSweep     time.Time
+}
+
+func newCountCache(ttl time.Duration) *countCache {
+	return &countCache{ttl: ttl, entries: make(map[string]cachedCount), lastSweep: time.Now()}
+}
+
+func (cc *countCache) get(key string) (int, bool) {
+	if cc == nil {
+		return 0, false
+	}
+	cc.Lock()
+	defer cc.Unlock()
+	entry, ok := cc.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return 0, false
+	}
+	return entry.count, true
+}
+
+// version is passed to set after the count is read, so it is only cached when nothing was invalidated meanwhile
+func (cc *countCache) version() uint64 {
+	if cc == nil {
+		return 0
+	}
+	cc.Lock()
+	defer cc.Unlock()
+	return cc.invalidations
+}
+
+func (cc *countCache) set(key string, count int, version uint64) {
+	if cc == nil {
+		return
+	}
+	cc.Lock()
+	defer cc.Unlock()
+	if version != cc.invalidations {
+		return
+	}
+	now := time.Now()
+	cc.entries[key] = cachedCount{count: count, expires: now.Add(cc.ttl)}
+	// drop expired entries now and then, so keys which are no longer counted do not pile up
+	if now.Sub(cc.lastSweep) > cc.ttl {
+		for k, entry := range cc.entries {
+			if now.After(entry.expires) {
+				delete(cc.entries, k)
+			}
+		}
+		cc.lastSweep = now
+	}
+}
+
+func (cc *countCache) invalidate(key string) {
+	if cc == nil {
+		return
+	}
+	cc.Lock()
+	defer cc.Unlock()
+	delete(cc.entries, key)
+	cc.invalidations++
+}
+
+// InvalidateCount forgets the cached count of the key, so the next Count asks the server. It does nothing
+// unless Config.CountCacheTTL is set.
+func (c *Client) InvalidateCount(namespace, entryKey string) {
+	c.counts.invalidate(readKey(0, namespace, entryKey))
+}
@@ -0,0 +1,258 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mailsac/dracula/protocol"
+)
+
+// DefaultDurableQueueMaxBytes is the size the durable queue file may grow to when EnableDurableQueue is given zero.
+const DefaultDurableQueueMaxBytes = 64 << 20
+
+const (
+	durableRetryMin = 100 * time.Millisecond
+	durableRetryMax = 10 * time.Second
+	// durableRecordHeaderSize is the namespace and value lengths before each queued put
+	durableRecordHeaderSize = 8
+)
+
+var (
+	ErrNoDurableQueue     = errors.New("dracula client durable queue is not enabled")
+	ErrDurableQueueFull   = errors.New("dracula client durable queue is full")
+	ErrDurableQueueClosed = errors.New("dracula client durable queue is closed")
+)
+
+type durableEntry struct {
+	namespace string
+	value     string
+}
+
+// durableQueue is a write ahead log of the PutDurable entries which no server has acknowledged yet. Entries
+// are appended to the file, and it is rewritten without the delivered ones after each batch.
+type durableQueue struct {
+	lock     sync.Mutex
+	path     string
+	file     *os.File // nil once closed
+	maxBytes int64
+	size     int64
+	pending  []durableEntry
+	// wake is signalled when entries are queued, so the sender does not wait for its retry
+	wake chan struct{}
+}
+
+// openDurableQueue loads the entries left in the file by an earlier client. A record cut short by a crash
+// while it was appended is dropped, as its PutDurable did not return.
+func openDurableQueue(path string, maxBytes int64) (*durableQueue, error) {
+	q := &durableQueue{path: path, maxBytes: maxBytes, wake: make(chan struct{}, 1)}
+	b, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for len(b) >= durableRecordHeaderSize {
+		nsLen := int(protocol.Uint32FromBytes(b[0:4]))
+		valueLen := int(protocol.Uint32FromBytes(b[4:8]))
+		if nsLen > protocol.NamespaceSize || valueLen > protocol.DataValueSize || len(b) < durableRecordHeaderSize+nsLen+valueLen {
+			break
+		}
+		b = b[durableRecordHeaderSize:]
+		q.pending = append(q.pending, durableEntry{namespace: string(b[:nsLen]), value: string(b[nsLen : nsLen+valueLen])})
+		b = b[nsLen+valueLen:]
+	}
+	if err = q.rewrite(q.pending); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func appendDurableRecord(buf []byte, e durableEntry) []byte {
+	buf = append(buf, protocol.Uint32ToBytes(uint32(len(e.namespace)))...)
+	buf = append(buf, protocol.Uint32ToBytes(uint32(len(e.value)))...)
+	buf = append(buf, e.namespace...)
+	return append(buf, e.value...)
+}
+
+// push appends the entry to the file, and syncs it, before queueing it for the sender
+func (q *durableQueue) push(e durableEntry) error {
+	record := appendDurableRecord(nil, e)
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.file == nil {
+		return ErrDurableQueueClosed
+	}
+	if q.size+int64(len(record)) > q.maxBytes {
+		return ErrDurableQueueFull
+	}
+	if _, err := q.file.Write(record); err != nil {
+		return err
+	}
+	if err := q.file.Sync(); err != nil {
+		return err
+	}
+	q.size += int64(len(record))
+	q.pending = append(q.pending, e)
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// peek returns the entries waiting to be delivered, oldest first
+func (q *durableQueue) peek() []durableEntry {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.pending[:len(q.pending):len(q.pending)]
+}
+
+// trim removes the first delivered entries from the queue and its file
+func (q *durableQueue) trim(delivered int) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.file == nil {
+		return ErrDurableQueueClosed
+	}
+	q.pending = q.pending[delivered:]
+	return q.rewrite(q.pending)
+}
+
+// rewrite replaces the file with the entries, by renaming a new one over it so a crash leaves one or the other.
+// The lock must be held, except while opening.
+func (q *durableQueue) rewrite(entries []durableEntry) error {
+	var buf []byte
+	for _, e := range entries {
+		buf = appendDurableRecord(buf, e)
+	}
+	tmp := q.path + ".tmp"
+	if err := writeFileSync(tmp, buf); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, q.path); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(q.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if q.file != nil {
+		q.file.Close()
+	}
+	q.file = file
+	q.size = int64(len(buf))
+	return nil
+}
+
+func writeFileSync(path string, b []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (q *durableQueue) len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.pending)
+}
+
+func (q *durableQueue) close() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.file == nil {
+		return nil
+	}
+	err := q.file.Close()
+	q.file = nil
+	return err
+}
+
+// EnableDurableQueue makes PutDurable available, queueing puts in the file at path until a server acknowledges
+// them. Puts left in the file by an earlier client are delivered too, so the same path must not be shared by
+// clients running at the same time. The file may grow to maxBytes, or DefaultDurableQueueMaxBytes when zero.
+// It must be called before Listen, which starts delivering.
+func (c *Client) EnableDurableQueue(path string, maxBytes int64) error {
+	if c.conn != nil {
+		return ErrClientAlreadyInit
+	}
+	if maxBytes <= 0 {
+		maxBytes = DefaultDurableQueueMaxBytes
+	}
+	q, err := openDurableQueue(path, maxBytes)
+	if err != nil {
+		return fmt.Errorf("dracula client opening durable queue: %w", err)
+	}
+	c.durable = q
+	return nil
+}
+
+// PutDurable is Put which is not lost to a dropped packet, an unavailable server, or the client restarting.
+// It returns once the put is saved to the durable queue, which delivers it in the background, retrying until
+// a server acknowledges it. Delivery is at least once: a put whose acknowledgement was lost is sent again, and
+// counts twice. It returns ErrDurableQueueFull rather than block when deliveries are too far behind.
+func (c *Client) PutDurable(namespace, value string) error {
+	if c.durable == nil {
+		return ErrNoDurableQueue
+	}
+	if err := checkPut(namespace, value); err != nil {
+		return err
+	}
+	if err := c.checkValueLen([]byte(value)); err != nil {
+		return err
+	}
+	return c.durable.push(durableEntry{namespace: namespace, value: value})
+}
+
+// DurablePending returns the number of durable puts which have not been delivered yet
+func (c *Client) DurablePending() int {
+	if c.durable == nil {
+		return 0
+	}
+	return c.durable.len()
+}
+
+// deliverDurableForever must run in its own thread. It sends the queued puts in order, and waits longer after
+// each failed attempt, up to durableRetryMax.
+func (c *Client) deliverDurableForever() {
+	retry := durableRetryMin
+	for !c.isDisposed() {
+		batch := c.durable.peek()
+		delivered := 0
+		for _, e := range batch {
+			if _, err := c.put(e.namespace, e.value); err != nil {
+				c.log.Println("client durable put failed, will retry", e.namespace, err)
+				break
+			}
+			delivered++
+		}
+		if delivered > 0 {
+			if err := c.durable.trim(delivered); err != nil {
+				c.log.Println("client durable queue trim failed", err)
+			}
+		}
+		if delivered < len(batch) {
+			time.Sleep(retry)
+			if retry < durableRetryMax {
+				retry *= 2
+			}
+			continue
+		}
+		retry = durableRetryMin
+		if len(batch) == 0 {
+			select {
+			case <-c.durable.wake:
+			case <-time.After(durableRetryMax):
+			}
+		}
+	}
+}
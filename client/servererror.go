@@ -0,0 +1,103 @@
+package client
+
+import (
+	"errors"
+	"strings"
+)
+
+// ServerErrorCode groups the errors a server can respond with.
+type ServerErrorCode string
+
+const (
+	CodeAuthFailed     ServerErrorCode = "auth_failed"
+	CodeBadPacket      ServerErrorCode = "bad_packet"
+	CodeUnknownCommand ServerErrorCode = "unknown_command"
+	CodeTooManyConns   ServerErrorCode = "too_many_connections"
+	CodeRateLimited    ServerErrorCode = "rate_limited"
+	CodeTimedOut       ServerErrorCode = "request_timed_out"
+	CodeReadOnly       ServerErrorCode = "read_only"
+	CodeValueTooLong   ServerErrorCode = "value_too_long"
+	CodeTooManySubs    ServerErrorCode = "too_many_subscriptions"
+	// CodeOther is an error the client does not recognize, likely from a newer server
+	CodeOther ServerErrorCode = "other"
+)
+
+var (
+	// ErrAuthFailed is when the server could not validate the packet with its pre-shared keys
+	ErrAuthFailed     = errors.New("dracula server auth failed")
+	ErrBadPacket      = errors.New("dracula server received a bad packet")
+	ErrUnknownCommand = errors.New("dracula server does not know the command")
+	ErrTooManyConns   = errors.New("dracula server has too many tcp connections")
+	// ErrRateLimited is when the client sent expensive commands, like CountServer, faster than the server allows
+	ErrRateLimited = errors.New("dracula server rate limited the request")
+	// ErrServerTimedOut is when the server could not handle the request within its request timeout
+	ErrServerTimedOut = errors.New("dracula server timed out handling the request")
+	// ErrReadOnly is when a put or delete was sent to a read only replica
+	ErrReadOnly = errors.New("dracula server is read only")
+	// ErrTooManySubscriptions is when Subscribe was sent to a server which has its max subscriptions open
+	ErrTooManySubscriptions = errors.New("dracula server has too many subscriptions")
+)
+
+// serverErrorPrefixes map the start of a server's error message to its code. They must match the
+// error strings in the protocol and server packages.
+var serverErrorPrefixes = []struct {
+	prefix string
+	code   ServerErrorCode
+}{
+	{"auth failed", CodeAuthFailed},
+	{"bad packet", CodeBadPacket},
+	{"unknown_command", CodeUnknownCommand},
+	{"dracula server has too many tcp connections", CodeTooManyConns},
+	{"rate_limited", CodeRateLimited},
+	{"request_timed_out", CodeTimedOut},
+	{"read_only", CodeReadOnly},
+	{"value_too_long", CodeValueTooLong},
+	{"too_many_subscriptions", CodeTooManySubs},
+}
+
+// ServerError is an error response from a server. Use errors.Is with the sentinel errors, like
+// ErrAuthFailed, to check what went wrong.
+type ServerError struct {
+	Code ServerErrorCode
+	// Detail is the message the server responded with
+	Detail string
+}
+
+func newServerError(detail string) *ServerError {
+	for _, p := range serverErrorPrefixes {
+		if strings.HasPrefix(detail, p.prefix) {
+			return &ServerError{Code: p.code, Detail: detail}
+		}
+	}
+	return &ServerError{Code: CodeOther, Detail: detail}
+}
+
+// Error is the server's message, unchanged.
+func (e *ServerError) Error() string {
+	return e.Detail
+}
+
+// Unwrap returns the sentinel error for the code, or nil for CodeOther.
+func (e *ServerError) Unwrap() error {
+	switch e.Code {
+	case CodeAuthFailed:
+		return ErrAuthFailed
+	case CodeBadPacket:
+		return ErrBadPacket
+	case CodeUnknownCommand:
+		return ErrUnknownCommand
+	case CodeTooManyConns:
+		return ErrTooManyConns
+	case CodeRateLimited:
+		return ErrRateLimited
+	case CodeTimedOut:
+		return ErrServerTimedOut
+	case CodeReadOnly:
+		return ErrReadOnly
+	case CodeValueTooLong:
+		return ErrValueTooLong
+	case CodeTooManySubs:
+		return ErrTooManySubscriptions
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package client
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/mailsac/dracula/protocol"
+	"github.com/mailsac/dracula/server"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerError(t *testing.T) {
+	cases := []struct {
+		detail   string
+		code     ServerErrorCode
+		sentinel error
+	}{
+		{protocol.ErrBadHash.Error(), CodeAuthFailed, ErrAuthFailed},
+		{protocol.ErrProtocolSpace2.Error() + ", found byte 0", CodeBadPacket, ErrBadPacket},
+		{protocol.ErrMalformedPacket.Error(), CodeBadPacket, ErrBadPacket},
+		{"unknown_command_Z", CodeUnknownCommand, ErrUnknownCommand},
+		{server.ErrTooManyTCPConns.Error(), CodeTooManyConns, ErrTooManyConns},
+		{server.ErrRateLimited.Error(), CodeRateLimited, ErrRateLimited},
+		{server.ErrRequestTimedOut.Error(), CodeTimedOut, ErrServerTimedOut},
+		{server.ErrReadOnly.Error(), CodeReadOnly, ErrReadOnly},
+		{server.ErrValueTooLong.Error(), CodeValueTooLong, ErrValueTooLong},
+		{server.ErrTooManySubscriptions.Error(), CodeTooManySubs, ErrTooManySubscriptions},
+	}
+	for _, c := range cases {
+		err := newServerError(c.detail)
+		assert.Equal(t, c.code, err.Code, c.detail)
+		assert.Equal(t, c.detail, err.Error())
+		assert.ErrorIs(t, err, c.sentinel)
+	}
+
+	other := newServerError("something new")
+	assert.Equal(t, CodeOther, other.Code)
+	assert.Nil(t, errors.Unwrap(other))
+}
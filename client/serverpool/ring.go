@@ -0,0 +1,48 @@
+package serverpool
+
+import (
+	"net"
+	"sort"
+	"strconv"
+
+	"github.com/OneOfOne/xxhash"
+)
+
+// ringReplicas is how many points each server has on the ring. More points spread keys more evenly.
+const ringReplicas = 100
+
+// ring is a consistent hash ring of servers. Removing a server only moves the keys it owned, so the ring
+// is built once from every server, and unhealthy servers are skipped when choosing rather than removed.
+type ring struct {
+	hashes  []uint64 // sorted
+	servers map[uint64]*net.UDPAddr
+}
+
+func newRing(servers []*net.UDPAddr) *ring {
+	r := &ring{servers: make(map[uint64]*net.UDPAddr, len(servers)*ringReplicas)}
+	for _, s := range servers {
+		for i := 0; i < ringReplicas; i++ {
+			h := xxhash.Checksum64([]byte(s.String() + "#" + strconv.Itoa(i)))
+			r.servers[h] = s
+			r.hashes = append(r.hashes, h)
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	return r
+}
+
+// choose returns the first server at or after the key on the ring which is usable, or nil when none are.
+func (r *ring) choose(key string, usable func(*net.UDPAddr) bool) *net.UDPAddr {
+	if len(r.hashes) == 0 {
+		return nil
+	}
+	h := xxhash.Checksum64([]byte(key))
+	start := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	for i := 0; i < len(r.hashes); i++ {
+		s := r.servers[r.hashes[(start+i)%len(r.hashes)]]
+		if usable(s) {
+			return s
+		}
+	}
+	return nil
+}
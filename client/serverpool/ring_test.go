@@ -0,0 +1,43 @@
+package serverpool
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPool_ChooseFor(t *testing.T) {
+	servers := []*net.UDPAddr{
+		{IP: net.ParseIP("127.0.0.1"), Port: 3509},
+		{IP: net.ParseIP("127.0.0.1"), Port: 3519},
+		{IP: net.ParseIP("127.0.0.1"), Port: 3529},
+	}
+	p := NewPool(nil, servers)
+	assert.Nil(t, p.ChooseFor("ns"), "nothing healthy yet")
+	p.healthy = servers
+
+	owners := make(map[string]*net.UDPAddr)
+	perServer := make(map[*net.UDPAddr]int)
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("ns%d", i)
+		owners[key] = p.ChooseFor(key)
+		assert.Equal(t, owners[key], p.ChooseFor(key), "same key, same server")
+		perServer[owners[key]]++
+	}
+	for _, s := range servers {
+		assert.Greater(t, perServer[s], 50, "keys should be spread across servers")
+	}
+
+	// only keys of the unhealthy server move
+	p.healthy = servers[:2]
+	for key, owner := range owners {
+		chosen := p.ChooseFor(key)
+		if owner == servers[2] {
+			assert.NotEqual(t, servers[2], chosen)
+		} else {
+			assert.Equal(t, owner, chosen)
+		}
+	}
+}
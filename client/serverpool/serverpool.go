@@ -2,6 +2,7 @@ package serverpool
 
 import (
 	"fmt"
+	"math"
 	"math/rand"
 	"net"
 	"sync"
@@ -9,8 +10,19 @@ import (
 )
 
 const (
-	healthLoopDurationHealthy   = 6 * time.Second
-	healthLoopDurationUnHealthy = 1 * time.Second
+	// DefaultHealthyInterval is how long to wait between healthchecks while some servers are healthy
+	DefaultHealthyInterval = 6 * time.Second
+	// DefaultUnhealthyInterval is how long to wait between healthchecks while every server is unhealthy
+	DefaultUnhealthyInterval = 1 * time.Second
+	// DefaultJitter is the fraction each wait is randomly lengthened or shortened by, so many clients started
+	// together don't healthcheck the servers in lockstep
+	DefaultJitter = 0.2
+	// DefaultThreshold is how many healthchecks in a row must fail to mark a server unhealthy, or pass to mark
+	// it healthy again
+	DefaultThreshold = 1
+	// maxConcurrentHealthchecks is how many servers are healthchecked at once, so a server which times out
+	// does not hold up checking the rest
+	maxConcurrentHealthchecks = 8
 )
 
 type Healthchecker interface {
@@ -24,18 +36,70 @@ type Pool struct {
 	servers   []*net.UDPAddr
 	healthy   []*net.UDPAddr
 	unhealthy []*net.UDPAddr
+	ring      *ring
 	disposed  bool
 	Debug     bool
+
+	healthyInterval   time.Duration
+	unhealthyInterval time.Duration
+	jitter            float64
+
+	// health is each server's state between checks, only used by the healthchecks, which run one at a time
+	health        map[*net.UDPAddr]*health
+	failThreshold int
+	riseThreshold int
+}
+
+// health is whether a server is considered healthy, and how many checks in a row disagreed
+type health struct {
+	healthy bool
+	streak  int
 }
 
 func NewPool(getChecker Healthchecker, servers []*net.UDPAddr) *Pool {
 	p := &Pool{
-		checker: getChecker,
-		servers: servers,
+		checker:           getChecker,
+		servers:           servers,
+		ring:              newRing(servers),
+		healthyInterval:   DefaultHealthyInterval,
+		unhealthyInterval: DefaultUnhealthyInterval,
+		jitter:            DefaultJitter,
+		health:            make(map[*net.UDPAddr]*health),
+		failThreshold:     DefaultThreshold,
+		riseThreshold:     DefaultThreshold,
 	}
 	return p
 }
 
+// SetHealthThresholds changes how many healthchecks in a row must fail before a healthy server is marked
+// unhealthy, and pass before an unhealthy one is marked healthy, so an isolated dropped packet does not fail
+// over. Zero keeps the default. It must be called before Listen.
+func (p *Pool) SetHealthThresholds(fail, rise int) {
+	if fail > 0 {
+		p.failThreshold = fail
+	}
+	if rise > 0 {
+		p.riseThreshold = rise
+	}
+}
+
+// SetHealthcheckIntervals changes how long to wait between healthchecks while some servers are healthy, and
+// while none are, and the fraction each wait is randomly varied by. Zero keeps the default, and a negative
+// jitter waits exactly. It must be called before Listen.
+func (p *Pool) SetHealthcheckIntervals(healthy, unhealthy time.Duration, jitter float64) {
+	if healthy > 0 {
+		p.healthyInterval = healthy
+	}
+	if unhealthy > 0 {
+		p.unhealthyInterval = unhealthy
+	}
+	if jitter < 0 {
+		p.jitter = 0
+	} else if jitter > 0 {
+		p.jitter = math.Min(jitter, 1)
+	}
+}
+
 func (p *Pool) Listen() {
 	// seed health and unhealthy servers immediately
 	healthy, unhealthy := p.healthcheck()
@@ -49,39 +113,91 @@ func (p *Pool) Listen() {
 
 // healthcheck is slow and should not block the main thread
 func (p *Pool) loopHealthcheck() {
-	if p.disposed {
-		return
-	}
-	healthy, unhealthy := p.healthcheck()
-	p.Lock()
-	p.healthy = healthy
-	p.unhealthy = unhealthy
-	p.Unlock()
+	for {
+		p.Lock()
+		wait := p.unhealthyInterval
+		if len(p.healthy) > 0 {
+			wait = p.healthyInterval
+		}
+		p.Unlock()
+		time.Sleep(jittered(wait, p.jitter))
 
-	if len(healthy) > 0 {
-		time.Sleep(healthLoopDurationHealthy)
-	} else {
-		time.Sleep(healthLoopDurationUnHealthy)
+		p.Lock()
+		disposed := p.disposed
+		p.Unlock()
+		if disposed {
+			return
+		}
+		healthy, unhealthy := p.healthcheck()
+		p.Lock()
+		p.healthy = healthy
+		p.unhealthy = unhealthy
+		p.Unlock()
 	}
-	p.loopHealthcheck()
+}
+
+// jittered is d randomly lengthened or shortened by up to the fraction jitter of it
+func jittered(d time.Duration, jitter float64) time.Duration {
+	return d + time.Duration(float64(d)*jitter*(2*rand.Float64()-1))
 }
 
 func (p *Pool) healthcheck() (healthy, unhealthy []*net.UDPAddr) {
-	var err error
-	for _, s := range p.servers {
-		err = p.checker.Healthcheck(s)
-		if err != nil {
-			unhealthy = append(unhealthy, s)
-			if p.Debug {
-				fmt.Println("dracula pool server unhealthy", s, err)
-			}
-		} else {
+	errs := make([]error, len(p.servers))
+	slots := make(chan struct{}, maxConcurrentHealthchecks)
+	var wg sync.WaitGroup
+	for i, s := range p.servers {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, s *net.UDPAddr) {
+			defer wg.Done()
+			errs[i] = p.checker.Healthcheck(s)
+			<-slots
+		}(i, s)
+	}
+	wg.Wait()
+
+	// recorded in order, as record is not safe to call concurrently
+	for i, s := range p.servers {
+		err := errs[i]
+		if err != nil && p.Debug {
+			fmt.Println("dracula pool server failed healthcheck", s, err)
+		}
+		if p.record(s, err == nil) {
 			healthy = append(healthy, s)
+		} else {
+			unhealthy = append(unhealthy, s)
 		}
 	}
 	return healthy, unhealthy
 }
 
+// record notes a server's healthcheck, and returns whether it is now considered healthy. The first check
+// decides straight away, and after that it takes the threshold of checks in a row to change.
+func (p *Pool) record(s *net.UDPAddr, passed bool) bool {
+	h, found := p.health[s]
+	if !found {
+		p.health[s] = &health{healthy: passed}
+		return passed
+	}
+	if passed == h.healthy {
+		h.streak = 0
+		return h.healthy
+	}
+	h.streak++
+	threshold := p.failThreshold
+	if passed {
+		threshold = p.riseThreshold
+	}
+	if h.streak >= threshold {
+		h.healthy = passed
+		h.streak = 0
+		if p.Debug {
+			fmt.Println("dracula pool server healthy changed", s, passed)
+		}
+	}
+	return h.healthy
+}
+
 func (p *Pool) Choose() *net.UDPAddr {
 	p.Lock()
 	defer p.Unlock()
@@ -96,6 +212,28 @@ func (p *Pool) Choose() *net.UDPAddr {
 	return p.healthy[ix]
 }
 
+// ChooseFor picks the server owning the key on a consistent hash ring, so the same key goes to the same
+// server while it is healthy. When it is unhealthy the key falls back to the next healthy server on the ring.
+func (p *Pool) ChooseFor(key string) *net.UDPAddr {
+	p.Lock()
+	defer p.Unlock()
+	return p.ring.choose(key, func(s *net.UDPAddr) bool {
+		for _, h := range p.healthy {
+			if h == s {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// Healthy returns the servers which passed their last healthcheck.
+func (p *Pool) Healthy() []*net.UDPAddr {
+	p.Lock()
+	defer p.Unlock()
+	return append([]*net.UDPAddr(nil), p.healthy...)
+}
+
 func (p *Pool) ListServers() string {
 	return fmt.Sprintf("%v", p.servers)
 }
@@ -108,5 +246,7 @@ func (p *Pool) ListUnHealthy() string {
 }
 
 func (p *Pool) Dispose() {
+	p.Lock()
 	p.disposed = true
+	p.Unlock()
 }
@@ -0,0 +1,111 @@
+package serverpool
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJittered(t *testing.T) {
+	var shorter, longer bool
+	for i := 0; i < 1000; i++ {
+		d := jittered(time.Second, 0.2)
+		assert.GreaterOrEqual(t, int64(d), int64(800*time.Millisecond))
+		assert.LessOrEqual(t, int64(d), int64(1200*time.Millisecond))
+		shorter = shorter || d < time.Second
+		longer = longer || d > time.Second
+	}
+	assert.True(t, shorter && longer, "varies both ways")
+	assert.Equal(t, time.Second, jittered(time.Second, 0))
+}
+
+// slowChecker fails the servers in slow after a timeout, and passes the rest straight away
+type slowChecker struct {
+	slow    map[int]bool
+	timeout time.Duration
+}
+
+func (c *slowChecker) Healthcheck(s *net.UDPAddr) error {
+	if c.slow[s.Port] {
+		time.Sleep(c.timeout)
+		return errors.New("timed out")
+	}
+	return nil
+}
+
+func TestPool_HealthcheckConcurrent(t *testing.T) {
+	checker := &slowChecker{slow: make(map[int]bool), timeout: 100 * time.Millisecond}
+	var servers []*net.UDPAddr
+	for port := 3500; port < 3520; port++ {
+		servers = append(servers, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: port})
+		if port%4 == 0 {
+			checker.slow[port] = true
+		}
+	}
+	p := NewPool(checker, servers)
+
+	start := time.Now()
+	healthy, unhealthy := p.healthcheck()
+	assert.Less(t, int64(time.Since(start)), int64(300*time.Millisecond), "the five timeouts overlap")
+	assert.Len(t, healthy, 15)
+	assert.Len(t, unhealthy, 5)
+	for i, s := range unhealthy {
+		assert.True(t, checker.slow[s.Port])
+		if i > 0 {
+			assert.Greater(t, s.Port, unhealthy[i-1].Port, "in pool order")
+		}
+	}
+}
+
+type countingChecker struct {
+	checks int32
+}
+
+func (c *countingChecker) Healthcheck(*net.UDPAddr) error {
+	atomic.AddInt32(&c.checks, 1)
+	return nil
+}
+
+func TestPool_SetHealthcheckIntervals(t *testing.T) {
+	checker := &countingChecker{}
+	p := NewPool(checker, []*net.UDPAddr{{IP: net.ParseIP("127.0.0.1"), Port: 3509}})
+	p.SetHealthcheckIntervals(0, 0, 0)
+	assert.Equal(t, DefaultHealthyInterval, p.healthyInterval, "zero keeps the default")
+	assert.Equal(t, DefaultJitter, p.jitter)
+	p.SetHealthcheckIntervals(0, 0, -1)
+	assert.Equal(t, float64(0), p.jitter, "negative disables jitter")
+
+	p.SetHealthcheckIntervals(20*time.Millisecond, 0, 0)
+	p.Listen()
+	time.Sleep(110 * time.Millisecond)
+	p.Dispose()
+	checks := atomic.LoadInt32(&checker.checks)
+	assert.GreaterOrEqual(t, checks, int32(4), "checked every interval")
+	time.Sleep(50 * time.Millisecond)
+	assert.LessOrEqual(t, atomic.LoadInt32(&checker.checks), checks+1, "stops once disposed")
+}
+
+func TestPool_HealthThresholds(t *testing.T) {
+	s := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 3509}
+	p := NewPool(nil, []*net.UDPAddr{s})
+	p.SetHealthThresholds(3, 2)
+
+	assert.True(t, p.record(s, true), "the first check decides")
+	assert.True(t, p.record(s, false))
+	assert.True(t, p.record(s, false))
+	assert.True(t, p.record(s, true), "a pass resets the misses")
+	assert.True(t, p.record(s, false))
+	assert.True(t, p.record(s, false))
+	assert.False(t, p.record(s, false), "unhealthy after three misses in a row")
+	assert.False(t, p.record(s, true))
+	assert.True(t, p.record(s, true), "healthy after two passes in a row")
+
+	defaults := NewPool(nil, []*net.UDPAddr{s})
+	defaults.SetHealthThresholds(0, 0)
+	assert.True(t, defaults.record(s, true))
+	assert.False(t, defaults.record(s, false), "one miss with the default")
+}
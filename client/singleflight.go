@@ -0,0 +1,52 @@
+package client
+
+import "sync"
+
+// flight is a read in progress, which identical reads wait on rather than sending their own request
+type flight struct {
+	wg    sync.WaitGroup
+	count int
+	err   error
+}
+
+// flightGroup shares the result of a read among every caller asking for the same thing at the same time,
+// like golang.org/x/sync/singleflight. A nil group does not share, so each caller sends its own request.
+type flightGroup struct {
+	sync.Mutex
+	flights map[string]*flight
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{flights: make(map[string]*flight)}
+}
+
+// do calls read, unless a read with the same key is already in flight, in which case it waits for that
+// read's result instead.
+func (g *flightGroup) do(key string, read func() (int, error)) (int, error) {
+	if g == nil {
+		return read()
+	}
+	g.Lock()
+	if f, ok := g.flights[key]; ok {
+		g.Unlock()
+		f.wg.Wait()
+		return f.count, f.err
+	}
+	f := &flight{}
+	f.wg.Add(1)
+	g.flights[key] = f
+	g.Unlock()
+
+	f.count, f.err = read()
+
+	g.Lock()
+	delete(g.flights, key)
+	g.Unlock()
+	f.wg.Done()
+	return f.count, f.err
+}
+
+// readKey identifies a read for sharing, by command, namespace and key
+func readKey(command byte, namespace, entryKey string) string {
+	return string(command) + namespace + "\x00" + entryKey
+}
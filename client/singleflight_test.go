@@ -0,0 +1,49 @@
+package client
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlightGroup(t *testing.T) {
+	g := newFlightGroup()
+	var reads int32
+	release := make(chan struct{})
+	read := func() (int, error) {
+		atomic.AddInt32(&reads, 1)
+		<-release
+		return 7, nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]int, 10)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = g.do(readKey('C', "ns", "key"), read)
+		}(i)
+	}
+	// give every caller time to join the first read while it is in flight
+	time.Sleep(50 * time.Millisecond)
+	other, _ := g.do(readKey('C', "ns", "other"), func() (int, error) { return 1, nil })
+	assert.Equal(t, 1, other, "different keys are not shared")
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&reads), "identical reads should share a request")
+	for _, r := range results {
+		assert.Equal(t, 7, r)
+	}
+	_, _ = g.do(readKey('C', "ns", "key"), read)
+	assert.Len(t, g.flights, 0, "finished reads are not kept")
+
+	var none *flightGroup
+	n, err := none.do("k", func() (int, error) { return 3, nil })
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+}
@@ -0,0 +1,156 @@
+package client
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mailsac/dracula/protocol"
+	"github.com/mailsac/dracula/server/rawmessage"
+)
+
+// subscriptionBuffer is how many events can wait in a subscription's channel before it stops reading more
+const subscriptionBuffer = 256
+
+// ErrBadSubscribeResponse is when a server responds to Subscribe with something other than its acknowledgement
+var ErrBadSubscribeResponse = errors.New("malformed subscribe response")
+
+// Event is a put streamed to a Subscribe channel
+type Event struct {
+	Namespace string
+	Key       string
+}
+
+// Subscribe streams each put to the namespace with a key matching the keyPattern glob, or every key when it is
+// empty, to the returned channel. It opens its own TCP connection to a random TCP server, which only sees the
+// puts made to it or replicated to it by its peers. Call the returned func to stop. The channel is closed when
+// the subscription ends, including when the server drops it because the events were not read fast enough, so
+// read them promptly. Servers from before Subscribe respond with an unknown command error.
+func (c *Client) Subscribe(namespace, keyPattern string) (<-chan Event, func(), error) {
+	if err := checkSizes(namespace, keyPattern); err != nil {
+		return nil, nil, err
+	}
+	if len(c.tcpServerList) < 1 {
+		return nil, nil, ErrNoHealthyTCPServers
+	}
+	server := c.tcpServerList[rand.Intn(len(c.tcpServerList))].String()
+	dialed, err := net.DialTimeout("tcp", server, c.timeoutDuration)
+	if err != nil {
+		c.log.Println("Connection to tcp dracula failed", server, err)
+		return nil, nil, ErrNoHealthyTCPServers
+	}
+	conn := dialed.(*net.TCPConn)
+
+	messageID := c.makeMessageID()
+	p := protocol.NewPacketFromParts(protocol.CmdTCPOnlySubscribe, messageID, []byte(namespace), []byte(keyPattern), c.signingKey())
+	p.DataValue = append(p.DataValue, protocol.StopSymbol...)
+	packetBuf, err := p.Bytes()
+	if err == nil || err == protocol.ErrBadOutputSize {
+		if err = conn.SetDeadline(time.Now().Add(c.timeoutDuration)); err == nil {
+			_, err = conn.Write(packetBuf)
+		}
+	}
+	reader := rawmessage.NewTcpReader(conn)
+	if err == nil {
+		err = c.readSubscribeAck(reader)
+	}
+	if err == nil {
+		err = conn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, sendError(err)
+	}
+
+	// stopped lets the reader give up on an event nobody is reading any more
+	stopped := make(chan struct{})
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			close(stopped)
+			conn.Close()
+		})
+	}
+	c.subsLock.Lock()
+	if c.isDisposed() {
+		c.subsLock.Unlock()
+		stop()
+		return nil, nil, ErrClientClosed
+	}
+	c.subs[conn] = stop
+	c.subsLock.Unlock()
+
+	events := make(chan Event, subscriptionBuffer)
+	go c.readSubscriptionForever(conn, reader, events, stopped)
+	return events, stop, nil
+}
+
+// readSubscribeAck waits for the empty response which acknowledges a subscription
+func (c *Client) readSubscribeAck(reader *rawmessage.TcpReader) error {
+	message, err := reader.ReadMessage(c.log)
+	if err != nil {
+		return err
+	}
+	resPacket, err := protocol.ParsePacket(message)
+	if err != nil && err != protocol.ErrInvalidPacketSizeTooLarge {
+		return err
+	}
+	if resPacket.Command == protocol.ResError {
+		return newServerError(resPacket.DataValueString())
+	}
+	if resPacket.Command != protocol.CmdTCPOnlySubscribe {
+		return ErrBadSubscribeResponse
+	}
+	return nil
+}
+
+// readSubscriptionForever must run in its own thread. It sends the events to the channel until the
+// connection closes, then closes the channel.
+func (c *Client) readSubscriptionForever(conn *net.TCPConn, reader *rawmessage.TcpReader, events chan<- Event, stopped <-chan struct{}) {
+	defer close(events)
+	defer func() {
+		c.subsLock.Lock()
+		stop := c.subs[conn]
+		delete(c.subs, conn)
+		c.subsLock.Unlock()
+		stop()
+	}()
+	for {
+		message, err := reader.ReadMessage(c.log)
+		if err != nil {
+			c.log.Println("client subscription ended:", conn.RemoteAddr(), err)
+			return
+		}
+		resPacket, err := protocol.ParsePacket(message)
+		if err != nil && err != protocol.ErrInvalidPacketSizeTooLarge {
+			c.log.Println("client subscription parse res packet failed", err, "|"+string(message)+"|")
+			continue
+		}
+		if resPacket.Command != protocol.CmdTCPOnlySubscribe {
+			c.log.Println("client subscription unexpected response:", string(resPacket.Command), resPacket.DataValueString())
+			continue
+		}
+		key, err := strconv.Unquote(resPacket.DataValueString())
+		if err != nil {
+			c.log.Println("client subscription bad key:", resPacket.DataValueString(), err)
+			continue
+		}
+		select {
+		case events <- Event{Namespace: resPacket.NamespaceString(), Key: key}:
+		case <-stopped:
+			return
+		}
+	}
+}
+
+// closeSubscriptions ends the open subscriptions, which closes their channels
+func (c *Client) closeSubscriptions() {
+	c.subsLock.Lock()
+	defer c.subsLock.Unlock()
+	for _, stop := range c.subs {
+		stop()
+	}
+}
@@ -0,0 +1,180 @@
+package client
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mailsac/dracula/client/waitingmessage"
+	"github.com/mailsac/dracula/protocol"
+	"github.com/mailsac/dracula/server/rawmessage"
+)
+
+// muxConn is a tcp connection shared by concurrent requests. Responses can arrive in any order, so they
+// are matched to their request by message ID, like the UDP responses are.
+type muxConn struct {
+	conn      *net.TCPConn
+	writeLock sync.Mutex
+	lock      sync.Mutex // locks pending and err
+	pending   map[uint32]waitingmessage.Callback
+	// err is why the connection failed, after which it takes no more requests
+	err error
+}
+
+// send writes the request, and calls cb with its response from readForever, or with an error.
+func (m *muxConn) send(packetBuf []byte, messageID uint32, timeout time.Duration, cb waitingmessage.Callback) {
+	m.lock.Lock()
+	if m.err != nil {
+		m.lock.Unlock()
+		cb([]byte{}, m.err)
+		return
+	}
+	m.pending[messageID] = cb
+	m.lock.Unlock()
+
+	time.AfterFunc(timeout, func() {
+		if timedOut := m.take(messageID); timedOut != nil {
+			timedOut([]byte{}, ErrMessageTimedOut)
+		}
+	})
+
+	m.writeLock.Lock()
+	err := m.conn.SetWriteDeadline(time.Now().Add(timeout))
+	if err == nil {
+		_, err = m.conn.Write(packetBuf)
+	}
+	m.writeLock.Unlock()
+	if err != nil {
+		// a partial write leaves the stream unusable for every request
+		m.fail(sendError(err))
+	}
+}
+
+// take removes and returns the callback waiting for the message, or nil when it was already called
+func (m *muxConn) take(messageID uint32) waitingmessage.Callback {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	cb := m.pending[messageID]
+	delete(m.pending, messageID)
+	return cb
+}
+
+// fail closes the connection and calls every waiting request back with the error
+func (m *muxConn) fail(err error) {
+	m.lock.Lock()
+	if m.err != nil {
+		m.lock.Unlock()
+		return
+	}
+	m.err = err
+	pending := m.pending
+	m.pending = make(map[uint32]waitingmessage.Callback)
+	m.lock.Unlock()
+
+	m.conn.Close()
+	for _, cb := range pending {
+		cb([]byte{}, err)
+	}
+}
+
+// failed is true once the connection can no longer be used
+func (m *muxConn) failed() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.err != nil
+}
+
+// readForever must run in its own thread. It dispatches responses until the connection fails.
+func (m *muxConn) readForever(c *Client) {
+	reader := rawmessage.NewTcpReader(m.conn)
+	for {
+		message, err := reader.ReadMessage(c.log)
+		if err != nil {
+			m.fail(err)
+			return
+		}
+		resPacket, err := protocol.ParsePacket(message)
+		if err != nil && err != protocol.ErrInvalidPacketSizeTooLarge {
+			c.log.Println("client tcp parse res packet failed", err, "|"+string(message)+"|")
+			continue
+		}
+		cb := m.take(resPacket.MessageID)
+		if resPacket.Command == protocol.ResError {
+			serverErr := newServerError(resPacket.DataValueString())
+			if cb == nil && (resPacket.MessageID == 0 || serverErr.Code == CodeTooManyConns) {
+				// not for any request, like when the server has too many connections and hangs up
+				m.fail(serverErr)
+				return
+			}
+			if cb == nil {
+				// for a request which already timed out, such as a late request_timed_out or rate_limited
+				c.log.Println("client tcp error without a waiting request, likely timed out:", resPacket.MessageID, serverErr)
+				continue
+			}
+			cb([]byte{}, serverErr)
+			continue
+		}
+		if cb == nil {
+			c.log.Println("client tcp response without a waiting request, likely timed out:", resPacket.MessageID)
+			continue
+		}
+		cb(tcpResponseData(resPacket), nil)
+	}
+}
+
+// muxConnFor returns the shared connection to a random tcp server, dialing it when there is none.
+func (c *Client) muxConnFor() (*muxConn, error) {
+	if len(c.tcpServerList) < 1 {
+		return nil, ErrNoHealthyTCPServers
+	}
+	server := c.tcpServerList[rand.Intn(len(c.tcpServerList))].String()
+
+	c.muxLock.Lock()
+	defer c.muxLock.Unlock()
+	if c.isDisposed() {
+		return nil, ErrClientClosed
+	}
+	if m, ok := c.muxConns[server]; ok && !m.failed() {
+		return m, nil
+	}
+	conn, err := net.DialTimeout("tcp", server, c.timeoutDuration)
+	if err != nil {
+		c.log.Println("Connection to tcp dracula failed", server, err)
+		return nil, ErrNoHealthyTCPServers
+	}
+	m := &muxConn{conn: conn.(*net.TCPConn), pending: make(map[uint32]waitingmessage.Callback)}
+	c.muxConns[server] = m
+	go m.readForever(c)
+	return m, nil
+}
+
+// _sendTCPMux sends the packet on a shared connection, see Config.MultiplexTCP
+func (c *Client) _sendTCPMux(packet *protocol.Packet, cb waitingmessage.Callback) {
+	c.log.Println("client sending multiplexed tcp packet:", string(packet.Command), packet.MessageID, packet.NamespaceString(), packet.DataValueString())
+	m, err := c.muxConnFor()
+	if err != nil {
+		cb([]byte{}, err)
+		return
+	}
+
+	// needs stop
+	packet.DataValue = append(packet.DataValue, protocol.StopSymbol...)
+	packetBuf, err := packet.Bytes()
+	if err != nil && err != protocol.ErrBadOutputSize {
+		// probably bad packet. udp commands are a full packet before the stop, so are too long with it
+		cb([]byte{}, err)
+		return
+	}
+	m.send(packetBuf, packet.MessageID, c.timeoutDuration, cb)
+}
+
+// closeMuxConns fails the requests waiting on shared connections, and closes them
+func (c *Client) closeMuxConns() {
+	c.muxLock.Lock()
+	defer c.muxLock.Unlock()
+	for server, m := range c.muxConns {
+		m.fail(ErrClientClosed)
+		delete(c.muxConns, server)
+	}
+}
@@ -10,6 +10,7 @@ var (
 	ErrMessageIDExists = errors.New("message ID already exists")
 	ErrMessageExpired  = errors.New("message expired")
 	ErrNoMessage       = errors.New("message not found or was garbage collected")
+	ErrDisposed        = errors.New("waiting message cache was disposed")
 
 	cleanupEveryDefault = time.Second * 10
 )
@@ -20,17 +21,26 @@ type Callback func([]byte, error)
 type waitingMessage struct {
 	Callback    Callback
 	CreatedSecs int64
+	timer       *time.Timer // only in precise mode
 }
 
 type ResponseCache struct {
 	sync.Mutex
 	cache        map[uint32]waitingMessage
 	disposed     bool
+	disposeErr   error // what pending callbacks are called with on dispose
 	cleanupEvery time.Duration
 	timeoutSecs  int64 // cached for fewer conversions
+	timeout      time.Duration
+	precise      bool
 	// TimedOutMessages channel can be listened over for when messages did not receive a response by the timeout deadline
 	// or a little later (in practice)
 	TimedOutMessages chan Callback
+	// done is closed by Dispose, to stop sending to TimedOutMessages
+	done        chan struct{}
+	disposeOnce sync.Once
+	// sendLock is held while sending to TimedOutMessages, so Dispose can wait for sends to stop before closing it
+	sendLock sync.RWMutex
 }
 
 func NewCache(timeout time.Duration) *ResponseCache {
@@ -42,14 +52,25 @@ func NewCache(timeout time.Duration) *ResponseCache {
 	rc := &ResponseCache{
 		cache:            make(map[uint32]waitingMessage),
 		timeoutSecs:      int64(timeout.Seconds()),
+		timeout:          timeout,
 		cleanupEvery:     cleanupEvery,
 		TimedOutMessages: make(chan Callback),
+		done:             make(chan struct{}),
 	}
 
 	rc.checkCleanup()
 	return rc
 }
 
+// NewPreciseCache is like NewCache, but each message times out exactly at its deadline, rather than when
+// the cleanup next runs, which can be up to 10 seconds late. It costs a timer per waiting message.
+// The cleanup still runs as a fallback.
+func NewPreciseCache(timeout time.Duration) *ResponseCache {
+	rc := NewCache(timeout)
+	rc.precise = true
+	return rc
+}
+
 // Len returns the count of the number of entries
 func (rc *ResponseCache) Len() int {
 	rc.Lock()
@@ -61,17 +82,44 @@ func (rc *ResponseCache) Add(messageID uint32, cb Callback) error {
 	rc.Lock()
 	defer rc.Unlock()
 
+	if rc.disposed {
+		return rc.disposeErr
+	}
 	if _, exists := rc.cache[messageID]; exists {
 		return ErrMessageIDExists
 	}
 
-	rc.cache[messageID] = waitingMessage{
+	message := waitingMessage{
 		Callback:    cb,
 		CreatedSecs: time.Now().Unix(),
 	}
+	if rc.precise {
+		var timer *time.Timer
+		// the lock is held until after timer is set, so expire can't run before then
+		timer = time.AfterFunc(rc.timeout, func() {
+			rc.expire(messageID, &timer)
+		})
+		message.timer = timer
+	}
+	rc.cache[messageID] = message
 	return nil
 }
 
+// expire times out one message in precise mode, unless it was already pulled
+func (rc *ResponseCache) expire(messageID uint32, timer **time.Timer) {
+	rc.Lock()
+	message, exists := rc.cache[messageID]
+	// the ID may have been reused by a newer message since this timer was set
+	if !exists || rc.disposed || message.timer != *timer {
+		rc.Unlock()
+		return
+	}
+	delete(rc.cache, messageID)
+	rc.Unlock()
+
+	rc.sendTimedOut([]Callback{message.Callback})
+}
+
 // Pull removes the expected message command if exists or returns an error
 func (rc *ResponseCache) Pull(messageID uint32) (Callback, error) {
 	rc.Lock()
@@ -83,8 +131,12 @@ func (rc *ResponseCache) Pull(messageID uint32) (Callback, error) {
 	}
 	// can only pull a message once
 	delete(rc.cache, messageID)
+	if message.timer != nil {
+		message.timer.Stop()
+	}
 
-	isExpired := message.CreatedSecs < (time.Now().Unix() - rc.timeoutSecs)
+	// precise timers remove messages once they expire, so any message still here is in time
+	isExpired := !rc.precise && message.CreatedSecs < (time.Now().Unix()-rc.timeoutSecs)
 	if isExpired {
 		return nil, ErrMessageExpired
 	}
@@ -94,51 +146,93 @@ func (rc *ResponseCache) Pull(messageID uint32) (Callback, error) {
 }
 
 // Dispose stops the cleanup operation and allows the whole cache to be to be garbage collected by go's runtime.
-// Also stops the channel
+// Also stops the channel. Callbacks still waiting are called with ErrDisposed, so nothing waits on them forever.
+// It is safe to call while timeouts are being sent, and more than once.
 func (rc *ResponseCache) Dispose() {
-	if rc != nil {
+	rc.DisposeWithError(ErrDisposed)
+}
+
+// DisposeWithError is Dispose, calling waiting callbacks with err instead of ErrDisposed. Adding messages
+// afterwards also returns err.
+func (rc *ResponseCache) DisposeWithError(err error) {
+	if rc == nil {
+		return
+	}
+	rc.disposeOnce.Do(func() {
+		rc.Lock()
 		rc.disposed = true
+		rc.disposeErr = err
+		pending := rc.cache
+		rc.cache = make(map[uint32]waitingMessage)
+		rc.Unlock()
+
+		// unblock any sends, then wait for them to stop before closing
+		close(rc.done)
+		rc.sendLock.Lock()
 		close(rc.TimedOutMessages)
-	}
+		rc.sendLock.Unlock()
+
+		for _, message := range pending {
+			if message.timer != nil {
+				message.timer.Stop()
+			}
+			message.Callback([]byte{}, err)
+		}
+	})
 }
 
 func (rc *ResponseCache) checkCleanup() {
-	if rc == nil || rc.disposed {
-		// item was disposed
+	if rc == nil {
 		return
 	}
 
 	rc.Lock()
-	defer rc.Unlock()
-
-	entryCount := len(rc.cache)
-	oneQuarter := entryCount / 3 // only crawl 1/3 of the entries at a time
+	if rc.disposed {
+		// item was disposed
+		rc.Unlock()
+		return
+	}
+	// every entry is checked, because map order is random, so a partial crawl can keep missing the
+	// same timed out messages and leave their callers waiting for many runs
 	cleanupWhenOlderThanSecs := time.Now().Unix() - rc.timeoutSecs
-	i := 0
-	var removeTheseKeys []uint32
-	var shouldCleanup bool
+	var timedOut []Callback
 	for messageID, entry := range rc.cache {
-		i++
-		shouldCleanup = entry.CreatedSecs < cleanupWhenOlderThanSecs
-		if shouldCleanup {
-			removeTheseKeys = append(removeTheseKeys, messageID)
-		}
-
-		if i > oneQuarter {
-			break
+		if entry.CreatedSecs < cleanupWhenOlderThanSecs {
+			timedOut = append(timedOut, entry.Callback)
+			delete(rc.cache, messageID)
 		}
 	}
+	rc.Unlock()
 
-	var messageID uint32
-	var cb Callback
-	for i = 0; i < len(removeTheseKeys); i++ {
-		messageID = removeTheseKeys[i]
-		cb = rc.cache[messageID].Callback
-		delete(rc.cache, messageID)
-		if !rc.disposed {
-			rc.TimedOutMessages <- cb
-		}
+	// sending happens without the lock, so responses can still be added and pulled while the
+	// listener is busy, and a listener which stopped reading can't block the cache
+	if !rc.sendTimedOut(timedOut) {
+		return
 	}
 
 	time.AfterFunc(rc.cleanupEvery, rc.checkCleanup)
 }
+
+// sendTimedOut sends the callbacks to TimedOutMessages, returning false when the cache was disposed first.
+// Callbacks which could not be sent are called with the dispose error.
+func (rc *ResponseCache) sendTimedOut(timedOut []Callback) bool {
+	rc.sendLock.RLock()
+	defer rc.sendLock.RUnlock()
+	for i, cb := range timedOut {
+		// TimedOutMessages can't be closed while the send lock is held, so this never panics
+		select {
+		case rc.TimedOutMessages <- cb:
+		case <-rc.done:
+			for _, unsent := range timedOut[i:] {
+				unsent([]byte{}, rc.disposeErr)
+			}
+			return false
+		}
+	}
+	select {
+	case <-rc.done:
+		return false
+	default:
+		return true
+	}
+}
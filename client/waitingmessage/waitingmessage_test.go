@@ -0,0 +1,107 @@
+package waitingmessage
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResponseCache_checkCleanup(t *testing.T) {
+	rc := NewCache(time.Second)
+	defer rc.Dispose()
+
+	const total = 3000
+	rc.Lock()
+	for i := uint32(0); i < total; i++ {
+		rc.cache[i] = waitingMessage{
+			Callback:    func([]byte, error) {},
+			CreatedSecs: time.Now().Unix() - 10, // already expired
+		}
+	}
+	rc.Unlock()
+
+	deadline := time.After(3 * time.Second)
+	for delivered := 0; delivered < total; delivered++ {
+		select {
+		case <-rc.TimedOutMessages:
+		case <-deadline:
+			t.Fatalf("only %d of %d timed out messages were delivered", delivered, total)
+		}
+	}
+	assert.Equal(t, 0, rc.Len())
+}
+
+func TestResponseCache_DisposeWithPendingTimeouts(t *testing.T) {
+	rc := NewCache(time.Second)
+
+	var disposedErrs int32
+	rc.Lock()
+	for i := uint32(0); i < 10; i++ {
+		rc.cache[i] = waitingMessage{
+			Callback: func(_ []byte, err error) {
+				if err == ErrDisposed {
+					atomic.AddInt32(&disposedErrs, 1)
+				}
+			},
+			CreatedSecs: time.Now().Unix() - 10, // already expired
+		}
+	}
+	rc.Unlock()
+	assert.NoError(t, rc.Add(100, func(_ []byte, err error) {
+		if err == ErrDisposed {
+			atomic.AddInt32(&disposedErrs, 1)
+		}
+	}))
+
+	// nothing reads the timeouts, so cleanup blocks sending them
+	time.Sleep(1500 * time.Millisecond)
+
+	disposed := make(chan struct{})
+	go func() {
+		rc.Dispose()
+		rc.Dispose() // twice is harmless
+		close(disposed)
+	}()
+	select {
+	case <-disposed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Dispose hung while timeouts were pending")
+	}
+
+	// every callback is called exactly once - the blocked timeouts and the waiting message
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&disposedErrs) == 11
+	}, time.Second, 10*time.Millisecond)
+	_, open := <-rc.TimedOutMessages
+	assert.False(t, open, "channel should be closed")
+}
+
+func TestResponseCache_precise(t *testing.T) {
+	rc := NewPreciseCache(200 * time.Millisecond)
+	defer rc.Dispose()
+
+	start := time.Now()
+	assert.NoError(t, rc.Add(1, func([]byte, error) {}))
+	assert.NoError(t, rc.Add(2, func([]byte, error) {}))
+	_, err := rc.Pull(2)
+	assert.NoError(t, err, "pulled in time")
+
+	select {
+	case <-rc.TimedOutMessages:
+		elapsed := time.Since(start)
+		assert.GreaterOrEqual(t, int64(elapsed), int64(200*time.Millisecond))
+		assert.Less(t, int64(elapsed), int64(500*time.Millisecond), "timeout should fire at the deadline")
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout did not fire")
+	}
+
+	// the pulled message's timer was stopped
+	select {
+	case <-rc.TimedOutMessages:
+		t.Fatal("pulled message should not time out")
+	case <-time.After(400 * time.Millisecond):
+	}
+	assert.Equal(t, 0, rc.Len())
+}
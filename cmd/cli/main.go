@@ -1,9 +1,12 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/mailsac/dracula/client"
@@ -14,12 +17,20 @@ var (
 	ns           = flag.String("n", "default", "Entry key namespace value")
 	entryKey     = flag.String("k", "", "Required: entry key or pattern for keys mode")
 	count        = flag.Bool("count", false, "Mode: Count items at entry key")
+	countNs      = flag.Bool("countns", false, "Mode: Count items at every entry key in the namespace")
+	countKeys    = flag.Bool("countkeys", false, "Mode: Count distinct entry keys with unexpired items in the namespace")
+	countServer  = flag.Bool("countserver", false, "Mode: Count items in every namespace on the server")
 	put          = flag.Bool("put", false, "Mode: Put item at entry key")
 	cmdKeys      = flag.Bool("keys", false, "Mode: list keys matching this pattern (TCP)")
+	topKeys      = flag.Int("top", 0, "Mode: list this many keys with the most entries (TCP)")
 	namespaces   = flag.Bool("namespaces", false, "Mode: list namespaces")
 	secret       = flag.String("s", "", "Optional pre-shared auth secret if not using env var DRACULA_SECRET")
 	localPort    = flag.Int("p", 3510, "Local client port to receive responses on")
+	bindIP       = flag.String("bind", "0.0.0.0", "Local IP to receive responses on")
 	timeoutSecs  = flag.Int64("t", 6, "Request timeout in seconds")
+	watch        = flag.Bool("watch", false, "With -count, keep printing the count with a timestamp every -interval until interrupted")
+	interval     = flag.Duration("interval", 2*time.Second, "Time between counts in -watch mode")
+	jsonOutput   = flag.Bool("json", false, "Print results as JSON, and errors as JSON to stderr")
 	help         = flag.Bool("h", false, "Print help")
 	verbose      = flag.Bool("v", false, "Verbose logging")
 	printVersion = flag.Bool("version", false, "Print version")
@@ -47,7 +58,7 @@ func main() {
 		fmt.Println("-n 'namespace' is required")
 		return
 	}
-	if *entryKey == "" {
+	if *entryKey == "" && *topKeys == 0 && !*namespaces && !*countNs && !*countKeys && !*countServer {
 		flag.Usage()
 		fmt.Println("-k 'entrykey' is required")
 		return
@@ -62,22 +73,41 @@ func main() {
 	if *cmdKeys {
 		totalModes++
 	}
+	if *topKeys > 0 {
+		totalModes++
+	}
+	if *namespaces {
+		totalModes++
+	}
+	if *countNs {
+		totalModes++
+	}
+	if *countKeys {
+		totalModes++
+	}
+	if *countServer {
+		totalModes++
+	}
 
 	if totalModes != 1 {
 		flag.Usage()
-		fmt.Println("either -put, -count, -keys is required")
+		fmt.Println("either -put, -count, -countns, -countkeys, -countserver, -keys, -top, -namespaces is required")
 		return
 	}
 	if *secret != "" {
 		preSharedSecret = *secret
 	}
 
-	conf := client.Config{RemoteUDPIPPortList: *ipPortPairs, Timeout: time.Duration(*timeoutSecs) * time.Second, PreSharedKey: preSharedSecret}
-	isTcp := *cmdKeys // todo more tcp commands
+	conf := client.Config{RemoteUDPIPPortList: *ipPortPairs, Timeout: time.Duration(*timeoutSecs) * time.Second, PreSharedKey: preSharedSecret, BindIP: *bindIP}
+	isTcp := *cmdKeys || *topKeys > 0 || *namespaces
 	if isTcp {
 		conf.RemoteTCPIPPortList = conf.RemoteUDPIPPortList
 		conf.RemoteUDPIPPortList = ""
 	}
+	if err := conf.Validate(); err != nil {
+		fmt.Println("Dracula bad client config", err)
+		os.Exit(1)
+	}
 	c := client.NewClient(conf)
 	if *verbose {
 		c.DebugEnable(fmt.Sprintf("%d", *localPort))
@@ -85,35 +115,64 @@ func main() {
 	if !isTcp {
 		err := c.Listen(*localPort)
 		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
+			exitErr(err)
 		}
 	}
 
+	if *count && *watch {
+		watchCount(c)
+		os.Exit(0)
+	}
 	if *count {
 		total, err := c.Count(*ns, *entryKey)
 		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
+			exitErr(err)
+		}
+		printCount(total)
+		os.Exit(0)
+	}
+	if *countNs {
+		total, err := c.CountNamespace(*ns)
+		if err != nil {
+			exitErr(err)
+		}
+		printCount(total)
+		os.Exit(0)
+	}
+	if *countKeys {
+		total, err := c.CountDistinctKeys(*ns)
+		if err != nil {
+			exitErr(err)
 		}
-		fmt.Println(total)
+		printCount(total)
+		os.Exit(0)
+	}
+	if *countServer {
+		total, err := c.CountServer()
+		if err != nil {
+			exitErr(err)
+		}
+		printCount(total)
 		os.Exit(0)
 	}
 	if *put {
 		err := c.Put(*ns, *entryKey)
 		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
+			exitErr(err)
+		}
+		if *jsonOutput {
+			printJSON(struct{}{})
 		}
 		os.Exit(0)
 	}
 	if *cmdKeys {
 		keys, err := c.KeyMatch(*ns, *entryKey)
 		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
+			exitErr(err)
 		}
-		if len(keys) == 0 {
+		if *jsonOutput {
+			printJSON(map[string][]string{"keys": keys})
+		} else if len(keys) == 0 {
 			fmt.Println("(no matched keys)")
 		} else {
 			for i, k := range keys {
@@ -123,21 +182,106 @@ func main() {
 
 		os.Exit(0)
 	}
+	if *topKeys > 0 {
+		top, err := c.TopKeys(*ns, *topKeys)
+		if err != nil {
+			exitErr(err)
+		}
+		if *jsonOutput {
+			type keyCount struct {
+				Key   string `json:"key"`
+				Count int    `json:"count"`
+			}
+			out := make([]keyCount, len(top))
+			for i, kc := range top {
+				out[i] = keyCount{Key: kc.Key, Count: kc.Count}
+			}
+			printJSON(map[string][]keyCount{"keys": out})
+		} else if len(top) == 0 {
+			fmt.Println("(no keys)")
+		} else {
+			for i, kc := range top {
+				fmt.Printf("%d) %s %d\n", i+1, kc.Key, kc.Count)
+			}
+		}
+
+		os.Exit(0)
+	}
 	if *namespaces {
 		namespaceList, err := c.ListNamespaces()
 		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
+			exitErr(err)
+		}
+		if len(namespaceList) == 1 && namespaceList[0] == "" {
+			namespaceList = []string{}
 		}
-		if len(namespaceList) > 0 {
+		if *jsonOutput {
+			printJSON(map[string][]string{"namespaces": namespaceList})
+		} else if len(namespaceList) == 0 {
+			fmt.Println("(no namespaces)")
+		} else {
 			for index, namespace := range namespaceList {
 				fmt.Printf("%d) %s\n", index+1, namespace)
 			}
-		} else {
-			fmt.Println("(no namespaces)")
+		}
+
+		os.Exit(0)
+	}
+}
+
+// watchCount prints one line with a timestamp and count each interval, until interrupted
+func watchCount(c *client.Client) {
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt, syscall.SIGTERM)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	defer c.Close()
+
+	for {
+		total, err := c.Count(*ns, *entryKey)
+		now := time.Now().Format(time.RFC3339)
+		switch {
+		case *jsonOutput && err != nil:
+			printJSON(map[string]string{"time": now, "error": err.Error()})
+		case *jsonOutput:
+			printJSON(map[string]interface{}{"time": now, "count": total})
+		case err != nil:
+			fmt.Println(now, err)
+		default:
+			fmt.Println(now, total)
+		}
+		select {
+		case <-interrupted:
+			return
+		case <-ticker.C:
 		}
 	}
+}
 
-	fmt.Println("no command matched")
+func printCount(total int) {
+	if *jsonOutput {
+		printJSON(map[string]int{"count": total})
+		return
+	}
+	fmt.Println(total)
+}
+
+// printJSON prints v as one line of JSON
+func printJSON(v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		exitErr(err)
+	}
+	fmt.Println(string(b))
+}
+
+// exitErr prints the error, as JSON to stderr in -json mode, and exits non-zero
+func exitErr(err error) {
+	if *jsonOutput {
+		b, _ := json.Marshal(map[string]string{"error": err.Error()})
+		fmt.Fprintln(os.Stderr, string(b))
+	} else {
+		fmt.Println(err)
+	}
 	os.Exit(1)
 }
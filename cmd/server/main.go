@@ -1,23 +1,54 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/mailsac/dracula/server"
+	"github.com/mailsac/dracula/store"
+	"io/ioutil"
 	"os"
+	"reflect"
 	"strings"
 	"sync"
+	"time"
 )
 
 var (
 	help            = flag.Bool("h", false, "Print this help")
+	configFile      = flag.String("config", "", "JSON file of settings named like the fields of server.Config, such as {\"ExpireAfter\": \"1m\", \"Workers\": 8}. Flags given on the command line override it")
 	expireAfterSecs = flag.Int64("t", 60, "TTL secs - entries will expire after this many seconds")
-	port            = flag.Int("p", 3509, "UDP this server will run on")
-	tcpPort         = flag.Int("tcp", 3509, "TCP port this server will run on")
+	expireAfterMs   = flag.Int64("tms", 0, "TTL millis - overrides -t for entries which expire in under a second, like 250")
+	port            = flag.Int("p", 3509, "UDP this server will run on. 0 disables UDP")
+	tcpPort         = flag.Int("tcp", 3509, "TCP port this server will run on. 0 disables TCP")
+	bindIP          = flag.String("bind", "0.0.0.0", "IP the UDP and TCP listeners bind to. Use an internal interface to keep them off public ones")
 	restHostPort    = flag.String("http", "0.0.0.0:3510", "Enable HTTP REST interface. Example: '0.0.0.0:3510'")
 	secret          = flag.String("s", "", "Optional pre-shared auth secret if not using env var DRACULA_SECRET")
 	peerIPPort      = flag.String("i", "", "Self peer IP and host like 192.168.0.1:3509 to identify self in the cluster")
 	peers           = flag.String("c", "", "Enable cluster replication. Peers must be comma-separated ip:port like `192.168.0.1:3509,192.168.0.2:3555`.")
+	discoverName    = flag.String("discover", "", "Discover cluster peers by DNS instead of -c. An SRV name like _dracula._udp.example.com, or host:port with an A record per peer. Requires -i")
+	discoverSecs    = flag.Int64("discoversecs", int64(server.DefaultDiscoveryInterval.Seconds()), "Secs between resolving -discover again to add and drop peers")
+	peerSyncSecs    = flag.Int64("sync", int64(server.DefaultPeerSyncInterval.Seconds()), "Secs between reconciling missing entries with cluster peers. 0 disables")
+	cleanupSecs     = flag.Int64("gc", int64(store.DefaultCleanupInterval.Seconds()), "Secs between garbage collecting expired entries of a portion of namespaces")
+	workers         = flag.Int("workers", 0, "Number of UDP packet processing workers. Defaults to number of CPUs + 1")
+	queueSize       = flag.Int("queue", 0, "Number of received UDP packets which can wait for a worker. Defaults to number of CPUs. Raise it if UDP packets drop during bursts")
+	queueFullMillis = flag.Int64("queuefullms", 0, "Millis a received UDP packet waits for room in a full -queue before it is dropped and counted. 0 waits as long as it takes, -1 drops straight away")
+	tcpWorkers      = flag.Int("tcpworkers", 0, "Number of TCP message processing workers. Defaults to number of CPUs + 1")
+	tcpQueueSize    = flag.Int("tcpqueue", 0, "Number of received TCP messages which can wait for a worker. Defaults to number of CPUs")
+	tcpIdleSecs     = flag.Int64("tcpidle", 0, "Secs before closing TCP connections which send nothing. 0 never closes them")
+	tcpKeepAlive    = flag.Int64("tcpkeepalive", 0, "Secs between TCP keepalive probes. 0 uses the OS default, -1 disables")
+	maxTCPConns     = flag.Int("maxtcp", 0, "Max open TCP connections. More are sent an error and closed. 0 is unlimited")
+	maxSubs         = flag.Int("maxsubs", server.DefaultMaxSubscriptions, "Max open subscriptions to puts. More get a too_many_subscriptions error")
+	fixedWindows    = flag.String("fixed", "", "Comma-separated namespaces which count in fixed windows aligned to the clock, resetting every -t, instead of sliding windows")
+	maxEntries      = flag.Int("max", 0, "Max entries a single key can hold. Oldest entries are dropped past it. 0 is unlimited")
+	maxValueLen     = flag.Int("maxvaluelen", 0, "Max bytes in a key which is put or counted. Longer ones get a value_too_long error. 0 is the most a packet fits")
+	expensiveRate   = flag.Float64("expensiverate", 0, "Max expensive commands per second from each client IP, like CountServer and KeyMatch. More get a rate_limited error. 0 is unlimited")
+	expensiveBurst  = flag.Int("expensiveburst", 0, "Expensive commands a client IP can send at once before -expensiverate applies. Defaults to -expensiverate rounded up")
+	timeoutMillis   = flag.Int64("timeoutms", 0, "Millis after receiving a request to give up on it with an error, such as when it waited behind slow requests. 0 never times out")
+	readOnly        = flag.Bool("readonly", false, "Refuse puts and deletes from clients, for a replica which is only sent them by peers listing it in -c")
+	slowMillis      = flag.Int64("slowms", 0, "Millis after which a request is logged as slow and counted in a prometheus metric. 0 disables")
+	nsMetricsSecs   = flag.Int64("nsmetrics", 0, "Secs between refreshing the per-namespace entries prometheus metric. 0 disables")
+	nsMetricsLimit  = flag.Int("nsmetricslimit", server.DefaultNamespaceMetricsLimit, "Max namespaces in the per-namespace entries prometheus metric, largest first")
 	verbose         = flag.Bool("v", false, "Verbose logging")
 	printVersion    = flag.Bool("version", false, "Print version")
 	promHostPort    = flag.String("prom", "", "Enable prometheus metrics. May cause pauses. Example: '0.0.0.0:9090'")
@@ -43,25 +74,100 @@ func main() {
 	if *secret != "" {
 		preSharedSecret = *secret
 	}
-	var s *server.Server
-	peerList := strings.Trim(*peers, " \n")
-	if len(peerList) > 0 && *peerIPPort == "" {
+	expireAfterMillis := *expireAfterSecs * 1000
+	if *expireAfterMs > 0 {
+		expireAfterMillis = *expireAfterMs
+	}
+	var fixedWindowNamespaces []string
+	if *fixedWindows != "" {
+		fixedWindowNamespaces = strings.Split(*fixedWindows, ",")
+	}
+	conf := server.Config{
+		ExpireAfter:              time.Duration(expireAfterMillis) * time.Millisecond,
+		PreSharedKeys:            []string{preSharedSecret},
+		SelfPeer:                 *peerIPPort,
+		PeerList:                 strings.Trim(*peers, " \n"),
+		CleanupInterval:          time.Duration(*cleanupSecs) * time.Second,
+		BindIP:                   *bindIP,
+		Workers:                  *workers,
+		QueueSize:                *queueSize,
+		QueueFullTimeout:         time.Duration(*queueFullMillis) * time.Millisecond,
+		TCPWorkers:               *tcpWorkers,
+		TCPQueueSize:             *tcpQueueSize,
+		MaxEntriesPerKey:         *maxEntries,
+		MaxValueLen:              *maxValueLen,
+		FixedWindowNamespaces:    fixedWindowNamespaces,
+		TCPIdleTimeout:           time.Duration(*tcpIdleSecs) * time.Second,
+		TCPKeepAlive:             time.Duration(*tcpKeepAlive) * time.Second,
+		MaxTCPConns:              *maxTCPConns,
+		MaxSubscriptions:         *maxSubs,
+		ExpensiveRateLimit:       *expensiveRate,
+		ExpensiveBurst:           *expensiveBurst,
+		RequestTimeout:           time.Duration(*timeoutMillis) * time.Millisecond,
+		ReadOnly:                 *readOnly,
+		SlowThreshold:            time.Duration(*slowMillis) * time.Millisecond,
+		NamespaceMetricsInterval: time.Duration(*nsMetricsSecs) * time.Second,
+		NamespaceMetricsLimit:    *nsMetricsLimit,
+		Version:                  Version,
+		Build:                    Build,
+	}
+	if *configFile != "" {
+		fileConf, err := server.ConfigFromFile(*configFile)
+		if err != nil {
+			fmt.Println("Dracula bad config file", err)
+			os.Exit(1)
+		}
+		inFile, err := settingsInFile(*configFile)
+		if err != nil {
+			fmt.Println("Dracula bad config file", err)
+			os.Exit(1)
+		}
+		given := make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) {
+			given[f.Name] = true
+		})
+		conf = withConfigFile(conf, fileConf, inFile, given)
+	}
+	peerList := conf.PeerList
+	selfPeer := conf.SelfPeer
+	if (len(peerList) > 0 || *discoverName != "") && selfPeer == "" {
 		flag.Usage()
-		fmt.Println("peer list and self peer ip:port are required together")
+		fmt.Println("peer list or discovery and self peer ip:port are required together")
+		os.Exit(1)
+	}
+	if len(peerList) > 0 && *discoverName != "" {
+		flag.Usage()
+		fmt.Println("peer list and discovery can't be used together")
+		os.Exit(1)
+	}
+	if len(peerList) == 0 {
+		// self alone is for discovery, which is enabled after New
+		conf.SelfPeer = ""
+	}
+	s, err := server.New(conf)
+	if err != nil {
+		fmt.Println("Dracula bad config", err)
 		os.Exit(1)
 	}
 	if len(peerList) > 0 {
-		s = server.NewServerWithPeers(*expireAfterSecs, preSharedSecret, *peerIPPort, peerList)
+		s.SetPeerSyncInterval(time.Duration(*peerSyncSecs) * time.Second)
 		if *verbose {
-			fmt.Printf("dracula server cluster mode enabled: self=%s; peers=%s \n", *peerIPPort, s.Peers())
+			fmt.Printf("dracula server cluster mode enabled: self=%s; peers=%s \n", selfPeer, s.Peers())
+		}
+	} else if *discoverName != "" {
+		if err := s.EnableDiscovery(selfPeer, *discoverName, time.Duration(*discoverSecs)*time.Second); err != nil {
+			fmt.Println("Dracula bad cluster config", err)
+			os.Exit(1)
+		}
+		s.SetPeerSyncInterval(time.Duration(*peerSyncSecs) * time.Second)
+		if *verbose {
+			fmt.Printf("dracula server cluster mode enabled: self=%s; discover=%s \n", selfPeer, *discoverName)
 		}
-	} else {
-		s = server.NewServer(*expireAfterSecs, preSharedSecret)
 	}
 	if *verbose {
 		s.DebugEnable(fmt.Sprintf("udp:%d, tcp:%d, http:%s -", *port, *tcpPort, *restHostPort))
 	}
-	err := s.Listen(*port, *tcpPort)
+	err = s.Listen(*port, *tcpPort)
 	if err != nil {
 		fmt.Println("Dracula udp/tcp startup listen error", err)
 		os.Exit(1)
@@ -72,7 +178,7 @@ func main() {
 		os.Exit(1)
 	}
 	if *verbose {
-		fmt.Println("will expire keys after", *expireAfterSecs, "seconds")
+		fmt.Println("will expire keys after", conf.ExpireAfter)
 	}
 	if *promHostPort != "" {
 		err = s.StoreMetrics.ListenAndServe(*promHostPort)
@@ -86,3 +192,75 @@ func main() {
 	wg.Add(1)
 	wg.Wait() // wait forever without burning cpu
 }
+
+// configFlags names the server.Config setting each flag sets
+var configFlags = map[string]string{
+	"t":              "ExpireAfter",
+	"tms":            "ExpireAfter",
+	"s":              "PreSharedKeys",
+	"i":              "SelfPeer",
+	"c":              "PeerList",
+	"gc":             "CleanupInterval",
+	"bind":           "BindIP",
+	"workers":        "Workers",
+	"queue":          "QueueSize",
+	"queuefullms":    "QueueFullTimeout",
+	"tcpworkers":     "TCPWorkers",
+	"tcpqueue":       "TCPQueueSize",
+	"max":            "MaxEntriesPerKey",
+	"maxvaluelen":    "MaxValueLen",
+	"fixed":          "FixedWindowNamespaces",
+	"tcpidle":        "TCPIdleTimeout",
+	"tcpkeepalive":   "TCPKeepAlive",
+	"maxtcp":         "MaxTCPConns",
+	"maxsubs":        "MaxSubscriptions",
+	"expensiverate":  "ExpensiveRateLimit",
+	"expensiveburst": "ExpensiveBurst",
+	"timeoutms":      "RequestTimeout",
+	"readonly":       "ReadOnly",
+	"slowms":         "SlowThreshold",
+	"nsmetrics":      "NamespaceMetricsInterval",
+	"nsmetricslimit": "NamespaceMetricsLimit",
+}
+
+// settingsInFile returns the names of the server.Config settings the config file has, so a setting the file
+// gives as zero, like {"MaxSubscriptions": 0}, is told apart from one it leaves out.
+func settingsInFile(path string) (map[string]bool, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var settings map[string]json.RawMessage
+	if err = json.Unmarshal(b, &settings); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	inFile := make(map[string]bool, len(settings))
+	for name := range settings {
+		// matched like server.ConfigFromFile does
+		field, found := reflect.TypeOf(server.Config{}).FieldByNameFunc(func(fieldName string) bool {
+			return strings.EqualFold(fieldName, name)
+		})
+		if found {
+			inFile[field.Name] = true
+		}
+	}
+	return inFile, nil
+}
+
+// withConfigFile returns the settings the config file has, except for those of the flags given on the command
+// line, which come from the flags' config along with the settings the file leaves out.
+func withConfigFile(flagConf, fileConf server.Config, inFile, given map[string]bool) server.Config {
+	givenSettings := make(map[string]bool)
+	for name := range given {
+		givenSettings[configFlags[name]] = true
+	}
+	settings := reflect.ValueOf(&fileConf).Elem()
+	flagSettings := reflect.ValueOf(flagConf)
+	for i := 0; i < settings.NumField(); i++ {
+		name := settings.Type().Field(i).Name
+		if givenSettings[name] || !inFile[name] {
+			settings.Field(i).Set(flagSettings.Field(i))
+		}
+	}
+	return fileConf
+}
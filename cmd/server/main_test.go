@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/mailsac/dracula/server"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithConfigFile(t *testing.T) {
+	path := t.TempDir() + "/dracula.json"
+	settings := `{"expireafter": "5s", "PreSharedKeys": ["from-file"], "Workers": 8, "BindIP": "10.0.0.1",
+		"ReadOnly": true, "MaxSubscriptions": 0}`
+	if err := ioutil.WriteFile(path, []byte(settings), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fileConf, err := server.ConfigFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inFile, err := settingsInFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flagConf := server.Config{
+		ExpireAfter:      time.Minute,
+		PreSharedKeys:    []string{"from-env"},
+		Workers:          4,
+		MaxSubscriptions: server.DefaultMaxSubscriptions,
+		BindIP:           "0.0.0.0",
+		Version:          "v1",
+	}
+
+	conf := withConfigFile(flagConf, fileConf, inFile, map[string]bool{"tms": true, "workers": true, "p": true})
+	assert.Equal(t, server.Config{
+		ExpireAfter:      time.Minute, // -tms given
+		PreSharedKeys:    []string{"from-file"},
+		Workers:          4, // -workers given
+		MaxSubscriptions: 0, // the file's zero beats the flag default
+		BindIP:           "10.0.0.1",
+		ReadOnly:         true,
+		Version:          "v1", // not in the file
+	}, conf)
+
+	// a flag given with its default still overrides the file
+	conf = withConfigFile(flagConf, fileConf, inFile, map[string]bool{"bind": true, "readonly": true, "maxsubs": true})
+	assert.Equal(t, "0.0.0.0", conf.BindIP)
+	assert.False(t, conf.ReadOnly)
+	assert.Equal(t, server.DefaultMaxSubscriptions, conf.MaxSubscriptions)
+	assert.Equal(t, 5*time.Second, conf.ExpireAfter)
+
+	_, err = settingsInFile(path + ".missing")
+	assert.Error(t, err)
+}
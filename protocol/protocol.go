@@ -1,12 +1,14 @@
 package protocol
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"log"
 	"math"
 	"net"
+	"strconv"
 	"strings"
 
 	"github.com/OneOfOne/xxhash"
@@ -17,17 +19,73 @@ const (
 	NamespaceSize int = 64
 	DataValueSize int = 1419
 
-	CmdCount          byte = 'C'
-	CmdPut            byte = 'P'
-	CmdPutReplicate   byte = 'R'
-	CmdCountNamespace byte = 'N'
-	CmdCountServer    byte = 'S'
+	CmdCount           byte = 'C'
+	CmdPut             byte = 'P' // responds with the key's uint32 count after the put
+	CmdPutReplicate    byte = 'R'
+	CmdPutReplicateAck byte = 'A' // peer acknowledging it received a replication
+	CmdCountNamespace  byte = 'N'
+	CmdCountServer     byte = 'S'
+	CmdNamespaceInfo   byte = 'F' // responds with the namespace's uint32 key count, which is 0 when it does not exist
+	CmdSyncDigest      byte = 'D' // peer sharing its entry count for a namespace, or a key in it
+	CmdSyncPull        byte = 'U' // peer asking for key digests of a namespace which it has fewer entries of
+	CmdPing            byte = 'B' // answered without touching the store, for healthchecks
+	// CmdPutReplicateAt is CmdPutReplicate with the data being the decimal unix millis of the put, a space,
+	// and the key, so a peer can tell whether the put came before a delete.
+	CmdPutReplicateAt byte = 'Q'
+	// CmdDelete removes a key and responds with uint32 1 when it had entries, or 0
+	CmdDelete byte = 'X'
+	// CmdDeleteReplicate is a CmdDelete sent to peers, with data like CmdPutReplicateAt. It is acked
+	// with CmdPutReplicateAck.
+	CmdDeleteReplicate byte = 'Z'
+	// CmdCountAt data is the uint32 unix seconds to count at followed by the key. It responds like CmdCount.
+	CmdCountAt byte = 'W'
+	// CmdCountKeys responds with the uint32 number of distinct keys in the namespace with unexpired entries.
+	// Every uppercase letter is taken, so it is lowercase.
+	CmdCountKeys byte = 'k'
+	// CmdCountWeighted data is the decimal half life in milliseconds, a space, and the key. It responds with
+	// the key's entries weighted by age as decimal text.
+	CmdCountWeighted byte = 'w'
+	// CmdPutBytes and CmdCountBytes are CmdPut and CmdCount with the key length prefixed, as by LengthPrefixed,
+	// so binary keys are read back exactly. They are udp only, since a key could contain the StopSymbol.
+	CmdPutBytes   byte = 'p'
+	CmdCountBytes byte = 'c'
+	// CmdGetReset is CmdDelete, responding with the uint32 count the key had instead. It is replicated like CmdDelete.
+	CmdGetReset byte = 'r'
+	// CmdCompact removes the namespace's expired entries now, and responds with the uint32 number removed.
+	CmdCompact byte = 'g'
+	// CmdPutWeight is CmdPut of several entries at once, with data being the decimal weight, from 1 to
+	// MaxPutWeight, a space, and the key. It responds like CmdPut.
+	CmdPutWeight byte = 'n'
+	// CmdPutWeightReplicate is a CmdPutWeight sent to peers, with data being the decimal unix millis of the put,
+	// a space, and the CmdPutWeight data. It is acked with CmdPutReplicateAck.
+	CmdPutWeightReplicate byte = 'm'
+	// CmdGetTTL responds with how long entries in the namespace count before they expire, as decimal milliseconds.
+	CmdGetTTL byte = 'e'
 
 	CmdTCPOnlyKeys       byte = 'K'
 	CmdTCPOnlyValues     byte = 'V'
 	CmdTCPOnlyStore      byte = 'T'
 	CmdTCPOnlyRetrieve   byte = 'I'
-	CmdTCPOnlyNamespaces byte = 'L'
+	CmdTCPOnlyNamespaces byte = 'L' // data of q quotes the namespaces in the response, as by JoinQuoted
+	CmdTCPOnlyTopKeys    byte = 'O' // data is the decimal limit of keys to return
+	// CmdTCPOnlyKeysPage data is the decimal offset, limit, and key pattern separated by spaces. The response
+	// is a line of 1 when more keys remain or 0 when not, followed by the keys.
+	CmdTCPOnlyKeysPage byte = 'G'
+	// CmdTCPOnlyNamespacesPage is like CmdTCPOnlyKeysPage, without a key pattern
+	CmdTCPOnlyNamespacesPage byte = 'H'
+	// CmdTCPOnlyKeysOpts is like CmdTCPOnlyKeys, with the data being option letters, a space, and the pattern.
+	// The letters are i to match case insensitively, e to include expired keys, and q to quote the keys in the
+	// response as by JoinQuoted, or - for none.
+	CmdTCPOnlyKeysOpts byte = 'M'
+	// CmdTCPOnlyInfo responds with JSON describing the server's version and configuration
+	CmdTCPOnlyInfo byte = 'Y'
+	// CmdTCPOnlyPeers data is + or - followed by an ip:port peer to add or remove, or empty to change nothing.
+	// It responds with the comma separated peers.
+	CmdTCPOnlyPeers byte = 'J'
+	// CmdTCPOnlySubscribe data is a key pattern, matched like CmdTCPOnlyKeys, or empty for every key. The server
+	// acknowledges it with an empty response, then sends a response with the same message ID, and the key quoted
+	// as by strconv.Quote, for each matching put to the namespace, until the connection closes.
+	CmdTCPOnlySubscribe byte = 's'
 
 	// ResError is a Cmd
 	ResError byte = 'E'
@@ -44,21 +102,90 @@ var (
 	ErrInvalidPacketSizeTooLarge = errors.New("bad packet: too large, size must be 1500 bytes")
 	ErrInvalidCommandByte        = errors.New("bad packet: invalid command byte")
 	ErrProtocolSpace1            = errors.New("bad packet: expected space 1")
-	ErrProtocolSpace2            = errors.New("bad packet: expected space 1")
+	ErrProtocolSpace2            = errors.New("bad packet: expected space 2")
 	ErrProtocolSpace3            = errors.New("bad packet: expected space 3")
+	ErrProtocolSpace4            = errors.New("bad packet: expected space 4")
 	ErrBadHash                   = errors.New("auth failed: packet hash invalid")
 	ErrBadOutputSize             = errors.New("wrong data size during packet construction")
+	ErrMalformedPacket           = errors.New("bad packet: malformed")
+	ErrLineBreak                 = errors.New("bad packet: namespace or key contains a line break")
 )
 
 var StopSymbol = []byte("\n.\n")
 
+// MaxPutWeight is the most entries one CmdPutWeight can add, so a single packet can't fill a key's memory.
+const MaxPutWeight = 1000
+
+// LengthPrefixed is b after its uint16 length, so it can be read back exactly with ReadLengthPrefixed, rather
+// than trimmed of the padding along with any spaces it starts or ends with.
+func LengthPrefixed(b []byte) []byte {
+	out := make([]byte, 2, 2+len(b))
+	binary.LittleEndian.PutUint16(out, uint16(len(b)))
+	return append(out, b...)
+}
+
+// ReadLengthPrefixed returns the bytes of data made by LengthPrefixed, ignoring the padding after them.
+func ReadLengthPrefixed(data []byte) ([]byte, error) {
+	if len(data) < 2 {
+		return nil, ErrMalformedPacket
+	}
+	n := int(binary.LittleEndian.Uint16(data))
+	if len(data) < 2+n {
+		return nil, ErrMalformedPacket
+	}
+	return data[2 : 2+n], nil
+}
+
+// JoinQuoted is the items Go quoted, one per line. List responses are otherwise the items one per line, which
+// is ambiguous for keys containing line breaks, and can end the tcp response early at a StopSymbol in a key.
+func JoinQuoted(items []string) []byte {
+	var out []byte
+	for i, item := range items {
+		if i != 0 {
+			out = append(out, '\n')
+		}
+		out = strconv.AppendQuote(out, item)
+	}
+	return out
+}
+
+// SplitQuoted reads the items of a list made by JoinQuoted.
+func SplitQuoted(b []byte) ([]string, error) {
+	items := []string{}
+	if len(b) == 0 {
+		return items, nil
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		item, err := strconv.Unquote(line)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// CheckLineBreaks returns ErrLineBreak when the namespace or key has a \n or \r. Lists of keys and namespaces
+// are sent one per line, ending with StopSymbol over tcp, so a stored line break would split into other keys.
+func CheckLineBreaks(namespace, key string) error {
+	if strings.ContainsAny(namespace, "\r\n") || strings.ContainsAny(key, "\r\n") {
+		return ErrLineBreak
+	}
+	return nil
+}
+
 // IsRequestCmd indicates if the server should accept this as a command
 func IsRequestCmd(c byte) bool {
-	return c == CmdCount || c == CmdPut || c == CmdCountNamespace || c == CmdCountServer || c == CmdPutReplicate
+	return c == CmdCount || c == CmdPut || c == CmdCountNamespace || c == CmdCountServer || c == CmdPutReplicate || c == CmdPutReplicateAck ||
+		c == CmdSyncDigest || c == CmdSyncPull || c == CmdNamespaceInfo || c == CmdPing || c == CmdCountAt || c == CmdPutReplicateAt || c == CmdDelete || c == CmdDeleteReplicate ||
+		c == CmdCountKeys || c == CmdCountWeighted || c == CmdPutBytes || c == CmdCountBytes || c == CmdCompact || c == CmdGetReset ||
+		c == CmdPutWeight || c == CmdPutWeightReplicate || c == CmdGetTTL
 }
 
 func IsTcpOnlyCmd(c byte) bool {
-	return c == CmdTCPOnlyKeys || c == CmdTCPOnlyRetrieve || c == CmdTCPOnlyValues || c == CmdTCPOnlyStore || c == CmdTCPOnlyNamespaces
+	return c == CmdTCPOnlyKeys || c == CmdTCPOnlyRetrieve || c == CmdTCPOnlyValues || c == CmdTCPOnlyStore || c == CmdTCPOnlyNamespaces ||
+		c == CmdTCPOnlyTopKeys || c == CmdTCPOnlyKeysPage || c == CmdTCPOnlyNamespacesPage || c == CmdTCPOnlyKeysOpts || c == CmdTCPOnlyInfo || c == CmdTCPOnlyPeers ||
+		c == CmdTCPOnlySubscribe
 }
 
 // IsResponseCmd indicates if the client should accept this as a command
@@ -92,19 +219,40 @@ func NewPacketFromParts(command byte, messageID, namespace, dataValue, preShared
 		Command:        command,
 		MessageID:      Uint32FromBytes(messageID),
 		MessageIDBytes: messageID,
-		Namespace:      *PadRight(&namespace, NamespaceSize),
-		DataValue:      *PadRight(&dataValue, DataValueSize),
+		Namespace:      padField(namespace, NamespaceSize),
+		DataValue:      padField(dataValue, DataValueSize),
 	}
 	p.SetHash(preSharedKey)
 	return p
 }
 
 func (p *Packet) NamespaceString() string {
-	return strings.TrimSpace(string(p.Namespace))
+	return TrimPadding(p.Namespace)
 }
 
 func (p *Packet) DataValueString() string {
-	return strings.TrimSpace(string(p.DataValue))
+	return TrimPadding(p.DataValue)
+}
+
+// padField pads a namespace or data value to size. Values which start or end with whitespace are padded with
+// NUL bytes, so TrimPadding returns them exactly rather than merged with their trimmed form. Others keep the
+// space padding which servers and clients from before NUL padding expect.
+func padField(in []byte, size int) []byte {
+	if len(in) >= size || strings.TrimSpace(string(in)) == string(in) {
+		return *PadRight(&in, size)
+	}
+	out := make([]byte, size)
+	copy(out, in)
+	return out
+}
+
+// TrimPadding returns a namespace or data value without its padding. NUL padding is removed exactly, while
+// space padding is trimmed along with any other whitespace at either end, as it always was.
+func TrimPadding(b []byte) string {
+	if len(b) != 0 && b[len(b)-1] == 0 {
+		return string(bytes.TrimRight(b, "\x00"))
+	}
+	return strings.TrimSpace(string(b))
 }
 
 // ParsePacket parses a packet like:
@@ -127,6 +275,10 @@ func ParsePacket(buf []byte) (*Packet, error) {
 	hBytes := buf[spaceIndex1+1 : spaceIndex2]
 	idBytes := buf[spaceIndex2+1 : spaceIndex3]
 	nsBytes := buf[spaceIndex3+1 : spaceIndex4]
+	// the packet is untrusted input, so be sure the number readers get enough bytes rather than panic
+	if len(hBytes) != 8 || len(idBytes) != 4 || len(nsBytes) != NamespaceSize {
+		return nil, ErrInvalidPacketSizeTooSmall
+	}
 	// allows shorter packet to be turned into 1500 byte total packet
 	endAt := int(math.Min(float64(len(buf)), float64(PacketSize)))
 	messageIData := buf[spaceIndex4+1 : endAt]
@@ -152,20 +304,16 @@ func ParsePacket(buf []byte) (*Packet, error) {
 
 	// expected spaces at fixed spots
 	if buf[spaceIndex1] != space {
-		fmt.Println("packet space 1 was", buf[spaceIndex1], "instead of", space, "\n", buf)
-		return &p, ErrProtocolSpace1
+		return &p, spaceError(ErrProtocolSpace1, buf[spaceIndex1])
 	}
 	if buf[spaceIndex2] != space {
-		fmt.Println("packet space 2 was", buf[spaceIndex2], "instead of", space, "\n", buf)
-		return &p, ErrProtocolSpace2
+		return &p, spaceError(ErrProtocolSpace2, buf[spaceIndex2])
 	}
 	if buf[spaceIndex3] != space {
-		fmt.Println("packet space 3 was", buf[spaceIndex3], "instead of", space, "\n", buf)
-		return &p, ErrProtocolSpace3
+		return &p, spaceError(ErrProtocolSpace3, buf[spaceIndex3])
 	}
 	if buf[spaceIndex4] != space {
-		fmt.Println("packet space 4 was", buf[spaceIndex4], "instead of", space, "\n", buf)
-		return &p, ErrProtocolSpace3
+		return &p, spaceError(ErrProtocolSpace4, buf[spaceIndex4])
 	}
 
 	if len(buf) > PacketSize && !IsTcpOnlyCmd(p.Command) {
@@ -175,11 +323,29 @@ func ParsePacket(buf []byte) (*Packet, error) {
 	return &p, nil
 }
 
+// spaceError adds the byte found where a space was expected, which is usually enough to tell a
+// truncated or shifted packet from garbage.
+func spaceError(err error, found byte) error {
+	return fmt.Errorf("%w, found byte %d", err, found)
+}
+
+// ParsePacketSafe is ParsePacket for untrusted network input. It never panics, for input of any length
+// or content, returning ErrMalformedPacket in the unexpected case parsing fails in a way the other errors
+// do not describe. Like ParsePacket, a partially parsed packet may be returned along with an error, so
+// the sender can be answered with its message ID.
+func ParsePacketSafe(buf []byte) (p *Packet, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			p = nil
+			err = ErrMalformedPacket
+		}
+	}()
+	return ParsePacket(buf)
+}
+
 // bytes formats the packet for transport. The first 8 bytes are a header.
 // // The last byte should be a line break. The data is a UTF-8 string.
 func (p *Packet) bytes() []byte {
-	//fmt.Println("Bytes()       message id", p.MessageID, "|")
-	//fmt.Println("Bytes()       Namespace", p.Namespace, "|", len(p.Namespace))
 	if len(p.HashBytes) < 8 {
 		panic("Packet.Bytes() called before setting Packet hash!")
 	}
@@ -187,8 +353,8 @@ func (p *Packet) bytes() []byte {
 		panic("Packet.Bytes() called without MessageIDBytes!")
 	}
 
-	namespace := *PadRight(&p.Namespace, NamespaceSize)
-	dataValue := *PadRight(&p.DataValue, DataValueSize)
+	namespace := padField(p.Namespace, NamespaceSize)
+	dataValue := padField(p.DataValue, DataValueSize)
 
 	out := []byte{
 		p.Command,
@@ -210,7 +376,6 @@ func (p *Packet) bytes() []byte {
 func (p *Packet) Bytes() ([]byte, error) {
 	out := p.bytes()
 	if len(out) != PacketSize && !IsTcpOnlyCmd(p.Command) {
-		fmt.Println("packet size outputted was", len(out), string(p.Command))
 		return out, ErrBadOutputSize
 	}
 
@@ -221,7 +386,9 @@ func (p *Packet) Bytes() ([]byte, error) {
 func HashPacket(p *Packet, preSharedKey []byte) []byte {
 	hasher := xxhash.New64()
 	// omit the spaces and hash the Message ID, Namespace, and DataValue
-	bytesToHash := append(preSharedKey, p.MessageIDBytes...)
+	// the key is capped so appending copies it, rather than writing into the caller's spare capacity,
+	// which races when the same key is used to hash on several goroutines
+	bytesToHash := append(preSharedKey[:len(preSharedKey):len(preSharedKey)], p.MessageIDBytes...)
 	bytesToHash = append(bytesToHash, p.Namespace...)
 	bytesToHash = append(bytesToHash, p.DataValue...)
 	return hasher.Sum(bytesToHash)
@@ -229,22 +396,18 @@ func HashPacket(p *Packet, preSharedKey []byte) []byte {
 
 // SetHash puts the hash on a packet
 func (p *Packet) SetHash(preSharedKey []byte) {
-	// omit the spaces and hash the Message ID, Namespace, and DataValue
-	bytesToHash := append(preSharedKey, p.MessageIDBytes...)
-	bytesToHash = append(bytesToHash, p.Namespace...)
-	bytesToHash = append(bytesToHash, p.DataValue...)
 	p.HashBytes = HashPacket(p, preSharedKey)
 	p.Hash = Uint64FromBytes(p.HashBytes)
 }
 
-// Validate returns an error is the packet's hash does not authenticate against the preSharedKey.
-func (p *Packet) Validate(preSharedKey []byte) error {
-	expectedHash := Uint64FromBytes(HashPacket(p, preSharedKey))
-	if p.Hash != expectedHash {
-		fmt.Printf("packet hash fail, packet: %d, server: %d \n", p.Hash, expectedHash)
-		return ErrBadHash
+// Validate returns an error if the packet's hash does not authenticate against any of the preSharedKeys.
+func (p *Packet) Validate(preSharedKeys ...[]byte) error {
+	for _, preSharedKey := range preSharedKeys {
+		if p.Hash == Uint64FromBytes(HashPacket(p, preSharedKey)) {
+			return nil
+		}
 	}
-	return nil
+	return ErrBadHash
 }
 
 // PadRight adds char space to make buffer reach desired size. If `in` is larger
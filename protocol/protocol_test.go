@@ -1,9 +1,12 @@
 package protocol
 
 import (
+	"bytes"
 	"github.com/stretchr/testify/assert"
+	"math/rand"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestParseNewPacketEmptySecret(t *testing.T) {
@@ -102,3 +105,166 @@ func TestParsePacketSizeTooSmall(t *testing.T) {
 	assert.Error(t, ErrInvalidPacketSizeTooSmall)
 	assert.Nil(t, tinyPacket)
 }
+
+func TestParsePacketMissingSpace(t *testing.T) {
+	packet := NewPacket('C', 32837, "willy_nilly", "special.golang.org", "")
+	b, err := packet.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[15] = 'x' // the space after the message ID
+
+	_, err = ParsePacket(b)
+	assert.ErrorIs(t, err, ErrProtocolSpace3)
+	assert.Contains(t, err.Error(), "found byte 120")
+}
+
+func TestParsePacketRandomBytes(t *testing.T) {
+	// the server parses untrusted network input, which must never panic
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for i := 0; i < 10_000; i++ {
+		buf := make([]byte, r.Intn(PacketSize*2))
+		r.Read(buf)
+		if len(buf) > spaceIndex4 && i%2 == 0 {
+			// get past the command and space checks
+			buf[0] = CmdCount
+			buf[spaceIndex1], buf[spaceIndex2], buf[spaceIndex3], buf[spaceIndex4] = space, space, space, space
+		}
+		packet, err := ParsePacket(buf)
+		if err == nil {
+			assert.Len(t, packet.HashBytes, 8)
+			assert.Len(t, packet.MessageIDBytes, 4)
+			assert.Len(t, packet.Namespace, NamespaceSize)
+		}
+	}
+}
+
+func TestCommandBytesUnique(t *testing.T) {
+	// protocol is the only packet format, so a command byte can't mean something else to a peer
+	commands := map[string]byte{
+		"CmdCount":                 CmdCount,
+		"CmdPut":                   CmdPut,
+		"CmdPutReplicate":          CmdPutReplicate,
+		"CmdPutReplicateAck":       CmdPutReplicateAck,
+		"CmdCountNamespace":        CmdCountNamespace,
+		"CmdCountServer":           CmdCountServer,
+		"CmdNamespaceInfo":         CmdNamespaceInfo,
+		"CmdSyncDigest":            CmdSyncDigest,
+		"CmdSyncPull":              CmdSyncPull,
+		"CmdPing":                  CmdPing,
+		"CmdCountAt":               CmdCountAt,
+		"CmdPutReplicateAt":        CmdPutReplicateAt,
+		"CmdDelete":                CmdDelete,
+		"CmdDeleteReplicate":       CmdDeleteReplicate,
+		"CmdTCPOnlyKeys":           CmdTCPOnlyKeys,
+		"CmdTCPOnlyValues":         CmdTCPOnlyValues,
+		"CmdTCPOnlyStore":          CmdTCPOnlyStore,
+		"CmdTCPOnlyRetrieve":       CmdTCPOnlyRetrieve,
+		"CmdTCPOnlyNamespaces":     CmdTCPOnlyNamespaces,
+		"CmdTCPOnlyTopKeys":        CmdTCPOnlyTopKeys,
+		"CmdTCPOnlyKeysPage":       CmdTCPOnlyKeysPage,
+		"CmdTCPOnlyNamespacesPage": CmdTCPOnlyNamespacesPage,
+		"CmdTCPOnlyKeysOpts":       CmdTCPOnlyKeysOpts,
+		"CmdTCPOnlyInfo":           CmdTCPOnlyInfo,
+		"CmdTCPOnlyPeers":          CmdTCPOnlyPeers,
+		"CmdTCPOnlySubscribe":      CmdTCPOnlySubscribe,
+		"CmdCountKeys":             CmdCountKeys,
+		"CmdCountWeighted":         CmdCountWeighted,
+		"CmdPutBytes":              CmdPutBytes,
+		"CmdCountBytes":            CmdCountBytes,
+		"CmdCompact":               CmdCompact,
+		"CmdGetReset":              CmdGetReset,
+		"CmdPutWeight":             CmdPutWeight,
+		"CmdPutWeightReplicate":    CmdPutWeightReplicate,
+		"CmdGetTTL":                CmdGetTTL,
+		"ResError":                 ResError,
+	}
+	seen := make(map[byte]string)
+	for name, c := range commands {
+		if other, ok := seen[c]; ok {
+			t.Errorf("%s and %s are both %q", name, other, c)
+		}
+		seen[c] = name
+		assert.NotEqual(t, space, c, name)
+	}
+}
+
+func FuzzParsePacket(f *testing.F) {
+	valid, _ := NewPacket(CmdCount, 3321, "somebody", "key", "secret").Bytes()
+	f.Add(valid)
+	f.Add(valid[:spaceIndex4+2])
+	f.Add(append(valid, []byte("overflow")...))
+	f.Add([]byte{})
+	f.Add([]byte{'C', ' '})
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		packet, err := ParsePacketSafe(buf)
+		if err != nil {
+			return
+		}
+		// a parsed packet formats back to bytes which parse the same
+		out := packet.bytes()
+		reparsed, err := ParsePacketSafe(out)
+		if err != nil {
+			t.Fatalf("reparse failed: %v", err)
+		}
+		if reparsed.Hash != packet.Hash || reparsed.MessageID != packet.MessageID || reparsed.NamespaceString() != packet.NamespaceString() {
+			t.Fatalf("reparse differs: %+v %+v", packet, reparsed)
+		}
+	})
+}
+
+func TestCheckLineBreaks(t *testing.T) {
+	assert.NoError(t, CheckLineBreaks("ns", "key with spaces"))
+	assert.ErrorIs(t, CheckLineBreaks("ns", "first\nsecond"), ErrLineBreak)
+	assert.ErrorIs(t, CheckLineBreaks("ns", "first\rsecond"), ErrLineBreak)
+	assert.ErrorIs(t, CheckLineBreaks("ns"+string(StopSymbol), "key"), ErrLineBreak)
+}
+
+func TestJoinQuoted(t *testing.T) {
+	items := []string{"plain", "", "first\nsecond", "stop" + string(StopSymbol), "\xff\x00"}
+	b := JoinQuoted(items)
+	assert.NotContains(t, string(b), string(StopSymbol))
+	assert.Equal(t, 4, strings.Count(string(b), "\n"), "only the separators are line breaks")
+	split, err := SplitQuoted(b)
+	assert.NoError(t, err)
+	assert.Equal(t, items, split)
+
+	split, err = SplitQuoted(JoinQuoted(nil))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{}, split)
+	_, err = SplitQuoted([]byte("unquoted"))
+	assert.Error(t, err)
+}
+
+func TestLengthPrefixed(t *testing.T) {
+	key := []byte{' ', 0, '\n', 'k', ' '}
+	p := NewPacketFromParts(CmdPutBytes, Uint32ToBytes(1), []byte("ns"), LengthPrefixed(key), []byte("secret"))
+	b, err := p.Bytes()
+	assert.NoError(t, err)
+	parsed, err := ParsePacket(b)
+	assert.NoError(t, err)
+	read, err := ReadLengthPrefixed(parsed.DataValue)
+	assert.NoError(t, err)
+	assert.Equal(t, key, read)
+
+	_, err = ReadLengthPrefixed([]byte{5, 0, 'a'})
+	assert.ErrorIs(t, err, ErrMalformedPacket)
+	_, err = ReadLengthPrefixed(nil)
+	assert.ErrorIs(t, err, ErrMalformedPacket)
+}
+
+func TestTrimPadding(t *testing.T) {
+	for _, value := range []string{"alice", " alice ", "\talice", "", "a b"} {
+		b, err := NewPacket(CmdPut, 1, value, value, "secret").Bytes()
+		assert.NoError(t, err)
+		parsed, err := ParsePacket(b)
+		assert.NoError(t, err)
+		assert.Equal(t, value, parsed.NamespaceString())
+		assert.Equal(t, value, parsed.DataValueString())
+	}
+	// older clients pad with spaces, which trims any whitespace
+	legacy := append([]byte(" alice "), bytes.Repeat([]byte(" "), 10)...)
+	assert.Equal(t, "alice", TrimPadding(legacy))
+	padded := NewPacket(CmdPut, 1, "ns", "alice", "secret").DataValue
+	assert.Equal(t, byte(' '), padded[len(padded)-1], "keys without whitespace at their ends keep space padding")
+}
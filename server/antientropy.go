@@ -0,0 +1,155 @@
+package server
+
+import (
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mailsac/dracula/protocol"
+)
+
+// DefaultPeerSyncInterval is how often a server shares namespace digests with its peers. Syncing
+// walks the whole store, so it is kept infrequent.
+const DefaultPeerSyncInterval = 10 * time.Minute
+
+// SetPeerSyncInterval changes how often peers reconcile missing entries with each other. Zero disables
+// syncing. It must be called before Listen.
+func (s *Server) SetPeerSyncInterval(interval time.Duration) {
+	s.peerSyncInterval = interval
+}
+
+// syncPeersForever must run in its own thread.
+func (s *Server) syncPeersForever() {
+	for {
+		time.Sleep(s.peerSyncInterval)
+		if s.isDisposed() {
+			return
+		}
+		s.syncPeers()
+	}
+}
+
+// syncPeers is anti-entropy for replication. It sends the entry count of every namespace to each peer.
+// A peer with fewer entries in a namespace answers with a CmdSyncPull, and is then sent the count of
+// every key in the namespace, along with when the key's newest entry was put, so it can put what it is
+// missing. Like a replicated put, a heal from before the key was deleted on the peer is ignored.
+//
+// This only heals missing entries - it does not remove extra ones - and the healed entries
+// expire from the time they were healed rather than the time they were originally put.
+func (s *Server) syncPeers() {
+	if len(s.currentPeers()) == 0 {
+		return
+	}
+	for _, ns := range s.store.Namespaces() {
+		count := s.store.CountEntries(ns)
+		if count == 0 {
+			continue
+		}
+		peers := s.currentPeers()
+		for i := range peers {
+			s.sendSyncDigest(&peers[i], ns, "", count, 0)
+		}
+	}
+}
+
+// sendSyncDigest sends the count at a namespace key, or for the whole namespace when the key is empty. A
+// key's count is followed by the unix milliseconds its newest entry was put at, and a space, before the key.
+func (s *Server) sendSyncDigest(peer *net.UDPAddr, ns, entryKey string, count int, lastPutMillis int64) {
+	if count > math.MaxUint32 {
+		count = math.MaxUint32 // prevent overflow
+	}
+	if entryKey != "" {
+		entryKey = strconv.FormatInt(lastPutMillis, 10) + " " + entryKey
+		if 4+len(entryKey) > protocol.DataValueSize {
+			s.log.Println("server sync skipped key too long for a digest:", peer, ns, entryKey)
+			return
+		}
+	}
+	data := append(protocol.Uint32ToBytes(uint32(count)), []byte(entryKey)...)
+	packet := protocol.NewPacketFromParts(protocol.CmdSyncDigest, protocol.Uint32ToBytes(0), []byte(ns), data, s.signingKey())
+	s.respondOrLogError(peer, packet)
+}
+
+// maxSyncHealEntries is the most entries a key's digest can heal at once, so one packet can't fill a key's
+// memory. Healed keys are also capped by the store's max entries per key.
+const maxSyncHealEntries = protocol.MaxPutWeight
+
+// syncPullBatch key digests are sent at a time for a sync pull, pausing syncPullPause between batches so a
+// large namespace doesn't flood the peer's socket buffer and have its digests dropped.
+const (
+	syncPullBatch = 100
+	syncPullPause = 10 * time.Millisecond
+)
+
+// handleSyncDigest puts whatever entries are missing compared to a peer's digest. Digests from anything
+// other than a current peer are ignored.
+func (s *Server) handleSyncDigest(remote *net.UDPAddr, packet *protocol.Packet) {
+	if !s.isPeer(remote) {
+		s.log.Println("server ignored sync digest from non-peer:", remote)
+		return
+	}
+	ns := packet.NamespaceString()
+	// the count is binary and may contain whitespace bytes, so it can't be trimmed with the key
+	remoteCount := int(protocol.Uint32FromBytes(packet.DataValue[0:4]))
+	entryKey := protocol.TrimPadding(packet.DataValue[4:])
+
+	if entryKey == "" {
+		if s.store.CountEntries(ns) < remoteCount {
+			s.log.Println("server sync pulling namespace from peer:", remote, ns)
+			pull := protocol.NewPacketFromParts(protocol.CmdSyncPull, protocol.Uint32ToBytes(0), packet.Namespace, []byte{}, s.signingKey())
+			s.respondOrLogError(remote, pull)
+		}
+		return
+	}
+
+	parts := strings.SplitN(entryKey, " ", 2)
+	lastPutMillis, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || len(parts) != 2 {
+		s.errLog.Println("server error: malformed sync digest from", remote, ns, entryKey)
+		return
+	}
+	entryKey = parts[1]
+
+	missing := remoteCount - s.store.Count(ns, entryKey)
+	if missing <= 0 {
+		return
+	}
+	if missing > maxSyncHealEntries {
+		missing = maxSyncHealEntries
+	}
+	if !s.store.PutWeightAt(ns, entryKey, lastPutMillis, missing) {
+		s.log.Println("server ignored sync heal from before a delete:", remote, ns, entryKey)
+		return
+	}
+	s.log.Println("server sync healed missing entries from peer:", remote, ns, entryKey, missing)
+}
+
+// handleSyncPull sends a digest for every key in the namespace, in paced batches on another thread. Pulls
+// are sent one at a time, and ones from anything other than a current peer are ignored.
+func (s *Server) handleSyncPull(remote *net.UDPAddr, packet *protocol.Packet) {
+	if !s.isPeer(remote) {
+		s.log.Println("server ignored sync pull from non-peer:", remote)
+		return
+	}
+	ns := packet.NamespaceString()
+	go func() {
+		s.syncPullLock.Lock()
+		defer s.syncPullLock.Unlock()
+		entryKeys := s.store.KeyMatch(ns, "*")
+		for i, entryKey := range entryKeys {
+			if i > 0 && i%syncPullBatch == 0 {
+				time.Sleep(syncPullPause)
+				if s.isDisposed() {
+					return
+				}
+			}
+			count := s.store.Count(ns, entryKey)
+			if count == 0 {
+				continue
+			}
+			s.sendSyncDigest(remote, ns, entryKey, count, s.store.LastPutMillis(ns, entryKey))
+		}
+	}()
+}
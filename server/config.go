@@ -0,0 +1,288 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"reflect"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/mailsac/dracula/protocol"
+	"github.com/mailsac/dracula/store/tree"
+)
+
+var (
+	// ErrBadBindIP is when Config.BindIP is not an IP address
+	ErrBadBindIP = errors.New("dracula server bind ip is invalid")
+	// ErrBadMaxValueLen is when Config.MaxValueLen is larger than a packet's data region
+	ErrBadMaxValueLen = fmt.Errorf("dracula server max value length must be at most %d", protocol.DataValueSize)
+	// ErrUnknownSetting is when a config file has a key which is not a setting of Config
+	ErrUnknownSetting = errors.New("dracula server config file has an unknown setting")
+	// ErrBadSetting is when a config file's value does not suit its setting, such as a list for a number
+	ErrBadSetting = errors.New("dracula server config file has a bad setting")
+)
+
+// Config tunes how the server runs. Zero values are replaced with defaults.
+type Config struct {
+	// ExpireAfter is how long entries count before they expire, at least MinimumExpiryMillis. It is required
+	// by New, and like the other settings New reads before Configure, it is ignored by Configure, since the
+	// store is made with it.
+	ExpireAfter time.Duration
+	// PreSharedKeys authenticate packets, see SetPreSharedKeys. The default is an empty key. Only New reads it.
+	PreSharedKeys []string
+	// SelfPeer and PeerList enable cluster replication, like NewServerWithPeers. SelfPeer is the ip:port this
+	// server is addressed by, and PeerList is the comma-separated ip:port of the servers, which may include
+	// self. Only New reads them.
+	SelfPeer string
+	PeerList string
+	// CleanupInterval is how often entries of namespaces which are not being read are expired, see
+	// SetCleanupInterval. The default is the store's. Only New reads it.
+	CleanupInterval time.Duration
+	// BindIP is the local address the UDP and TCP listeners are bound to, such as an internal interface
+	// to keep dracula off a public one. The default is 0.0.0.0, every interface.
+	BindIP string
+	// Workers is how many goroutines process received UDP packets. The default is the number of CPUs plus one.
+	// More workers keep cheap commands flowing while others are busy with expensive ones like CountServer,
+	// at the cost of more context switching.
+	Workers int
+	// QueueSize is how many received UDP packets can wait for a worker. The default is the number of CPUs.
+	// When the queue is full the UDP read loop stalls and the OS drops datagrams, so a larger queue absorbs
+	// bursts, at the cost of memory and latency for the packets waiting in it.
+	QueueSize int
+	// QueueFullTimeout is how long a received UDP packet waits for room in a full queue before it is dropped and
+	// counted in dracula_udp_dropped_backpressure_total. Reads from the socket stall while it waits, so the OS
+	// drops datagrams unseen instead. Zero waits for room however long it takes, and negative drops straight away.
+	QueueFullTimeout time.Duration
+	// TCPWorkers is how many goroutines process received TCP messages. TCP has its own workers so a storm
+	// of UDP puts does not hold up slower TCP requests like KeyMatch, and vice versa. The default is the
+	// number of CPUs plus one.
+	TCPWorkers int
+	// TCPQueueSize is how many received TCP messages can wait for a worker. When it is full, connections
+	// stop being read until a worker frees up. The default is the number of CPUs.
+	TCPQueueSize int
+	// MaxEntriesPerKey caps how many entries a single key can hold, protecting memory from a client putting
+	// one key over and over. Once a key is at the cap the oldest entry is dropped on each put, so its count
+	// saturates at the cap. Zero means unlimited.
+	MaxEntriesPerKey int
+	// TCPIdleTimeout closes TCP connections which send nothing for this long, so abandoned connections do
+	// not hold a goroutine and socket forever. Zero never closes idle connections.
+	TCPIdleTimeout time.Duration
+	// TCPKeepAlive is the period of TCP keepalive probes, which detect peers that went away without
+	// closing the connection. Zero leaves the OS default, and negative disables keepalive.
+	TCPKeepAlive time.Duration
+	// MaxTCPConns limits how many TCP connections can be open at once, since each holds a goroutine and
+	// a file descriptor. Connections beyond it are sent an error and closed. Zero is unlimited.
+	MaxTCPConns int
+	// MaxSubscriptions limits how many subscriptions to puts can be open at once, since each holds a TCP
+	// connection and a goroutine. More are refused with a too_many_subscriptions error. The default is
+	// DefaultMaxSubscriptions.
+	MaxSubscriptions int
+	// FixedWindowNamespaces count in fixed windows instead of sliding ones, for quotas which reset at
+	// predictable times. Their entries expire together at the end of each wall clock window, which is the
+	// server's expiry long and aligned to the unix epoch, such as the top of each minute for 60 seconds.
+	FixedWindowNamespaces []string
+	// ExpensiveRateLimit is how many expensive commands per second each client IP can send, such as CountServer,
+	// CountNamespace, KeyMatch and listing namespaces, which walk a namespace or the whole store. Past it they get a rate_limited
+	// error, so one client looping over them can't tie up the workers. Cheap commands like Put and Count are
+	// never limited. Zero is unlimited.
+	ExpensiveRateLimit float64
+	// ExpensiveBurst is how many expensive commands a client IP can send at once before ExpensiveRateLimit
+	// applies. The default is ExpensiveRateLimit rounded up.
+	ExpensiveBurst int
+	// RequestTimeout abandons requests which are not handled within it of being received, such as ones which
+	// waited behind expensive commands for a worker, with a request_timed_out error. CountServer also stops
+	// counting once it passes. Zero never times out.
+	RequestTimeout time.Duration
+	// ReadOnly refuses puts, deletes and imports from clients with a read_only error, for replicas which only
+	// scale reads. Puts and deletes replicated from peers are still applied, so list the replica in the peers of
+	// the servers taking writes. Counts and key matches are served as usual.
+	ReadOnly bool
+	// MaxValueLen is the longest key, in bytes, which Put and Count accept. Longer ones get a value_too_long
+	// error, so a client sending keys which are too long finds out rather than having them cut short into
+	// another key. It can be at most, and defaults to, protocol.DataValueSize.
+	MaxValueLen int
+	// SlowThreshold logs every request whose handling takes longer than it, with its command, namespace,
+	// and key or pattern, and counts it in dracula_slow_operations_total. It catches clients calling expensive
+	// commands like CountServer in a loop. Zero disables it.
+	SlowThreshold time.Duration
+	// NamespaceMetricsInterval is how often the dracula_namespace_entries metric is refreshed with the entry
+	// count of the largest namespaces. Counting walks every namespace, so keep it infrequent. Zero disables it.
+	NamespaceMetricsInterval time.Duration
+	// NamespaceMetricsLimit is how many of the largest namespaces are in dracula_namespace_entries, since each
+	// namespace is its own series. The default is DefaultNamespaceMetricsLimit.
+	NamespaceMetricsLimit int
+	// Version and Build label the dracula_build_info metric. The default is "unknown".
+	Version string
+	Build   string
+	// Logger receives the server's logs, using its output, prefix and flags, instead of stdout. The server
+	// does not modify it. Errors are always logged to it, and debug logs only after DebugEnable.
+	Logger *log.Logger
+}
+
+// ConfigFromFile reads a config from a JSON object of settings named like the fields of Config, ignoring case,
+// such as {"ExpireAfter": "1m", "Workers": 8}. Durations are strings like "1m30s", lists are arrays of strings,
+// and other settings are plain JSON values. Logger can't be set from a file. Settings left out are zero, so
+// they get their defaults.
+func ConfigFromFile(path string) (Config, error) {
+	var conf Config
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return conf, err
+	}
+	var settings map[string]json.RawMessage
+	if err = json.Unmarshal(b, &settings); err != nil {
+		return conf, fmt.Errorf("%s: %w", path, err)
+	}
+	fields := reflect.ValueOf(&conf).Elem()
+	for name, raw := range settings {
+		field := fields.FieldByNameFunc(func(fieldName string) bool {
+			return strings.EqualFold(fieldName, name)
+		})
+		if !field.IsValid() || field.Type() == reflect.TypeOf(conf.Logger) {
+			return conf, fmt.Errorf("%s: %w: %q", path, ErrUnknownSetting, name)
+		}
+		if err = setField(field, raw); err != nil {
+			return conf, fmt.Errorf("%s: %w: %q: %v", path, ErrBadSetting, name, err)
+		}
+	}
+	return conf, nil
+}
+
+// setField decodes the JSON value into a Config field, which must be exactly the field's type. Numbers are
+// decoded as numbers, so a number in a string, or a fraction for a whole number, is refused.
+func setField(field reflect.Value, raw json.RawMessage) error {
+	if field.Type() == reflect.TypeOf(time.Duration(0)) {
+		var duration string
+		if err := json.Unmarshal(raw, &duration); err != nil {
+			return err
+		}
+		d, err := time.ParseDuration(duration)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+	value := reflect.New(field.Type())
+	if err := json.Unmarshal(raw, value.Interface()); err != nil {
+		return err
+	}
+	field.Set(value.Elem())
+	return nil
+}
+
+// withDefaults returns the config with zero values replaced by defaults
+func (c Config) withDefaults() Config {
+	if c.BindIP == "" {
+		c.BindIP = "0.0.0.0"
+	}
+	if c.Workers <= 0 {
+		c.Workers = runtime.NumCPU() + 1
+	}
+	if c.QueueSize <= 0 {
+		c.QueueSize = runtime.NumCPU()
+	}
+	if c.TCPWorkers <= 0 {
+		c.TCPWorkers = runtime.NumCPU() + 1
+	}
+	if c.TCPQueueSize <= 0 {
+		c.TCPQueueSize = runtime.NumCPU()
+	}
+	if c.Version == "" {
+		c.Version = "unknown"
+	}
+	if c.Build == "" {
+		c.Build = "unknown"
+	}
+	if c.ExpensiveRateLimit > 0 && c.ExpensiveBurst <= 0 {
+		c.ExpensiveBurst = int(math.Ceil(c.ExpensiveRateLimit))
+	}
+	if c.MaxSubscriptions <= 0 {
+		c.MaxSubscriptions = DefaultMaxSubscriptions
+	}
+	if c.MaxValueLen <= 0 {
+		c.MaxValueLen = protocol.DataValueSize
+	}
+	if c.NamespaceMetricsLimit <= 0 {
+		c.NamespaceMetricsLimit = DefaultNamespaceMetricsLimit
+	}
+	return c
+}
+
+// validate checks the settings Configure applies, once defaults are filled in
+func (c Config) validate() error {
+	if net.ParseIP(c.BindIP) == nil {
+		return fmt.Errorf("%w: %q", ErrBadBindIP, c.BindIP)
+	}
+	if c.MaxValueLen > protocol.DataValueSize {
+		return fmt.Errorf("%w: %d", ErrBadMaxValueLen, c.MaxValueLen)
+	}
+	return nil
+}
+
+// New makes a server from the config, returning an error for any invalid setting rather than panicking
+// like NewServer. ExpireAfter is required.
+func New(conf Config) (*Server, error) {
+	if conf.ExpireAfter < MinimumExpiryMillis*time.Millisecond {
+		return nil, ErrExpiryTooSmall
+	}
+	var self *net.UDPAddr
+	var peers []net.UDPAddr
+	if conf.SelfPeer != "" || conf.PeerList != "" {
+		var err error
+		if self, peers, err = parsePeers(conf.SelfPeer, conf.PeerList); err != nil {
+			return nil, err
+		}
+	}
+	if err := conf.withDefaults().validate(); err != nil {
+		return nil, err
+	}
+	s := newServer(conf.ExpireAfter.Milliseconds())
+	s.self = self
+	s.peers = peers
+	s.SetPreSharedKeys(conf.PreSharedKeys...)
+	if conf.CleanupInterval > 0 {
+		s.SetCleanupInterval(conf.CleanupInterval)
+	}
+	if err := s.Configure(conf); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Configure tunes the server. It must be called before Listen. The settings which only New reads, like
+// ExpireAfter and PeerList, are ignored.
+func (s *Server) Configure(conf Config) error {
+	if s.listening() {
+		return ErrServerAlreadyInit
+	}
+	conf = conf.withDefaults()
+	if err := conf.validate(); err != nil {
+		return err
+	}
+	s.conf = conf
+	s.store.SetMaxEntriesPerKey(s.conf.MaxEntriesPerKey)
+	s.rateLimiter = nil
+	if s.conf.ExpensiveRateLimit > 0 {
+		s.rateLimiter = newRateLimiter(s.conf.ExpensiveRateLimit, s.conf.ExpensiveBurst)
+	}
+	for _, ns := range s.conf.FixedWindowNamespaces {
+		s.store.SetWindowMode(ns, tree.WindowFixed)
+	}
+	if conf.Logger != nil {
+		debugging := s.log.Writer() != ioutil.Discard
+		s.log = log.New(conf.Logger.Writer(), conf.Logger.Prefix(), conf.Logger.Flags())
+		s.logOutput = conf.Logger.Writer()
+		s.errLog = conf.Logger
+		if !debugging {
+			s.DebugDisable()
+		}
+	}
+	return nil
+}
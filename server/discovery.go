@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// DefaultDiscoveryInterval is how often peers are resolved again when discovering them by DNS.
+const DefaultDiscoveryInterval = 30 * time.Second
+
+// ErrBadDiscoveryName is when the name to discover peers by is neither an SRV name nor a host:port.
+var ErrBadDiscoveryName = errors.New("dracula server discovery name must be an SRV name or host:port")
+
+// discovery finds peers by resolving a DNS name
+type discovery struct {
+	// name is an SRV record name when port is empty, otherwise a host with A or AAAA records
+	name     string
+	port     string
+	interval time.Duration
+	resolver *net.Resolver
+}
+
+// EnableDiscovery replaces the peers with the servers a DNS name resolves to, every interval, so the cluster
+// follows deployments which add and remove servers. The name is either an SRV record, like
+// _dracula._udp.example.com, which gives each server's host and port, or a host:port whose A or AAAA records
+// are servers all on that port. selfPeerHostPort is how this server is addressed, so it is left out of its
+// own peers. A zero interval is DefaultDiscoveryInterval. It must be called before Listen, which starts the
+// lookups.
+func (s *Server) EnableDiscovery(selfPeerHostPort, name string, interval time.Duration) error {
+	if s.listening() {
+		return ErrServerAlreadyInit
+	}
+	self, err := net.ResolveUDPAddr("udp", selfPeerHostPort)
+	if err != nil {
+		return fmt.Errorf("%w: %q: %v", ErrBadSelfPeer, selfPeerHostPort, err)
+	}
+	d := &discovery{name: name, interval: interval, resolver: net.DefaultResolver}
+	if host, port, err := net.SplitHostPort(name); err == nil {
+		if _, err := strconv.Atoi(port); err != nil || host == "" {
+			return fmt.Errorf("%w: %q", ErrBadDiscoveryName, name)
+		}
+		d.name, d.port = host, port
+	} else if name == "" {
+		return fmt.Errorf("%w: %q", ErrBadDiscoveryName, name)
+	}
+	if d.interval <= 0 {
+		d.interval = DefaultDiscoveryInterval
+	}
+	s.self = self
+	s.discovery = d
+	return nil
+}
+
+// discoverPeersForever must run in its own thread.
+func (s *Server) discoverPeersForever() {
+	for {
+		s.discoverPeers()
+		time.Sleep(s.discovery.interval)
+		if s.isDisposed() {
+			return
+		}
+	}
+}
+
+// discoverPeers resolves the peers and replaces them. A failed lookup keeps the current peers, so a DNS
+// outage does not stop replication.
+func (s *Server) discoverPeers() {
+	ctx, cancel := context.WithTimeout(context.Background(), s.discovery.interval)
+	defer cancel()
+	found, err := s.discovery.lookup(ctx)
+	if err != nil {
+		s.errLog.Println("server error: discovering peers", s.discovery.name, err)
+		return
+	}
+	var peers []net.UDPAddr
+	for i := range found {
+		if !s.isSelf(&found[i]) {
+			peers = append(peers, found[i])
+		}
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].String() < peers[j].String() })
+	if addrsString(peers) != s.Peers() {
+		s.log.Println("server discovered peers:", addrsString(peers))
+	}
+	s.setPeers(peers)
+}
+
+// lookup resolves the servers the name points to
+func (d *discovery) lookup(ctx context.Context) ([]net.UDPAddr, error) {
+	type target struct {
+		host string
+		port int
+	}
+	var targets []target
+	if d.port != "" {
+		port, _ := strconv.Atoi(d.port) // checked by EnableDiscovery
+		targets = append(targets, target{d.name, port})
+	} else {
+		_, srvs, err := d.resolver.LookupSRV(ctx, "", "", d.name)
+		if err != nil {
+			return nil, err
+		}
+		for _, srv := range srvs {
+			targets = append(targets, target{srv.Target, int(srv.Port)})
+		}
+	}
+
+	var addrs []net.UDPAddr
+	for _, t := range targets {
+		ips, err := d.resolver.LookupIPAddr(ctx, t.host)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			addrs = append(addrs, net.UDPAddr{IP: ip.IP, Port: t.port})
+		}
+	}
+	return addrs, nil
+}
+
+// addrsString is the addresses comma separated, like the peer list
+func addrsString(addrs []net.UDPAddr) string {
+	var out string
+	for i, a := range addrs {
+		if i != 0 {
+			out += ","
+		}
+		out += a.String()
+	}
+	return out
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/mailsac/dracula/protocol"
+)
+
+// ErrBadImportEntry is when an imported entry has a namespace or key which a put would refuse
+var ErrBadImportEntry = errors.New("dracula server import entry is invalid")
+
+// ExportEntry is one entry in the newline-delimited JSON export format
+type ExportEntry struct {
+	Namespace string `json:"namespace"`
+	Key       string `json:"key"`
+	// ExpireAt is the unix seconds when the entry expires
+	ExpireAt int64 `json:"expireAt"`
+}
+
+// ExportNDJSON writes every unexpired entry as one JSON ExportEntry per line.
+func (s *Server) ExportNDJSON(w io.Writer) error {
+	enc := json.NewEncoder(w) // each Encode ends with a newline
+	return s.store.EachNamespace(func(ns string, keys map[string][]int64) error {
+		for entryKey, expireAtSecs := range keys {
+			for _, expireAt := range expireAtSecs {
+				if err := enc.Encode(ExportEntry{Namespace: ns, Key: entryKey, ExpireAt: expireAt}); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// ImportNDJSON puts entries from JSON ExportEntry lines with their given expiry, returning how many were
+// imported. Entries which already expired are skipped. Imported entries are not replicated to peers. A server
+// with Config.ReadOnly refuses to import with ErrReadOnly. The import stops at the first entry which a put
+// would refuse, such as a key with a line break, with ErrBadImportEntry.
+func (s *Server) ImportNDJSON(r io.Reader) (imported int, err error) {
+	if s.conf.ReadOnly {
+		return 0, ErrReadOnly
+	}
+	dec := json.NewDecoder(r)
+	for {
+		var entry ExportEntry
+		err = dec.Decode(&entry)
+		if err == io.EOF {
+			return imported, nil
+		}
+		if err != nil {
+			return imported, err
+		}
+		if err = s.checkImportEntry(entry); err != nil {
+			return imported, err
+		}
+		if entry.ExpireAt <= time.Now().Unix() {
+			continue
+		}
+		s.store.PutExpireAt(entry.Namespace, entry.Key, entry.ExpireAt)
+		imported++
+	}
+}
+
+// checkImportEntry refuses entries which a put would, so an import can't store a key that splits the lists of
+// keys and namespaces into others.
+func (s *Server) checkImportEntry(entry ExportEntry) error {
+	if entry.Namespace == "" || entry.Key == "" {
+		return fmt.Errorf("%w: namespace and key are required", ErrBadImportEntry)
+	}
+	if len(entry.Namespace) > protocol.NamespaceSize {
+		return fmt.Errorf("%w: namespace %q is longer than %d bytes", ErrBadImportEntry, entry.Namespace, protocol.NamespaceSize)
+	}
+	if len(entry.Key) > s.conf.MaxValueLen {
+		return fmt.Errorf("%w: %s: %q", ErrBadImportEntry, ErrValueTooLong, entry.Key)
+	}
+	if err := protocol.CheckLineBreaks(entry.Namespace, entry.Key); err != nil {
+		return fmt.Errorf("%w: %s: %q", ErrBadImportEntry, err, entry.Key)
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package server
+
+import "time"
+
+// Info describes how a running server is configured, to tell servers in a cluster apart.
+type Info struct {
+	Version string `json:"version"`
+	Build   string `json:"build"`
+	// ExpireAfterSecs is rounded down, so it is 0 for an expiry under a second. See ExpireAfterMillis.
+	ExpireAfterSecs   int64 `json:"expireAfterSecs"`
+	ExpireAfterMillis int64 `json:"expireAfterMillis"`
+	// Peers is how many other servers puts are replicated to
+	Peers int `json:"peers"`
+	// Storage is where entries are kept. It is always "memory", since entries are only written to disk
+	// by an on demand snapshot or export.
+	Storage    string `json:"storage"`
+	UptimeSecs int64  `json:"uptimeSecs"`
+	// ReadOnly servers refuse puts from clients, see Config.ReadOnly
+	ReadOnly bool `json:"readOnly"`
+}
+
+// Info returns the server's version and configuration. It does not touch the store.
+func (s *Server) Info() Info {
+	info := Info{
+		Version:           s.conf.Version,
+		Build:             s.conf.Build,
+		ExpireAfterSecs:   s.expireAfterMillis / 1000,
+		ExpireAfterMillis: s.expireAfterMillis,
+		Peers:             len(s.currentPeers()),
+		Storage:           "memory",
+		ReadOnly:          s.conf.ReadOnly,
+	}
+	if !s.startedAt.IsZero() {
+		info.UptimeSecs = int64(time.Since(s.startedAt).Seconds())
+	}
+	return info
+}
@@ -0,0 +1,66 @@
+package server
+
+// keyExpiredQueueSize is how many expired keys can wait for the OnKeyExpired handler before more are dropped
+const keyExpiredQueueSize = 1024
+
+type expiredKey struct {
+	namespace string
+	key       string
+}
+
+// OnKeyExpired calls fn with each key whose last entries were removed by the periodic cleanup, such as a rate
+// limit bucket which cleared. Keys found expired when a request uses them are not reported, to keep it cheap,
+// so fn is not called for every key which expires. fn runs on its own goroutine, one key at a time, and when
+// it falls keyExpiredQueueSize keys behind more are dropped and counted in dracula_key_expired_dropped_total.
+// It replaces any earlier fn, and nil stops the calls. Every fn shares one queue and goroutine, so replacing
+// fn does not leave the earlier one's running.
+func (s *Server) OnKeyExpired(fn func(namespace, key string)) {
+	s.keyExpiredLock.Lock()
+	defer s.keyExpiredLock.Unlock()
+	s.keyExpiredFn = fn
+	if fn == nil {
+		s.store.SetOnKeyExpired(nil)
+		return
+	}
+	if s.keyExpiredQueue == nil {
+		queue := make(chan expiredKey, keyExpiredQueueSize)
+		s.keyExpiredQueue = queue
+		go s.notifyKeyExpiredForever(queue, s.callKeyExpired)
+	}
+	queue := s.keyExpiredQueue
+	s.store.SetOnKeyExpired(func(ns, entryKey string) {
+		s.queueExpiredKey(queue, expiredKey{namespace: ns, key: entryKey})
+	})
+}
+
+// callKeyExpired calls the current OnKeyExpired fn, skipping keys queued before it was set to nil
+func (s *Server) callKeyExpired(namespace, key string) {
+	s.keyExpiredLock.Lock()
+	fn := s.keyExpiredFn
+	s.keyExpiredLock.Unlock()
+	if fn != nil {
+		fn(namespace, key)
+	}
+}
+
+// queueExpiredKey queues the key for the handler, or drops it when the queue is full, so a slow handler
+// does not hold up the cleanup
+func (s *Server) queueExpiredKey(queue chan expiredKey, k expiredKey) {
+	select {
+	case queue <- k:
+	default:
+		s.metrics.keyExpiredDropped.Inc()
+	}
+}
+
+// notifyKeyExpiredForever must run in its own thread. It calls fn with the queued keys until the server closes.
+func (s *Server) notifyKeyExpiredForever(queue chan expiredKey, fn func(namespace, key string)) {
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case k := <-queue:
+			fn(k.namespace, k.key)
+		}
+	}
+}
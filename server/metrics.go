@@ -0,0 +1,159 @@
+package server
+
+import (
+	"sort"
+	"time"
+
+	"github.com/mailsac/dracula/protocol"
+	"github.com/mailsac/dracula/store"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultNamespaceMetricsLimit is how many namespaces get a dracula_namespace_entries series by default
+const DefaultNamespaceMetricsLimit = 20
+
+// serverMetrics are served alongside the store metrics
+type serverMetrics struct {
+	tcpConnections         prometheus.Gauge
+	tcpConnectionsRejected prometheus.Counter
+	udpReadErrors          prometheus.Counter
+	udpQueueFull           prometheus.Counter
+	udpDropped             prometheus.Counter
+	keyExpiredDropped      prometheus.Counter
+	subscriptionsDropped   prometheus.Counter
+	slowOperations         *prometheus.CounterVec
+	requestsTimedOut       prometheus.Counter
+	requestDuration        *prometheus.HistogramVec
+	namespaceEntries       *prometheus.GaugeVec
+	buildInfo              *prometheus.GaugeVec
+	startTime              prometheus.Gauge
+	// udpQueueLength and udpQueueCapacity read the udp queue, so they are made with it by registerUDPQueueMetrics
+	udpQueueLength   prometheus.GaugeFunc
+	udpQueueCapacity prometheus.GaugeFunc
+}
+
+func newServerMetrics(storeMetrics *store.Metrics) *serverMetrics {
+	m := &serverMetrics{
+		tcpConnections: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "dracula_tcp_connections",
+			Help: "Number of open TCP connections",
+		}),
+		tcpConnectionsRejected: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "dracula_tcp_connections_rejected_total",
+			Help: "Count of TCP connections rejected because the max connections were open",
+		}),
+		udpReadErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "dracula_udp_read_errors_total",
+			Help: "Count of failed reads from the UDP socket",
+		}),
+		udpQueueFull: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "dracula_udp_queue_full_total",
+			Help: "Count of received UDP packets which found the queue full, stalling reads from the socket until a worker freed up",
+		}),
+		udpDropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "dracula_udp_dropped_backpressure_total",
+			Help: "Count of received UDP packets dropped because the queue stayed full past the queue full timeout",
+		}),
+		keyExpiredDropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "dracula_key_expired_dropped_total",
+			Help: "Count of expired keys not passed to the OnKeyExpired handler because it fell behind",
+		}),
+		subscriptionsDropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "dracula_subscriptions_dropped_total",
+			Help: "Count of subscriptions closed because the subscriber fell too far behind the puts",
+		}),
+		slowOperations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dracula_slow_operations_total",
+			Help: "Count of requests which took longer than the slow threshold to handle, by command",
+		}, []string{"command"}),
+		requestsTimedOut: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "dracula_requests_timed_out_total",
+			Help: "Count of requests abandoned because they were not handled within the request timeout",
+		}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "dracula_request_duration_seconds",
+			Help:    "How long requests took to handle, including the store operation and the response, by command",
+			Buckets: prometheus.ExponentialBuckets(0.00001, 4, 10), // 10µs to about 2.6s
+		}, []string{"command"}),
+		namespaceEntries: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "dracula_namespace_entries",
+			Help: "Number of entries in the largest namespaces, as of the last refresh",
+		}, []string{"namespace"}),
+		buildInfo: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "dracula_build_info",
+			Help: "Always 1, labeled with the version and build of the running server",
+		}, []string{"version", "build"}),
+		startTime: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "dracula_start_time_seconds",
+			Help: "Unix time the server started listening",
+		}),
+	}
+	storeMetrics.MustRegister(m.tcpConnections, m.tcpConnectionsRejected, m.udpReadErrors, m.udpQueueFull, m.udpDropped, m.keyExpiredDropped, m.subscriptionsDropped, m.slowOperations, m.requestsTimedOut, m.requestDuration, m.namespaceEntries, m.buildInfo, m.startTime)
+	return m
+}
+
+// registerUDPQueueMetrics exports how full the udp queue is when scraped. The queue must already be made.
+func (s *Server) registerUDPQueueMetrics() {
+	queue := s.udpMessages
+	s.metrics.udpQueueLength = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "dracula_udp_queue_length",
+		Help: "Number of received UDP packets waiting for a worker",
+	}, func() float64 { return float64(len(queue)) })
+	s.metrics.udpQueueCapacity = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "dracula_udp_queue_capacity",
+		Help: "Number of received UDP packets which can wait for a worker before reads from the socket stall",
+	}, func() float64 { return float64(cap(queue)) })
+	s.StoreMetrics.MustRegister(s.metrics.udpQueueLength, s.metrics.udpQueueCapacity)
+}
+
+// observeRequest records how long the request took since started, and logs and counts it when it took longer
+// than Config.SlowThreshold
+func (s *Server) observeRequest(packet *protocol.Packet, started time.Time) {
+	took := time.Since(started)
+	s.metrics.requestDuration.WithLabelValues(string(packet.Command)).Observe(took.Seconds())
+	if s.conf.SlowThreshold <= 0 || took <= s.conf.SlowThreshold {
+		return
+	}
+	s.metrics.slowOperations.WithLabelValues(string(packet.Command)).Inc()
+	s.errLog.Println("server slow operation:", string(packet.Command), packet.NamespaceString(), packet.DataValueString(), took)
+}
+
+// refreshNamespaceMetricsForever must run in its own thread.
+func (s *Server) refreshNamespaceMetricsForever() {
+	for {
+		time.Sleep(s.conf.NamespaceMetricsInterval)
+		if s.isDisposed() {
+			return
+		}
+		s.refreshNamespaceMetrics()
+	}
+}
+
+// refreshNamespaceMetrics replaces the namespace entries metric with the largest namespaces. Smaller ones
+// are left out so the number of series stays bounded.
+func (s *Server) refreshNamespaceMetrics() {
+	type nsCount struct {
+		ns    string
+		count int
+	}
+	var counts []nsCount
+	for _, ns := range s.store.Namespaces() {
+		if count := s.store.CountEntries(ns); count > 0 {
+			counts = append(counts, nsCount{ns, count})
+		}
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].count != counts[j].count {
+			return counts[i].count > counts[j].count
+		}
+		return counts[i].ns < counts[j].ns
+	})
+	if len(counts) > s.conf.NamespaceMetricsLimit {
+		counts = counts[:s.conf.NamespaceMetricsLimit]
+	}
+
+	s.metrics.namespaceEntries.Reset()
+	for _, c := range counts {
+		s.metrics.namespaceEntries.WithLabelValues(c.ns).Set(float64(c.count))
+	}
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/mailsac/dracula/protocol"
+)
+
+// rateLimitCleanupInterval is how often buckets of addresses which stopped sending are dropped
+const rateLimitCleanupInterval = time.Minute
+
+// ErrRateLimited is the error response when an address sends expensive commands faster than
+// Config.ExpensiveRateLimit. Clients match its text, so it must not change.
+var ErrRateLimited = errors.New("rate_limited")
+
+// isExpensiveCmd is true for commands which walk a whole namespace or the whole store. Listing namespaces
+// counts, since it runs a cleanup pass over the store first.
+func isExpensiveCmd(c byte) bool {
+	switch c {
+	case protocol.CmdCountServer, protocol.CmdCountNamespace, protocol.CmdCountKeys, protocol.CmdTCPOnlyKeys, protocol.CmdTCPOnlyKeysOpts,
+		protocol.CmdTCPOnlyKeysPage, protocol.CmdTCPOnlyTopKeys, protocol.CmdCompact, protocol.CmdTCPOnlyNamespaces,
+		protocol.CmdTCPOnlyNamespacesPage:
+		return true
+	}
+	return false
+}
+
+// bucket is a token bucket, refilled lazily from the time it was last taken from
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a token bucket for each remote IP. Ports are ignored, since each tcp connection and
+// many udp sockets of one client get their own.
+type rateLimiter struct {
+	lock    sync.Mutex
+	rate    float64 // tokens per second
+	burst   float64
+	buckets map[string]*bucket
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*bucket)}
+}
+
+// allow takes a token from the address's bucket, and is false when it has none
+func (r *rateLimiter) allow(addr string, now time.Time) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	b, ok := r.buckets[addr]
+	if !ok {
+		b = &bucket{tokens: r.burst, last: now}
+		r.buckets[addr] = b
+	}
+	b.tokens = math.Min(r.burst, b.tokens+now.Sub(b.last).Seconds()*r.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// cleanup drops the buckets which have refilled, since a new bucket starts full anyway
+func (r *rateLimiter) cleanup(now time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for addr, b := range r.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*r.rate >= r.burst {
+			delete(r.buckets, addr)
+		}
+	}
+}
+
+// cleanupRateLimitsForever must run in its own thread.
+func (s *Server) cleanupRateLimitsForever() {
+	for {
+		time.Sleep(rateLimitCleanupInterval)
+		if s.isDisposed() {
+			return
+		}
+		s.rateLimiter.cleanup(time.Now())
+	}
+}
@@ -3,10 +3,13 @@ package rawmessage
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"github.com/mailsac/dracula/protocol"
 	"io"
 	"log"
 	"net"
+	"sync"
+	"time"
 	"unicode"
 )
 
@@ -14,18 +17,116 @@ type RawMessage struct {
 	Message        []byte
 	Remote         *net.UDPAddr
 	MaybeTcpClient *net.TCPConn
+	pooled         bool
+	// ctx is done once handling the message should be abandoned, see SetContext
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
-// ReadOneTcpMessage can be used for the client or server
+// SetContext derives the message's context from parent, with a timeout from now unless it is zero. Set it
+// when the message is received, so time spent waiting for a worker counts toward the timeout.
+func (m *RawMessage) SetContext(parent context.Context, timeout time.Duration) {
+	if timeout > 0 {
+		m.ctx, m.cancel = context.WithTimeout(parent, timeout)
+		return
+	}
+	m.ctx, m.cancel = context.WithCancel(parent)
+}
+
+// Context is done once handling the message should be abandoned. It is never done when SetContext was
+// not called.
+func (m *RawMessage) Context() context.Context {
+	if m.ctx == nil {
+		return context.Background()
+	}
+	return m.ctx
+}
+
+// buffers recycles packet sized message buffers, to cut garbage collection under high packet rates
+var buffers = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, protocol.PacketSize)
+	},
+}
+
+// NewPooled returns a message with a packet sized buffer from a pool. Release must be called once
+// nothing references the buffer, or any packet parsed from it, so the buffer can be reused.
+func NewPooled() *RawMessage {
+	return &RawMessage{Message: buffers.Get().([]byte), pooled: true}
+}
+
+// ClearAfter zeroes the message after the first n bytes, so a short read does not leave the
+// previous message's bytes in a reused buffer.
+func (m *RawMessage) ClearAfter(n int) {
+	for i := n; i < len(m.Message); i++ {
+		m.Message[i] = 0
+	}
+}
+
+// Release returns a pooled message buffer for reuse, and cancels the message's context.
+func (m *RawMessage) Release() {
+	if m.cancel != nil {
+		m.cancel()
+		m.cancel = nil
+	}
+	if !m.pooled {
+		return
+	}
+	m.pooled = false
+	buffers.Put(m.Message[:protocol.PacketSize])
+	m.Message = nil
+}
+
+// ReadOneTcpMessage can be used for the client or server. Anything read past the message is lost, so use a
+// TcpReader on connections where messages can be sent back to back.
 func ReadOneTcpMessage(l *log.Logger, sendToChannel chan *RawMessage, conn *net.TCPConn) error {
-	reader := bufio.NewReader(conn)
+	return NewTcpReader(conn).ReadOne(l, sendToChannel)
+}
+
+// TcpReader reads messages from a tcp connection. It keeps what it read past the end of a message for the
+// next one, so messages sent back to back, like pipelined requests, are not lost.
+type TcpReader struct {
+	conn   *net.TCPConn
+	reader *bufio.Reader
+}
+
+func NewTcpReader(conn *net.TCPConn) *TcpReader {
+	return &TcpReader{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// ReadOne reads the next message and sends it to the channel.
+func (r *TcpReader) ReadOne(l *log.Logger, sendToChannel chan *RawMessage) error {
+	m, err := r.ReadRaw(l)
+	if err != nil {
+		return err
+	}
+	sendToChannel <- m
+	return nil
+}
+
+// ReadRaw reads the next message, with the connection it came from.
+func (r *TcpReader) ReadRaw(l *log.Logger) (*RawMessage, error) {
+	message, err := r.ReadMessage(l)
+	if err != nil {
+		return nil, err
+	}
+	tcpAddr := r.conn.RemoteAddr().(*net.TCPAddr)
+	return &RawMessage{
+		Message:        message,
+		Remote:         &net.UDPAddr{IP: tcpAddr.IP, Port: tcpAddr.Port},
+		MaybeTcpClient: r.conn,
+	}, nil
+}
+
+// ReadMessage reads the next message, without the stop symbol, padded to the packet size.
+func (r *TcpReader) ReadMessage(l *log.Logger) ([]byte, error) {
 	// read lines until full Message is buffered - buffer lives only in this loop
-	message, err := reader.ReadBytes('\n')
+	message, err := r.reader.ReadBytes('\n')
 	if err != nil {
 		if err != io.EOF {
-			l.Println("ReadOneTcpMessage TCP ReadBytes error:", err, conn.RemoteAddr())
+			l.Println("ReadOneTcpMessage TCP ReadBytes error:", err, r.conn.RemoteAddr())
 		}
-		return err
+		return nil, err
 	}
 
 	// remove spaces and line breaks from the front
@@ -34,10 +135,11 @@ func ReadOneTcpMessage(l *log.Logger, sendToChannel chan *RawMessage, conn *net.
 	// Check if the Message ends with stop symbol i.e., it's a complete Message.
 	// If not, keep reading until we find a complete Message.
 	for !bytes.HasSuffix(message, protocol.StopSymbol) {
-		line, err := reader.ReadBytes('\n')
+		line, err := r.reader.ReadBytes('\n')
 		if err != nil {
+			// the message is incomplete, so there is nothing to pass on
 			l.Println("ReadOneTcpMessage TCP ReadBytes to fill buf error:", err)
-			break
+			return nil, err
 		}
 		message = append(message, line...)
 	}
@@ -45,13 +147,5 @@ func ReadOneTcpMessage(l *log.Logger, sendToChannel chan *RawMessage, conn *net.
 	// now remove stop symbol
 	message = message[0 : len(message)-len(protocol.StopSymbol)]
 	message = bytes.TrimRightFunc(message, unicode.IsSpace)
-	message = *protocol.PadRight(&message, protocol.PacketSize)
-
-	tcpAddr := conn.RemoteAddr().(*net.TCPAddr)
-	sendToChannel <- &RawMessage{
-		Message:        message,
-		Remote:         &net.UDPAddr{IP: tcpAddr.IP, Port: tcpAddr.Port},
-		MaybeTcpClient: conn,
-	}
-	return nil
+	return *protocol.PadRight(&message, protocol.PacketSize), nil
 }
@@ -0,0 +1,96 @@
+package rawmessage
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mailsac/dracula/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRawMessage_Release(t *testing.T) {
+	m := NewPooled()
+	assert.Len(t, m.Message, protocol.PacketSize)
+	m.Message[protocol.PacketSize-1] = 'x'
+	m.ClearAfter(protocol.PacketSize - 1)
+	assert.Equal(t, byte(0), m.Message[protocol.PacketSize-1])
+
+	m.Release()
+	assert.Nil(t, m.Message)
+	m.Release() // twice is harmless
+
+	unpooled := &RawMessage{Message: []byte("tcp")}
+	unpooled.Release()
+	assert.Equal(t, []byte("tcp"), unpooled.Message, "only pooled buffers are recycled")
+}
+
+func TestRawMessage_Context(t *testing.T) {
+	m := NewPooled()
+	assert.NoError(t, m.Context().Err(), "never done without SetContext")
+	m.Release()
+
+	m = NewPooled()
+	m.SetContext(context.Background(), time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	assert.ErrorIs(t, m.Context().Err(), context.DeadlineExceeded)
+
+	m = NewPooled()
+	m.SetContext(context.Background(), 0)
+	ctx := m.Context()
+	assert.NoError(t, ctx.Err())
+	m.Release()
+	assert.ErrorIs(t, ctx.Err(), context.Canceled, "released messages are cancelled")
+}
+
+func TestTcpReader_BackToBack(t *testing.T) {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// both messages in one write, so they arrive in one read
+		conn.Write([]byte("first\n.\nsecond\n.\n"))
+	}()
+	conn, err := listener.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	l := log.New(ioutil.Discard, "", 0)
+	reader := NewTcpReader(conn)
+	first, err := reader.ReadMessage(l)
+	assert.NoError(t, err)
+	assert.Equal(t, "first", string(first[:5]))
+	assert.Len(t, first, protocol.PacketSize)
+	second, err := reader.ReadMessage(l)
+	assert.NoError(t, err)
+	assert.Equal(t, "second", string(second[:6]))
+}
+
+var sink *RawMessage
+
+func BenchmarkRawMessage_alloc(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		sink = &RawMessage{Message: make([]byte, protocol.PacketSize)}
+	}
+}
+
+func BenchmarkRawMessage_pooled(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		sink = NewPooled()
+		sink.Release()
+	}
+}
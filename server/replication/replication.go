@@ -0,0 +1,157 @@
+package replication
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// key identifies a replicated packet by the peer it was exchanged with and its message ID.
+type key struct {
+	peer      string
+	messageID uint32
+}
+
+// Pending is a replicated packet which was sent to a peer but has not been acknowledged.
+type Pending struct {
+	Peer      *net.UDPAddr
+	MessageID uint32
+	Packet    []byte
+	Attempts  int
+	sentAt    time.Time
+}
+
+// Outstanding tracks replications sent to peers which are waiting for an ack. It is the server side
+// equivalent of the client's waitingmessage cache, except that entries which time out are retried
+// rather than failed.
+type Outstanding struct {
+	sync.Mutex
+	pending    map[key]*Pending
+	timeout    time.Duration
+	maxRetries int
+	// unreachable are peers whose latest replication was dropped, until they ack one
+	unreachable map[string]bool
+}
+
+// NewOutstanding makes a tracker where a replication is resent when no ack arrives within timeout,
+// up to maxRetries times after the first attempt.
+func NewOutstanding(timeout time.Duration, maxRetries int) *Outstanding {
+	return &Outstanding{
+		pending:     make(map[key]*Pending),
+		timeout:     timeout,
+		maxRetries:  maxRetries,
+		unreachable: make(map[string]bool),
+	}
+}
+
+// Add starts tracking a replication packet which was just sent to peer.
+func (o *Outstanding) Add(peer *net.UDPAddr, messageID uint32, packet []byte) {
+	o.Lock()
+	defer o.Unlock()
+	o.pending[key{peer: peer.String(), messageID: messageID}] = &Pending{
+		Peer:      peer,
+		MessageID: messageID,
+		Packet:    packet,
+		Attempts:  1,
+		sentAt:    time.Now(),
+	}
+}
+
+// Ack stops tracking the replication, returning false if it was not being tracked.
+func (o *Outstanding) Ack(peer *net.UDPAddr, messageID uint32) bool {
+	o.Lock()
+	defer o.Unlock()
+	k := key{peer: peer.String(), messageID: messageID}
+	if _, exists := o.pending[k]; !exists {
+		return false
+	}
+	delete(o.pending, k)
+	delete(o.unreachable, k.peer)
+	return true
+}
+
+// Due returns the replications which went unacknowledged past the timeout. Those in `retry` should
+// be resent, and are considered sent again. Those in `dropped` used up all their retries and are
+// no longer tracked.
+func (o *Outstanding) Due() (retry, dropped []Pending) {
+	o.Lock()
+	defer o.Unlock()
+	now := time.Now()
+	for k, p := range o.pending {
+		if now.Sub(p.sentAt) < o.timeout {
+			continue
+		}
+		if p.Attempts > o.maxRetries {
+			delete(o.pending, k)
+			o.unreachable[k.peer] = true
+			dropped = append(dropped, *p)
+			continue
+		}
+		p.Attempts++
+		p.sentAt = now
+		retry = append(retry, *p)
+	}
+	return retry, dropped
+}
+
+// Len returns the number of replications waiting for an ack.
+func (o *Outstanding) Len() int {
+	o.Lock()
+	defer o.Unlock()
+	return len(o.pending)
+}
+
+// Unreachable returns the peers which did not ack their latest replication after every retry, sorted.
+// A peer is reachable again once it acks one. Peers which were not sent anything are not included.
+func (o *Outstanding) Unreachable() []string {
+	o.Lock()
+	defer o.Unlock()
+	peers := make([]string, 0, len(o.unreachable))
+	for peer := range o.unreachable {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+// Received remembers which replications arrived recently, so a retried replication whose ack was
+// lost is not counted twice.
+type Received struct {
+	sync.Mutex
+	seen        map[key]time.Time
+	rememberFor time.Duration
+	lastCleanup time.Time
+}
+
+// NewReceived makes a tracker which remembers replications for the rememberFor duration. It
+// should be longer than the time a sender will spend retrying.
+func NewReceived(rememberFor time.Duration) *Received {
+	return &Received{
+		seen:        make(map[key]time.Time),
+		rememberFor: rememberFor,
+		lastCleanup: time.Now(),
+	}
+}
+
+// First returns true when this is the first time the replication from peer arrived.
+func (r *Received) First(peer *net.UDPAddr, messageID uint32) bool {
+	r.Lock()
+	defer r.Unlock()
+	now := time.Now()
+	if now.Sub(r.lastCleanup) > r.rememberFor {
+		for k, at := range r.seen {
+			if now.Sub(at) > r.rememberFor {
+				delete(r.seen, k)
+			}
+		}
+		r.lastCleanup = now
+	}
+
+	k := key{peer: peer.String(), messageID: messageID}
+	if at, exists := r.seen[k]; exists && now.Sub(at) <= r.rememberFor {
+		return false
+	}
+	r.seen[k] = now
+	return true
+}
@@ -1,9 +1,15 @@
 package server
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"strings"
+	"time"
+
+	"github.com/mailsac/dracula/protocol"
 )
 
 type BaseResponse struct {
@@ -19,6 +25,17 @@ type ListResponse struct {
 	List []string `json:"list"`
 }
 
+type HealthResponse struct {
+	Status     string `json:"status"`
+	UptimeSecs int64  `json:"uptimeSecs"`
+	Store      string `json:"store"`
+	// UnreachablePeers did not ack their latest replication, see replication.Outstanding.Unreachable
+	UnreachablePeers []string `json:"unreachablePeers,omitempty"`
+}
+
+// storeCheckTimeout is how long the store has to answer a health check before it is considered unresponsive
+const storeCheckTimeout = time.Second
+
 func MethodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusMethodNotAllowed)
 	resp := BaseResponse{Message: "Method not allowed", Details: r.Method + " " + r.URL.Path}
@@ -32,7 +49,7 @@ func NotMatchedHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func GetBaseHandler(s *Server, w http.ResponseWriter, r *http.Request) {
-	resp := BaseResponse{Message: "OK", Details: "Dracula rest server - Routes:  GET /namespaces, GET /count, GET /put"}
+	resp := BaseResponse{Message: "OK", Details: "Dracula rest server - Routes:  GET /namespaces, GET /count, GET /put, GET /snapshot, GET /export, POST /import, GET /healthz, GET /readyz, GET /info"}
 	json.NewEncoder(w).Encode(resp)
 }
 
@@ -61,7 +78,26 @@ func PutHandler(s *Server, w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(resp)
 		return
 	}
+	if s.conf.ReadOnly {
+		w.WriteHeader(http.StatusForbidden)
+		resp := BaseResponse{Message: "Forbidden", Details: ErrReadOnly.Error()}
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+	if len(key) > s.conf.MaxValueLen {
+		w.WriteHeader(http.StatusBadRequest)
+		resp := BaseResponse{Message: "Bad request", Details: ErrValueTooLong.Error()}
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+	if err := protocol.CheckLineBreaks(namespace, key); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		resp := BaseResponse{Message: "Bad request", Details: err.Error()}
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
 	s.store.Put(namespace, key)
+	s.publishPut(namespace, key)
 	count := s.store.Count(namespace, key)
 	resp := CountResponse{Count: count}
 	json.NewEncoder(w).Encode(resp)
@@ -73,6 +109,120 @@ func NamespacesHandler(s *Server, w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(resp)
 }
 
+func SnapshotHandler(s *Server, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"dracula.snapshot\"")
+	if err := s.Snapshot(w); err != nil {
+		// headers were already sent, so the best that can be done is a truncated snapshot which fails to restore
+		s.log.Println("server error: writing snapshot", err)
+	}
+}
+
+func ExportHandler(s *Server, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	if err := s.ExportNDJSON(w); err != nil {
+		s.log.Println("server error: writing export", err)
+	}
+}
+
+func ImportHandler(s *Server, w http.ResponseWriter, r *http.Request) {
+	imported, err := s.ImportNDJSON(r.Body)
+	if errors.Is(err, ErrReadOnly) {
+		w.WriteHeader(http.StatusForbidden)
+		resp := BaseResponse{Message: "Forbidden", Details: ErrReadOnly.Error()}
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		resp := BaseResponse{Message: "Bad request", Details: fmt.Sprintf("imported %d entries before error: %s", imported, err)}
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+	resp := CountResponse{Count: imported}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// health checks the listeners are up and the store answers. Peers are only checked for readiness.
+func (s *Server) health(checkPeers bool) (resp HealthResponse, ok bool) {
+	ok = s.listening() && !s.isDisposed()
+	if !s.startedAt.IsZero() {
+		resp.UptimeSecs = int64(time.Since(s.startedAt).Seconds())
+	}
+
+	// the store answering at all shows it is not stuck behind a lock
+	answered := make(chan struct{})
+	go func() {
+		s.store.CountKeys("")
+		close(answered)
+	}()
+	select {
+	case <-answered:
+		resp.Store = "ok"
+	case <-time.After(storeCheckTimeout):
+		resp.Store = "unresponsive"
+		ok = false
+	}
+
+	if checkPeers && s.replicationsOutstanding != nil {
+		resp.UnreachablePeers = s.replicationsOutstanding.Unreachable()
+		if len(resp.UnreachablePeers) > 0 {
+			ok = false
+		}
+	}
+
+	resp.Status = "ok"
+	if !ok {
+		resp.Status = "unavailable"
+	}
+	return resp, ok
+}
+
+func healthHandler(s *Server, w http.ResponseWriter, checkPeers bool) {
+	resp, ok := s.health(checkPeers)
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// HealthzHandler is for liveness probes. It fails when the listeners are closed or the store is stuck.
+func HealthzHandler(s *Server, w http.ResponseWriter, r *http.Request) {
+	healthHandler(s, w, false)
+}
+
+// ReadyzHandler is for readiness probes. In a cluster it also fails while a peer is not acking replications.
+func ReadyzHandler(s *Server, w http.ResponseWriter, r *http.Request) {
+	healthHandler(s, w, true)
+}
+
+// InfoHandler responds with the server's version and configuration, see Server.Info
+// InfoHandler requires the pre-shared key as a bearer token, since the info describes the server's
+// configuration. A server without a key, like an unauthenticated TCP or UDP request, needs no token.
+func InfoHandler(s *Server, w http.ResponseWriter, r *http.Request) {
+	if !s.authorizedHTTP(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		resp := BaseResponse{Message: "Unauthorized", Details: "the pre-shared key is required as an Authorization: Bearer token"}
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+	json.NewEncoder(w).Encode(s.Info())
+}
+
+// authorizedHTTP returns true when the request's bearer token is one of the pre-shared keys, or when the
+// server accepts an empty key
+func (s *Server) authorizedHTTP(r *http.Request) bool {
+	header := r.Header.Get("Authorization")
+	token := strings.TrimPrefix(header, "Bearer ")
+	bearer := token != header
+	for _, key := range s.validKeys() {
+		if len(key) == 0 || (bearer && subtle.ConstantTimeCompare([]byte(token), key) == 1) {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *Server) restServer(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
@@ -107,6 +257,48 @@ func (s *Server) restServer(w http.ResponseWriter, r *http.Request) {
 		default:
 			MethodNotAllowedHandler(w, r)
 		}
+	case "/snapshot":
+		switch r.Method {
+		case http.MethodGet:
+			SnapshotHandler(s, w, r)
+		default:
+			MethodNotAllowedHandler(w, r)
+		}
+	case "/export":
+		switch r.Method {
+		case http.MethodGet:
+			ExportHandler(s, w, r)
+		default:
+			MethodNotAllowedHandler(w, r)
+		}
+	case "/import":
+		switch r.Method {
+		case http.MethodPost:
+			ImportHandler(s, w, r)
+		default:
+			MethodNotAllowedHandler(w, r)
+		}
+	case "/healthz":
+		switch r.Method {
+		case http.MethodGet:
+			HealthzHandler(s, w, r)
+		default:
+			MethodNotAllowedHandler(w, r)
+		}
+	case "/readyz":
+		switch r.Method {
+		case http.MethodGet:
+			ReadyzHandler(s, w, r)
+		default:
+			MethodNotAllowedHandler(w, r)
+		}
+	case "/info":
+		switch r.Method {
+		case http.MethodGet:
+			InfoHandler(s, w, r)
+		default:
+			MethodNotAllowedHandler(w, r)
+		}
 	default:
 		NotMatchedHandler(w, r)
 	}
@@ -1,47 +1,166 @@
 package server
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"math"
 	"net"
 	"net/http"
 	"os"
-	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/mailsac/dracula/protocol"
 	"github.com/mailsac/dracula/server/rawmessage"
+	"github.com/mailsac/dracula/server/replication"
 	"github.com/mailsac/dracula/store"
+	"github.com/mailsac/dracula/store/tree"
 )
 
-const MinimumExpirySecs = 2
+const (
+	MinimumExpirySecs = 2
+	// MinimumExpiryMillis is the shortest expiry NewServerMillis allows, for sliding windows under a second.
+	MinimumExpiryMillis = 100
+
+	// ReplicationAckTimeout is how long to wait for a peer to ack a replicated put before resending it.
+	ReplicationAckTimeout = 500 * time.Millisecond
+	// ReplicationMaxRetries is how many times a replicated put is resent to a peer which does not ack it.
+	ReplicationMaxRetries = 3
+
+	// MaxTopKeys is the most keys a TopKeys request can return, to keep responses small.
+	MaxTopKeys = 100
+	// MaxPageSize is the most keys or namespaces a page request can return, to keep responses small.
+	MaxPageSize = 1000
+)
 
 var (
-	// ErrExpiryTooSmall means the server was attempted to be initialized with less than MinimumExpirySecs.
+	// ErrExpiryTooSmall means the server was attempted to be initialized with less than MinimumExpirySecs,
+	// or MinimumExpiryMillis.
 	// Values smaller than this are unreliable so they are not allowed.
 	ErrExpiryTooSmall    = errors.New("dracula server expiry is too short")
 	ErrServerAlreadyInit = errors.New("dracula server already initialized")
 	ErrBadPeersFormat    = errors.New("dracula server peers must be comma separated string of ipaddress:port")
+	ErrBadSelfPeer       = errors.New("dracula server self peer does not resolve")
+	ErrNoPeers           = errors.New("dracula server peer list has no peers besides self")
+	ErrPeerIsSelf        = errors.New("dracula server can't be its own peer")
+	ErrPeerNotFound      = errors.New("dracula server does not have the peer")
+	ErrTooManyTCPConns   = errors.New("dracula server has too many tcp connections")
+	ErrNoListeners       = errors.New("dracula server needs a udp or tcp port to listen on")
+	ErrServerClosed      = errors.New("dracula server is closed")
+	// ErrReadOnly is the error response to a put or delete sent to a server with Config.ReadOnly. Clients match
+	// its text, so it must not change.
+	ErrReadOnly = errors.New("read_only")
+	// ErrValueTooLong is the error response to a put or count of a key longer than Config.MaxValueLen. Clients
+	// match its text, so it must not change.
+	ErrValueTooLong = errors.New("value_too_long")
+	// ErrRequestTimedOut is the error response to a request which was not handled within Config.RequestTimeout.
+	// Clients match its text, so it must not change.
+	ErrRequestTimedOut = errors.New("request_timed_out")
+	// ErrPeersNeedUDP is because replication between peers is over UDP.
+	ErrPeersNeedUDP = errors.New("dracula server with peers must listen on udp")
 )
 
 type Server struct {
 	store             *store.Store
 	StoreMetrics      *store.Metrics
+	metrics           *serverMetrics
 	conn              *net.UDPConn
 	tcpConn           *net.TCPListener
-	disposed          bool
-	preSharedKey      []byte
-	expireAfterSecs   int64
-	messageProcessing chan *rawmessage.RawMessage
-	peers             []net.UDPAddr
+	tcpConnSlots      chan struct{} // holds a value for each open tcp connection, when limited
+	rateLimiter       *rateLimiter  // limits expensive commands, when configured
+	disposed          int32         // 1 once closed, accessed atomically
+	keysLock          sync.RWMutex
+	preSharedKeys     [][]byte // the first key signs, and any can validate
+	expireAfterMillis int64
+	conf              Config
+	udpMessages       chan *rawmessage.RawMessage
+	tcpMessages       chan *rawmessage.RawMessage
+	peersLock         sync.RWMutex
+	peers             []net.UDPAddr // replaced rather than changed in place, see currentPeers
+	self              *net.UDPAddr
+	discovery         *discovery // finds the peers by DNS, when enabled
+	subscriptions     subscriptions
 	log               *log.Logger
+	// logOutput is where debug logs go while enabled
+	logOutput io.Writer
+	// errLog gets errors, which are logged even when debug logs are disabled
+	errLog *log.Logger
+	// startedAt is when Listen was called
+	startedAt time.Time
+	// ctx is the parent of every request's context, and is cancelled by Close
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	replicationIDCounter  uint32
+	replicationTimeout    time.Duration
+	replicationMaxRetries int
+	// replicationsOutstanding are puts sent to peers which have not been ack'd
+	replicationsOutstanding *replication.Outstanding
+	// replicationsReceived are puts from peers which were recently applied, to ignore retries
+	replicationsReceived *replication.Received
+	peerSyncInterval     time.Duration
+	// syncPullLock is held while key digests are sent for a sync pull, so pulls are sent one at a time
+	syncPullLock sync.Mutex
+	// keyExpiredLock locks keyExpiredFn and keyExpiredQueue, see OnKeyExpired
+	keyExpiredLock  sync.Mutex
+	keyExpiredFn    func(namespace, key string)
+	keyExpiredQueue chan expiredKey
+}
+
+// NewServerWithPeers is NewServer for a server replicating to a cluster. selfPeerHostPort is how this server
+// is addressed in the comma-separated peerStringList of ip:port. It returns an error naming the peer which
+// failed when the list is malformed, when self does not resolve, or when there are no peers besides self.
+func NewServerWithPeers(expireAfterSecs int64, preSharedKey, selfPeerHostPort, peerStringList string) (*Server, error) {
+	if expireAfterSecs < MinimumExpirySecs {
+		return nil, ErrExpiryTooSmall
+	}
+	return NewServerWithPeersMillis(expireAfterSecs*1000, preSharedKey, selfPeerHostPort, peerStringList)
+}
+
+// NewServerWithPeersMillis is NewServerWithPeers with the expiry in milliseconds, see NewServerMillis.
+func NewServerWithPeersMillis(expireAfterMillis int64, preSharedKey, selfPeerHostPort, peerStringList string) (*Server, error) {
+	if selfPeerHostPort == "" && peerStringList == "" {
+		return nil, ErrNoPeers
+	}
+	return New(Config{
+		ExpireAfter:   time.Duration(expireAfterMillis) * time.Millisecond,
+		PreSharedKeys: []string{preSharedKey},
+		SelfPeer:      selfPeerHostPort,
+		PeerList:      peerStringList,
+	})
+}
+
+// MustNewServerWithPeers is NewServerWithPeers which panics on an error, for peers known to be valid.
+func MustNewServerWithPeers(expireAfterSecs int64, preSharedKey, selfPeerHostPort, peerStringList string) *Server {
+	s, err := NewServerWithPeers(expireAfterSecs, preSharedKey, selfPeerHostPort, peerStringList)
+	if err != nil {
+		panic(err)
+	}
+	return s
 }
 
-func NewServerWithPeers(expireAfterSecs int64, preSharedKey, selfPeerHostPort, peerStringList string) *Server {
-	s := NewServer(expireAfterSecs, preSharedKey)
+// ValidatePeers checks the self peer and peer list the way NewServerWithPeers does, without making a server,
+// so configuration can be checked before a deploy.
+func ValidatePeers(selfPeerHostPort, peerStringList string) error {
+	_, _, err := parsePeers(selfPeerHostPort, peerStringList)
+	return err
+}
+
+// parsePeers resolves self, and parses the peer list without self in it
+func parsePeers(selfPeerHostPort, peerStringList string) (*net.UDPAddr, []net.UDPAddr, error) {
+	// self may be identified by hostname, or a different address than the peer list uses for it
+	self, err := net.ResolveUDPAddr("udp", selfPeerHostPort)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %q: %v", ErrBadSelfPeer, selfPeerHostPort, err)
+	}
 	var peers []net.UDPAddr
 	if len(peerStringList) > 0 {
 		peerParts := strings.Split(peerStringList, ",")
@@ -50,47 +169,239 @@ func NewServerWithPeers(expireAfterSecs int64, preSharedKey, selfPeerHostPort, p
 				// skip adding self to cluster peer list, otherwise we'll double count to ourselves
 				continue
 			}
-			hostPortParts := strings.Split(peerHostPort, ":")
-			if len(hostPortParts) != 2 {
-				panic(ErrBadPeersFormat)
-			}
-			ip := net.ParseIP(hostPortParts[0])
-			if ip == nil {
-				panic(ErrBadPeersFormat)
+			peer, err := parsePeer(peerHostPort)
+			if err != nil {
+				return nil, nil, err
 			}
-			port, errBadNum := strconv.Atoi(hostPortParts[1])
-			if errBadNum != nil {
-				panic(ErrBadPeersFormat)
+			if isSameAddr(self, &peer) {
+				continue
 			}
-			peers = append(peers, net.UDPAddr{
-				IP:   ip,
-				Port: port,
-			})
+			peers = append(peers, peer)
 		}
 	}
+	if len(peers) == 0 {
+		return nil, nil, ErrNoPeers
+	}
+	return self, peers, nil
+}
+
+// currentPeers returns the peers replications are sent to. The slice must not be changed, but it can be
+// read without a lock, because the peers are replaced by setPeers rather than changed in place.
+func (s *Server) currentPeers() []net.UDPAddr {
+	s.peersLock.RLock()
+	defer s.peersLock.RUnlock()
+	return s.peers
+}
+
+// setPeers replaces the peers replications are sent to
+func (s *Server) setPeers(peers []net.UDPAddr) {
+	s.peersLock.Lock()
+	defer s.peersLock.Unlock()
 	s.peers = peers
-	return s
 }
+
+// AddPeer starts replicating to another server at ip:port, without a restart, such as during maintenance.
+// Adding a peer which is already one does nothing. It is not given the entries put before it was added
+// until the next peer sync. With discovery enabled, the next lookup replaces the added peer.
+func (s *Server) AddPeer(hostPort string) error {
+	peer, err := parsePeer(hostPort)
+	if err != nil {
+		return err
+	}
+	if s.isSelf(&peer) {
+		return fmt.Errorf("%w: %q", ErrPeerIsSelf, hostPort)
+	}
+	if s.listening() && s.conn == nil {
+		return ErrPeersNeedUDP
+	}
+	s.peersLock.Lock()
+	defer s.peersLock.Unlock()
+	for _, p := range s.peers {
+		if p.IP.Equal(peer.IP) && p.Port == peer.Port {
+			return nil
+		}
+	}
+	// copied, so a slice from currentPeers is not changed under its reader
+	peers := make([]net.UDPAddr, len(s.peers), len(s.peers)+1)
+	copy(peers, s.peers)
+	s.peers = append(peers, peer)
+	return nil
+}
+
+// RemovePeer stops replicating to the server at ip:port. Replications it has not acked are still retried.
+func (s *Server) RemovePeer(hostPort string) error {
+	peer, err := parsePeer(hostPort)
+	if err != nil {
+		return err
+	}
+	s.peersLock.Lock()
+	defer s.peersLock.Unlock()
+	for i, p := range s.peers {
+		if p.IP.Equal(peer.IP) && p.Port == peer.Port {
+			peers := make([]net.UDPAddr, 0, len(s.peers)-1)
+			peers = append(peers, s.peers[:i]...)
+			s.peers = append(peers, s.peers[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %q", ErrPeerNotFound, hostPort)
+}
+
+// clustered is true for a server which replicates, even while discovery has found no peers
+func (s *Server) clustered() bool {
+	return s.discovery != nil || len(s.currentPeers()) != 0
+}
+
+// parsePeer parses one ip:port of a peer list
+func parsePeer(peerHostPort string) (net.UDPAddr, error) {
+	hostPortParts := strings.Split(peerHostPort, ":")
+	if len(hostPortParts) != 2 {
+		return net.UDPAddr{}, fmt.Errorf("%w: %q", ErrBadPeersFormat, peerHostPort)
+	}
+	ip := net.ParseIP(hostPortParts[0])
+	if ip == nil {
+		return net.UDPAddr{}, fmt.Errorf("%w: %q", ErrBadPeersFormat, peerHostPort)
+	}
+	port, errBadNum := strconv.Atoi(hostPortParts[1])
+	if errBadNum != nil {
+		return net.UDPAddr{}, fmt.Errorf("%w: %q", ErrBadPeersFormat, peerHostPort)
+	}
+	return net.UDPAddr{
+		IP:   ip,
+		Port: port,
+	}, nil
+}
+
+// isSelf returns true when addr is this server's self peer address, even when the address is a
+// different form of it - such as an interface IP of this host instead of the hostname, on the self port.
+// When the server binds to one IP, only that IP is self.
+func (s *Server) isSelf(addr *net.UDPAddr) bool {
+	if !isSameAddr(s.self, addr) {
+		return false
+	}
+	if bind := net.ParseIP(s.conf.BindIP); bind != nil && !bind.IsUnspecified() && !addr.IP.Equal(s.self.IP) {
+		return addr.IP.Equal(bind)
+	}
+	return true
+}
+
+// isPeer returns true when addr is one of the current peers, in any form isSameAddr accepts
+func (s *Server) isPeer(addr *net.UDPAddr) bool {
+	peers := s.currentPeers()
+	for i := range peers {
+		if isSameAddr(&peers[i], addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// isSameAddr returns true when addr is the same IP and port as self, or when both IPs are addresses of this
+// host's interfaces and the ports are the same, so they reach the same listener. Other loopback IPs, like
+// 127.0.0.2, are not an interface's address, so a peer listening on one is not mistaken for self.
+func isSameAddr(self, addr *net.UDPAddr) bool {
+	if self == nil || addr.Port != self.Port {
+		return false
+	}
+	if addr.IP.Equal(self.IP) {
+		return true
+	}
+	return isInterfaceIP(addr.IP) && isInterfaceIP(self.IP)
+}
+
+// isInterfaceIP returns true when ip is the address of one of this host's interfaces
+func isInterfaceIP(ip net.IP) bool {
+	interfaceAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range interfaceAddrs {
+		if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 func NewServer(expireAfterSecs int64, preSharedKey string) *Server {
 	if expireAfterSecs < MinimumExpirySecs {
 		panic(ErrExpiryTooSmall)
 	}
-	psk := []byte(preSharedKey)
-	st := store.NewStore(expireAfterSecs)
+	return NewServerMillis(expireAfterSecs*1000, preSharedKey)
+}
+
+// NewServerMillis is NewServer with the expiry in milliseconds, for rate limits with windows shorter than
+// a second. The expiry must be at least MinimumExpiryMillis.
+func NewServerMillis(expireAfterMillis int64, preSharedKey string) *Server {
+	s, err := New(Config{
+		ExpireAfter:   time.Duration(expireAfterMillis) * time.Millisecond,
+		PreSharedKeys: []string{preSharedKey},
+	})
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// newServer makes a server with the default config, for New to configure
+func newServer(expireAfterMillis int64) *Server {
+	st := store.NewStoreMillis(expireAfterMillis)
+	ctx, cancel := context.WithCancel(context.Background())
 	serv := &Server{
-		store:             st,
-		StoreMetrics:      st.LastMetrics,
-		preSharedKey:      psk,
-		expireAfterSecs:   expireAfterSecs,
-		messageProcessing: make(chan *rawmessage.RawMessage, runtime.NumCPU()),
-		log:               log.New(os.Stdout, "", 0),
+		ctx:                   ctx,
+		cancel:                cancel,
+		store:                 st,
+		StoreMetrics:          st.LastMetrics,
+		metrics:               newServerMetrics(st.LastMetrics),
+		expireAfterMillis:     expireAfterMillis,
+		conf:                  Config{}.withDefaults(),
+		log:                   log.New(os.Stdout, "", 0),
+		logOutput:             os.Stdout,
+		errLog:                log.Default(),
+		replicationTimeout:    ReplicationAckTimeout,
+		replicationMaxRetries: ReplicationMaxRetries,
+		peerSyncInterval:      DefaultPeerSyncInterval,
 	}
 	serv.DebugDisable()
 	return serv
 }
 
+// SetPreSharedKeys replaces the keys which authenticate packets, without restarting. A packet is
+// valid when signed by any of the keys, and the server signs with the first key. To rotate keys
+// without downtime, set the new key and the old key, update every client and peer to the new key,
+// then set the new key alone.
+func (s *Server) SetPreSharedKeys(keys ...string) {
+	if len(keys) == 0 {
+		keys = []string{""}
+	}
+	psks := make([][]byte, len(keys))
+	for i, k := range keys {
+		psks[i] = []byte(k)
+	}
+	s.keysLock.Lock()
+	s.preSharedKeys = psks
+	s.keysLock.Unlock()
+}
+
+func (s *Server) signingKey() []byte {
+	s.keysLock.RLock()
+	defer s.keysLock.RUnlock()
+	return s.preSharedKeys[0]
+}
+
+func (s *Server) validKeys() [][]byte {
+	s.keysLock.RLock()
+	defer s.keysLock.RUnlock()
+	return s.preSharedKeys
+}
+
+// SetCleanupInterval changes how often the store actively expires entries of namespaces which are not being read.
+func (s *Server) SetCleanupInterval(interval time.Duration) {
+	s.store.SetCleanupInterval(interval)
+}
+
 func (s *Server) DebugEnable(prefix string) {
-	s.log.SetOutput(os.Stdout)
+	s.log.SetOutput(s.logOutput)
 	s.log.SetPrefix(prefix + " ")
 }
 
@@ -98,37 +409,96 @@ func (s *Server) DebugDisable() {
 	s.log.SetOutput(ioutil.Discard)
 }
 
+// Listen starts the UDP and TCP listeners. Either port can be 0 to run without that transport, such as
+// UDP only for the hot path of puts and counts, or TCP only for a node serving KeyMatch.
 func (s *Server) Listen(udpPort, tcpPort int) error {
-	if s.conn != nil {
+	if s.listening() {
 		return ErrServerAlreadyInit
 	}
-	conn, err := net.ListenUDP("udp", &net.UDPAddr{
-		Port: udpPort,
-		IP:   net.ParseIP("0.0.0.0"),
-	})
-	if err != nil {
-		return err
+	if udpPort == 0 && tcpPort == 0 {
+		return ErrNoListeners
+	}
+	if udpPort == 0 && s.clustered() {
+		return ErrPeersNeedUDP
+	}
+	var conn *net.UDPConn
+	var err error
+	if udpPort != 0 {
+		conn, err = net.ListenUDP("udp", &net.UDPAddr{
+			Port: udpPort,
+			IP:   net.ParseIP(s.conf.BindIP),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if tcpPort != 0 {
+		s.tcpConn, err = net.ListenTCP("tcp", &net.TCPAddr{
+			Port: tcpPort,
+			IP:   net.ParseIP(s.conf.BindIP),
+		})
+		if err != nil {
+			if conn != nil {
+				conn.Close()
+			}
+			return err
+		}
 	}
 	s.conn = conn
+	s.startedAt = time.Now()
+	s.metrics.startTime.Set(float64(s.startedAt.Unix()))
+	s.metrics.buildInfo.WithLabelValues(s.conf.Version, s.conf.Build).Set(1)
 
-	tcpConn, err := net.ListenTCP("tcp", &net.TCPAddr{
-		Port: tcpPort,
-		IP:   net.ParseIP("0.0.0.0"),
-	})
-	if err != nil {
-		return err
+	// each transport has its own queue and workers, so a flood on one does not hold up the other
+	if s.conn != nil {
+		s.log.Printf("server listening udp %s\n", s.conn.LocalAddr().String())
+		s.udpMessages = make(chan *rawmessage.RawMessage, s.conf.QueueSize)
+		s.registerUDPQueueMetrics()
+		s.setupWorkers(s.udpMessages, s.conf.Workers)
+	}
+	if s.tcpConn != nil {
+		s.log.Printf("server listening tcp %s\n", s.tcpConn.Addr().String())
+		s.tcpMessages = make(chan *rawmessage.RawMessage, s.conf.TCPQueueSize)
+		if s.conf.MaxTCPConns > 0 {
+			s.tcpConnSlots = make(chan struct{}, s.conf.MaxTCPConns)
+		}
+		s.setupWorkers(s.tcpMessages, s.conf.TCPWorkers)
+	}
+	if s.conf.NamespaceMetricsInterval > 0 {
+		go s.refreshNamespaceMetricsForever()
+	}
+	if s.rateLimiter != nil {
+		go s.cleanupRateLimitsForever()
 	}
-	s.tcpConn = tcpConn
-
-	s.log.Printf("server listening udp+tcp %s\n", conn.LocalAddr().String())
 
-	s.setupWorkers(runtime.NumCPU()) // as many workers as buffer size of channel
+	// set up even without peers, since they can be added while running
+	if s.conn != nil {
+		s.replicationsOutstanding = replication.NewOutstanding(s.replicationTimeout, s.replicationMaxRetries)
+		// remember received replications for longer than a peer could be retrying them
+		s.replicationsReceived = replication.NewReceived(s.replicationWindow())
+		go s.retryReplications()
+		if s.peerSyncInterval > 0 {
+			go s.syncPeersForever()
+		}
+		if s.discovery != nil {
+			go s.discoverPeersForever()
+		}
+	}
 
-	go s.readUDPFrames()
-	go s.ReadTCPFrames()
+	if s.conn != nil {
+		go s.readUDPFrames()
+	}
+	if s.tcpConn != nil {
+		go s.ReadTCPFrames()
+	}
 	return nil
 }
 
+// listening is true once Listen has started either transport
+func (s *Server) listening() bool {
+	return s.conn != nil || s.tcpConn != nil
+}
+
 func (s *Server) ListenHTTP(hostPort string) error {
 	if hostPort == "" {
 		return nil
@@ -154,16 +524,23 @@ func (s *Server) ListenHTTP(hostPort string) error {
 	return nil
 }
 
+// Close stops the listeners and workers. It is safe to call more than once, from several goroutines at once,
+// and on a server whose Listen failed or was never called. Only the first call does anything.
 func (s *Server) Close() error {
-	if s.disposed {
+	if !atomic.CompareAndSwapInt32(&s.disposed, 0, 1) {
 		return nil
 	}
-	s.disposed = true
-	udpErr := s.conn.Close()
-	tcpErr := s.tcpConn.Close()
+	// cancelling stops the workers, and the queues are left open, since readers may still be sending to them
+	s.cancel()
+	var udpErr, tcpErr error
+	if s.conn != nil {
+		udpErr = s.conn.Close()
+	}
+	if s.tcpConn != nil {
+		tcpErr = s.tcpConn.Close()
+	}
 
 	s.store.DisableCleanup()
-	close(s.messageProcessing)
 
 	if udpErr != nil {
 		return udpErr
@@ -176,24 +553,64 @@ func (s *Server) Close() error {
 
 func (s *Server) readUDPFrames() {
 	for {
-		if s.disposed {
+		if s.isDisposed() {
 			break
 		}
-		message := make([]byte, protocol.PacketSize)
-		_, remote, err := s.conn.ReadFromUDP(message[:])
+		m := rawmessage.NewPooled()
+		n, remote, err := s.conn.ReadFromUDP(m.Message)
 		if err != nil {
 			s.log.Println("server udp read error:", err)
+			s.metrics.udpReadErrors.Inc()
+			m.Release()
 			continue
 		}
-		s.messageProcessing <- &rawmessage.RawMessage{Message: message, Remote: remote}
+		m.ClearAfter(n)
+		m.Remote = remote
+		m.SetContext(s.ctx, s.conf.RequestTimeout)
+		s.enqueueUDP(m)
+	}
+}
+
+// enqueueUDP queues the message for a worker. When the queue is full it waits up to Config.QueueFullTimeout
+// for room, then drops the message. Messages received as the server closes are dropped.
+func (s *Server) enqueueUDP(m *rawmessage.RawMessage) {
+	select {
+	case s.udpMessages <- m:
+		return
+	default:
+	}
+	// the os drops datagrams while the socket is not read, so count how often that can happen
+	s.metrics.udpQueueFull.Inc()
+	switch {
+	case s.conf.QueueFullTimeout == 0:
+		select {
+		case s.udpMessages <- m:
+		case <-s.ctx.Done():
+			m.Release()
+		}
+		return
+	case s.conf.QueueFullTimeout > 0:
+		timer := time.NewTimer(s.conf.QueueFullTimeout)
+		defer timer.Stop()
+		select {
+		case s.udpMessages <- m:
+			return
+		case <-s.ctx.Done():
+			m.Release()
+			return
+		case <-timer.C:
+		}
 	}
+	s.log.Println("server dropped udp packet, queue is full:", m.Remote)
+	s.metrics.udpDropped.Inc()
+	m.Release()
 }
 
 // ReadTCPFrames can be used by a dracula server OR client to accept and handle TCP connections,
 // reading the protocol frames and passing them to a channel for processing.
 func (s *Server) ReadTCPFrames() {
 	for {
-		if s.disposed {
+		if s.isDisposed() {
 			break
 		}
 		conn, err := s.tcpConn.AcceptTCP()
@@ -201,123 +618,543 @@ func (s *Server) ReadTCPFrames() {
 			s.log.Println("server tcp accept error:", err)
 			continue
 		}
+		if !s.acquireTCPConn() {
+			s.rejectTCPConn(conn)
+			continue
+		}
 		go s.handleTCPConnection(conn)
 	}
 }
 
+// acquireTCPConn takes a slot for a new tcp connection, returning false when the max are already open
+func (s *Server) acquireTCPConn() bool {
+	if s.tcpConnSlots != nil {
+		select {
+		case s.tcpConnSlots <- struct{}{}:
+		default:
+			return false
+		}
+	}
+	s.metrics.tcpConnections.Inc()
+	return true
+}
+
+func (s *Server) releaseTCPConn() {
+	if s.tcpConnSlots != nil {
+		<-s.tcpConnSlots
+	}
+	s.metrics.tcpConnections.Dec()
+}
+
+// rejectTCPConn tells the client there are too many connections, then hangs up
+func (s *Server) rejectTCPConn(conn *net.TCPConn) {
+	s.log.Println("server rejected tcp connection:", conn.RemoteAddr(), ErrTooManyTCPConns)
+	s.metrics.tcpConnectionsRejected.Inc()
+	resPacket := protocol.NewPacketFromParts(protocol.ResError, protocol.Uint32ToBytes(0), []byte{}, []byte(ErrTooManyTCPConns.Error()), s.signingKey())
+	resPacket.RequestClient = conn
+	s.respondOrLogErrorTCP(resPacket)
+	conn.Close()
+}
+
 func (s *Server) handleTCPConnection(conn *net.TCPConn) {
+	defer s.releaseTCPConn()
 	defer conn.Close()
+	if s.conf.TCPKeepAlive != 0 {
+		if err := conn.SetKeepAlive(s.conf.TCPKeepAlive > 0); err != nil {
+			s.log.Println("server tcp keepalive error:", conn.RemoteAddr(), err)
+		}
+		if s.conf.TCPKeepAlive > 0 {
+			if err := conn.SetKeepAlivePeriod(s.conf.TCPKeepAlive); err != nil {
+				s.log.Println("server tcp keepalive period error:", conn.RemoteAddr(), err)
+			}
+		}
+	}
+	// one reader for the connection, so requests a client sends back to back are all read
+	reader := rawmessage.NewTcpReader(conn)
+	var sub *subscription
+	defer func() {
+		if sub != nil {
+			s.unsubscribe(sub)
+		}
+	}()
 	var err error
 	for {
-		err = rawmessage.ReadOneTcpMessage(s.log, s.messageProcessing, conn)
+		// subscribers send nothing while they wait for puts, so they are never idle
+		if s.conf.TCPIdleTimeout > 0 && sub == nil {
+			if err = conn.SetReadDeadline(time.Now().Add(s.conf.TCPIdleTimeout)); err != nil {
+				break
+			}
+		}
+		var m *rawmessage.RawMessage
+		m, err = reader.ReadRaw(s.log)
 		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				s.log.Println("server closing idle tcp connection:", conn.RemoteAddr())
+			}
 			break
 		}
+		if len(m.Message) > 0 && m.Message[0] == protocol.CmdTCPOnlySubscribe && sub == nil {
+			if sub = s.subscribe(m); sub != nil {
+				conn.SetReadDeadline(time.Time{})
+			}
+			continue
+		}
+		m.SetContext(s.ctx, s.conf.RequestTimeout)
+		select {
+		case s.tcpMessages <- m:
+		case <-s.ctx.Done():
+			m.Release()
+			return
+		}
 	}
 }
 
+// worker handles messages until the server is closed
 func (s *Server) worker(messages <-chan *rawmessage.RawMessage) {
-	for m := range messages {
-		message := m.Message
-		remote := m.Remote
-		maybeTcpClient := m.MaybeTcpClient
-		packet, err := protocol.ParsePacket(message)
-		if maybeTcpClient != nil {
-			packet.RequestClient = maybeTcpClient
-		}
-
-		var resPacket *protocol.Packet
-		respond := func() {
-			if packet.RequestClient != nil {
-				resPacket.RequestClient = packet.RequestClient
-				s.respondOrLogErrorTCP(resPacket)
-				return
-			}
-			s.respondOrLogError(remote, resPacket)
+	for {
+		select {
+		case m := <-messages:
+			s.handleMessage(m)
+			// nothing references the message buffer after it is handled, so it can be reused
+			m.Release()
+		case <-s.ctx.Done():
+			return
 		}
+	}
+}
 
-		if err != nil {
-			s.log.Println("server received BAD packet:", remote, string(packet.Command), packet.MessageID, packet.NamespaceString(), packet.DataValueString(), err)
-			resPacket = protocol.NewPacketFromParts(protocol.ResError, packet.MessageIDBytes, packet.Namespace, []byte(err.Error()), s.preSharedKey)
-			respond()
-			continue
+// handleMessage parses, authenticates, and responds to one message
+func (s *Server) handleMessage(m *rawmessage.RawMessage) {
+	message := m.Message
+	psk := s.signingKey()
+	remote := m.Remote
+	maybeTcpClient := m.MaybeTcpClient
+	packet, err := protocol.ParsePacketSafe(message)
+	if packet == nil {
+		// too malformed to even respond to
+		s.log.Println("server received unparseable packet:", remote, err)
+		return
+	}
+	if maybeTcpClient != nil {
+		packet.RequestClient = maybeTcpClient
+	}
+
+	var resPacket *protocol.Packet
+	respond := func() {
+		if packet.RequestClient != nil {
+			resPacket.RequestClient = packet.RequestClient
+			s.respondOrLogErrorTCP(resPacket)
+			return
 		}
-		err = packet.Validate(s.preSharedKey)
-		if err != nil {
-			s.log.Println("server got bad hash:", remote, string(packet.Command), packet.MessageID, packet.NamespaceString(), packet.DataValueString())
-			resPacket = protocol.NewPacketFromParts(protocol.ResError, packet.MessageIDBytes, packet.Namespace, []byte(err.Error()), s.preSharedKey)
-			respond()
-			continue
+		s.respondOrLogError(remote, resPacket)
+	}
+	respondTimedOut := func() {
+		if s.isDisposed() {
+			return
 		}
+		s.metrics.requestsTimedOut.Inc()
+		s.log.Println("server request timed out:", remote, string(packet.Command), packet.MessageID, packet.NamespaceString())
+		resPacket = protocol.NewPacketFromParts(protocol.ResError, packet.MessageIDBytes, packet.Namespace, []byte(ErrRequestTimedOut.Error()), psk)
+		respond()
+	}
+
+	if err != nil {
+		s.log.Println("server received BAD packet:", remote, string(packet.Command), packet.MessageID, packet.NamespaceString(), packet.DataValueString(), err)
+		resPacket = protocol.NewPacketFromParts(protocol.ResError, packet.MessageIDBytes, packet.Namespace, []byte(err.Error()), psk)
+		respond()
+		return
+	}
+	err = packet.Validate(s.validKeys()...)
+	if err != nil {
+		s.log.Println("server got bad hash:", remote, string(packet.Command), packet.MessageID, packet.NamespaceString(), packet.DataValueString())
+		resPacket = protocol.NewPacketFromParts(protocol.ResError, packet.MessageIDBytes, packet.Namespace, []byte(err.Error()), psk)
+		respond()
+		return
+	}
 
-		s.log.Println("server received packet:", remote, string(packet.Command), packet.MessageID, packet.NamespaceString(), packet.DataValueString())
+	s.log.Println("server received packet:", remote, string(packet.Command), packet.MessageID, packet.NamespaceString(), packet.DataValueString())
+	defer s.observeRequest(packet, time.Now())
 
-		switch packet.Command {
-		case protocol.CmdPutReplicate:
-			// replications get Put() but don't respond or re-replicate
-			s.store.Put(packet.NamespaceString(), packet.DataValueString())
-			break
-		case protocol.CmdPut:
-			s.store.Put(packet.NamespaceString(), packet.DataValueString())
-			resPacket = protocol.NewPacketFromParts(protocol.CmdPut, packet.MessageIDBytes, packet.Namespace, []byte{}, s.preSharedKey)
-			respond()
-			if len(s.peers) != 0 {
-				// note that the packet is copied because it will be changed
-				s.republish(*packet)
-			}
-			break
-		case protocol.CmdCount:
-			countInt := s.store.Count(packet.NamespaceString(), packet.DataValueString())
-			if countInt > math.MaxUint32 {
-				countInt = math.MaxUint32 // prevent overflow
-			}
-			c := uint32(countInt)
-			resPacket = protocol.NewPacketFromParts(protocol.CmdCount, packet.MessageIDBytes, packet.Namespace, protocol.Uint32ToBytes(c), s.preSharedKey)
-			respond()
+	if s.rateLimiter != nil && isExpensiveCmd(packet.Command) && !s.rateLimiter.allow(remote.IP.String(), time.Now()) {
+		s.log.Println("server rate limited:", remote, string(packet.Command), packet.MessageID, packet.NamespaceString())
+		resPacket = protocol.NewPacketFromParts(protocol.ResError, packet.MessageIDBytes, packet.Namespace, []byte(ErrRateLimited.Error()), psk)
+		respond()
+		return
+	}
+
+	if s.conf.ReadOnly && (packet.Command == protocol.CmdPut || packet.Command == protocol.CmdPutBytes || packet.Command == protocol.CmdDelete ||
+		packet.Command == protocol.CmdGetReset || packet.Command == protocol.CmdPutWeight) {
+		s.log.Println("server refused write to read only:", remote, string(packet.Command), packet.MessageID, packet.NamespaceString())
+		resPacket = protocol.NewPacketFromParts(protocol.ResError, packet.MessageIDBytes, packet.Namespace, []byte(ErrReadOnly.Error()), psk)
+		respond()
+		return
+	}
+
+	// requests which waited in the queue past their timeout are not worth handling, as the client gave up
+	ctx := m.Context()
+	if ctx.Err() != nil {
+		respondTimedOut()
+		return
+	}
+
+	switch packet.Command {
+	case protocol.CmdPutReplicate, protocol.CmdPutReplicateAt, protocol.CmdDeleteReplicate, protocol.CmdPutWeightReplicate:
+		// replications get applied and ack'd, but don't re-replicate
+		if s.isSelf(remote) {
+			s.log.Println("server dropped replication from self:", remote, packet.MessageID)
 			break
-		case protocol.CmdCountNamespace:
-			countInt := s.store.CountEntries(packet.NamespaceString())
-			if countInt > math.MaxUint32 {
-				countInt = math.MaxUint32 // prevent overflow
-			}
-			c := uint32(countInt)
-			resPacket = protocol.NewPacketFromParts(protocol.CmdCountNamespace, packet.MessageIDBytes, packet.Namespace, protocol.Uint32ToBytes(c), s.preSharedKey)
+		}
+		if s.replicationsReceived == nil || s.replicationsReceived.First(remote, packet.MessageID) {
+			s.applyReplication(remote, packet)
+		} else {
+			s.log.Println("server ignored repeated replication:", remote, packet.MessageID)
+		}
+		resPacket = protocol.NewPacketFromParts(protocol.CmdPutReplicateAck, packet.MessageIDBytes, packet.Namespace, []byte{}, psk)
+		respond()
+		break
+	case protocol.CmdPutReplicateAck:
+		if s.replicationsOutstanding == nil || !s.replicationsOutstanding.Ack(remote, packet.MessageID) {
+			s.log.Println("server got unexpected replication ack:", remote, packet.MessageID)
+		}
+		break
+	case protocol.CmdSyncDigest:
+		s.handleSyncDigest(remote, packet)
+		break
+	case protocol.CmdSyncPull:
+		s.handleSyncPull(remote, packet)
+		break
+	case protocol.CmdPut, protocol.CmdPutBytes, protocol.CmdPutWeight:
+		entryKey, keyErr := s.entryKeyOf(packet)
+		if keyErr == nil && packet.Command != protocol.CmdPutBytes {
+			keyErr = protocol.CheckLineBreaks(packet.NamespaceString(), entryKey)
+		} else if keyErr == nil {
+			// binary keys may contain line breaks, so listing them needs quoted lists
+			keyErr = protocol.CheckLineBreaks(packet.NamespaceString(), "")
+		}
+		weight, weightErr := putWeightOf(packet)
+		if keyErr == nil {
+			keyErr = weightErr
+		}
+		if keyErr != nil {
+			resPacket = protocol.NewPacketFromParts(protocol.ResError, packet.MessageIDBytes, packet.Namespace, []byte(keyErr.Error()), psk)
 			respond()
 			break
-		case protocol.CmdCountServer:
-			countInt := s.store.CountServerEntries()
-			if countInt > math.MaxUint32 {
-				countInt = math.MaxUint32 // prevent overflow
+		}
+		putMillis := nowMillis()
+		s.store.PutWeight(packet.NamespaceString(), entryKey, weight)
+		s.publishPut(packet.NamespaceString(), entryKey)
+		// the count after the put saves clients which rate limit from counting separately
+		countInt := s.store.Count(packet.NamespaceString(), entryKey)
+		if countInt > math.MaxUint32 {
+			countInt = math.MaxUint32 // prevent overflow
+		}
+		resPacket = protocol.NewPacketFromParts(packet.Command, packet.MessageIDBytes, packet.Namespace, protocol.Uint32ToBytes(uint32(countInt)), psk)
+		respond()
+		if len(s.currentPeers()) != 0 {
+			// note that the packet is copied because it will be changed, and replications carry the plain key
+			replicated := *packet
+			replicated.DataValue = []byte(entryKey)
+			if weight == 1 {
+				s.republish(replicated, protocol.CmdPutReplicateAt, putMillis)
+			} else {
+				s.republishWeight(replicated, weight, putMillis)
 			}
-			c := uint32(countInt)
-			resPacket = protocol.NewPacketFromParts(protocol.CmdCountServer, packet.MessageIDBytes, packet.Namespace, protocol.Uint32ToBytes(c), s.preSharedKey)
-			respond()
-			break
-		case protocol.CmdTCPOnlyKeys:
-			matchedKeys := s.store.KeyMatch(packet.NamespaceString(), packet.DataValueString())
-			s.log.Println("KeyMatch", packet.NamespaceString(), packet.DataValueString(), matchedKeys)
-			resPacket = protocol.NewPacketFromParts(protocol.CmdTCPOnlyKeys, packet.MessageIDBytes, packet.Namespace, []byte(strings.Join(matchedKeys, "\n")), s.preSharedKey)
+		}
+		break
+	case protocol.CmdCount, protocol.CmdCountBytes:
+		entryKey, keyErr := s.entryKeyOf(packet)
+		if keyErr != nil {
+			resPacket = protocol.NewPacketFromParts(protocol.ResError, packet.MessageIDBytes, packet.Namespace, []byte(keyErr.Error()), psk)
 			respond()
 			break
-		case protocol.CmdTCPOnlyNamespaces:
-			namespaces := s.store.Namespaces()
-			s.log.Println("Namespaces", packet.NamespaceString(), packet.DataValueString(), namespaces)
-			resPacket = protocol.NewPacketFromParts(protocol.CmdTCPOnlyNamespaces, packet.MessageIDBytes, packet.Namespace, []byte(strings.Join(namespaces, "\n")), s.preSharedKey)
+		}
+		countInt := s.store.Count(packet.NamespaceString(), entryKey)
+		if countInt > math.MaxUint32 {
+			countInt = math.MaxUint32 // prevent overflow
+		}
+		c := uint32(countInt)
+		resPacket = protocol.NewPacketFromParts(packet.Command, packet.MessageIDBytes, packet.Namespace, protocol.Uint32ToBytes(c), psk)
+		respond()
+		break
+	case protocol.CmdDelete:
+		deleteMillis := nowMillis()
+		var deleted uint32
+		if s.store.DeleteAt(packet.NamespaceString(), packet.DataValueString(), deleteMillis, s.tombstoneFor()) {
+			deleted = 1
+		}
+		resPacket = protocol.NewPacketFromParts(protocol.CmdDelete, packet.MessageIDBytes, packet.Namespace, protocol.Uint32ToBytes(deleted), psk)
+		respond()
+		if len(s.currentPeers()) != 0 {
+			s.republish(*packet, protocol.CmdDeleteReplicate, deleteMillis)
+		}
+		break
+	case protocol.CmdGetReset:
+		resetMillis := nowMillis()
+		countInt := s.store.ResetAt(packet.NamespaceString(), packet.DataValueString(), resetMillis, s.tombstoneFor())
+		if countInt > math.MaxUint32 {
+			countInt = math.MaxUint32 // prevent overflow
+		}
+		resPacket = protocol.NewPacketFromParts(protocol.CmdGetReset, packet.MessageIDBytes, packet.Namespace, protocol.Uint32ToBytes(uint32(countInt)), psk)
+		respond()
+		if len(s.currentPeers()) != 0 {
+			// peers only need to remove the same entries, so it replicates as a delete
+			s.republish(*packet, protocol.CmdDeleteReplicate, resetMillis)
+		}
+		break
+	case protocol.CmdCountAt:
+		// the time is binary and may contain whitespace bytes, so it can't be trimmed with the key
+		atSecs := int64(protocol.Uint32FromBytes(packet.DataValue[0:4]))
+		entryKey := protocol.TrimPadding(packet.DataValue[4:])
+		countInt := s.store.CountAt(packet.NamespaceString(), entryKey, atSecs)
+		if countInt > math.MaxUint32 {
+			countInt = math.MaxUint32 // prevent overflow
+		}
+		resPacket = protocol.NewPacketFromParts(protocol.CmdCountAt, packet.MessageIDBytes, packet.Namespace, protocol.Uint32ToBytes(uint32(countInt)), psk)
+		respond()
+		break
+	case protocol.CmdCountNamespace:
+		countInt := s.store.CountEntries(packet.NamespaceString())
+		if countInt > math.MaxUint32 {
+			countInt = math.MaxUint32 // prevent overflow
+		}
+		c := uint32(countInt)
+		resPacket = protocol.NewPacketFromParts(protocol.CmdCountNamespace, packet.MessageIDBytes, packet.Namespace, protocol.Uint32ToBytes(c), psk)
+		respond()
+		break
+	case protocol.CmdCountWeighted:
+		parts := strings.SplitN(packet.DataValueString(), " ", 2)
+		halfLifeMillis, parseErr := strconv.ParseInt(parts[0], 10, 64)
+		if len(parts) != 2 || parseErr != nil || halfLifeMillis <= 0 {
+			resPacket = protocol.NewPacketFromParts(protocol.ResError, packet.MessageIDBytes, packet.Namespace, []byte(protocol.ErrMalformedPacket.Error()), psk)
 			respond()
 			break
-		default:
-			resPacket = protocol.NewPacketFromParts(protocol.ResError, packet.MessageIDBytes, packet.Namespace, []byte("unknown_command_"+string(packet.Command)), s.preSharedKey)
-			respond()
+		}
+		weighted := s.store.CountWeighted(packet.NamespaceString(), parts[1], time.Duration(halfLifeMillis)*time.Millisecond)
+		resPacket = protocol.NewPacketFromParts(protocol.CmdCountWeighted, packet.MessageIDBytes, packet.Namespace, []byte(strconv.FormatFloat(weighted, 'g', -1, 64)), psk)
+		respond()
+		break
+	case protocol.CmdGetTTL:
+		// every namespace expires after the server's expiry, which is also the length of fixed windows
+		ttl := strconv.FormatInt(s.expireAfterMillis, 10)
+		resPacket = protocol.NewPacketFromParts(protocol.CmdGetTTL, packet.MessageIDBytes, packet.Namespace, []byte(ttl), psk)
+		respond()
+		break
+	case protocol.CmdCountKeys:
+		countInt := s.store.CountDistinctKeys(packet.NamespaceString())
+		if countInt > math.MaxUint32 {
+			countInt = math.MaxUint32 // prevent overflow
+		}
+		resPacket = protocol.NewPacketFromParts(protocol.CmdCountKeys, packet.MessageIDBytes, packet.Namespace, protocol.Uint32ToBytes(uint32(countInt)), psk)
+		respond()
+		break
+	case protocol.CmdCompact:
+		reclaimed := s.store.Compact(packet.NamespaceString())
+		if reclaimed > math.MaxUint32 {
+			reclaimed = math.MaxUint32 // prevent overflow
+		}
+		resPacket = protocol.NewPacketFromParts(protocol.CmdCompact, packet.MessageIDBytes, packet.Namespace, protocol.Uint32ToBytes(uint32(reclaimed)), psk)
+		respond()
+		break
+	case protocol.CmdNamespaceInfo:
+		countInt, _ := s.store.CountKeys(packet.NamespaceString())
+		if countInt > math.MaxUint32 {
+			countInt = math.MaxUint32 // prevent overflow
+		}
+		c := uint32(countInt)
+		resPacket = protocol.NewPacketFromParts(protocol.CmdNamespaceInfo, packet.MessageIDBytes, packet.Namespace, protocol.Uint32ToBytes(c), psk)
+		respond()
+		break
+	case protocol.CmdPing:
+		resPacket = protocol.NewPacketFromParts(protocol.CmdPing, packet.MessageIDBytes, packet.Namespace, []byte{}, psk)
+		respond()
+		break
+	case protocol.CmdCountServer:
+		countInt, err := s.store.CountServerEntriesContext(ctx)
+		if err != nil {
+			respondTimedOut()
 			break
 		}
+		if countInt > math.MaxUint32 {
+			countInt = math.MaxUint32 // prevent overflow
+		}
+		c := uint32(countInt)
+		resPacket = protocol.NewPacketFromParts(protocol.CmdCountServer, packet.MessageIDBytes, packet.Namespace, protocol.Uint32ToBytes(c), psk)
+		respond()
+		break
+	case protocol.CmdTCPOnlyKeys:
+		matchedKeys := s.store.KeyMatch(packet.NamespaceString(), packet.DataValueString())
+		s.log.Println("KeyMatch", packet.NamespaceString(), packet.DataValueString(), matchedKeys)
+		resPacket = protocol.NewPacketFromParts(protocol.CmdTCPOnlyKeys, packet.MessageIDBytes, packet.Namespace, []byte(strings.Join(matchedKeys, "\n")), psk)
+		respond()
+		break
+	case protocol.CmdTCPOnlyKeysOpts:
+		flags, keyPattern := packet.DataValueString(), ""
+		if i := strings.IndexByte(flags, ' '); i >= 0 {
+			flags, keyPattern = flags[:i], flags[i+1:]
+		}
+		opts := tree.MatchOptions{
+			CaseInsensitive: strings.Contains(flags, "i"),
+			IncludeExpired:  strings.Contains(flags, "e"),
+		}
+		matchedKeys := s.store.KeyMatchOpts(packet.NamespaceString(), keyPattern, opts)
+		res := []byte(strings.Join(matchedKeys, "\n"))
+		if strings.Contains(flags, "q") {
+			res = protocol.JoinQuoted(matchedKeys)
+		}
+		resPacket = protocol.NewPacketFromParts(protocol.CmdTCPOnlyKeysOpts, packet.MessageIDBytes, packet.Namespace, res, psk)
+		respond()
+		break
+	case protocol.CmdTCPOnlyTopKeys:
+		// TCP framing trims whitespace, which a binary number could contain, so the limit is decimal text
+		limit, err := strconv.Atoi(packet.DataValueString())
+		if err != nil || limit > MaxTopKeys {
+			limit = MaxTopKeys
+		}
+		topKeys := s.store.TopKeys(packet.NamespaceString(), limit)
+		lines := make([]string, len(topKeys))
+		for i, kc := range topKeys {
+			lines[i] = kc.Key + ":" + strconv.Itoa(kc.Count)
+		}
+		s.log.Println("TopKeys", packet.NamespaceString(), limit, lines)
+		resPacket = protocol.NewPacketFromParts(protocol.CmdTCPOnlyTopKeys, packet.MessageIDBytes, packet.Namespace, []byte(strings.Join(lines, "\n")), psk)
+		respond()
+		break
+	case protocol.CmdTCPOnlyKeysPage:
+		offset, limit, keyPattern := parsePageRequest(packet.DataValueString())
+		page, more := s.store.KeyMatchPage(packet.NamespaceString(), keyPattern, offset, limit)
+		s.log.Println("KeyMatchPage", packet.NamespaceString(), offset, limit, keyPattern, page, more)
+		resPacket = protocol.NewPacketFromParts(protocol.CmdTCPOnlyKeysPage, packet.MessageIDBytes, packet.Namespace, pageResponse(page, more), psk)
+		respond()
+		break
+	case protocol.CmdTCPOnlyNamespacesPage:
+		offset, limit, _ := parsePageRequest(packet.DataValueString())
+		page, more := s.store.NamespacesPage(offset, limit)
+		s.log.Println("NamespacesPage", offset, limit, page, more)
+		resPacket = protocol.NewPacketFromParts(protocol.CmdTCPOnlyNamespacesPage, packet.MessageIDBytes, packet.Namespace, pageResponse(page, more), psk)
+		respond()
+		break
+	case protocol.CmdTCPOnlyPeers:
+		// data is + or - and the peer to add or remove it, or empty to only list the peers
+		var peerErr error
+		data := packet.DataValueString()
+		if strings.HasPrefix(data, "+") {
+			peerErr = s.AddPeer(data[1:])
+		} else if strings.HasPrefix(data, "-") {
+			peerErr = s.RemovePeer(data[1:])
+		}
+		if peerErr != nil {
+			resPacket = protocol.NewPacketFromParts(protocol.ResError, packet.MessageIDBytes, packet.Namespace, []byte(peerErr.Error()), psk)
+		} else {
+			if data != "" {
+				s.errLog.Println("server peers changed by", remote, data, "and are now:", s.Peers())
+			}
+			resPacket = protocol.NewPacketFromParts(protocol.CmdTCPOnlyPeers, packet.MessageIDBytes, packet.Namespace, []byte(s.Peers()), psk)
+		}
+		respond()
+		break
+	case protocol.CmdTCPOnlyInfo:
+		info, _ := json.Marshal(s.Info()) // only strings and numbers, which always encode
+		resPacket = protocol.NewPacketFromParts(protocol.CmdTCPOnlyInfo, packet.MessageIDBytes, packet.Namespace, info, psk)
+		respond()
+		break
+	case protocol.CmdTCPOnlyNamespaces:
+		namespaces := s.store.Namespaces()
+		s.log.Println("Namespaces", packet.NamespaceString(), packet.DataValueString(), namespaces)
+		res := []byte(strings.Join(namespaces, "\n"))
+		if packet.DataValueString() == "q" {
+			res = protocol.JoinQuoted(namespaces)
+		}
+		resPacket = protocol.NewPacketFromParts(protocol.CmdTCPOnlyNamespaces, packet.MessageIDBytes, packet.Namespace, res, psk)
+		respond()
+		break
+	default:
+		resPacket = protocol.NewPacketFromParts(protocol.ResError, packet.MessageIDBytes, packet.Namespace, []byte("unknown_command_"+string(packet.Command)), psk)
+		respond()
+		break
+	}
+}
+
+// entryKeyOf is the key a put or count is for, which binary commands like CmdPutBytes prefix with its length.
+// Keys longer than Config.MaxValueLen are an error.
+func (s *Server) entryKeyOf(packet *protocol.Packet) (string, error) {
+	key := packet.DataValueString()
+	if packet.Command == protocol.CmdPutBytes || packet.Command == protocol.CmdCountBytes {
+		b, err := protocol.ReadLengthPrefixed(packet.DataValue)
+		if err != nil {
+			return "", err
+		}
+		key = string(b)
+	}
+	if packet.Command == protocol.CmdPutWeight {
+		// the weight before the key is checked by putWeightOf
+		parts := strings.SplitN(key, " ", 2)
+		key = parts[len(parts)-1]
+	}
+	if len(key) > s.conf.MaxValueLen {
+		return "", ErrValueTooLong
+	}
+	return key, nil
+}
+
+// putWeightOf is how many entries a put adds, which CmdPutWeight gives before the key, and is otherwise one
+func putWeightOf(packet *protocol.Packet) (int, error) {
+	if packet.Command != protocol.CmdPutWeight {
+		return 1, nil
+	}
+	parts := strings.SplitN(packet.DataValueString(), " ", 2)
+	weight, err := strconv.Atoi(parts[0])
+	if len(parts) != 2 || err != nil || weight < 1 || weight > protocol.MaxPutWeight {
+		return 0, protocol.ErrMalformedPacket
 	}
+	return weight, nil
 }
 
-// republish changes the packet for republication and sends to all peers as an 'R' command packet.
-func (s *Server) republish(packet protocol.Packet) {
+// parsePageRequest reads the decimal offset and limit, and the remaining key pattern, from a page request.
+// The limit is capped at MaxPageSize.
+func parsePageRequest(data string) (offset, limit int, keyPattern string) {
+	parts := strings.SplitN(data, " ", 3)
+	offset, _ = strconv.Atoi(parts[0])
+	if offset < 0 {
+		offset = 0
+	}
+	limit = MaxPageSize
+	if len(parts) > 1 {
+		if requested, err := strconv.Atoi(parts[1]); err == nil && requested < limit {
+			limit = requested
+		}
+	}
+	if len(parts) > 2 {
+		keyPattern = parts[2]
+	}
+	return offset, limit, keyPattern
+}
+
+// pageResponse is a line saying whether more remain after the page, followed by the page
+func pageResponse(page []string, more bool) []byte {
+	moreLine := "0"
+	if more {
+		moreLine = "1"
+	}
+	return []byte(strings.Join(append([]string{moreLine}, page...), "\n"))
+}
+
+// republish changes the packet for republication and sends it to all peers as the replicate command,
+// with the time it happened at prefixed to the key. Each peer is expected to ack the packet, otherwise
+// it will be resent by retryReplications.
+func (s *Server) republish(packet protocol.Packet, command byte, atMillis int64) {
+	entryKey := packet.DataValueString()
+	packet.DataValue = []byte(strconv.FormatInt(atMillis, 10) + " " + entryKey)
+	if len(packet.DataValue) > protocol.DataValueSize && command == protocol.CmdPutReplicateAt {
+		// the time does not fit with a key this long, so it goes without
+		command = protocol.CmdPutReplicate
+		packet.DataValue = []byte(entryKey)
+	}
+	// the client's message ID is only unique to that client, so replications get their own ID
+	packet.MessageID = atomic.AddUint32(&s.replicationIDCounter, 1)
+	packet.MessageIDBytes = protocol.Uint32ToBytes(packet.MessageID)
 	// re-hash the packet
-	packet.Command = protocol.CmdPutReplicate
-	packet.SetHash(s.preSharedKey)
+	packet.Command = command
+	packet.SetHash(s.signingKey())
 
 	b, err := packet.Bytes()
 	if err != nil {
@@ -325,19 +1162,124 @@ func (s *Server) republish(packet protocol.Packet) {
 		return
 	}
 
-	for _, peer := range s.peers {
-		_, err = s.conn.WriteToUDP(b, &peer)
+	peers := s.currentPeers()
+	for i := range peers {
+		peer := &peers[i]
+		s.replicationsOutstanding.Add(peer, packet.MessageID, b)
+		_, err = s.conn.WriteToUDP(b, peer)
 		if err != nil {
+			// it will be retried
 			s.log.Println("server error: replicating to", peer, err, packet.MessageID, packet.NamespaceString(), packet.DataValueString())
-			return
+			continue
 		}
 		s.log.Println("server replicated to peer:", peer, packet.MessageID, packet.NamespaceString(), packet.DataValueString())
 	}
 }
 
-func (s *Server) setupWorkers(numWorkers int) {
-	for w := 0; w <= numWorkers; w++ {
-		go s.worker(s.messageProcessing)
+// republishWeight is republish for a put of several entries, which goes to peers as one CmdPutWeightReplicate.
+// When the weight and time don't fit with the key, each entry is replicated on its own instead.
+func (s *Server) republishWeight(packet protocol.Packet, weight int, atMillis int64) {
+	entryKey := packet.DataValueString()
+	weighted := strconv.Itoa(weight) + " " + entryKey
+	if len(strconv.FormatInt(atMillis, 10))+1+len(weighted) > protocol.DataValueSize {
+		for i := 0; i < weight; i++ {
+			s.republish(packet, protocol.CmdPutReplicateAt, atMillis)
+		}
+		return
+	}
+	packet.DataValue = []byte(weighted)
+	s.republish(packet, protocol.CmdPutWeightReplicate, atMillis)
+}
+
+// applyReplication applies a put or delete replicated from a peer. Puts and deletes carry the time they
+// happened, so a put which crosses a delete on the wire is only applied when it came after the delete.
+// This compares the clocks of different servers, so it relies on peers keeping their clocks in sync.
+func (s *Server) applyReplication(remote *net.UDPAddr, packet *protocol.Packet) {
+	ns := packet.NamespaceString()
+	if packet.Command == protocol.CmdPutReplicate {
+		// from a peer which does not send the time
+		s.store.Put(ns, packet.DataValueString())
+		s.publishPut(ns, packet.DataValueString())
+		return
+	}
+	parts := strings.SplitN(packet.DataValueString(), " ", 2)
+	atMillis, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || len(parts) != 2 {
+		s.errLog.Println("server error: malformed replication from", remote, packet.MessageID, ns, packet.DataValueString())
+		return
+	}
+	entryKey := parts[1]
+	if packet.Command == protocol.CmdDeleteReplicate {
+		s.store.DeleteAt(ns, entryKey, atMillis, s.tombstoneFor())
+		return
+	}
+	weight := 1
+	if packet.Command == protocol.CmdPutWeightReplicate {
+		weightParts := strings.SplitN(entryKey, " ", 2)
+		weight, err = strconv.Atoi(weightParts[0])
+		if err != nil || len(weightParts) != 2 || weight < 1 || weight > protocol.MaxPutWeight {
+			s.errLog.Println("server error: malformed replication from", remote, packet.MessageID, ns, packet.DataValueString())
+			return
+		}
+		entryKey = weightParts[1]
+	}
+	if !s.store.PutWeightAt(ns, entryKey, atMillis, weight) {
+		s.log.Println("server ignored replicated put from before a delete:", remote, packet.MessageID, ns, entryKey)
+		return
+	}
+	s.publishPut(ns, entryKey)
+}
+
+// replicationWindow is how long a peer could be retrying a replication for
+func (s *Server) replicationWindow() time.Duration {
+	return s.replicationTimeout * time.Duration(s.replicationMaxRetries+2)
+}
+
+// tombstoneFor is how long deletes are remembered to ignore older replicated puts, which is only needed
+// with peers. With peer syncing, a peer can offer the deleted entries until they expire, so it is at least
+// the expiry.
+func (s *Server) tombstoneFor() time.Duration {
+	if !s.clustered() {
+		return 0
+	}
+	window := s.replicationWindow()
+	if expireAfter := time.Duration(s.expireAfterMillis) * time.Millisecond; s.peerSyncInterval > 0 && expireAfter > window {
+		return expireAfter
+	}
+	return window
+}
+
+// nowMillis is the current unix time in milliseconds
+func nowMillis() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// retryReplications must run in its own thread. It resends replications which peers did not ack in time,
+// until they run out of retries.
+func (s *Server) retryReplications() {
+	for {
+		time.Sleep(s.replicationTimeout / 2)
+		if s.isDisposed() {
+			return
+		}
+		retry, dropped := s.replicationsOutstanding.Due()
+		for _, p := range dropped {
+			s.log.Println("server error: peer never acked replication:", p.Peer, p.MessageID, "attempts", p.Attempts)
+		}
+		for _, p := range retry {
+			_, err := s.conn.WriteToUDP(p.Packet, p.Peer)
+			if err != nil {
+				s.log.Println("server error: retrying replication to", p.Peer, err, p.MessageID)
+				continue
+			}
+			s.log.Println("server retried replication to peer:", p.Peer, p.MessageID, "attempt", p.Attempts)
+		}
+	}
+}
+
+func (s *Server) setupWorkers(messages <-chan *rawmessage.RawMessage, numWorkers int) {
+	for w := 0; w < numWorkers; w++ {
+		go s.worker(messages)
 	}
 }
 
@@ -345,12 +1287,12 @@ func (s *Server) respondOrLogError(addr *net.UDPAddr, packet *protocol.Packet) {
 	s.log.Println("server sending packet:", addr, string(packet.Command), packet.MessageID, packet.NamespaceString(), packet.DataValueString())
 	b, err := packet.Bytes()
 	if err != nil {
-		log.Println("server error: constructing packet for response", addr, err, packet)
+		s.errLog.Println("server error: constructing packet for response", addr, err, packet)
 		return
 	}
 	_, err = s.conn.WriteToUDP(b, addr)
 	if err != nil {
-		log.Println("server error: responding", addr, err, packet)
+		s.errLog.Println("server error: responding", addr, err, packet)
 		return
 	}
 }
@@ -360,31 +1302,50 @@ func (s *Server) respondOrLogErrorTCP(packet *protocol.Packet) {
 	packet.DataValue = append(packet.DataValue, protocol.StopSymbol...)
 	b, err := packet.Bytes()
 	if err != nil && err != protocol.ErrBadOutputSize {
-		log.Println("server error: constructing tcp res", packet.RequestClient, err, "|", string(b), "|")
+		s.errLog.Println("server error: constructing tcp res", packet.RequestClient, err, "|", string(b), "|")
 		return
 	}
 	_, err = packet.RequestClient.Write(b)
 	if err != nil {
-		log.Println("server error: res from tcp write", packet.RequestClient, err, packet)
+		s.errLog.Println("server error: res from tcp write", packet.RequestClient, err, packet)
 		return
 	}
 }
 
-// Clear is for unit testing purposes. It will completely clear the data store.
+// Snapshot writes a backup of all entries in the store, which can be loaded with Restore.
+func (s *Server) Snapshot(w io.Writer) error {
+	return s.store.Snapshot(w)
+}
+
+// Restore loads a backup made by Snapshot into the store, dropping entries which have since expired.
+func (s *Server) Restore(r io.Reader) error {
+	return s.store.Restore(r)
+}
+
+// Reset removes every entry, such as to flush everything as an admin action. It is safe while requests are
+// being handled, which finish on either side of it. Configuration like fixed window namespaces is kept, and
+// peers are not told, so each server in a cluster must be reset.
+func (s *Server) Reset() error {
+	if s.isDisposed() {
+		return ErrServerClosed
+	}
+	s.store.Reset()
+	return nil
+}
+
+// Clear is for unit testing purposes. It will completely clear the data store. See Reset.
 func (s *Server) Clear() {
-	s.store = store.NewStore(s.expireAfterSecs)
+	s.store.Reset()
+}
+
+// isDisposed is true once Close was called
+func (s *Server) isDisposed() bool {
+	return atomic.LoadInt32(&s.disposed) == 1
 }
 
 // Peers provides an informational notice about which peers this server will publish to, not including self
 func (s *Server) Peers() string {
-	var peers string
-	for i, p := range s.peers {
-		if i != 0 {
-			peers += ","
-		}
-		peers += p.String()
-	}
-	return peers
+	return addrsString(s.currentPeers())
 }
 
 func (s *Server) httpRouter(w http.ResponseWriter, r *http.Request) {
@@ -1,11 +1,26 @@
 package server
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"github.com/mailsac/dracula/client"
+	"github.com/mailsac/dracula/protocol"
+	"github.com/mailsac/dracula/server/rawmessage"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"log"
+	"math"
 	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -97,19 +112,19 @@ func TestServer_Roundtrip(t *testing.T) {
 func TestServer_Replication(t *testing.T) {
 	peers := "127.0.0.1:9010,127.0.0.1:9020,127.0.0.1:9030"
 	// setup 3 servers
-	s1 := NewServerWithPeers(60, "asdf", "127.0.0.1:9010", peers)
+	s1 := MustNewServerWithPeers(60, "asdf", "127.0.0.1:9010", peers)
 	s1.DebugEnable("9010")
 	if err := s1.Listen(9010, 9010); err != nil {
 		t.Fatal(err)
 	}
 
-	s2 := NewServerWithPeers(60, "asdf", "127.0.0.1:9020", peers)
+	s2 := MustNewServerWithPeers(60, "asdf", "127.0.0.1:9020", peers)
 	s1.DebugEnable("9020")
 	if err := s2.Listen(9020, 9020); err != nil {
 		t.Fatal(err)
 	}
 
-	s3 := NewServerWithPeers(60, "asdf", "127.0.0.1:9030", peers)
+	s3 := MustNewServerWithPeers(60, "asdf", "127.0.0.1:9030", peers)
 	s3.DebugEnable("9030")
 	if err := s3.Listen(9030, 9030); err != nil {
 		t.Fatal(err)
@@ -169,6 +184,932 @@ func TestServer_Replication(t *testing.T) {
 	}
 }
 
+func TestNewServerWithPeers_Errors(t *testing.T) {
+	_, err := NewServerWithPeers(60, "", "127.0.0.1:9010", "127.0.0.1:9010,127.0.0.1:9020,nope:9030")
+	assert.ErrorIs(t, err, ErrBadPeersFormat)
+	assert.Contains(t, err.Error(), `"nope:9030"`, "names the peer which failed")
+	_, err = NewServerWithPeers(60, "", "127.0.0.1:9010", "127.0.0.1:9010,127.0.0.1")
+	assert.ErrorIs(t, err, ErrBadPeersFormat)
+	_, err = NewServerWithPeers(60, "", "127.0.0.1:notaport", "127.0.0.1:9020")
+	assert.ErrorIs(t, err, ErrBadSelfPeer)
+	_, err = NewServerWithPeers(60, "", "127.0.0.1:9010", "127.0.0.1:9010")
+	assert.ErrorIs(t, err, ErrNoPeers)
+	_, err = NewServerWithPeers(1, "", "127.0.0.1:9010", "127.0.0.1:9020")
+	assert.ErrorIs(t, err, ErrExpiryTooSmall)
+
+	assert.NoError(t, ValidatePeers("127.0.0.1:9010", "127.0.0.1:9010,127.0.0.1:9020"))
+	assert.ErrorIs(t, ValidatePeers("127.0.0.1:9010", ""), ErrNoPeers)
+	assert.Panics(t, func() { MustNewServerWithPeers(60, "", "127.0.0.1:9010", "bad") })
+}
+
+func TestNew(t *testing.T) {
+	_, err := New(Config{})
+	assert.ErrorIs(t, err, ErrExpiryTooSmall)
+	_, err = New(Config{ExpireAfter: time.Minute, SelfPeer: "127.0.0.1:9010", PeerList: "127.0.0.1:9010"})
+	assert.ErrorIs(t, err, ErrNoPeers)
+	_, err = New(Config{ExpireAfter: time.Minute, BindIP: "nope"})
+	assert.ErrorIs(t, err, ErrBadBindIP)
+
+	s, err := New(Config{
+		ExpireAfter:   250 * time.Millisecond,
+		PreSharedKeys: []string{"new", "old"},
+		SelfPeer:      "127.0.0.1:9010",
+		PeerList:      "127.0.0.1:9010,127.0.0.1:9020",
+		ReadOnly:      true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(250), s.expireAfterMillis)
+	assert.Equal(t, [][]byte{[]byte("new"), []byte("old")}, s.validKeys())
+	assert.Equal(t, "127.0.0.1:9020", s.Peers())
+	assert.True(t, s.conf.ReadOnly)
+	assert.Equal(t, DefaultMaxSubscriptions, s.conf.MaxSubscriptions, "has defaults")
+}
+
+func TestConfigFromFile(t *testing.T) {
+	path := t.TempDir() + "/dracula.json"
+	write := func(settings string) {
+		if err := ioutil.WriteFile(path, []byte(settings), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`{"ExpireAfter": "1m30s", "workers": 8, "ReadOnly": true, "ExpensiveRateLimit": 2.5,
+		"PeerList": "127.0.0.1:9010,127.0.0.1:9020", "FixedWindowNamespaces": ["quota", "daily"]}`)
+	conf, err := ConfigFromFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, Config{
+		ExpireAfter:           90 * time.Second,
+		Workers:               8,
+		ReadOnly:              true,
+		ExpensiveRateLimit:    2.5,
+		PeerList:              "127.0.0.1:9010,127.0.0.1:9020",
+		FixedWindowNamespaces: []string{"quota", "daily"},
+	}, conf)
+
+	for _, unknown := range []string{`{"Nope": 1}`, `{"Logger": {}}`} {
+		write(unknown)
+		_, err = ConfigFromFile(path)
+		assert.ErrorIs(t, err, ErrUnknownSetting, unknown)
+	}
+	for _, bad := range []string{
+		`{"Workers": [8]}`,
+		`{"Workers": "8"}`,
+		`{"Workers": 1.5}`,
+		`{"BindIP": ["127.0.0.1"]}`,
+		`{"ReadOnly": {"yes": true}}`,
+		`{"ExpireAfter": 60}`,
+		`{"ExpireAfter": "a minute"}`,
+		`{"FixedWindowNamespaces": "quota"}`,
+	} {
+		write(bad)
+		_, err = ConfigFromFile(path)
+		assert.ErrorIs(t, err, ErrBadSetting, bad)
+	}
+	write(`["ExpireAfter"]`)
+	_, err = ConfigFromFile(path)
+	assert.Error(t, err)
+	_, err = ConfigFromFile(path + ".missing")
+	assert.Error(t, err)
+}
+
+func TestServer_Discovery(t *testing.T) {
+	s := NewServer(60, "asdf")
+	assert.ErrorIs(t, s.EnableDiscovery("127.0.0.1:9200", "", 0), ErrBadDiscoveryName)
+	assert.ErrorIs(t, s.EnableDiscovery("127.0.0.1:9200", "localhost:port", 0), ErrBadDiscoveryName)
+	assert.ErrorIs(t, s.EnableDiscovery("127.0.0.1:nope", "localhost:9201", 0), ErrBadSelfPeer)
+	assert.NoError(t, s.EnableDiscovery("127.0.0.1:9200", "localhost:9201", 50*time.Millisecond))
+	defaulted := NewServer(60, "")
+	assert.NoError(t, defaulted.EnableDiscovery("127.0.0.1:9200", "_dracula._udp.example.com", 0))
+	assert.Equal(t, DefaultDiscoveryInterval, defaulted.discovery.interval)
+	if err := s.Listen(9200, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	peer := NewServer(60, "asdf")
+	if err := peer.Listen(9201, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Contains(t, s.Peers(), "127.0.0.1:9201")
+
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9200})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	b, err := protocol.NewPacket(protocol.CmdPut, 1, "default", "key", "asdf").Bytes()
+	assert.NoError(t, err)
+	_, err = conn.Write(b)
+	assert.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 1, peer.store.Count("default", "key"), "replicated to the discovered peer")
+}
+
+func TestServer_AddRemovePeer(t *testing.T) {
+	s := MustNewServerWithPeers(60, "asdf", "127.0.0.1:9204", "127.0.0.1:9204,127.0.0.1:9205")
+	assert.ErrorIs(t, s.AddPeer("localhost:9206"), ErrBadPeersFormat)
+	assert.ErrorIs(t, s.AddPeer("127.0.0.1:9204"), ErrPeerIsSelf)
+	assert.ErrorIs(t, s.RemovePeer("127.0.0.1:9206"), ErrPeerNotFound)
+	assert.NoError(t, s.AddPeer("127.0.0.1:9205"), "already a peer")
+	assert.Equal(t, "127.0.0.1:9205", s.Peers())
+	if err := s.Listen(9204, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	added := NewServer(60, "asdf")
+	if err := added.Listen(9206, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer added.Close()
+
+	// replicating while the peers change
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			s.republish(*protocol.NewPacket(protocol.CmdPut, 1, "default", "before", "asdf"), protocol.CmdPutReplicateAt, nowMillis())
+		}
+	}()
+	assert.NoError(t, s.AddPeer("127.0.0.1:9206"))
+	assert.NoError(t, s.RemovePeer("127.0.0.1:9205"))
+	wg.Wait()
+	assert.Equal(t, "127.0.0.1:9206", s.Peers())
+
+	s.republish(*protocol.NewPacket(protocol.CmdPut, 1, "default", "after", "asdf"), protocol.CmdPutReplicateAt, nowMillis())
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 1, added.store.Count("default", "after"), "replicated to the added peer")
+}
+
+// TestServer_ConcurrentReconfigure is for running with -race
+func TestServer_ConcurrentReconfigure(t *testing.T) {
+	s := MustNewServerWithPeers(60, "asdf", "127.0.0.1:9209", "127.0.0.1:9209,127.0.0.1:9210")
+	if err := s.Listen(9209, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9209})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			b, _ := protocol.NewPacket(protocol.CmdPut, uint32(i), "default", "key", "asdf").Bytes()
+			conn.Write(b)
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		assert.NoError(t, s.AddPeer("127.0.0.1:9211"))
+		s.Clear()
+		assert.NoError(t, s.RemovePeer("127.0.0.1:9211"))
+	}
+	wg.Wait()
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, "127.0.0.1:9210", s.Peers())
+}
+
+func TestServer_Reset(t *testing.T) {
+	s := NewServer(60, "asdf")
+	if err := s.Listen(9212, 0); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9212})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// resets while puts are being handled
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			b, _ := protocol.NewPacket(protocol.CmdPut, uint32(i), "ns"+strconv.Itoa(i%5), "key", "asdf").Bytes()
+			conn.Write(b)
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		assert.NoError(t, s.Reset())
+		time.Sleep(time.Millisecond)
+	}
+	wg.Wait()
+	time.Sleep(50 * time.Millisecond)
+
+	assert.NoError(t, s.Reset())
+	assert.Equal(t, 0, s.store.CountServerEntries())
+	s.store.Put("ns", "key")
+	assert.Equal(t, 1, s.store.Count("ns", "key"), "usable after a reset")
+
+	assert.NoError(t, s.Close())
+	assert.ErrorIs(t, s.Reset(), ErrServerClosed)
+}
+
+func TestServer_RejectsLineBreaks(t *testing.T) {
+	s := NewServer(60, "asdf")
+	if err := s.Listen(9227, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9227})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for i, value := range []string{"first\nsecond", "first\r\nsecond", "first\n.\nsecond"} {
+		b, _ := protocol.NewPacket(protocol.CmdPut, uint32(i), "ns", value, "asdf").Bytes()
+		_, err = conn.Write(b)
+		assert.NoError(t, err)
+		res := make([]byte, protocol.PacketSize)
+		assert.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+		_, err = conn.Read(res)
+		assert.NoError(t, err)
+		resPacket, _ := protocol.ParsePacket(res)
+		assert.Equal(t, protocol.ResError, resPacket.Command)
+		assert.Equal(t, protocol.ErrLineBreak.Error(), resPacket.DataValueString())
+	}
+	b, _ := protocol.NewPacket(protocol.CmdPut, 10, "ns\nother", "key", "asdf").Bytes()
+	conn.Write(b)
+	time.Sleep(50 * time.Millisecond)
+
+	assert.Empty(t, s.store.KeyMatch("ns", "*"), "the value must not split into the keys first and second")
+	assert.Empty(t, s.store.Namespaces())
+
+	res := httptest.NewRecorder()
+	s.restServer(res, httptest.NewRequest(http.MethodGet, "/put?namespace=ns&key=first%0Asecond", nil))
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+	assert.Empty(t, s.store.KeyMatch("ns", "*"))
+}
+
+func TestServer_ReplicationSelfAlternateAddress(t *testing.T) {
+	s := MustNewServerWithPeers(60, "asdf", "localhost:9080", "127.0.0.1:9080,127.0.0.1:9090")
+	assert.Equal(t, "127.0.0.1:9090", s.Peers(), "self should not be a peer when listed by IP")
+	s.DebugEnable("9080")
+	if err := s.Listen(9080, 9080); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// a replication which came from self is not counted
+	b, err := protocol.NewPacket(protocol.CmdPutReplicate, 1, "default", "asdf", "asdf").Bytes()
+	assert.NoError(t, err)
+	_, err = s.conn.WriteToUDP(b, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9080})
+	assert.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 0, s.store.Count("default", "asdf"))
+}
+
+func TestServer_SelfOnlyOnInterfaceAddrs(t *testing.T) {
+	s := MustNewServerWithPeers(60, "asdf", "127.0.0.1:9265", "127.0.0.1:9265,127.0.0.2:9265")
+	assert.Equal(t, "127.0.0.2:9265", s.Peers(), "another loopback IP is not self")
+	assert.True(t, s.isSelf(&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9265}))
+	assert.False(t, s.isSelf(&net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 9265}))
+	assert.False(t, s.isSelf(&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9266}))
+
+	// another interface of this host is self, unless the server only binds to the self IP
+	addrs, err := net.InterfaceAddrs()
+	assert.NoError(t, err)
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() {
+			continue
+		}
+		other := &net.UDPAddr{IP: ipNet.IP, Port: 9265}
+		assert.True(t, s.isSelf(other), other)
+		assert.NoError(t, s.Configure(Config{BindIP: "127.0.0.1"}))
+		assert.False(t, s.isSelf(other), other)
+		break
+	}
+}
+
+func TestServer_ReplicationRetried(t *testing.T) {
+	peers := "127.0.0.1:9040,127.0.0.1:9050"
+	s1 := MustNewServerWithPeers(60, "asdf", "127.0.0.1:9040", peers)
+	s1.replicationTimeout = 100 * time.Millisecond
+	s1.DebugEnable("9040")
+	if err := s1.Listen(9040, 9040); err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+
+	c := client.NewClient(client.Config{RemoteUDPIPPortList: "127.0.0.1:9040", PreSharedKey: "asdf"})
+	c.DebugEnable("9001")
+	if err := c.Listen(9001); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// second peer is not up yet, so the first replication attempt is lost
+	assert.NoError(t, c.Put("default", "asdf"))
+	time.Sleep(20 * time.Millisecond) // replication happens after responding
+	assert.Equal(t, 1, s1.replicationsOutstanding.Len())
+
+	s2 := MustNewServerWithPeers(60, "asdf", "127.0.0.1:9050", peers)
+	s2.DebugEnable("9050")
+	if err := s2.Listen(9050, 9050); err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+
+	time.Sleep(250 * time.Millisecond)
+	assert.Equal(t, 1, s2.store.Count("default", "asdf"), "replication should have been retried")
+	assert.Equal(t, 0, s1.replicationsOutstanding.Len(), "retried replication should have been acked")
+
+	// a repeated replication, like when an ack gets lost, is not double counted
+	b, err := protocol.NewPacket(protocol.CmdPutReplicate, 777, "default", "dup", "asdf").Bytes()
+	assert.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, err = s1.conn.WriteToUDP(b, &s1.peers[0])
+		assert.NoError(t, err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 1, s2.store.Count("default", "dup"))
+}
+
+func TestServer_ReplicatedDelete(t *testing.T) {
+	peers := "127.0.0.1:9193,127.0.0.1:9194"
+	s1 := MustNewServerWithPeers(60, "asdf", "127.0.0.1:9193", peers)
+	if err := s1.Listen(9193, 9193); err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+	s2 := MustNewServerWithPeers(60, "asdf", "127.0.0.1:9194", peers)
+	if err := s2.Listen(9194, 9194); err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+
+	c := client.NewClient(client.Config{RemoteUDPIPPortList: "127.0.0.1:9193", PreSharedKey: "asdf"})
+	if err := c.Listen(9195); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	assert.NoError(t, c.Put("default", "k"))
+	assert.NoError(t, c.Put("default", "k"))
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, 2, s2.store.Count("default", "k"))
+
+	beforeDelete := nowMillis()
+	time.Sleep(5 * time.Millisecond)
+	deleted, err := c.Delete("default", "k")
+	assert.NoError(t, err)
+	assert.True(t, deleted)
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, 0, s1.store.Count("default", "k"))
+	assert.Equal(t, 0, s2.store.Count("default", "k"), "delete should replicate")
+
+	replicate := func(messageID uint32, command byte, atMillis int64) {
+		data := strconv.FormatInt(atMillis, 10) + " k"
+		b, err := protocol.NewPacket(command, messageID, "default", data, "asdf").Bytes()
+		assert.NoError(t, err)
+		_, err = s1.conn.WriteToUDP(b, &s1.peers[0])
+		assert.NoError(t, err)
+		time.Sleep(30 * time.Millisecond)
+	}
+
+	// a put from before the delete, which crossed it on the wire, arrives late
+	replicate(1001, protocol.CmdPutReplicateAt, beforeDelete)
+	assert.Equal(t, 0, s2.store.Count("default", "k"), "older put should not resurrect the key")
+
+	// a put after the delete still applies
+	assert.NoError(t, c.Put("default", "k"))
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, 1, s1.store.Count("default", "k"))
+	assert.Equal(t, 1, s2.store.Count("default", "k"))
+
+	// a delete from before that put, arriving late, leaves it
+	replicate(1002, protocol.CmdDeleteReplicate, beforeDelete)
+	assert.Equal(t, 1, s2.store.Count("default", "k"))
+
+	deleted, err = c.Delete("default", "missing")
+	assert.NoError(t, err)
+	assert.False(t, deleted)
+}
+
+func TestServer_PeerSync(t *testing.T) {
+	peers := "127.0.0.1:9060,127.0.0.1:9070"
+	s1 := MustNewServerWithPeers(60, "asdf", "127.0.0.1:9060", peers)
+	s1.SetPeerSyncInterval(0)
+	s1.DebugEnable("9060")
+	if err := s1.Listen(9060, 9060); err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+
+	s2 := MustNewServerWithPeers(60, "asdf", "127.0.0.1:9070", peers)
+	s2.SetPeerSyncInterval(0)
+	s2.DebugEnable("9070")
+	if err := s2.Listen(9070, 9070); err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+
+	// entries put directly in the store are not replicated, like when a peer was down
+	s1.store.Put("default", "a")
+	s1.store.Put("default", "a")
+	s1.store.Put("default", "a")
+	s1.store.Put("default", "b")
+	s1.store.Put("other", "c")
+	s1.store.Put("other", "c")
+	s2.store.Put("default", "a")
+	s2.store.Put("third", "d")
+
+	s1.syncPeers()
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Equal(t, 3, s2.store.Count("default", "a"))
+	assert.Equal(t, 1, s2.store.Count("default", "b"))
+	assert.Equal(t, 2, s2.store.Count("other", "c"))
+	// extra entries are left alone
+	assert.Equal(t, 1, s2.store.Count("third", "d"))
+	assert.Equal(t, 0, s1.store.Count("third", "d"))
+
+	// syncing again does not double count
+	s1.syncPeers()
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 3, s2.store.Count("default", "a"))
+	assert.Equal(t, 7, s2.store.CountServerEntries())
+}
+
+func TestServer_PeerSyncAfterDelete(t *testing.T) {
+	peers := "127.0.0.1:9261,127.0.0.1:9262"
+	s1 := MustNewServerWithPeers(60, "asdf", "127.0.0.1:9261", peers)
+	s1.SetPeerSyncInterval(0)
+	if err := s1.Listen(9261, 9261); err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+
+	s2 := MustNewServerWithPeers(60, "asdf", "127.0.0.1:9262", peers)
+	s2.SetPeerSyncInterval(0)
+	if err := s2.Listen(9262, 9262); err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+
+	// the delete on s2 never reached s1
+	s1.store.Put("default", "k")
+	s1.store.Put("default", "k")
+	s1.store.Put("default", "healed")
+	s2.store.Put("default", "k")
+	time.Sleep(2 * time.Millisecond)
+	assert.True(t, s2.store.DeleteAt("default", "k", nowMillis(), s2.tombstoneFor()))
+
+	s1.syncPeers()
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 0, s2.store.Count("default", "k"), "sync should not resurrect the deleted key")
+	assert.Equal(t, 1, s2.store.Count("default", "healed"))
+
+	// a put after the delete is healed
+	time.Sleep(2 * time.Millisecond)
+	s1.store.Put("default", "k")
+	s1.syncPeers()
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 3, s2.store.Count("default", "k"))
+}
+
+func TestServer_SyncDigestLimits(t *testing.T) {
+	peers := "127.0.0.1:9060,127.0.0.1:9070"
+	s := MustNewServerWithPeers(60, "asdf", "127.0.0.1:9060", peers)
+	peer := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9070}
+	digest := func(count uint32, entryKey string) *protocol.Packet {
+		data := append(protocol.Uint32ToBytes(count), []byte(strconv.FormatInt(nowMillis(), 10)+" "+entryKey)...)
+		return protocol.NewPacketFromParts(protocol.CmdSyncDigest, protocol.Uint32ToBytes(0), []byte("default"), data, []byte("asdf"))
+	}
+
+	s.handleSyncDigest(&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9080}, digest(3, "k"))
+	assert.Equal(t, 0, s.store.Count("default", "k"), "digests from non-peers are ignored")
+
+	s.handleSyncDigest(peer, digest(3, "k"))
+	assert.Equal(t, 3, s.store.Count("default", "k"))
+
+	s.handleSyncDigest(peer, digest(math.MaxUint32, "big"))
+	assert.Equal(t, maxSyncHealEntries, s.store.Count("default", "big"), "healing is capped")
+}
+
+func TestServer_CloseConcurrent(t *testing.T) {
+	NewServer(60, "").Close()
+	failed := NewServer(60, "")
+	assert.Error(t, failed.Listen(-1, 0))
+	assert.NoError(t, failed.Close(), "after a failed listen")
+
+	s := NewServer(60, "")
+	s.Configure(Config{QueueSize: 1, Workers: 1, TCPQueueSize: 1, TCPWorkers: 1})
+	if err := s.Listen(9256, 9256); err != nil {
+		t.Fatal(err)
+	}
+	// keep the queues full, so readers are blocked sending to them as it closes
+	stop := make(chan struct{})
+	defer close(stop)
+	udp, err := net.Dial("udp", "127.0.0.1:9256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	tcp, err := net.Dial("tcp", "127.0.0.1:9256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	put, _ := protocol.NewPacketFromParts(protocol.CmdPut, protocol.Uint32ToBytes(1), []byte("ns"), []byte("key"), []byte("")).Bytes()
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				udp.Write(put)
+				tcp.Write(append(append([]byte{}, put...), protocol.StopSymbol...))
+			}
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Close()
+		}()
+	}
+	wg.Wait()
+	// readers which were blocked must not panic sending to a closed queue
+	time.Sleep(50 * time.Millisecond)
+	assert.True(t, s.isDisposed())
+}
+
+func TestServer_TCPIdleTimeout(t *testing.T) {
+	s := NewServer(60, "")
+	assert.NoError(t, s.Configure(Config{TCPIdleTimeout: 200 * time.Millisecond}))
+	if err := s.Listen(9100, 9100); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:9100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the server hangs up on the silent connection, well before this deadline
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	start := time.Now()
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err)
+	assert.Less(t, int64(time.Since(start)), int64(2*time.Second), "connection should close when idle")
+
+	assert.ErrorIs(t, s.Configure(Config{}), ErrServerAlreadyInit)
+}
+
+func TestServer_UDPQueueMetrics(t *testing.T) {
+	s := NewServer(60, "")
+	assert.NoError(t, s.Configure(Config{QueueSize: 3}))
+	if err := s.Listen(9243, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	assert.Equal(t, float64(3), testutil.ToFloat64(s.metrics.udpQueueCapacity))
+	assert.Equal(t, float64(0), testutil.ToFloat64(s.metrics.udpQueueLength))
+	assert.Equal(t, float64(0), testutil.ToFloat64(s.metrics.udpQueueFull))
+	assert.Equal(t, float64(0), testutil.ToFloat64(s.metrics.udpReadErrors))
+}
+
+func TestServer_QueueFullTimeout(t *testing.T) {
+	s := NewServer(60, "")
+	s.udpMessages = make(chan *rawmessage.RawMessage, 1)
+	s.udpMessages <- rawmessage.NewPooled()
+
+	s.conf.QueueFullTimeout = -1
+	s.enqueueUDP(rawmessage.NewPooled())
+	assert.Equal(t, float64(1), testutil.ToFloat64(s.metrics.udpDropped), "dropped straight away")
+
+	s.conf.QueueFullTimeout = 10 * time.Millisecond
+	s.enqueueUDP(rawmessage.NewPooled())
+	assert.Equal(t, float64(2), testutil.ToFloat64(s.metrics.udpDropped), "dropped after waiting")
+
+	s.conf.QueueFullTimeout = time.Second
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		(<-s.udpMessages).Release()
+	}()
+	s.enqueueUDP(rawmessage.NewPooled())
+	assert.Equal(t, float64(2), testutil.ToFloat64(s.metrics.udpDropped), "queued once a worker took one")
+	assert.Equal(t, float64(3), testutil.ToFloat64(s.metrics.udpQueueFull))
+	assert.Len(t, s.udpMessages, 1)
+}
+
+func TestServer_OnKeyExpired(t *testing.T) {
+	s := NewServer(60, "")
+	defer s.Close()
+	queue := make(chan expiredKey, 1)
+	s.queueExpiredKey(queue, expiredKey{namespace: "limits", key: "10.0.0.1"})
+	s.queueExpiredKey(queue, expiredKey{namespace: "limits", key: "10.0.0.2"})
+	assert.Equal(t, float64(1), testutil.ToFloat64(s.metrics.keyExpiredDropped), "dropped while the handler is behind")
+
+	expired := make(chan string, 2)
+	go s.notifyKeyExpiredForever(queue, func(namespace, key string) {
+		expired <- namespace + " " + key
+	})
+	select {
+	case key := <-expired:
+		assert.Equal(t, "limits 10.0.0.1", key)
+	case <-time.After(time.Second):
+		t.Fatal("expired key was not passed to the handler")
+	}
+}
+
+func TestServer_OnKeyExpiredReplaced(t *testing.T) {
+	s := NewServer(60, "")
+	defer s.Close()
+	goroutines := runtime.NumGoroutine()
+	expired := make(chan string, 1)
+	for i := 0; i < 10; i++ {
+		s.OnKeyExpired(func(namespace, key string) {
+			t.Error("a replaced handler was called")
+		})
+		s.OnKeyExpired(nil)
+	}
+	s.OnKeyExpired(func(namespace, key string) {
+		expired <- namespace + " " + key
+	})
+	assert.LessOrEqual(t, runtime.NumGoroutine(), goroutines+1, "handlers share one goroutine")
+
+	s.queueExpiredKey(s.keyExpiredQueue, expiredKey{namespace: "limits", key: "10.0.0.1"})
+	select {
+	case key := <-expired:
+		assert.Equal(t, "limits 10.0.0.1", key)
+	case <-time.After(time.Second):
+		t.Fatal("expired key was not passed to the current handler")
+	}
+}
+
+func TestServer_PublishDropsSlowSubscriber(t *testing.T) {
+	s := NewServer(60, "")
+	defer s.Close()
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	conn, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// not streamed, like a subscriber which stopped reading
+	sub := &subscription{namespace: "ns", match: func(string) bool { return true }, conn: conn, keys: make(chan string, 2), done: make(chan struct{})}
+	s.subscriptions.subs = map[*subscription]struct{}{sub: {}}
+	s.subscriptions.count = 1
+
+	s.publishPut("other", "k")
+	s.publishPut("ns", "k")
+	s.publishPut("ns", "k")
+	assert.Len(t, sub.keys, 2)
+	assert.Equal(t, float64(0), testutil.ToFloat64(s.metrics.subscriptionsDropped))
+	s.publishPut("ns", "k")
+	assert.Equal(t, float64(1), testutil.ToFloat64(s.metrics.subscriptionsDropped))
+	assert.Empty(t, s.subscriptions.subs)
+	assert.Equal(t, int32(0), s.subscriptions.count)
+	select {
+	case <-sub.done:
+	default:
+		t.Fatal("dropped subscription was not ended")
+	}
+}
+
+func TestServer_MaxTCPConns(t *testing.T) {
+	s := NewServer(60, "")
+	assert.NoError(t, s.Configure(Config{MaxTCPConns: 1}))
+	if err := s.Listen(9110, 9110); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	first, err := net.Dial("tcp", "127.0.0.1:9110")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond) // accepted
+	assert.Equal(t, float64(1), testutil.ToFloat64(s.metrics.tcpConnections))
+
+	second, err := net.Dial("tcp", "127.0.0.1:9110")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	assert.NoError(t, second.SetReadDeadline(time.Now().Add(5*time.Second)))
+	res, err := ioutil.ReadAll(second)
+	assert.NoError(t, err, "rejected connection should be closed by the server")
+	assert.Contains(t, string(res), ErrTooManyTCPConns.Error())
+	assert.Equal(t, float64(1), testutil.ToFloat64(s.metrics.tcpConnectionsRejected))
+
+	// closing frees the slot
+	first.Close()
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, float64(0), testutil.ToFloat64(s.metrics.tcpConnections))
+	third, err := net.Dial("tcp", "127.0.0.1:9110")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer third.Close()
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, float64(1), testutil.ToFloat64(s.metrics.tcpConnections))
+}
+
+func TestServer_NamespaceMetrics(t *testing.T) {
+	s := NewServer(60, "")
+	assert.NoError(t, s.Configure(Config{NamespaceMetricsLimit: 2}))
+	for i := 0; i < 3; i++ {
+		s.store.Put("big", "a")
+	}
+	s.store.Put("medium", "a")
+	s.store.Put("medium", "b")
+	s.store.Put("small", "a")
+
+	s.refreshNamespaceMetrics()
+	assert.Equal(t, 2, testutil.CollectAndCount(s.metrics.namespaceEntries), "limited to the largest namespaces")
+	assert.Equal(t, float64(3), testutil.ToFloat64(s.metrics.namespaceEntries.WithLabelValues("big")))
+	assert.Equal(t, float64(2), testutil.ToFloat64(s.metrics.namespaceEntries.WithLabelValues("medium")))
+}
+
+func TestServer_BuildInfoMetrics(t *testing.T) {
+	s := NewServer(60, "")
+	assert.NoError(t, s.Configure(Config{Version: "v1.2.3"}))
+	if err := s.Listen(9140, 9140); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(s.metrics.buildInfo.WithLabelValues("v1.2.3", "unknown")))
+	assert.InDelta(t, float64(time.Now().Unix()), testutil.ToFloat64(s.metrics.startTime), 2)
+}
+
+func TestServer_SlowOperations(t *testing.T) {
+	var logs bytes.Buffer
+	s := NewServer(60, "")
+	assert.NoError(t, s.Configure(Config{SlowThreshold: 10 * time.Millisecond, Logger: log.New(&logs, "", 0)}))
+	packet := protocol.NewPacket(protocol.CmdCountServer, 1, "things", "user:*", "")
+
+	s.observeRequest(packet, time.Now())
+	assert.Equal(t, float64(0), testutil.ToFloat64(s.metrics.slowOperations.WithLabelValues("S")))
+	assert.Empty(t, logs.String())
+
+	s.observeRequest(packet, time.Now().Add(-20*time.Millisecond))
+	assert.Equal(t, float64(1), testutil.ToFloat64(s.metrics.slowOperations.WithLabelValues("S")))
+	assert.Contains(t, logs.String(), "server slow operation: S things user:*")
+	assert.Equal(t, 1, testutil.CollectAndCount(s.metrics.requestDuration), "every request is timed")
+
+	// disabled by default
+	s = NewServer(60, "")
+	s.observeRequest(packet, time.Now().Add(-time.Hour))
+	assert.Equal(t, float64(0), testutil.ToFloat64(s.metrics.slowOperations.WithLabelValues("S")))
+}
+
+func TestPutWeightOf(t *testing.T) {
+	for data, want := range map[string]int{"3 key": 3, "1000 a key": 1000, "0 key": 0, "1001 key": 0, "key": 0, "x key": 0} {
+		weight, err := putWeightOf(&protocol.Packet{Command: protocol.CmdPutWeight, DataValue: []byte(data)})
+		assert.Equal(t, want, weight, data)
+		if want == 0 {
+			assert.ErrorIs(t, err, protocol.ErrMalformedPacket, data)
+		}
+	}
+	weight, err := putWeightOf(&protocol.Packet{Command: protocol.CmdPut, DataValue: []byte("3 key")})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, weight, "other puts add one entry")
+}
+
+func TestRateLimiter(t *testing.T) {
+	r := newRateLimiter(2, 3)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		assert.True(t, r.allow("10.0.0.1", now), "within the burst")
+	}
+	assert.False(t, r.allow("10.0.0.1", now))
+	assert.True(t, r.allow("10.0.0.2", now), "each address has its own bucket")
+
+	// refills at the rate
+	assert.True(t, r.allow("10.0.0.1", now.Add(500*time.Millisecond)))
+	assert.False(t, r.allow("10.0.0.1", now.Add(500*time.Millisecond)))
+
+	r.cleanup(now.Add(time.Second))
+	assert.Len(t, r.buckets, 1, "10.0.0.2 refilled so is dropped")
+	r.cleanup(now.Add(10 * time.Second))
+	assert.Len(t, r.buckets, 0)
+}
+
+func TestIsExpensiveCmd(t *testing.T) {
+	assert.True(t, isExpensiveCmd(protocol.CmdCountServer))
+	assert.True(t, isExpensiveCmd(protocol.CmdTCPOnlyNamespaces), "cleans up the whole store")
+	assert.True(t, isExpensiveCmd(protocol.CmdTCPOnlyNamespacesPage))
+	assert.False(t, isExpensiveCmd(protocol.CmdPut))
+	assert.False(t, isExpensiveCmd(protocol.CmdCount))
+}
+
+func TestServer_RequestTimeout(t *testing.T) {
+	s := NewServer(60, "asdf")
+	assert.NoError(t, s.Configure(Config{RequestTimeout: time.Nanosecond}))
+	if err := s.Listen(9213, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9213})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	b, err := protocol.NewPacket(protocol.CmdCountServer, 7, "", "", "asdf").Bytes()
+	assert.NoError(t, err)
+	_, err = conn.Write(b)
+	assert.NoError(t, err)
+	res := make([]byte, protocol.PacketSize)
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = conn.Read(res)
+	assert.NoError(t, err)
+	resPacket, err := protocol.ParsePacket(res)
+	assert.NoError(t, err)
+	assert.Equal(t, protocol.ResError, resPacket.Command)
+	assert.Equal(t, uint32(7), resPacket.MessageID)
+	assert.Equal(t, ErrRequestTimedOut.Error(), resPacket.DataValueString())
+	assert.Equal(t, float64(1), testutil.ToFloat64(s.metrics.requestsTimedOut))
+}
+
+func TestServer_BindIP(t *testing.T) {
+	s := NewServer(60, "")
+	assert.ErrorIs(t, s.Configure(Config{BindIP: "localhost"}), ErrBadBindIP)
+	assert.NoError(t, s.Configure(Config{BindIP: "127.0.0.1"}))
+	if err := s.Listen(9150, 9150); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	assert.Equal(t, "127.0.0.1:9150", s.conn.LocalAddr().String())
+	assert.Equal(t, "127.0.0.1:9150", s.tcpConn.Addr().String())
+}
+
+func TestServer_ListenSingleTransport(t *testing.T) {
+	assert.ErrorIs(t, NewServer(60, "").Listen(0, 0), ErrNoListeners)
+	assert.ErrorIs(t, MustNewServerWithPeers(60, "", "127.0.0.1:9160", "127.0.0.1:9160,127.0.0.1:9170").Listen(0, 9160), ErrPeersNeedUDP)
+	assert.NoError(t, NewServer(60, "").Close(), "closing a server which never listened")
+
+	udpOnly := NewServer(60, "")
+	if err := udpOnly.Listen(9160, 0); err != nil {
+		t.Fatal(err)
+	}
+	c := client.NewClient(client.Config{RemoteUDPIPPortList: "127.0.0.1:9160"})
+	if err := c.Listen(9161); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	assert.NoError(t, c.Put("default", "asdf"))
+	_, err := net.Dial("tcp", "127.0.0.1:9160")
+	assert.Error(t, err, "tcp should be disabled")
+	assert.ErrorIs(t, udpOnly.Listen(9160, 0), ErrServerAlreadyInit)
+	assert.NoError(t, udpOnly.Close())
+
+	tcpOnly := NewServer(60, "")
+	if err := tcpOnly.Listen(0, 9170); err != nil {
+		t.Fatal(err)
+	}
+	tc := client.NewClient(client.Config{RemoteTCPIPPortList: "127.0.0.1:9170"})
+	defer tc.Close()
+	_, err = tc.ListNamespaces()
+	assert.NoError(t, err)
+	assert.Nil(t, tcpOnly.conn)
+	assert.NoError(t, tcpOnly.Close())
+}
+
+func TestServer_HealthcheckDoesNotTouchStore(t *testing.T) {
+	s := NewServer(60, "")
+	if err := s.Listen(9180, 9180); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	c := client.NewClient(client.Config{RemoteUDPIPPortList: "127.0.0.1:9180"})
+	if err := c.Listen(9181); err != nil { // healthchecks the server
+		t.Fatal(err)
+	}
+	defer c.Close()
+	assert.NoError(t, c.Healthcheck(&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9180}))
+
+	assert.Empty(t, s.store.Namespaces())
+	assert.Equal(t, 0, s.store.CountServerEntries())
+}
+
 func TestServer_MultipleClientsNoPanic(t *testing.T) {
 	// setup
 	s := NewServer(60, "")
@@ -311,6 +1252,249 @@ func TestServer_MultipleClientsNoPanic(t *testing.T) {
 	wg.Wait()
 }
 
+func TestServer_Millis(t *testing.T) {
+	assert.PanicsWithValue(t, ErrExpiryTooSmall, func() { NewServerMillis(MinimumExpiryMillis-1, "") })
+
+	s := NewServerMillis(250, "")
+	s.store.Put("default", "burst")
+	assert.Equal(t, 1, s.store.Count("default", "burst"))
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, 0, s.store.Count("default", "burst"))
+	assert.Equal(t, int64(250), s.Info().ExpireAfterMillis)
+}
+
+func TestServer_InfoREST(t *testing.T) {
+	s := NewServer(30, "")
+	res := httptest.NewRecorder()
+	s.restServer(res, httptest.NewRequest(http.MethodGet, "/info", nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	var info Info
+	assert.NoError(t, json.Unmarshal(res.Body.Bytes(), &info))
+	assert.Equal(t, Info{Version: "unknown", Build: "unknown", ExpireAfterSecs: 30, ExpireAfterMillis: 30000, Storage: "memory"}, info)
+
+	authed := NewServer(30, "secret")
+	authed.SetPreSharedKeys("secret", "old")
+	for _, header := range []string{"", "Bearer nope", "secret"} {
+		res = httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/info", nil)
+		req.Header.Set("Authorization", header)
+		authed.restServer(res, req)
+		assert.Equal(t, http.StatusUnauthorized, res.Code, header)
+		assert.NotContains(t, res.Body.String(), "expireAfter")
+	}
+	for _, key := range []string{"secret", "old"} {
+		res = httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/info", nil)
+		req.Header.Set("Authorization", "Bearer "+key)
+		authed.restServer(res, req)
+		assert.Equal(t, http.StatusOK, res.Code, key)
+	}
+}
+
+func TestServer_ReadOnlyREST(t *testing.T) {
+	s := NewServer(30, "")
+	assert.NoError(t, s.Configure(Config{ReadOnly: true}))
+	res := httptest.NewRecorder()
+	s.restServer(res, httptest.NewRequest(http.MethodGet, "/put?namespace=ns&key=k", nil))
+	assert.Equal(t, http.StatusForbidden, res.Code)
+	assert.Contains(t, res.Body.String(), ErrReadOnly.Error())
+	assert.Equal(t, 0, s.store.Count("ns", "k"))
+	assert.True(t, s.Info().ReadOnly)
+
+	line := fmt.Sprintf(`{"namespace":"ns","key":"k","expireAt":%d}`, time.Now().Unix()+60)
+	res = httptest.NewRecorder()
+	s.restServer(res, httptest.NewRequest(http.MethodPost, "/import", strings.NewReader(line)))
+	assert.Equal(t, http.StatusForbidden, res.Code)
+	assert.Contains(t, res.Body.String(), ErrReadOnly.Error())
+	assert.Equal(t, 0, s.store.Count("ns", "k"))
+}
+
+func TestServer_SubscribeLimitConcurrent(t *testing.T) {
+	s := NewServer(30, "")
+	assert.NoError(t, s.Configure(Config{MaxSubscriptions: 3}))
+	defer s.Close()
+	b, err := protocol.NewPacket(protocol.CmdTCPOnlySubscribe, 1, "ns", "", "").Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the subscribers' connections only need to take the responses
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var opened int32
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < 50; i++ {
+		conn, err := net.DialTCP("tcp", nil, ln.Addr().(*net.TCPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			if s.subscribe(&rawmessage.RawMessage{Message: b, MaybeTcpClient: conn}) != nil {
+				atomic.AddInt32(&opened, 1)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	assert.Equal(t, int32(3), opened)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&s.subscriptions.count))
+}
+
+func TestServer_MaxValueLen(t *testing.T) {
+	s := NewServer(30, "")
+	assert.ErrorIs(t, s.Configure(Config{MaxValueLen: protocol.DataValueSize + 1}), ErrBadMaxValueLen)
+	assert.NoError(t, s.Configure(Config{MaxValueLen: 4}))
+	res := httptest.NewRecorder()
+	s.restServer(res, httptest.NewRequest(http.MethodGet, "/put?namespace=ns&key=12345", nil))
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+	assert.Contains(t, res.Body.String(), ErrValueTooLong.Error())
+	assert.Equal(t, 0, s.store.Count("ns", "12345"))
+}
+
+func TestServer_HealthReadiness(t *testing.T) {
+	peers := "127.0.0.1:9120,127.0.0.1:9130"
+	s1 := MustNewServerWithPeers(60, "asdf", "127.0.0.1:9120", peers)
+	s1.replicationTimeout = 50 * time.Millisecond
+	s1.replicationMaxRetries = 1
+
+	probe := func(path string) (int, HealthResponse) {
+		res := httptest.NewRecorder()
+		s1.restServer(res, httptest.NewRequest(http.MethodGet, path, nil))
+		var health HealthResponse
+		assert.NoError(t, json.Unmarshal(res.Body.Bytes(), &health))
+		return res.Code, health
+	}
+
+	code, health := probe("/healthz")
+	assert.Equal(t, http.StatusServiceUnavailable, code, "not listening yet")
+	assert.Equal(t, "unavailable", health.Status)
+	assert.Equal(t, "ok", health.Store)
+
+	if err := s1.Listen(9120, 9120); err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+	code, _ = probe("/healthz")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = probe("/readyz")
+	assert.Equal(t, http.StatusOK, code)
+
+	c := client.NewClient(client.Config{RemoteUDPIPPortList: "127.0.0.1:9120", PreSharedKey: "asdf"})
+	if err := c.Listen(9121); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// the peer is down, so the replication is dropped after its retry
+	assert.NoError(t, c.Put("default", "asdf"))
+	time.Sleep(250 * time.Millisecond)
+	code, health = probe("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, []string{"127.0.0.1:9130"}, health.UnreachablePeers)
+	code, _ = probe("/healthz")
+	assert.Equal(t, http.StatusOK, code, "peers do not affect liveness")
+
+	s2 := MustNewServerWithPeers(60, "asdf", "127.0.0.1:9130", peers)
+	if err := s2.Listen(9130, 9130); err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	assert.NoError(t, c.Put("default", "asdf"))
+	time.Sleep(50 * time.Millisecond)
+	code, health = probe("/readyz")
+	assert.Equal(t, http.StatusOK, code, "peer acked again")
+	assert.Equal(t, "ok", health.Status)
+}
+
+func TestServer_ExportImportNDJSON(t *testing.T) {
+	s := NewServer(60, "")
+	s.store.Put("default", "asdf")
+	s.store.Put("default", "asdf")
+	s.store.Put("other", "jkl")
+
+	res := httptest.NewRecorder()
+	s.restServer(res, httptest.NewRequest(http.MethodGet, "/export", nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+	lines := strings.Split(strings.TrimSpace(res.Body.String()), "\n")
+	assert.Len(t, lines, 3)
+	var entry ExportEntry
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &entry))
+	assert.Greater(t, entry.ExpireAt, time.Now().Unix())
+
+	expired := `{"namespace":"default","key":"gone","expireAt":1}`
+	body := res.Body.String() + expired + "\n"
+	s2 := NewServer(60, "")
+	res = httptest.NewRecorder()
+	s2.restServer(res, httptest.NewRequest(http.MethodPost, "/import", strings.NewReader(body)))
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.JSONEq(t, `{"count":3}`, res.Body.String())
+	assert.Equal(t, 2, s2.store.Count("default", "asdf"))
+	assert.Equal(t, 1, s2.store.Count("other", "jkl"))
+	assert.Equal(t, 0, s2.store.Count("default", "gone"))
+
+	imported, err := s2.ImportNDJSON(strings.NewReader(`{"namespace":"default","key":"asdf","expireAt":` + strconv.FormatInt(time.Now().Unix()+30, 10) + "}\n{bad"))
+	assert.Error(t, err)
+	assert.Equal(t, 1, imported)
+	assert.Equal(t, 3, s2.store.Count("default", "asdf"))
+
+	expireAt := strconv.FormatInt(time.Now().Unix()+30, 10)
+	for _, bad := range []string{
+		`{"namespace":"default","key":"a\n.\nb","expireAt":` + expireAt + `}`,
+		`{"namespace":"de\rfault","key":"a","expireAt":` + expireAt + `}`,
+		`{"namespace":"default","key":"","expireAt":` + expireAt + `}`,
+		`{"namespace":"` + strings.Repeat("n", protocol.NamespaceSize+1) + `","key":"a","expireAt":` + expireAt + `}`,
+		`{"namespace":"default","key":"` + strings.Repeat("k", protocol.DataValueSize+1) + `","expireAt":` + expireAt + `}`,
+	} {
+		res = httptest.NewRecorder()
+		s2.restServer(res, httptest.NewRequest(http.MethodPost, "/import", strings.NewReader(bad)))
+		assert.Equal(t, http.StatusBadRequest, res.Code, bad)
+	}
+	assert.Equal(t, 0, s2.store.Count("default", "a\n.\nb"))
+	assert.Equal(t, []string{"asdf"}, s2.store.KeyMatch("default", "*"), "no key with a line break was stored")
+	_, err = s2.ImportNDJSON(strings.NewReader(`{"namespace":"default","key":"a\nb","expireAt":` + expireAt + `}`))
+	assert.ErrorIs(t, err, ErrBadImportEntry)
+}
+
+func BenchmarkServer_Replication(b *testing.B) {
+	peers := "127.0.0.1:9214,127.0.0.1:9215"
+	s1 := MustNewServerWithPeers(60, "asdf", "127.0.0.1:9214", peers)
+	if err := s1.Listen(9214, 0); err != nil {
+		b.Fatal(err)
+	}
+	defer s1.Close()
+	s2 := MustNewServerWithPeers(60, "asdf", "127.0.0.1:9215", peers)
+	if err := s2.Listen(9215, 0); err != nil {
+		b.Fatal(err)
+	}
+	defer s2.Close()
+	c := client.NewClient(client.Config{RemoteUDPIPPortList: "127.0.0.1:9214", Timeout: time.Second * 5, PreSharedKey: "asdf"})
+	if err := c.Listen(9216); err != nil {
+		b.Fatal(err)
+	}
+	defer c.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := c.Put("bench", strconv.Itoa(i%100)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	// waits for the peer to catch up, so replication is part of the measure
+	deadline := time.Now().Add(5 * time.Second)
+	for s2.store.CountEntries("bench") < b.N && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+}
+
 // consider convert to benchmark
 func TestServer_HeavyConcurrency(t *testing.T) {
 	// Conditions: many clients reading and writing at once, expire keys very quickly,
@@ -393,6 +1577,12 @@ func TestServer_HeavyConcurrency(t *testing.T) {
 func helperRandStr(s int) string {
 	b := make([]byte, s)
 	rand.Read(b)
+	// line breaks are refused in keys and namespaces
+	for i := range b {
+		if b[i] == '\n' || b[i] == '\r' {
+			b[i] = ' '
+		}
+	}
 	return string(b)
 }
 
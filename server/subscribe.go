@@ -0,0 +1,159 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mailsac/dracula/protocol"
+	"github.com/mailsac/dracula/server/rawmessage"
+	"github.com/mailsac/dracula/store/tree"
+)
+
+const (
+	// DefaultMaxSubscriptions is how many subscriptions can be open at once when Config.MaxSubscriptions is zero
+	DefaultMaxSubscriptions = 64
+	// subscriptionBuffer is how many puts can wait to be written to a subscriber before it is dropped as too slow
+	subscriptionBuffer = 256
+)
+
+// ErrTooManySubscriptions is the error response to a subscribe when Config.MaxSubscriptions are open. Clients
+// match its text, so it must not change.
+var ErrTooManySubscriptions = errors.New("too_many_subscriptions")
+
+// subscription streams the puts to a namespace with keys matching a pattern to a tcp connection
+type subscription struct {
+	namespace string
+	match     func(string) bool
+	conn      *net.TCPConn
+	messageID []byte
+	keys      chan string
+	// done is closed once the subscription ends, see unsubscribe
+	done chan struct{}
+	once sync.Once
+}
+
+// subscriptions are the open subscriptions. count lets puts skip the lock when there are none.
+type subscriptions struct {
+	lock  sync.RWMutex
+	subs  map[*subscription]struct{}
+	count int32 // accessed atomically
+}
+
+// subscribe handles a CmdTCPOnlySubscribe read from the connection, returning the subscription when it was
+// opened. It is handled by the connection rather than a worker, so the connection knows to stop timing out
+// while it waits for puts.
+func (s *Server) subscribe(m *rawmessage.RawMessage) *subscription {
+	psk := s.signingKey()
+	packet, err := protocol.ParsePacketSafe(m.Message)
+	if packet == nil {
+		s.log.Println("server received unparseable subscribe:", m.Remote, err)
+		return nil
+	}
+	refuse := func(err error) {
+		s.log.Println("server refused subscribe:", m.Remote, packet.MessageID, packet.NamespaceString(), err)
+		resPacket := protocol.NewPacketFromParts(protocol.ResError, packet.MessageIDBytes, packet.Namespace, []byte(err.Error()), psk)
+		resPacket.RequestClient = m.MaybeTcpClient
+		s.respondOrLogErrorTCP(resPacket)
+	}
+	if err == nil {
+		err = packet.Validate(s.validKeys()...)
+	}
+	if err != nil {
+		refuse(err)
+		return nil
+	}
+
+	pattern := packet.DataValueString()
+	if pattern == "" {
+		pattern = "*"
+	}
+	sub := &subscription{
+		namespace: packet.NamespaceString(),
+		match:     tree.KeyMatcher(pattern, tree.MatchGlob),
+		conn:      m.MaybeTcpClient,
+		messageID: packet.MessageIDBytes,
+		keys:      make(chan string, subscriptionBuffer),
+		done:      make(chan struct{}),
+	}
+	// the limit is checked under the lock, so subscribes at the same time can't all slip under it
+	s.subscriptions.lock.Lock()
+	if len(s.subscriptions.subs) >= s.conf.MaxSubscriptions {
+		s.subscriptions.lock.Unlock()
+		refuse(ErrTooManySubscriptions)
+		return nil
+	}
+	if s.subscriptions.subs == nil {
+		s.subscriptions.subs = make(map[*subscription]struct{})
+	}
+	s.subscriptions.subs[sub] = struct{}{}
+	atomic.AddInt32(&s.subscriptions.count, 1)
+	s.subscriptions.lock.Unlock()
+	s.log.Println("server opened subscription:", m.Remote, sub.namespace, pattern)
+
+	// an empty event acknowledges the subscription before any puts are streamed
+	resPacket := protocol.NewPacketFromParts(protocol.CmdTCPOnlySubscribe, sub.messageID, packet.Namespace, []byte{}, psk)
+	resPacket.RequestClient = sub.conn
+	s.respondOrLogErrorTCP(resPacket)
+	go s.streamSubscription(sub)
+	return sub
+}
+
+// streamSubscription must run in its own thread. It writes each put to the subscriber until the subscription
+// ends or the server closes.
+func (s *Server) streamSubscription(sub *subscription) {
+	for {
+		select {
+		case <-sub.done:
+			return
+		case <-s.ctx.Done():
+			s.unsubscribe(sub)
+			return
+		case key := <-sub.keys:
+			// quoted, so keys with line breaks can't end the message early
+			resPacket := protocol.NewPacketFromParts(protocol.CmdTCPOnlySubscribe, sub.messageID, []byte(sub.namespace), []byte(strconv.Quote(key)), s.signingKey())
+			resPacket.RequestClient = sub.conn
+			s.respondOrLogErrorTCP(resPacket)
+		}
+	}
+}
+
+// publishPut sends the put to the subscriptions it matches. Subscribers which fell subscriptionBuffer puts
+// behind are dropped, and their connection closed, rather than holding up the put.
+func (s *Server) publishPut(ns, entryKey string) {
+	if atomic.LoadInt32(&s.subscriptions.count) == 0 {
+		return
+	}
+	var slow []*subscription
+	s.subscriptions.lock.RLock()
+	for sub := range s.subscriptions.subs {
+		if sub.namespace != ns || !sub.match(entryKey) {
+			continue
+		}
+		select {
+		case sub.keys <- entryKey:
+		default:
+			slow = append(slow, sub)
+		}
+	}
+	s.subscriptions.lock.RUnlock()
+	for _, sub := range slow {
+		s.log.Println("server dropped slow subscriber:", sub.conn.RemoteAddr(), sub.namespace)
+		s.metrics.subscriptionsDropped.Inc()
+		s.unsubscribe(sub)
+		sub.conn.Close()
+	}
+}
+
+// unsubscribe ends the subscription. It is safe to call more than once.
+func (s *Server) unsubscribe(sub *subscription) {
+	sub.once.Do(func() {
+		s.subscriptions.lock.Lock()
+		delete(s.subscriptions.subs, sub)
+		atomic.AddInt32(&s.subscriptions.count, -1)
+		s.subscriptions.lock.Unlock()
+		close(sub.done)
+	})
+}
@@ -0,0 +1,66 @@
+package store
+
+import (
+	"encoding/gob"
+	"errors"
+	"io"
+)
+
+// snapshotVersion is incremented when the snapshot format changes
+const snapshotVersion = 1
+
+var ErrSnapshotVersion = errors.New("dracula snapshot version is not supported")
+
+type snapshotHeader struct {
+	Version int
+}
+
+// snapshotNamespace is one namespace of a snapshot. The snapshot is a header followed by a
+// snapshotNamespace per namespace, and ends with an empty snapshotNamespace.
+type snapshotNamespace struct {
+	Namespace string
+	// Keys are each key's entries, as the unix seconds the entry expires at
+	Keys map[string][]int64
+}
+
+// Snapshot writes a point in time backup of every namespace, key, and entry expiry. Namespaces are
+// written one at a time, so the backup is only consistent per namespace while puts are happening.
+func (s *Store) Snapshot(w io.Writer) error {
+	enc := gob.NewEncoder(w)
+	if err := enc.Encode(snapshotHeader{Version: snapshotVersion}); err != nil {
+		return err
+	}
+	err := s.EachNamespace(func(ns string, keys map[string][]int64) error {
+		return enc.Encode(snapshotNamespace{Namespace: ns, Keys: keys})
+	})
+	if err != nil {
+		return err
+	}
+	// marks the end, so a truncated snapshot is an error
+	return enc.Encode(snapshotNamespace{})
+}
+
+// Restore loads a backup made by Snapshot, adding to what is already in the store. Entries which
+// expired since the backup was made are dropped.
+func (s *Store) Restore(r io.Reader) error {
+	dec := gob.NewDecoder(r)
+	var header snapshotHeader
+	if err := dec.Decode(&header); err != nil {
+		return err
+	}
+	if header.Version != snapshotVersion {
+		return ErrSnapshotVersion
+	}
+	for {
+		var sns snapshotNamespace
+		if err := dec.Decode(&sns); err != nil {
+			return err
+		}
+		if sns.Namespace == "" && len(sns.Keys) == 0 {
+			return nil
+		}
+		for entryKey, expireAtSecs := range sns.Keys {
+			s.PutExpireAt(sns.Namespace, entryKey, expireAtSecs...)
+		}
+	}
+}
@@ -1,16 +1,21 @@
 package store
 
 import (
+	"context"
+	"github.com/OneOfOne/xxhash"
 	"github.com/emirpasic/gods/maps/hashmap"
 	"github.com/mailsac/dracula/store/tree"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"net/http"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var runDuration = time.Second * 15
+// DefaultCleanupInterval is how often the store garbage collects a portion of namespaces.
+const DefaultCleanupInterval = time.Second * 15
 
 // denominator of how many namespaces to garbage collect max on a run. if 3 then 1/3 or `<total keys>/3`
 const maxNamespacesDenom = 2
@@ -23,6 +28,12 @@ type Metrics struct {
 	keysRemainingInGCNamespaces       prometheus.Gauge
 	countTotalRemainingInGCNamespaces prometheus.Gauge
 	gcPauseTime                       prometheus.Gauge
+	entriesReclaimed                  prometheus.Gauge
+}
+
+// MustRegister adds more collectors to the registry served by ListenAndServe, such as server metrics.
+func (m *Metrics) MustRegister(cs ...prometheus.Collector) {
+	m.registry.MustRegister(cs...)
 }
 
 func (m *Metrics) ListenAndServe(promHostPort string) error {
@@ -38,18 +49,51 @@ func (m *Metrics) ListenAndServe(promHostPort string) error {
 	return err
 }
 
+// namespaceShards is how many separately locked maps the namespaces are spread across, so operations
+// on unrelated namespaces do not contend on a single lock.
+const namespaceShards = 32
+
+// shard is a portion of the namespaces
+type shard struct {
+	sync.Mutex // mutex locks namespaces, windowModes and tombstones
+	namespaces *hashmap.Map
+	// windowModes outlive the namespace subtrees, which are removed once empty
+	windowModes map[string]tree.WindowMode
+	tombstones  map[tombstoneKey]tombstone
+}
+
+type tombstoneKey struct {
+	ns       string
+	entryKey string
+}
+
+// tombstone remembers a delete for a while, so puts from before the delete which are still on their way
+// from a peer are not applied after it.
+type tombstone struct {
+	deletedAtMillis int64
+	until           time.Time
+}
+
 // Store provides a way to store entries and count them based on namespaces.
 // Old entries are garbage collected in a way that attempts to not block for too long.
 type Store struct {
-	sync.Mutex            // mutext locks namespaces
-	namespaces            *hashmap.Map
-	expireAfterSecs       int64
-	cleanupServiceEnabled bool
+	cleanupEveryNanos     int64 // accessed atomically, so first to be 64-bit aligned
+	maxEntriesPerKey      int64 // accessed atomically
+	shards                [namespaceShards]*shard
+	expireAfterMillis     int64
+	cleanupServiceEnabled int32 // 1 while enabled, accessed atomically
 	LastMetrics           *Metrics
+	cleanupLock           sync.Mutex // locks lastGCdNamespaces and onKeyExpired
 	lastGCdNamespaces     map[string]bool
+	onKeyExpired          func(ns, entryKey string)
 }
 
 func NewStore(expireAfterSecs int64) *Store {
+	return NewStoreMillis(expireAfterSecs * 1000)
+}
+
+// NewStoreMillis is NewStore with the expiry in milliseconds, for expiries shorter than a second.
+func NewStoreMillis(expireAfterMillis int64) *Store {
 	registry := prometheus.NewRegistry()
 	maxNamespacesDenomGauge := prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "dracula_max_namespaces_denom",
@@ -75,11 +119,15 @@ func NewStore(expireAfterSecs int64) *Store {
 		Name: "dracula_gc_pause_millis",
 		Help: "How long last garbage collection took in milliseconds",
 	})
-	registry.MustRegister(maxNamespacesDenomGauge, namespacesTotalCount, namespacesGarbageCollected, keysRemainingInGCNamespaces, countTotalRemainingInGCNamespaces, gcPauseTime)
+	entriesReclaimed := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "dracula_entries_reclaimed_in_gc",
+		Help: "Count of expired entries removed during last cleanup run",
+	})
+	registry.MustRegister(maxNamespacesDenomGauge, namespacesTotalCount, namespacesGarbageCollected, keysRemainingInGCNamespaces, countTotalRemainingInGCNamespaces, gcPauseTime, entriesReclaimed)
 
 	s := &Store{
-		expireAfterSecs: expireAfterSecs,
-		namespaces:      hashmap.New(),
+		expireAfterMillis: expireAfterMillis,
+		cleanupEveryNanos: int64(DefaultCleanupInterval),
 		LastMetrics: &Metrics{
 			registry:                          registry,
 			maxNamespacesDenom:                maxNamespacesDenomGauge,
@@ -88,9 +136,17 @@ func NewStore(expireAfterSecs int64) *Store {
 			keysRemainingInGCNamespaces:       keysRemainingInGCNamespaces,
 			countTotalRemainingInGCNamespaces: countTotalRemainingInGCNamespaces,
 			gcPauseTime:                       gcPauseTime,
+			entriesReclaimed:                  entriesReclaimed,
 		},
 	}
-	s.cleanupServiceEnabled = true
+	for i := range s.shards {
+		s.shards[i] = &shard{
+			namespaces:  hashmap.New(),
+			windowModes: make(map[string]tree.WindowMode),
+			tombstones:  make(map[tombstoneKey]tombstone),
+		}
+	}
+	atomic.StoreInt32(&s.cleanupServiceEnabled, 1)
 	s.LastMetrics.maxNamespacesDenom.Set(maxNamespacesDenom)
 
 	go s.runCleanup()
@@ -98,35 +154,130 @@ func NewStore(expireAfterSecs int64) *Store {
 	return s
 }
 
+// shardFor returns the shard which owns the namespace
+func (s *Store) shardFor(ns string) *shard {
+	return s.shards[xxhash.ChecksumString32(ns)%namespaceShards]
+}
+
+// getTree returns the subtree for a namespace
+func (s *Store) getTree(ns string) (*tree.Tree, bool) {
+	sh := s.shardFor(ns)
+	sh.Lock()
+	subtreeI, found := sh.namespaces.Get(ns)
+	sh.Unlock()
+	if !found {
+		return nil, false
+	}
+	return subtreeI.(*tree.Tree), true
+}
+
+// getOrCreateTree returns the subtree for a namespace, adding the namespace when it does not exist
+func (s *Store) getOrCreateTree(ns string) *tree.Tree {
+	sh := s.shardFor(ns)
+	sh.Lock()
+	defer sh.Unlock()
+	subtreeI, found := sh.namespaces.Get(ns)
+	if found {
+		return subtreeI.(*tree.Tree)
+	}
+	subtree := tree.NewTreeMillis(s.expireAfterMillis)
+	subtree.SetMaxEntriesPerKey(int(atomic.LoadInt64(&s.maxEntriesPerKey)))
+	subtree.SetWindowMode(sh.windowModes[ns])
+	sh.namespaces.Put(ns, subtree)
+	return subtree
+}
+
+// namespaceKeys returns every namespace across all shards, randomly ordered
+func (s *Store) namespaceKeys() []string {
+	var keys []string
+	for _, sh := range s.shards {
+		sh.Lock()
+		for _, key := range sh.namespaces.Keys() {
+			keys = append(keys, key.(string))
+		}
+		sh.Unlock()
+	}
+	return keys
+}
+
+// SetCleanupInterval changes how often the background cleanup runs, starting after the next run. Intervals
+// which aren't positive are ignored.
+func (s *Store) SetCleanupInterval(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	atomic.StoreInt64(&s.cleanupEveryNanos, int64(interval))
+}
+
+// SetMaxEntriesPerKey caps how many entries any key holds, so one abusive key can't grow without bound.
+// Once a key is at the cap, each put drops its oldest entry and Count saturates at the cap. Zero means
+// unlimited, which is the default.
+func (s *Store) SetMaxEntriesPerKey(max int) {
+	// stored before the shards are updated, so a namespace added meanwhile either reads it or is updated
+	atomic.StoreInt64(&s.maxEntriesPerKey, int64(max))
+	for _, sh := range s.shards {
+		sh.Lock()
+		for _, subtreeI := range sh.namespaces.Values() {
+			subtreeI.(*tree.Tree).SetMaxEntriesPerKey(max)
+		}
+		sh.Unlock()
+	}
+}
+
+// SetWindowMode changes how entries put in the namespace expire, see tree.WindowMode. The default is
+// tree.WindowSliding. Entries already in the namespace keep their expiry.
+func (s *Store) SetWindowMode(ns string, mode tree.WindowMode) {
+	sh := s.shardFor(ns)
+	sh.Lock()
+	defer sh.Unlock()
+	if mode == tree.WindowSliding {
+		delete(sh.windowModes, ns)
+	} else {
+		sh.windowModes[ns] = mode
+	}
+	if subtreeI, found := sh.namespaces.Get(ns); found {
+		subtreeI.(*tree.Tree).SetWindowMode(mode)
+	}
+}
+
 func (s *Store) EnableCleanup() {
-	s.cleanupServiceEnabled = true
+	atomic.StoreInt32(&s.cleanupServiceEnabled, 1)
 }
 
 func (s *Store) DisableCleanup() {
-	s.cleanupServiceEnabled = false
+	atomic.StoreInt32(&s.cleanupServiceEnabled, 0)
 }
 
-// runCleanup must run in its own thread and returns the current
-// namespaces left after cleanup runs. This will typically not be
-// the exact namespaces with keys, because not all namespaces are
-// crawled on each run.
-func (s *Store) runCleanup() []string {
-	if !s.cleanupServiceEnabled {
-		return []string{}
+// SetOnKeyExpired calls fn with each key whose last entries the periodic cleanup removes. Keys found expired
+// when they are used, or by Compact, are not passed to it. fn holds up the cleanup, so it must be quick. Nil
+// stops the calls.
+func (s *Store) SetOnKeyExpired(fn func(ns, entryKey string)) {
+	s.cleanupLock.Lock()
+	defer s.cleanupLock.Unlock()
+	s.onKeyExpired = fn
+}
+
+// runCleanup must run in its own thread. It actively expires entries on an interval, so namespaces which
+// are written but never read do not hold memory forever.
+func (s *Store) runCleanup() {
+	if atomic.LoadInt32(&s.cleanupServiceEnabled) == 0 {
+		return
 	}
+	defer time.AfterFunc(time.Duration(atomic.LoadInt64(&s.cleanupEveryNanos)), s.runCleanup)
+	s.cleanup()
+}
 
+// cleanup expires a portion of the namespaces to bound how long a run takes, and returns the current
+// namespaces left after cleanup runs. This will typically not be the exact namespaces with keys,
+// because not all namespaces are crawled on each run.
+func (s *Store) cleanup() []string {
 	start := time.Now()
 
-	defer time.AfterFunc(runDuration, func() {
-		s.runCleanup()
-	})
-
-	s.Lock()
-	keys := s.namespaces.Keys() // they are randomly ordered
-	s.Unlock()
+	s.sweepTombstones()
+	keys := s.namespaceKeys() // they are randomly ordered
 
 	hashSize := len(keys)
-	maxNamespaces := hashSize / maxNamespacesDenom
+	maxNamespaces := (hashSize + maxNamespacesDenom - 1) / maxNamespacesDenom // rounded up to include a lone namespace
 
 	s.LastMetrics.namespacesTotalCount.Set(float64(hashSize))
 	s.LastMetrics.namespacesGarbageCollected.Set(float64(maxNamespaces))
@@ -134,44 +285,53 @@ func (s *Store) runCleanup() []string {
 	nsSubtrees := make(map[string]*tree.Tree)
 	crawledKeys := make(map[string]bool)
 
-	s.Lock()
+	s.cleanupLock.Lock()
+	defer s.cleanupLock.Unlock()
 	{
 		// pointers to some the subtrees are fetched
 		var ns string
 		var found bool
-		var subtreeI interface{}
+		var subtree *tree.Tree
 		var crawledLast bool
 
 		for i := 0; i < maxNamespaces; i++ {
-			ns = keys[i].(string)
+			ns = keys[i]
 			_, crawledLast = s.lastGCdNamespaces[ns]
 			if crawledLast {
 				continue
 			}
-			subtreeI, found = s.namespaces.Get(ns)
+			subtree, found = s.getTree(ns)
 			if !found {
 				continue
 			}
-			nsSubtrees[ns] = subtreeI.(*tree.Tree)
+			nsSubtrees[ns] = subtree
 		}
 	}
-	s.Unlock()
 
-	var subtreeKeys []string
+	var subtreeKeyCount int
 	var knownKeysCount int
 	var subtreeKeyTrackCount int
 	var tally int
+	var subtreeReclaimed int
+	var reclaimed int
 	for ns, subtree := range nsSubtrees {
-		// Keys will cleanup every empty entry key
-		subtreeKeys, subtreeKeyTrackCount = subtree.Keys()
-		knownKeysCount += len(subtreeKeys)
+		// Expire will cleanup every empty entry key
+		var onExpired func(string)
+		if s.onKeyExpired != nil {
+			ns := ns
+			onExpired = func(entryKey string) { s.onKeyExpired(ns, entryKey) }
+		}
+		subtreeKeyCount, subtreeKeyTrackCount, subtreeReclaimed = subtree.ExpireEach(onExpired)
+		knownKeysCount += subtreeKeyCount
 		tally += subtreeKeyTrackCount
+		reclaimed += subtreeReclaimed
 
-		if len(subtreeKeys) == 0 {
+		if subtreeKeyCount == 0 {
 			// an empty subtree can be removed from the top level namespaces
-			s.Lock()
-			s.namespaces.Remove(ns)
-			s.Unlock()
+			sh := s.shardFor(ns)
+			sh.Lock()
+			sh.namespaces.Remove(ns)
+			sh.Unlock()
 			continue
 		}
 		crawledKeys[ns] = true
@@ -182,95 +342,382 @@ func (s *Store) runCleanup() []string {
 
 	s.LastMetrics.keysRemainingInGCNamespaces.Set(float64(knownKeysCount))
 	s.LastMetrics.countTotalRemainingInGCNamespaces.Set(float64(tally))
+	s.LastMetrics.entriesReclaimed.Set(float64(reclaimed))
 	s.LastMetrics.gcPauseTime.Set(float64(time.Since(start).Milliseconds()))
 
-	s.Lock()
-	keys = s.namespaces.Keys()
-	s.Unlock()
-	var keyList []string
-	for _, key := range keys {
-		keyList = append(keyList, key.(string))
-	}
-	return keyList
+	return s.namespaceKeys()
 }
 
 func (s *Store) Put(ns, entryKey string) {
-	var subtree *tree.Tree
-	s.Lock()
-	subtreeI, found := s.namespaces.Get(ns)
-	s.Unlock()
-	if !found {
-		subtree = tree.NewTree(s.expireAfterSecs)
-		s.Lock()
-		s.namespaces.Put(ns, subtree)
-		s.Unlock()
-	} else {
-		subtree = subtreeI.(*tree.Tree)
-	}
+	s.PutWeight(ns, entryKey, 1)
+}
 
-	subtree.Put(entryKey)
+// PutWeight adds `weight` entries to a namespace and key at once, as if it was put that many times.
+func (s *Store) PutWeight(ns, entryKey string, weight int) {
+	subtree := s.getOrCreateTree(ns)
+	subtree.Touch()
+	subtree.PutWeight(entryKey, weight)
+}
+
+// PutExpireAt adds entries which expire at the given unix seconds, rather than the store's expiry.
+// Already expired entries are ignored.
+func (s *Store) PutExpireAt(ns, entryKey string, expireAtSecs ...int64) {
+	s.getOrCreateTree(ns).PutExpireAt(entryKey, expireAtSecs...)
+}
+
+// EachNamespace calls fn with every namespace which has unexpired entries, and a copy of each key's entries as
+// the unix seconds they expire at. It stops at the first error fn returns.
+func (s *Store) EachNamespace(fn func(ns string, keys map[string][]int64) error) error {
+	for _, ns := range s.namespaceKeys() {
+		subtree, found := s.getTree(ns)
+		if !found {
+			continue
+		}
+		keys := subtree.Entries()
+		if len(keys) == 0 {
+			continue
+		}
+		if err := fn(ns, keys); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Count returns the number of entries at a namespace and key, returning
 // zero even if the namespace or key does not exist.
 func (s *Store) Count(ns, entryKey string) int {
-	s.Lock()
-	subtreeI, found := s.namespaces.Get(ns)
-	s.Unlock()
+	subtree, found := s.getTree(ns)
 	if !found {
 		return 0
 	}
-	subtree := subtreeI.(*tree.Tree)
 
+	subtree.Touch()
 	return subtree.Count(entryKey)
 }
 
+// LastPutMillis returns when the newest unexpired entry at a namespace and key was put, in unix milliseconds,
+// or zero when it has none.
+func (s *Store) LastPutMillis(ns, entryKey string) int64 {
+	subtree, found := s.getTree(ns)
+	if !found {
+		return 0
+	}
+	return subtree.LastPutMillis(entryKey)
+}
+
+// CountAt returns how many entries at a namespace and key will still be unexpired at the unix seconds
+// `atSecs`, for forecasting whether a key will still be over a limit. Like Count, it returns zero even
+// if the namespace or key does not exist.
+func (s *Store) CountAt(ns, entryKey string, atSecs int64) int {
+	subtree, found := s.getTree(ns)
+	if !found {
+		return 0
+	}
+
+	subtree.Touch()
+	return subtree.CountAt(entryKey, atSecs)
+}
+
+// CountWeighted returns the entries at a namespace and key weighted by age, halving every halfLife, so recent
+// entries count for more. See tree.Tree.CountWeighted. Like Count, it returns zero even if the namespace or
+// key does not exist.
+func (s *Store) CountWeighted(ns, entryKey string, halfLife time.Duration) float64 {
+	subtree, found := s.getTree(ns)
+	if !found {
+		return 0
+	}
+
+	subtree.Touch()
+	return subtree.CountWeighted(entryKey, int64(halfLife/time.Millisecond))
+}
+
 // Namespaces returns the approximate current namespaces list
 func (s *Store) Namespaces() []string {
-	keys := s.runCleanup()
+	keys := s.cleanup()
 	return keys
 }
 
+// NamespaceStat describes a namespace, see NamespaceStats
+type NamespaceStat struct {
+	Namespace string
+	// Keys includes keys whose entries expired but were not cleaned up yet, like CountKeys
+	Keys int
+	// LastAccess is when the namespace was last put or counted, or the zero time when it only holds
+	// entries from a restore or a peer sync
+	LastAccess time.Time
+}
+
+// NamespaceStats describes every namespace, least recently accessed first, so cold namespaces can be told
+// apart from busy ones. It is cheap like CountKeys, because entries are not counted.
+func (s *Store) NamespaceStats() []NamespaceStat {
+	var stats []NamespaceStat
+	for _, ns := range s.namespaceKeys() {
+		subtree, found := s.getTree(ns)
+		if !found {
+			continue
+		}
+		stat := NamespaceStat{Namespace: ns, Keys: subtree.Size()}
+		if millis := subtree.LastAccessMillis(); millis > 0 {
+			stat.LastAccess = time.Unix(0, millis*int64(time.Millisecond))
+		}
+		stats = append(stats, stat)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if !stats[i].LastAccess.Equal(stats[j].LastAccess) {
+			return stats[i].LastAccess.Before(stats[j].LastAccess)
+		}
+		return stats[i].Namespace < stats[j].Namespace
+	})
+	return stats
+}
+
+// NamespacesPage returns up to limit namespaces sorted lexicographically, after skipping the first offset,
+// and whether more remain. Like Namespaces it is approximate, because it does not wait for garbage
+// collection to remove namespaces whose entries have all expired.
+func (s *Store) NamespacesPage(offset, limit int) ([]string, bool) {
+	keys := s.namespaceKeys()
+	sort.Strings(keys)
+	if offset >= len(keys) || limit <= 0 {
+		return []string{}, false
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	keys = keys[offset:]
+	if len(keys) > limit {
+		return keys[:limit], true
+	}
+	return keys, false
+}
+
+// CountKeys returns how many keys a namespace has, and whether the namespace exists. It is cheap because
+// entries are not counted, so keys whose entries expired but were not cleaned up yet are included.
+func (s *Store) CountKeys(ns string) (int, bool) {
+	subtree, found := s.getTree(ns)
+	if !found {
+		return 0, false
+	}
+
+	keyCount := subtree.Size()
+	return keyCount, keyCount > 0
+}
+
+// CountDistinctKeys returns how many keys in the namespace have unexpired entries. Unlike CountKeys, keys
+// whose entries all expired are left out, so it is as expensive as CountEntries.
+func (s *Store) CountDistinctKeys(ns string) int {
+	subtree, found := s.getTree(ns)
+	if !found {
+		return 0
+	}
+
+	keys, _ := subtree.Keys()
+	return len(keys)
+}
+
+// Compact removes the namespace's expired entries, and keys left without any, now rather than waiting for the
+// namespace to be cleaned up. It returns how many entries were removed. This is an expensive operation.
+func (s *Store) Compact(ns string) int {
+	subtree, found := s.getTree(ns)
+	if !found {
+		return 0
+	}
+
+	keyCount, _, reclaimed := subtree.Expire()
+	if keyCount == 0 {
+		s.cleanupLock.Lock()
+		sh := s.shardFor(ns)
+		sh.Lock()
+		sh.namespaces.Remove(ns)
+		sh.Unlock()
+		s.cleanupLock.Unlock()
+	}
+	return reclaimed
+}
+
 // CountEntries returns the count of all entries for the entire namespace.
 // This is an expensive operation.
 func (s *Store) CountEntries(ns string) int {
-	s.Lock()
-	subtreeI, found := s.namespaces.Get(ns)
-	s.Unlock()
+	subtree, found := s.getTree(ns)
 	if !found {
 		return 0
 	}
-	subtree := subtreeI.(*tree.Tree)
 
 	_, count := subtree.Keys()
 	return count
 }
 
-// KeyMatch crawls the subtree to return keys containing keyPattern string.
+// KeyMatch crawls the subtree to return keys matching the keyPattern glob, where `*` matches any run of
+// characters and everything else must match exactly. See tree.MatchGlob. Keys are sorted lexicographically.
 func (s *Store) KeyMatch(ns string, keyPattern string) []string {
-	s.Lock()
-	subtreeI, found := s.namespaces.Get(ns)
-	s.Unlock()
+	return s.KeyMatchMode(ns, keyPattern, tree.MatchGlob)
+}
+
+// KeyMatchMode crawls the subtree to return keys matching keyPattern in the given mode, sorted lexicographically.
+func (s *Store) KeyMatchMode(ns string, keyPattern string, mode tree.MatchMode) []string {
+	return s.KeyMatchOpts(ns, keyPattern, tree.MatchOptions{Mode: mode})
+}
 
+// KeyMatchOpts returns keys in the namespace matching keyPattern with the options, such as case insensitively.
+func (s *Store) KeyMatchOpts(ns string, keyPattern string, opts tree.MatchOptions) []string {
+	subtree, found := s.getTree(ns)
 	if !found {
 		return []string{}
 	}
-	subtree := subtreeI.(*tree.Tree)
 
-	return subtree.KeyMatch(keyPattern)
+	return subtree.KeyMatchOpts(keyPattern, opts)
+}
+
+// TopKeys returns up to limit keys in a namespace with the most entries, highest count first.
+// Keys with the same count are in key order. It is as expensive as CountEntries.
+func (s *Store) TopKeys(ns string, limit int) []tree.KeyCount {
+	subtree, found := s.getTree(ns)
+	if !found || limit <= 0 {
+		return []tree.KeyCount{}
+	}
+
+	counts := subtree.KeyCounts()
+	// stable, so keys of the same count stay in key order
+	sort.SliceStable(counts, func(i, j int) bool {
+		return counts[i].Count > counts[j].Count
+	})
+	if len(counts) > limit {
+		counts = counts[:limit]
+	}
+	return counts
+}
+
+// KeyMatchPage returns up to limit keys in a namespace matching the keyPattern glob, after skipping the first
+// offset matches, and whether more matches remain. Pages are in the same sorted order as KeyMatch.
+func (s *Store) KeyMatchPage(ns, keyPattern string, offset, limit int) ([]string, bool) {
+	subtree, found := s.getTree(ns)
+	if !found {
+		return []string{}, false
+	}
+
+	return subtree.KeyMatchPage(keyPattern, offset, limit)
+}
+
+// Delete removes a key and all its entries from a namespace, returning whether the key had unexpired entries.
+func (s *Store) Delete(ns, entryKey string) bool {
+	subtree, found := s.getTree(ns)
+	if !found {
+		return false
+	}
+
+	return subtree.Delete(entryKey)
+}
+
+// DeleteAt removes the entries of a key which were put at or before the unix milliseconds `atMillis`, returning
+// whether any unexpired entries were removed. It leaves a tombstone for `tombstoneFor`, during which PutAt
+// ignores puts from at or before the delete. That keeps a delete and a replicated put which cross on the wire
+// from ending up different on each peer. Zero leaves no tombstone.
+func (s *Store) DeleteAt(ns, entryKey string, atMillis int64, tombstoneFor time.Duration) bool {
+	return s.ResetAt(ns, entryKey, atMillis, tombstoneFor) > 0
+}
+
+// ResetAt is DeleteAt, returning how many unexpired entries were removed. That is the key's count up to
+// `atMillis`, read and reset to zero at once, so no entry is counted by two resets or lost between them.
+func (s *Store) ResetAt(ns, entryKey string, atMillis int64, tombstoneFor time.Duration) int {
+	if tombstoneFor > 0 {
+		sh := s.shardFor(ns)
+		sh.Lock()
+		k := tombstoneKey{ns: ns, entryKey: entryKey}
+		if existing, found := sh.tombstones[k]; !found || existing.deletedAtMillis < atMillis {
+			sh.tombstones[k] = tombstone{deletedAtMillis: atMillis, until: time.Now().Add(tombstoneFor)}
+		}
+		sh.Unlock()
+	}
+
+	subtree, found := s.getTree(ns)
+	if !found {
+		return 0
+	}
+	return subtree.ResetBefore(entryKey, atMillis)
+}
+
+// PutAt is Put for a put which happened at the unix milliseconds `putMillis`, such as one replicated from a
+// peer. It is ignored, returning false, when a tombstone shows the key was deleted at or after then.
+func (s *Store) PutAt(ns, entryKey string, putMillis int64) bool {
+	return s.PutWeightAt(ns, entryKey, putMillis, 1)
+}
+
+// PutWeightAt is PutAt for PutWeight.
+func (s *Store) PutWeightAt(ns, entryKey string, putMillis int64, weight int) bool {
+	sh := s.shardFor(ns)
+	sh.Lock()
+	k := tombstoneKey{ns: ns, entryKey: entryKey}
+	ts, found := sh.tombstones[k]
+	if found && time.Now().After(ts.until) {
+		delete(sh.tombstones, k)
+		found = false
+	}
+	sh.Unlock()
+	if found && putMillis <= ts.deletedAtMillis {
+		return false
+	}
+	s.PutWeight(ns, entryKey, weight)
+	return true
+}
+
+// Reset removes every namespace and tombstone, keeping settings like window modes. Operations running at the
+// same time finish before or after it, per shard.
+func (s *Store) Reset() {
+	for _, sh := range s.shards {
+		sh.Lock()
+		sh.namespaces = hashmap.New()
+		sh.tombstones = make(map[tombstoneKey]tombstone)
+		sh.Unlock()
+	}
+	s.cleanupLock.Lock()
+	s.lastGCdNamespaces = nil
+	s.cleanupLock.Unlock()
+}
+
+// sweepTombstones forgets tombstones which are past their time
+func (s *Store) sweepTombstones() {
+	now := time.Now()
+	for _, sh := range s.shards {
+		sh.Lock()
+		for k, ts := range sh.tombstones {
+			if now.After(ts.until) {
+				delete(sh.tombstones, k)
+			}
+		}
+		sh.Unlock()
+	}
+}
+
+// DeleteMatch removes every key in a namespace matching keyPattern, returning how many keys with unexpired
+// entries were removed.
+func (s *Store) DeleteMatch(ns, keyPattern string) int {
+	subtree, found := s.getTree(ns)
+	if !found {
+		return 0
+	}
+
+	return subtree.DeleteMatch(keyPattern)
 }
 
 // CountServerEntries returns the count of all entries for the entire server.
 // This is an extremely expensive operation.
 func (s *Store) CountServerEntries() int {
-	s.Lock()
-	spaces := s.namespaces.Keys() // they are randomly ordered
-	s.Unlock()
+	count, _ := s.CountServerEntriesContext(context.Background())
+	return count
+}
+
+// CountServerEntriesContext is CountServerEntries which stops between namespaces with the context's error
+// once it is done.
+func (s *Store) CountServerEntriesContext(ctx context.Context) (int, error) {
+	spaces := s.namespaceKeys() // they are randomly ordered
 	var entryCount int
 	var c int
 	for _, ns := range spaces {
-		c = s.CountEntries(ns.(string))
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		c = s.CountEntries(ns)
 		entryCount += c
 	}
-	return entryCount
+	return entryCount, nil
 }
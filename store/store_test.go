@@ -0,0 +1,336 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mailsac/dracula/store/tree"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// benchStore has a namespace of keys each with a few entries, and a hot key with many
+func benchStore(keys int) *Store {
+	s := NewStore(60)
+	s.DisableCleanup()
+	for i := 0; i < keys; i++ {
+		for j := 0; j < 3; j++ {
+			s.Put("bench", "key"+strconv.Itoa(i))
+		}
+	}
+	for i := 0; i < 5000; i++ {
+		s.Put("bench", "hot")
+	}
+	return s
+}
+
+func BenchmarkStore_Put(b *testing.B) {
+	for _, keys := range []int{100, 100000} {
+		s := benchStore(keys)
+		b.Run("hot/keys="+strconv.Itoa(keys), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				s.Put("bench", "hot")
+			}
+		})
+		b.Run("cold/keys="+strconv.Itoa(keys), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				s.Put("bench", "new"+strconv.Itoa(i))
+			}
+		})
+	}
+}
+
+func BenchmarkStore_Count(b *testing.B) {
+	for _, keys := range []int{100, 100000} {
+		s := benchStore(keys)
+		b.Run("hot/keys="+strconv.Itoa(keys), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				s.Count("bench", "hot")
+			}
+		})
+		b.Run("cold/keys="+strconv.Itoa(keys), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				s.Count("bench", "key"+strconv.Itoa(i%keys))
+			}
+		})
+	}
+}
+
+func BenchmarkStore_KeyMatch(b *testing.B) {
+	for _, keys := range []int{100, 100000} {
+		s := benchStore(keys)
+		b.Run("keys="+strconv.Itoa(keys), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				s.KeyMatch("bench", "key1*")
+			}
+		})
+	}
+}
+
+func BenchmarkStore_ParallelNamespaces(b *testing.B) {
+	s := NewStore(60)
+	s.DisableCleanup()
+	var worker int64
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		// each goroutine works in its own namespace
+		ns := "namespace" + strconv.FormatInt(atomic.AddInt64(&worker, 1), 10)
+		i := 0
+		for pb.Next() {
+			key := strconv.Itoa(i % 100)
+			s.Put(ns, key)
+			s.Count(ns, key)
+			i++
+		}
+	})
+}
+
+func TestStore_cleanup(t *testing.T) {
+	s := NewStore(1)
+	s.DisableCleanup()
+	s.Put("written", "never")
+	s.Put("written", "never")
+	s.Put("written", "read")
+	assert.Equal(t, []string{"written"}, s.namespaceKeys())
+
+	time.Sleep(time.Second)
+	assert.Empty(t, s.cleanup(), "namespace should have been removed once its entries expired")
+	assert.Equal(t, float64(3), testutil.ToFloat64(s.LastMetrics.entriesReclaimed))
+}
+
+func TestStore_SetCleanupInterval(t *testing.T) {
+	s := NewStore(60)
+	defer s.DisableCleanup()
+	// the cleanup reads the interval on its own thread as it reschedules
+	s.SetCleanupInterval(time.Millisecond)
+	for i := 0; i < 20; i++ {
+		s.SetCleanupInterval(time.Duration(i+1) * time.Millisecond)
+		time.Sleep(time.Millisecond)
+	}
+	s.SetCleanupInterval(0)
+	s.SetCleanupInterval(-time.Second)
+	assert.Equal(t, int64(20*time.Millisecond), atomic.LoadInt64(&s.cleanupEveryNanos), "intervals which aren't positive are ignored")
+}
+
+func TestStore_SetMaxEntriesPerKeyConcurrent(t *testing.T) {
+	s := NewStore(60)
+	s.DisableCleanup()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			s.Put("ns"+strconv.Itoa(i), "k")
+		}
+	}()
+	s.SetMaxEntriesPerKey(2)
+	<-done
+	// namespaces added while the cap was set are capped too
+	for i := 0; i < 200; i++ {
+		ns := "ns" + strconv.Itoa(i)
+		s.Put(ns, "k")
+		s.Put(ns, "k")
+		assert.Equal(t, 2, s.Count(ns, "k"), ns)
+	}
+}
+
+func TestStore_CountDistinctKeys(t *testing.T) {
+	s := NewStoreMillis(50)
+	s.DisableCleanup()
+	s.Put("visitors", "10.0.0.1")
+	s.Put("visitors", "10.0.0.2")
+	time.Sleep(60 * time.Millisecond)
+	s.Put("visitors", "10.0.0.3")
+	s.Put("visitors", "10.0.0.3")
+
+	keyCount, _ := s.CountKeys("visitors")
+	assert.Equal(t, 3, keyCount, "expired keys are still counted until cleaned up")
+	assert.Equal(t, 1, s.CountDistinctKeys("visitors"))
+	assert.Equal(t, 2, s.CountEntries("visitors"))
+	assert.Equal(t, 0, s.CountDistinctKeys("missing"))
+}
+
+func TestStore_Compact(t *testing.T) {
+	s := NewStoreMillis(50)
+	s.DisableCleanup()
+	s.Put("visitors", "10.0.0.1")
+	s.Put("visitors", "10.0.0.1")
+	s.Put("gone", "10.0.0.2")
+	time.Sleep(60 * time.Millisecond)
+	s.Put("visitors", "10.0.0.3")
+
+	assert.Equal(t, 2, s.Compact("visitors"))
+	keyCount, _ := s.CountKeys("visitors")
+	assert.Equal(t, 1, keyCount)
+	assert.Equal(t, 1, s.Compact("gone"))
+	assert.NotContains(t, s.Namespaces(), "gone", "empty namespaces are removed")
+	assert.Equal(t, 0, s.Compact("missing"))
+}
+
+func TestStore_SetOnKeyExpired(t *testing.T) {
+	s := NewStoreMillis(50)
+	s.DisableCleanup()
+	var expired []string
+	s.SetOnKeyExpired(func(ns, entryKey string) {
+		expired = append(expired, ns+" "+entryKey)
+	})
+	s.Put("visitors", "10.0.0.1")
+	s.Put("visitors", "10.0.0.1")
+	time.Sleep(60 * time.Millisecond)
+	s.Put("visitors", "10.0.0.2")
+
+	s.cleanup()
+	assert.Equal(t, []string{"visitors 10.0.0.1"}, expired, "only keys left without entries")
+	s.lastGCdNamespaces = nil
+	s.cleanup()
+	assert.Len(t, expired, 1, "a key is only reported when its entries are removed")
+}
+
+func TestStore_SetWindowMode(t *testing.T) {
+	s := NewStore(60)
+	s.DisableCleanup()
+	s.SetWindowMode("billing", tree.WindowFixed)
+	s.Put("billing", "acct")
+	assert.Equal(t, int64(0), s.getOrCreateTree("billing").Entries()["acct"][0]%60)
+
+	// the mode outlives the namespace being removed once empty
+	sh := s.shardFor("billing")
+	sh.Lock()
+	sh.namespaces.Remove("billing")
+	sh.Unlock()
+	s.Put("billing", "acct")
+	assert.Equal(t, int64(0), s.getOrCreateTree("billing").Entries()["acct"][0]%60)
+}
+
+func TestStore_DeleteAtTombstone(t *testing.T) {
+	s := NewStore(60)
+	s.DisableCleanup()
+	s.Put("ns", "k")
+	deletedAt := time.Now().UnixNano() / int64(time.Millisecond)
+	assert.True(t, s.DeleteAt("ns", "k", deletedAt, 100*time.Millisecond))
+	assert.Equal(t, 0, s.Count("ns", "k"))
+
+	assert.False(t, s.PutAt("ns", "k", deletedAt-1), "put from before the delete crossed it")
+	assert.Equal(t, 0, s.Count("ns", "k"))
+	assert.True(t, s.PutAt("ns", "k", deletedAt+1))
+	assert.Equal(t, 1, s.Count("ns", "k"))
+
+	// once the tombstone is gone, late puts are applied
+	time.Sleep(150 * time.Millisecond)
+	s.sweepTombstones()
+	assert.True(t, s.PutAt("ns", "k", deletedAt-1))
+	assert.Equal(t, 2, s.Count("ns", "k"))
+}
+
+func TestStore_Reset(t *testing.T) {
+	s := NewStore(60)
+	s.DisableCleanup()
+	s.SetWindowMode("billing", tree.WindowFixed)
+	s.Put("a", "key")
+	s.Put("billing", "acct")
+	s.DeleteAt("a", "gone", time.Now().UnixNano()/int64(time.Millisecond), time.Minute)
+
+	s.Reset()
+	assert.Empty(t, s.Namespaces())
+	assert.Equal(t, 0, s.Count("a", "key"))
+	assert.True(t, s.PutAt("a", "gone", 1), "tombstones are removed")
+
+	s.Put("billing", "acct")
+	assert.Equal(t, int64(0), s.getOrCreateTree("billing").Entries()["acct"][0]%60, "window modes are kept")
+}
+
+func TestStore_CountServerEntriesContext(t *testing.T) {
+	s := NewStore(60)
+	s.DisableCleanup()
+	s.Put("a", "key")
+	s.Put("b", "key")
+	count, err := s.CountServerEntriesContext(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = s.CountServerEntriesContext(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestStore_NamespacesPage(t *testing.T) {
+	s := NewStore(60)
+	s.DisableCleanup()
+	for _, ns := range []string{"c", "a", "d", "b"} {
+		s.Put(ns, "key")
+	}
+
+	page, more := s.NamespacesPage(0, 3)
+	assert.Equal(t, []string{"a", "b", "c"}, page)
+	assert.True(t, more)
+
+	page, more = s.NamespacesPage(3, 3)
+	assert.Equal(t, []string{"d"}, page)
+	assert.False(t, more)
+
+	page, more = s.NamespacesPage(4, 3)
+	assert.Empty(t, page)
+	assert.False(t, more)
+}
+
+func TestStore_NamespaceStats(t *testing.T) {
+	s := NewStore(60)
+	s.DisableCleanup()
+	s.PutExpireAt("restored", "key", time.Now().Unix()+30)
+	s.Put("cold", "a")
+	s.Put("cold", "b")
+	time.Sleep(5 * time.Millisecond)
+	s.Put("busy", "a")
+	time.Sleep(5 * time.Millisecond)
+	s.Count("cold", "a")
+	time.Sleep(5 * time.Millisecond)
+	s.Count("busy", "a")
+
+	stats := s.NamespaceStats()
+	if assert.Len(t, stats, 3) {
+		assert.Equal(t, "restored", stats[0].Namespace)
+		assert.True(t, stats[0].LastAccess.IsZero(), "restores are not accesses")
+		assert.Equal(t, NamespaceStat{Namespace: "cold", Keys: 2, LastAccess: stats[1].LastAccess}, stats[1])
+		assert.Equal(t, "busy", stats[2].Namespace)
+		assert.True(t, stats[1].LastAccess.Before(stats[2].LastAccess))
+		assert.WithinDuration(t, time.Now(), stats[2].LastAccess, time.Second)
+	}
+}
+
+func TestStore_SnapshotRestore(t *testing.T) {
+	s := NewStore(60)
+	s.DisableCleanup()
+	s.Put("default", "asdf")
+	s.Put("default", "asdf")
+	s.Put("default", "jkl")
+	s.Put("other", "asdf")
+	s.getOrCreateTree("other").PutExpireAt("expiring", time.Now().Unix()+1)
+
+	var backup bytes.Buffer
+	assert.NoError(t, s.Snapshot(&backup))
+
+	time.Sleep(time.Second)
+	restored := NewStore(60)
+	restored.DisableCleanup()
+	assert.NoError(t, restored.Restore(bytes.NewReader(backup.Bytes())))
+	assert.Equal(t, 2, restored.Count("default", "asdf"))
+	assert.Equal(t, 1, restored.Count("default", "jkl"))
+	assert.Equal(t, 1, restored.Count("other", "asdf"))
+	assert.Equal(t, 0, restored.Count("other", "expiring"), "expired since backup should be dropped")
+	assert.Equal(t, 4, restored.CountServerEntries())
+
+	t.Run("truncated snapshot is an error", func(t *testing.T) {
+		truncated := backup.Bytes()[0 : backup.Len()-5]
+		assert.Error(t, NewStore(60).Restore(bytes.NewReader(truncated)))
+	})
+}
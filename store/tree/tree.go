@@ -2,9 +2,12 @@ package tree
 
 import (
 	"github.com/emirpasic/gods/trees/redblacktree"
+	"math"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -12,19 +15,72 @@ type ExpireAtSecs int64
 
 // Tree is a a thread-safe data structure for tracking expirable items. It automatically expires old entries and keys.
 // It does not garbage collect. Items are only expired when interacting with the data structure.
+// Entries are tracked as the unix milliseconds they expire at, so expiries shorter than a second work.
 type Tree struct {
+	// lastAccessMillis is first so it is 64-bit aligned for atomic access on 32-bit platforms
+	lastAccessMillis int64
 	sync.Mutex
-	defaultExpireAfterSecs int64
-	tree                   *redblacktree.Tree
+	defaultExpireAfterMillis int64
+	maxEntriesPerKey         int
+	windowMode               WindowMode
+	tree                     *redblacktree.Tree
 }
 
+// WindowMode is how the expiry of a put entry is chosen
+type WindowMode int
+
+const (
+	// WindowSliding expires each entry the tree's expiry after it was put, so counts are a rolling window.
+	WindowSliding WindowMode = iota
+	// WindowFixed expires entries at the end of the wall clock window they were put in, where windows are
+	// the tree's expiry long and aligned to the unix epoch, such as the top of each minute. Every entry in a
+	// window expires together, so counts reset at each window boundary.
+	WindowFixed
+)
+
 func NewTree(expireAfterSecs int64) *Tree {
+	return NewTreeMillis(expireAfterSecs * 1000)
+}
+
+// NewTreeMillis is NewTree with the expiry in milliseconds.
+func NewTreeMillis(expireAfterMillis int64) *Tree {
 	return &Tree{
-		defaultExpireAfterSecs: expireAfterSecs,
-		tree:                   redblacktree.NewWithStringComparator(),
+		defaultExpireAfterMillis: expireAfterMillis,
+		tree:                     redblacktree.NewWithStringComparator(),
 	}
 }
 
+// nowMillis is the current unix time in milliseconds
+func nowMillis() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// Touch records that the tree was accessed now, see LastAccessMillis
+func (n *Tree) Touch() {
+	atomic.StoreInt64(&n.lastAccessMillis, nowMillis())
+}
+
+// LastAccessMillis is the unix milliseconds of the last Touch, or zero when it was never touched
+func (n *Tree) LastAccessMillis() int64 {
+	return atomic.LoadInt64(&n.lastAccessMillis)
+}
+
+// SetMaxEntriesPerKey caps how many entries a key holds. Once a key is at the cap, each put drops the
+// oldest entry, so Count saturates at the cap. Zero means unlimited.
+func (n *Tree) SetMaxEntriesPerKey(max int) {
+	n.Lock()
+	defer n.Unlock()
+	n.maxEntriesPerKey = max
+}
+
+// SetWindowMode changes how the expiry of entries put from now on is chosen. Entries already in the tree
+// keep their expiry.
+func (n *Tree) SetWindowMode(mode WindowMode) {
+	n.Lock()
+	defer n.Unlock()
+	n.windowMode = mode
+}
+
 // Keys returns a list of all valid keys in the tree, and a sum of every key's valid entries.
 // It is expensive because it will result in the entire tree being counted and expired where necessary.
 func (n *Tree) Keys() ([]string, int) {
@@ -54,74 +110,474 @@ func (n *Tree) Keys() ([]string, int) {
 	return outKeys, outCount
 }
 
+// Size returns how many keys are in the tree without counting them. It is cheap, but it includes keys
+// whose entries have all expired and not been cleaned up yet.
+func (n *Tree) Size() int {
+	n.Lock()
+	defer n.Unlock()
+	return n.tree.Size()
+}
+
+// KeyCount is a key and how many unexpired entries it has
+type KeyCount struct {
+	Key   string
+	Count int
+}
+
+// KeyCounts returns every valid key in the tree with its count of entries, in key order. Like Keys,
+// it is expensive because the entire tree is counted and expired where necessary.
+func (n *Tree) KeyCounts() []KeyCount {
+	n.Lock()
+	keysI := n.tree.Keys()
+	n.Unlock()
+
+	var out []KeyCount
+	for _, iface := range keysI {
+		key := iface.(string)
+		keyCount := n.Count(key)
+		if keyCount == 0 {
+			continue
+		}
+		out = append(out, KeyCount{Key: key, Count: keyCount})
+	}
+	return out
+}
+
+// Expire removes every expired entry, and any keys left without entries. It returns how many keys and
+// entries remain, and how many entries were removed. Like Keys, it is expensive, but it only holds the
+// lock for one key at a time.
+func (n *Tree) Expire() (keyCount, entryCount, reclaimed int) {
+	return n.ExpireEach(nil)
+}
+
+// ExpireEach is Expire, calling onExpired with each key whose last entries it removed. It is called
+// without the lock held.
+func (n *Tree) ExpireEach(onExpired func(key string)) (keyCount, entryCount, reclaimed int) {
+	n.Lock()
+	keysI := n.tree.Keys()
+	n.Unlock()
+
+	var remaining, removed int
+	for _, iface := range keysI {
+		remaining, removed = n.expireKey(iface.(string))
+		reclaimed += removed
+		if remaining == 0 {
+			if removed > 0 && onExpired != nil {
+				onExpired(iface.(string))
+			}
+			continue
+		}
+		keyCount++
+		entryCount += remaining
+	}
+	return keyCount, entryCount, reclaimed
+}
+
+func (n *Tree) expireKey(entryKey string) (remaining, reclaimed int) {
+	n.Lock()
+	defer n.Unlock()
+
+	datesMillis := n.getAndCleanupUnsafe(entryKey)
+	if datesMillis == nil {
+		return 0, 0
+	}
+	before := len(*datesMillis)
+	datesMillis = removeExpired(datesMillis)
+	remaining = len(*datesMillis)
+	if remaining == 0 {
+		n.tree.Remove(entryKey)
+	} else {
+		n.tree.Put(entryKey, *datesMillis)
+	}
+	return remaining, before - remaining
+}
+
 // Count will return the number of entries at `entryKey`. It has the side effect of cleaning up
 // stale entries and entry keys.
 func (n *Tree) Count(entryKey string) int {
 	n.Lock()
 	defer n.Unlock()
 
-	datesSecs := n.getAndCleanupUnsafe(entryKey)
-	if datesSecs == nil {
+	datesMillis := n.getAndCleanupUnsafe(entryKey)
+	if datesMillis == nil {
+		return 0
+	}
+
+	if len(*datesMillis) == 0 {
+		n.tree.Remove(entryKey)
+		return 0
+	}
+
+	datesMillis = removeExpired(datesMillis)
+	count := len(*datesMillis)
+	n.tree.Put(entryKey, *datesMillis)
+	return count
+}
+
+// CountAt returns how many entries at `entryKey` will still be unexpired at the unix seconds `atSecs`,
+// which is the same as Count when `atSecs` is now or in the past. It cleans up like Count does.
+func (n *Tree) CountAt(entryKey string, atSecs int64) int {
+	n.Lock()
+	defer n.Unlock()
+
+	datesMillis := n.getAndCleanupUnsafe(entryKey)
+	if datesMillis == nil {
 		return 0
 	}
 
-	if len(*datesSecs) == 0 {
+	datesMillis = removeExpired(datesMillis)
+	if len(*datesMillis) == 0 {
 		n.tree.Remove(entryKey)
 		return 0
 	}
+	n.tree.Put(entryKey, *datesMillis)
 
-	datesSecs = removeExpired(datesSecs)
-	count := len(*datesSecs)
-	n.tree.Put(entryKey, *datesSecs)
+	atMillis := atSecs * 1000
+	var count int
+	for _, removeAt := range *datesMillis {
+		if removeAt > atMillis {
+			count++
+		}
+	}
 	return count
 }
 
-// KeyMatch crawls the subtree to return keys starting with the `keyPattern` string.
+// LastPutMillis returns when the newest unexpired entry at `entryKey` was put, in unix milliseconds, or zero
+// when it has none. Like CountWeighted, that is its expiry less the tree's expiry.
+func (n *Tree) LastPutMillis(entryKey string) int64 {
+	n.Lock()
+	defer n.Unlock()
+
+	datesMillis := n.getAndCleanupUnsafe(entryKey)
+	if datesMillis == nil {
+		return 0
+	}
+	var newest int64
+	for _, removeAt := range *removeExpired(datesMillis) {
+		if removeAt > newest {
+			newest = removeAt
+		}
+	}
+	if newest == 0 {
+		return 0
+	}
+	return newest - n.defaultExpireAfterMillis
+}
+
+// CountWeighted sums the entries at `entryKey` weighted by their age, halving every `halfLifeMillis`, so an
+// entry put now weighs 1 and one put a half life ago weighs 0.5. An entry's age is its expiry less the tree's
+// expiry, which with WindowFixed is the start of its window rather than when it was put. It cleans up like
+// Count does.
+func (n *Tree) CountWeighted(entryKey string, halfLifeMillis int64) float64 {
+	n.Lock()
+	defer n.Unlock()
+
+	datesMillis := n.getAndCleanupUnsafe(entryKey)
+	if datesMillis == nil {
+		return 0
+	}
+
+	datesMillis = removeExpired(datesMillis)
+	if len(*datesMillis) == 0 {
+		n.tree.Remove(entryKey)
+		return 0
+	}
+	n.tree.Put(entryKey, *datesMillis)
+
+	now := nowMillis()
+	var weighted float64
+	for _, removeAt := range *datesMillis {
+		ageMillis := now - (removeAt - n.defaultExpireAfterMillis)
+		if ageMillis < 0 {
+			// put on a peer whose clock is ahead
+			ageMillis = 0
+		}
+		weighted += math.Exp2(-float64(ageMillis) / float64(halfLifeMillis))
+	}
+	return weighted
+}
+
+// MatchMode is how a key pattern is compared to keys
+type MatchMode int
+
+const (
+	// MatchGlob matches the whole key, where each `*` matches any run of characters, including none.
+	// Every other character matches only itself, so `a` matches just the key `a`, and `a*` matches
+	// keys starting with `a`.
+	MatchGlob MatchMode = iota
+	// MatchPrefix matches keys starting with the pattern
+	MatchPrefix
+	// MatchSubstring matches keys containing the pattern anywhere
+	MatchSubstring
+)
+
+// MatchOptions adjust how KeyMatchOpts compares keys
+type MatchOptions struct {
+	Mode MatchMode
+	// CaseInsensitive matches keys regardless of letter case
+	CaseInsensitive bool
+	// IncludeExpired also returns keys whose entries have all expired, but which were not cleaned up yet
+	IncludeExpired bool
+}
+
+// KeyMatch crawls the subtree to return keys matching the `keyPattern` glob. See MatchGlob.
 func (n *Tree) KeyMatch(keyPattern string) []string {
+	return n.KeyMatchMode(keyPattern, MatchGlob)
+}
+
+// KeyMatchMode crawls the subtree to return keys matching `keyPattern` in the given mode. Keys are returned
+// in lexicographic byte order, because that is the order the tree stores them in, so no sort is needed.
+func (n *Tree) KeyMatchMode(keyPattern string, mode MatchMode) []string {
+	return n.KeyMatchOpts(keyPattern, MatchOptions{Mode: mode})
+}
+
+// KeyMatchOpts is KeyMatchMode with more options.
+func (n *Tree) KeyMatchOpts(keyPattern string, opts MatchOptions) []string {
 	var out []string
-	var wg sync.WaitGroup
-	re, err := regexp.Compile(strings.ReplaceAll(keyPattern, "*", "(^|$|.+)"))
-	if err != nil {
-		return []string{err.Error()}
-	}
-
-	wg.Add(1)
-	go func() {
-		iterator := n.tree.Iterator()
-		var k string
-		var kOk bool
-		existed := iterator.Next()
-		for existed {
-			k, kOk = iterator.Key().(string)
-			if !kOk {
-				break
-			}
-			existed = iterator.Next()
-			if re.MatchString(k) {
-				if n.Count(k) > 0 {
-					out = append(out, k)
-				}
+	n.eachMatch(keyMatcher(keyPattern, opts.Mode, opts.CaseInsensitive), opts.IncludeExpired, func(k string) bool {
+		out = append(out, k)
+		return true
+	})
+	return out
+}
+
+// KeyMatchPage returns up to `limit` keys matching the `keyPattern` glob, after skipping the first
+// `offset` matches, in the same order as KeyMatch. It stops crawling once the page is full, and reports
+// whether more matches remain after the page.
+func (n *Tree) KeyMatchPage(keyPattern string, offset, limit int) (page []string, more bool) {
+	page = []string{}
+	if limit <= 0 {
+		return page, false
+	}
+	var skipped int
+	n.eachMatch(keyMatcher(keyPattern, MatchGlob, false), false, func(k string) bool {
+		if skipped < offset {
+			skipped++
+			return true
+		}
+		if len(page) == limit {
+			more = true
+			return false
+		}
+		page = append(page, k)
+		return true
+	})
+	return page, more
+}
+
+// eachMatch calls fn with every valid key that matches, in key order, until fn returns false. Keys without
+// unexpired entries are skipped unless includeExpired is set. The matching keys are copied under the lock,
+// like Keys does, since Count changes the tree and can't run while it is being iterated.
+func (n *Tree) eachMatch(match func(string) bool, includeExpired bool, fn func(key string) bool) {
+	var matched []string
+	n.Lock()
+	iterator := n.tree.Iterator()
+	for iterator.Next() {
+		k, ok := iterator.Key().(string)
+		if !ok {
+			break
+		}
+		if match(k) {
+			matched = append(matched, k)
+		}
+	}
+	n.Unlock()
+
+	for _, k := range matched {
+		if includeExpired || n.Count(k) > 0 {
+			if !fn(k) {
+				return
 			}
 		}
-		wg.Done()
-	}()
-	wg.Wait()
+	}
+}
 
-	return out
+// Delete removes the key and all its entries, returning whether the key had any unexpired entries.
+func (n *Tree) Delete(entryKey string) bool {
+	n.Lock()
+	defer n.Unlock()
+
+	datesMillis := n.getAndCleanupUnsafe(entryKey)
+	if datesMillis == nil {
+		return false
+	}
+	n.tree.Remove(entryKey)
+	return len(*removeExpired(datesMillis)) > 0
+}
+
+// DeleteBefore removes the entries at `entryKey` which were put at or before the unix milliseconds
+// `atMillis`, keeping any put later. It returns whether any unexpired entries were removed. When an
+// entry was put is worked out from its expiry, so in fixed windows every entry of the window is
+// considered put at the start of it.
+func (n *Tree) DeleteBefore(entryKey string, atMillis int64) bool {
+	return n.ResetBefore(entryKey, atMillis) > 0
+}
+
+// ResetBefore is DeleteBefore, returning how many unexpired entries were removed. Counting and removing them
+// happen under one lock, so each entry is in the count of exactly one reset.
+func (n *Tree) ResetBefore(entryKey string, atMillis int64) int {
+	n.Lock()
+	defer n.Unlock()
+
+	datesMillis := n.getAndCleanupUnsafe(entryKey)
+	if datesMillis == nil {
+		return 0
+	}
+	datesMillis = removeExpired(datesMillis)
+	var kept []int64
+	for _, removeAt := range *datesMillis {
+		if removeAt-n.defaultExpireAfterMillis > atMillis {
+			kept = append(kept, removeAt)
+		}
+	}
+	if len(kept) == 0 {
+		n.tree.Remove(entryKey)
+	} else {
+		n.tree.Put(entryKey, kept)
+	}
+	return len(*datesMillis) - len(kept)
+}
+
+// DeleteMatch removes every key matching the `keyPattern` glob the same way as KeyMatch, returning how
+// many of the removed keys had unexpired entries.
+func (n *Tree) DeleteMatch(keyPattern string) int {
+	match := keyMatcher(keyPattern, MatchGlob, false)
+
+	n.Lock()
+	defer n.Unlock()
+
+	var removed int
+	for _, iface := range n.tree.Keys() {
+		key := iface.(string)
+		if !match(key) {
+			continue
+		}
+		datesMillis := n.getAndCleanupUnsafe(key)
+		if datesMillis == nil {
+			continue
+		}
+		n.tree.Remove(key)
+		if len(*removeExpired(datesMillis)) > 0 {
+			removed++
+		}
+	}
+	return removed
 }
 
 func (n *Tree) Put(entryKey string) {
+	n.PutWeight(entryKey, 1)
+}
+
+// PutWeight adds `weight` entries to a key at once, as if it was put that many times.
+func (n *Tree) PutWeight(entryKey string, weight int) {
 	n.Lock()
 	defer n.Unlock()
 
-	datesSecs := n.getAndCleanupUnsafe(entryKey)
-	if datesSecs == nil {
-		datesSecs = &[]int64{}
+	datesMillis := n.getAndCleanupUnsafe(entryKey)
+	if datesMillis == nil {
+		datesMillis = &[]int64{}
 	}
-	datesSecs = removeExpired(datesSecs)
-	secs := time.Now().Unix()
-	nextDatesSecs := append(*datesSecs, secs+n.defaultExpireAfterSecs)
-	n.tree.Put(entryKey, nextDatesSecs)
+	datesMillis = removeExpired(datesMillis)
+	nextDatesMillis := insertSorted(*datesMillis, n.expireAtUnsafe(nowMillis()), weight)
+	n.tree.Put(entryKey, n.capEntriesUnsafe(nextDatesMillis))
+}
+
+// insertSorted adds `count` of the expiry to the sorted dates, keeping them sorted. It is usually the latest
+// expiry, so it is appended, but it can be earlier after the window mode changed or the clock moved backwards.
+func insertSorted(dates []int64, expireAt int64, count int) []int64 {
+	if len(dates) == 0 || dates[len(dates)-1] <= expireAt {
+		for i := 0; i < count; i++ {
+			dates = append(dates, expireAt)
+		}
+		return dates
+	}
+	at := sort.Search(len(dates), func(i int) bool {
+		return dates[i] > expireAt
+	})
+	out := make([]int64, 0, len(dates)+count)
+	out = append(out, dates[:at]...)
+	for i := 0; i < count; i++ {
+		out = append(out, expireAt)
+	}
+	return append(out, dates[at:]...)
+}
+
+// PutExpireAt adds entries to a key which expire at the given unix seconds, instead of the tree's expiry.
+// Entries which are already expired are ignored.
+func (n *Tree) PutExpireAt(entryKey string, expireAtSecs ...int64) {
+	expireAtMillis := make([]int64, len(expireAtSecs))
+	for i, secs := range expireAtSecs {
+		expireAtMillis[i] = secs * 1000
+	}
+	n.PutExpireAtMillis(entryKey, expireAtMillis...)
+}
+
+// PutExpireAtMillis is PutExpireAt with unix milliseconds.
+func (n *Tree) PutExpireAtMillis(entryKey string, expireAtMillis ...int64) {
+	n.Lock()
+	defer n.Unlock()
+
+	datesMillis := n.getAndCleanupUnsafe(entryKey)
+	if datesMillis == nil {
+		datesMillis = &[]int64{}
+	}
+	datesMillis = removeExpired(datesMillis)
+	currentTime := nowMillis()
+	nextDatesMillis := *datesMillis
+	sorted := true
+	for _, removeAt := range expireAtMillis {
+		if removeAt > currentTime {
+			if len(nextDatesMillis) > 0 && removeAt < nextDatesMillis[len(nextDatesMillis)-1] {
+				sorted = false
+			}
+			nextDatesMillis = append(nextDatesMillis, removeAt)
+		}
+	}
+	if len(nextDatesMillis) == 0 {
+		return
+	}
+	// keep them in expiry order, which removeExpired relies on
+	if !sorted {
+		sort.Slice(nextDatesMillis, func(i, j int) bool {
+			return nextDatesMillis[i] < nextDatesMillis[j]
+		})
+	}
+	n.tree.Put(entryKey, n.capEntriesUnsafe(nextDatesMillis))
+}
+
+// Entries returns a copy of every key's unexpired entries, as the unix seconds each entry expires at.
+// Seconds are rounded up, so an entry is never dropped early when put back with PutExpireAt.
+func (n *Tree) Entries() map[string][]int64 {
+	n.Lock()
+	keysI := n.tree.Keys()
+	n.Unlock()
+
+	out := make(map[string][]int64, len(keysI))
+	for _, iface := range keysI {
+		key := iface.(string)
+		n.Lock()
+		datesMillis := n.getAndCleanupUnsafe(key)
+		if datesMillis != nil {
+			datesMillis = removeExpired(datesMillis)
+			if len(*datesMillis) > 0 {
+				secs := make([]int64, len(*datesMillis))
+				for i, removeAt := range *datesMillis {
+					secs[i] = (removeAt + 999) / 1000
+				}
+				out[key] = secs
+			}
+		}
+		n.Unlock()
+	}
+	return out
+}
+
+// expireAtUnsafe returns when an entry put at `putMillis` expires in the tree's window mode
+func (n *Tree) expireAtUnsafe(putMillis int64) int64 {
+	if n.windowMode == WindowFixed && n.defaultExpireAfterMillis > 0 {
+		return (putMillis/n.defaultExpireAfterMillis + 1) * n.defaultExpireAfterMillis
+	}
+	return putMillis + n.defaultExpireAfterMillis
 }
 
 // getAndCleanupUnsafe does not lock the mutex, so it can be used inside a lock
@@ -139,18 +595,77 @@ func (n *Tree) getAndCleanupUnsafe(entryKey string) *[]int64 {
 	return &dates // not extra copy
 }
 
-func removeExpired(datesSecs *[]int64) *[]int64 {
-	if len(*datesSecs) == 0 {
-		return datesSecs
+// capEntriesUnsafe drops the oldest entries beyond the max entries per key. Entries are in expiry order,
+// so the oldest are at the front.
+func (n *Tree) capEntriesUnsafe(dates []int64) []int64 {
+	if n.maxEntriesPerKey <= 0 || len(dates) <= n.maxEntriesPerKey {
+		return dates
 	}
-	currentTime := time.Now().Unix()
-	var out []int64
-	// TODO: these are already sorted, so we can discard earlier entries
-	for _, removeAt := range *datesSecs {
-		if removeAt > currentTime {
-			// KEEP - not expired
-			out = append(out, removeAt)
+	return dates[len(dates)-n.maxEntriesPerKey:]
+}
+
+// KeyMatcher returns whether a key matches `keyPattern` in the given mode, the same way as KeyMatchMode, for
+// matching keys which are not in a tree.
+func KeyMatcher(keyPattern string, mode MatchMode) func(string) bool {
+	return keyMatcher(keyPattern, mode, false)
+}
+
+// keyMatcher returns a func reporting whether a key matches the pattern in the given mode
+func keyMatcher(keyPattern string, mode MatchMode, caseInsensitive bool) func(string) bool {
+	switch mode {
+	case MatchPrefix, MatchSubstring:
+		compare := strings.HasPrefix
+		if mode == MatchSubstring {
+			compare = strings.Contains
 		}
+		if !caseInsensitive {
+			return func(key string) bool {
+				return compare(key, keyPattern)
+			}
+		}
+		lowerPattern := strings.ToLower(keyPattern)
+		return func(key string) bool {
+			return compare(strings.ToLower(key), lowerPattern)
+		}
+	}
+	// everything between the stars is literal, so keys like `.+` are not treated as regex
+	parts := strings.Split(keyPattern, "*")
+	for i := range parts {
+		parts[i] = regexp.QuoteMeta(parts[i])
+	}
+	flags := "(?s)"
+	if caseInsensitive {
+		flags = "(?si)"
+	}
+	re := regexp.MustCompile(flags + "^" + strings.Join(parts, ".*") + "$")
+	return re.MatchString
+}
+
+// removeExpired drops the expired entries. The puts keep entries in expiry order, so the expired entries are
+// all at the front, which are trimmed off without copying or scanning the rest. Only the ends are checked, as
+// a guard against a slice which was not put in order.
+func removeExpired(datesMillis *[]int64) *[]int64 {
+	dates := *datesMillis
+	if len(dates) == 0 {
+		return datesMillis
+	}
+	currentTime := nowMillis()
+	if dates[0] > dates[len(dates)-1] {
+		var out []int64
+		for _, removeAt := range dates {
+			if removeAt > currentTime {
+				// KEEP - not expired
+				out = append(out, removeAt)
+			}
+		}
+		return &out
+	}
+	firstUnexpired := sort.Search(len(dates), func(i int) bool {
+		return dates[i] > currentTime
+	})
+	if firstUnexpired == 0 {
+		return datesMillis
 	}
+	out := dates[firstUnexpired:]
 	return &out
 }
@@ -1,21 +1,26 @@
 package tree
 
 import (
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"math/rand"
+	"sort"
+	"sync"
 	"testing"
 	"time"
 )
 
 func TestTree_removeExpired(t *testing.T) {
-	keep1 := time.Now().Unix() + 5
-	keep2 := time.Now().Unix() + 200
+	now := nowMillis()
+	keep1 := now + 5000
+	keep2 := now + 200000
+	// puts keep entries in expiry order
 	entries := []int64{
-		time.Now().Unix() - 2,  // expired
-		time.Now().Unix() - 60, // expired
-		keep1,                  // KEEP
-		keep2,                  // KEEP
-		time.Now().Unix() - 1,  // expired
+		now - 60000, // expired
+		now - 2000,  // expired
+		now - 1000,  // expired
+		keep1,       // KEEP
+		keep2,       // KEEP
 	}
 
 	result := removeExpired(&entries)
@@ -24,6 +29,21 @@ func TestTree_removeExpired(t *testing.T) {
 	assert.Equal(t, (*result)[1], keep2)
 }
 
+func TestTree_PutKeepsExpiryOrder(t *testing.T) {
+	tr := NewTree(60)
+	now := time.Now().Unix()
+	// an expiry later than the tree's, then puts which expire before it
+	tr.PutExpireAt("k", now+120)
+	tr.PutWeight("k", 2)
+	tr.PutExpireAt("k", now+90, now+30)
+	val, _ := tr.tree.Get("k")
+	dates := val.([]int64)
+	assert.Len(t, dates, 5)
+	assert.True(t, sort.SliceIsSorted(dates, func(i, j int) bool { return dates[i] < dates[j] }), "%v", dates)
+	assert.Equal(t, 5, tr.Count("k"))
+	assert.Equal(t, 2, tr.CountAt("k", now+65))
+}
+
 func TestTree_Count(t *testing.T) {
 	t.Run("count returns number of non-expired and removes expired values", func(t *testing.T) {
 		tr := NewTree(2)
@@ -80,6 +100,90 @@ func TestTree_Count(t *testing.T) {
 	})
 }
 
+func TestTree_MaxEntriesPerKey(t *testing.T) {
+	t.Run("count saturates at the cap", func(t *testing.T) {
+		tr := NewTree(60)
+		tr.SetMaxEntriesPerKey(3)
+		for i := 0; i < 10; i++ {
+			tr.Put("willy")
+		}
+		tr.Put("pander")
+		assert.Equal(t, 3, tr.Count("willy"))
+		assert.Equal(t, 1, tr.Count("pander"))
+	})
+	t.Run("drops the oldest entries first", func(t *testing.T) {
+		tr := NewTree(60)
+		tr.SetMaxEntriesPerKey(2)
+		now := time.Now().Unix()
+		tr.PutExpireAt("willy", now+30, now+10, now+20)
+		assert.Equal(t, []int64{now + 20, now + 30}, tr.Entries()["willy"])
+	})
+	t.Run("zero is unlimited", func(t *testing.T) {
+		tr := NewTree(60)
+		tr.SetMaxEntriesPerKey(0)
+		for i := 0; i < 10; i++ {
+			tr.Put("willy")
+		}
+		assert.Equal(t, 10, tr.Count("willy"))
+	})
+}
+
+func TestTree_PutWeight(t *testing.T) {
+	tr := NewTree(60)
+	tr.Put("willy")
+	tr.PutWeight("willy", 10)
+	assert.Equal(t, 11, tr.Count("willy"))
+
+	tr.SetMaxEntriesPerKey(5)
+	tr.PutWeight("pander", 10)
+	assert.Equal(t, 5, tr.Count("pander"), "capped like repeated puts")
+}
+
+func TestTree_Delete(t *testing.T) {
+	t.Run("removes a key and reports whether it existed", func(t *testing.T) {
+		tr := NewTree(60)
+		tr.Put("willy")
+		tr.Put("willy")
+		tr.Put("pander")
+
+		assert.True(t, tr.Delete("willy"))
+		assert.Equal(t, 0, tr.Count("willy"))
+		assert.Equal(t, 1, tr.Count("pander"))
+		assert.False(t, tr.Delete("willy"), "already deleted")
+		assert.False(t, tr.Delete("never-put"))
+
+		tr.Put("willy")
+		assert.Equal(t, 1, tr.Count("willy"), "can be put again after delete")
+	})
+	t.Run("does not report expired keys as existing", func(t *testing.T) {
+		tr := NewTree(1)
+		tr.Put("willy")
+		time.Sleep(time.Second)
+		assert.False(t, tr.Delete("willy"))
+	})
+}
+
+func TestTree_DeleteMatch(t *testing.T) {
+	tr := NewTree(60)
+	tr.Put("a:sdf")
+	tr.Put("a:sdf")
+	tr.Put("a:elvis")
+	tr.Put("b:elvis")
+	tr.Put("bla")
+
+	assert.Equal(t, 2, tr.DeleteMatch("a:*"))
+	assert.Equal(t, 0, tr.Count("a:sdf"))
+	assert.Equal(t, 0, tr.Count("a:elvis"))
+	assert.Equal(t, 1, tr.Count("b:elvis"))
+	assert.Equal(t, 1, tr.Count("bla"))
+	assert.Equal(t, 0, tr.DeleteMatch("a:*"))
+
+	assert.Equal(t, 2, tr.DeleteMatch("*"))
+	keys, entryCount := tr.Keys()
+	assert.Equal(t, 0, len(keys))
+	assert.Equal(t, 0, entryCount)
+}
+
 func TestTree_KeyMatch(t *testing.T) {
 	t.Run("returns only matches for a keyPattern", func(t *testing.T) {
 		tr := NewTree(60)
@@ -106,12 +210,22 @@ func TestTree_KeyMatch(t *testing.T) {
 		tr.Put(".+")
 		tr.Put("nil")
 
-		assert.Equal(t, 3, len(tr.KeyMatch("^a:*")))
+		assert.ElementsMatch(t, []string{"a:sdf", "a:", "a:elvis:5"}, tr.KeyMatch("a:*"))
 
 		m := tr.KeyMatch("*bla*")
 		assert.Equalf(t, 3, len(m), "%+v", m)
 
-		assert.ElementsMatch(t, []string{"a:elvis:5", "b:elvis:8:elvis", "e:elvis", "c:elvis:1"}, tr.KeyMatch("*elvis*"))
+		// without a star the whole key must match
+		assert.Equal(t, []string{"a"}, tr.KeyMatch("a"))
+		assert.Empty(t, tr.KeyMatch("bl"))
+		assert.ElementsMatch(t, []string{"b:elvis:8:elvis", "e:elvis"}, tr.KeyMatch("*elvis"))
+		assert.Equal(t, []string{"b:elvis:8:elvis"}, tr.KeyMatch("b*elvis*elvis"))
+
+		// regex characters are literal
+		assert.Equal(t, []string{".+"}, tr.KeyMatch(".+"))
+		assert.Empty(t, tr.KeyMatch("^a:*"))
+
+		assert.Equal(t, []string{"a:elvis:5", "b:elvis:8:elvis", "c:elvis:1", "e:elvis"}, tr.KeyMatch("*elvis*"), "sorted")
 
 		// everything
 		all := tr.KeyMatch("*")
@@ -130,7 +244,7 @@ func TestTree_KeyMatch(t *testing.T) {
 		tr.Put("cdbe")
 		tr.Put("cd:aa")
 
-		result := tr.KeyMatch("cd")
+		result := tr.KeyMatch("cd*")
 		assert.ElementsMatch(t, []string{"cdbe", "cd:aa"}, result)
 
 	})
@@ -144,7 +258,237 @@ func TestTree_KeyMatch(t *testing.T) {
 					string(charset[rand.Intn(len(charset))]) +
 					string(charset[rand.Intn(len(charset))]))
 		}
-		assert.NotEmpty(t, tr.KeyMatch("a"))
+		assert.NotEmpty(t, tr.KeyMatch("a*"))
 	})
 
 }
+
+func TestTree_KeyMatchPage(t *testing.T) {
+	tr := NewTree(60)
+	tr.Put("c")
+	tr.Put("a")
+	tr.Put("b")
+	tr.Put("x:a")
+
+	page, more := tr.KeyMatchPage("*", 0, 2)
+	assert.Equal(t, []string{"a", "b"}, page)
+	assert.True(t, more)
+
+	page, more = tr.KeyMatchPage("*", 2, 2)
+	assert.Equal(t, []string{"c", "x:a"}, page)
+	assert.False(t, more, "the page ended exactly at the last key")
+
+	page, more = tr.KeyMatchPage("x*", 1, 2)
+	assert.Empty(t, page)
+	assert.False(t, more)
+
+	page, more = tr.KeyMatchPage("*", 0, 0)
+	assert.Empty(t, page)
+	assert.False(t, more)
+}
+
+func TestTree_KeyMatchMode(t *testing.T) {
+	tr := NewTree(60)
+	tr.Put("a:sdf")
+	tr.Put("a")
+	tr.Put("ba:")
+	tr.Put("a*b")
+
+	assert.ElementsMatch(t, []string{"a:sdf", "a", "a*b"}, tr.KeyMatchMode("a", MatchPrefix))
+	assert.ElementsMatch(t, []string{"a:sdf", "ba:"}, tr.KeyMatchMode("a:", MatchSubstring))
+	assert.Equal(t, []string{"a*b"}, tr.KeyMatchMode("*", MatchSubstring), "stars are literal outside glob mode")
+	assert.Equal(t, []string{"a"}, tr.KeyMatchMode("a", MatchGlob))
+}
+
+func TestTree_Millis(t *testing.T) {
+	tr := NewTreeMillis(250)
+	tr.Put("burst")
+	tr.Put("burst")
+	assert.Equal(t, 2, tr.Count("burst"))
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, 0, tr.Count("burst"))
+
+	// seconds are rounded up, so entries are not lost by a snapshot
+	expireAt := nowMillis() + 1500
+	tr.PutExpireAtMillis("soon", expireAt)
+	assert.Equal(t, []int64{(expireAt + 999) / 1000}, tr.Entries()["soon"])
+}
+
+func TestTree_WindowFixed(t *testing.T) {
+	tr := NewTree(60)
+	tr.SetWindowMode(WindowFixed)
+	tr.Put("quota")
+	tr.Put("quota")
+	entries := tr.Entries()["quota"]
+	assert.Len(t, entries, 2)
+	assert.Equal(t, entries[0], entries[1], "entries in a window expire together")
+	assert.Equal(t, int64(0), entries[0]%60, "expires at the top of the minute")
+	assert.LessOrEqual(t, entries[0], time.Now().Unix()+60)
+
+	// entries put while sliding keep their own expiry
+	tr.SetWindowMode(WindowSliding)
+	tr.PutExpireAt("sliding", time.Now().Unix()+30)
+	tr.Put("sliding")
+	assert.Equal(t, 2, tr.Count("sliding"))
+}
+
+func TestTree_DeleteBefore(t *testing.T) {
+	tr := NewTree(60)
+	now := nowMillis()
+	// put 3 seconds ago, 1 second ago, and in a second
+	tr.PutExpireAtMillis("k", now+57000, now+59000, now+61000)
+
+	assert.True(t, tr.DeleteBefore("k", now-2000))
+	assert.Equal(t, 2, tr.Count("k"))
+	assert.True(t, tr.DeleteBefore("k", now))
+	assert.Equal(t, 1, tr.Count("k"), "the entry put after the delete is kept")
+	assert.False(t, tr.DeleteBefore("k", now))
+	assert.True(t, tr.DeleteBefore("k", now+1000))
+	assert.Equal(t, 0, tr.Size())
+}
+
+func TestTree_ResetBeforeConcurrent(t *testing.T) {
+	tr := NewTree(60)
+	const puts = 10000
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < puts/4; i++ {
+				tr.Put("k")
+			}
+		}()
+	}
+	stop := make(chan struct{})
+	totals := make(chan int)
+	go func() {
+		total := 0
+		for {
+			select {
+			case <-stop:
+				totals <- total
+				return
+			default:
+				total += tr.ResetBefore("k", nowMillis()+1)
+			}
+		}
+	}()
+	wg.Wait()
+	close(stop)
+	// entries put after the last reset in the loop are left for one more
+	resetTotal := <-totals + tr.ResetBefore("k", nowMillis()+1)
+	assert.Equal(t, puts, resetTotal, "every entry is in exactly one reset")
+	assert.Equal(t, 0, tr.Count("k"))
+}
+
+func TestTree_KeyMatchConcurrent(t *testing.T) {
+	tr := NewTree(60)
+	for i := 0; i < 100; i++ {
+		tr.Put(fmt.Sprintf("a:%d", i))
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				key := fmt.Sprintf("a:%d", (w*500+i)%200)
+				tr.Put(key)
+				tr.Count(key)
+			}
+		}(w)
+	}
+	for i := 0; i < 50; i++ {
+		assert.GreaterOrEqual(t, len(tr.KeyMatch("a:*")), 100)
+	}
+	wg.Wait()
+	assert.Len(t, tr.KeyMatch("a:*"), 200)
+}
+
+func TestTree_CountAt(t *testing.T) {
+	tr := NewTree(60)
+	now := time.Now().Unix()
+	tr.PutExpireAt("k", now+10, now+20, now+30)
+
+	assert.Equal(t, 3, tr.CountAt("k", now-100))
+	assert.Equal(t, 3, tr.CountAt("k", now))
+	assert.Equal(t, 2, tr.CountAt("k", now+10))
+	assert.Equal(t, 1, tr.CountAt("k", now+25))
+	assert.Equal(t, 0, tr.CountAt("k", now+30))
+	assert.Equal(t, 0, tr.CountAt("missing", now))
+	// forecasting does not remove anything
+	assert.Equal(t, 3, tr.Count("k"))
+}
+
+func TestTree_LastPutMillis(t *testing.T) {
+	tr := NewTree(60)
+	assert.Equal(t, int64(0), tr.LastPutMillis("k"))
+
+	before := nowMillis()
+	tr.Put("k")
+	tr.Put("k")
+	last := tr.LastPutMillis("k")
+	assert.GreaterOrEqual(t, last, before)
+	assert.LessOrEqual(t, last, nowMillis())
+
+	// expired entries don't count
+	now := time.Now().Unix()
+	tr.PutExpireAt("old", now-10)
+	assert.Equal(t, int64(0), tr.LastPutMillis("old"))
+}
+
+func TestTree_CountWeighted(t *testing.T) {
+	tr := NewTree(60)
+	now := nowMillis()
+	// put now, one half life ago, and two half lives ago
+	tr.PutExpireAtMillis("k", now+60000, now+50000, now+40000)
+
+	assert.InDelta(t, 1+0.5+0.25, tr.CountWeighted("k", 10000), 0.01)
+	assert.InDelta(t, 3, tr.CountWeighted("k", 1000000000), 0.01, "a long half life is nearly Count")
+	assert.Equal(t, float64(0), tr.CountWeighted("missing", 10000))
+	assert.Equal(t, 3, tr.Count("k"))
+}
+
+func TestTree_KeyMatchOpts(t *testing.T) {
+	tr := NewTree(60)
+	tr.Put("User:Bob")
+	tr.Put("user:alice")
+	tr.Put("admin:USER")
+	// PutExpireAt skips past expiries, so put the expired entry directly
+	tr.tree.Put("user:gone", []int64{nowMillis() - 10000})
+
+	// first, because matching without the option cleans up the expired key
+	assert.Equal(t, []string{"user:alice", "user:gone"}, tr.KeyMatchOpts("user:*", MatchOptions{IncludeExpired: true}))
+	assert.Equal(t, []string{"User:Bob", "user:alice"}, tr.KeyMatchOpts("USER:*", MatchOptions{CaseInsensitive: true}))
+	assert.Equal(t, []string{}, append([]string{}, tr.KeyMatchOpts("USER:*", MatchOptions{})...))
+	assert.Equal(t, []string{"User:Bob", "user:alice"}, tr.KeyMatchOpts("user", MatchOptions{Mode: MatchPrefix, CaseInsensitive: true}))
+	assert.Equal(t, []string{"User:Bob", "admin:USER", "user:alice"}, tr.KeyMatchOpts("uSeR", MatchOptions{Mode: MatchSubstring, CaseInsensitive: true}))
+}
+
+func BenchmarkTree_removeExpired(b *testing.B) {
+	now := nowMillis()
+	entries := make([]int64, 5000)
+	for i := range entries {
+		// first tenth are expired
+		entries[i] = now - 500 + int64(i)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		removeExpired(&entries)
+	}
+}
+
+func BenchmarkTree_PutCountHotKey(b *testing.B) {
+	tr := NewTree(60)
+	for i := 0; i < 5000; i++ {
+		tr.Put("hot")
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tr.Put("hot")
+		tr.Count("hot")
+	}
+}